@@ -0,0 +1,94 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// durationAnomaly is the alert sent when a run takes much longer than its
+// median duration.
+type durationAnomaly struct {
+	Command               string  `json:"command"`
+	ElapsedSeconds        float64 `json:"elapsedSeconds"`
+	MedianDurationSeconds float64 `json:"medianDurationSeconds"`
+	Factor                float64 `json:"factor"`
+	Revision              string  `json:"revision,omitempty"`
+}
+
+// slowThreshold returns the duration after which a run of the command is
+// considered anomalous, or zero if there isn't enough history.
+func slowThreshold(ctx context.Context, command string) (time.Duration, time.Duration, error) {
+	entries, err := queryHistory(ctx, command, "", ANOMALY_HISTORY_RUNS)
+	if err != nil {
+		return 0, 0, err
+	}
+	summary := summarizeHistory(entries)
+	if summary.Succeeded < ANOMALY_MIN_RUNS {
+		return 0, 0, nil
+	}
+	median := time.Duration(summary.MedianDurationSeconds * float64(time.Second))
+	return time.Duration(float64(median) * ANOMALY_FACTOR), median, nil
+}
+
+// sendDurationAlert publishes the anomaly to ANOMALY_TOPIC and posts it to
+// ANOMALY_WEBHOOK_URL, if configured.
+func sendDurationAlert(ctx context.Context, anomaly durationAnomaly) {
+	anomaly.Revision = os.Getenv("K_REVISION")
+	body, err := json.Marshal(anomaly)
+	if err != nil {
+		log.Printf("Failed to encode duration alert: %v", err)
+		return
+	}
+	if ANOMALY_TOPIC != "" {
+		if _, err := publishMessage(ctx, ANOMALY_TOPIC, body, map[string]string{"command": anomaly.Command}); err != nil {
+			log.Printf("Failed to publish duration alert: %v", err)
+		}
+	}
+	if ANOMALY_WEBHOOK_URL != "" {
+		if err := postWebhook(ctx, ANOMALY_WEBHOOK_URL, body); err != nil {
+			log.Printf("Failed to send duration alert: %v", err)
+		}
+	}
+}
+
+var webhookClient = &http.Client{Timeout: 30 * time.Second}
+
+// postWebhook posts a JSON body to a webhook URL.
+func postWebhook(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
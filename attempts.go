@@ -0,0 +1,111 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path"
+
+	"github.com/rosmo/long-cloud-run/pkg/runner"
+)
+
+// attemptRecord stores the latest attempt at running a Pub/Sub message as
+// an object under ATTEMPTS_GCS_URI, until the message is acknowledged, so
+// that a redelivery can tell the command what the previous attempt was.
+type attemptRecord struct {
+	bucket string
+	name   string
+}
+
+// newAttemptRecord returns the record of the attempts at a message, or nil
+// if ATTEMPTS_GCS_URI isn't set.
+func newAttemptRecord(m *PubSubMessage) *attemptRecord {
+	if ATTEMPTS_GCS_URI == "" || m.Message.ID == "" {
+		return nil
+	}
+	bucket, prefix, err := parseGCSPrefix(ATTEMPTS_GCS_URI)
+	if err != nil {
+		return nil
+	}
+	return &attemptRecord{
+		bucket: bucket,
+		name:   prefix + path.Base(m.Subscription) + "/" + m.Message.ID + ".json",
+	}
+}
+
+// previous returns the previous attempt, or nil if there wasn't one.
+func (a *attemptRecord) previous(ctx context.Context) (*runner.Attempt, error) {
+	data, err := downloadObject(ctx, a.bucket, a.name)
+	if isAPIError(err, http.StatusNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var attempt runner.Attempt
+	if err := json.Unmarshal(data, &attempt); err != nil {
+		return nil, err
+	}
+	return &attempt, nil
+}
+
+// start sets the attempt number and previous attempt of a command, and
+// records the command's run as the latest attempt. Pub/Sub only counts the
+// deliveries of subscriptions with a dead-letter topic, so the number is
+// otherwise counted from the records.
+func (a *attemptRecord) start(ctx context.Context, command *runner.Command, deliveryAttempt int, transcript string) error {
+	previous, err := a.previous(ctx)
+	if err != nil {
+		return err
+	}
+	command.Attempt = 1
+	if previous != nil {
+		command.Attempt = previous.Number + 1
+		command.Previous = previous
+	}
+	if deliveryAttempt > command.Attempt {
+		command.Attempt = deliveryAttempt
+	}
+	data, err := json.Marshal(runner.Attempt{Number: command.Attempt, JobID: command.JobID, Transcript: transcript})
+	if err != nil {
+		return err
+	}
+	_, err = uploadObject(ctx, a.bucket, a.name, "application/json", data, -1)
+	return err
+}
+
+// finish deletes the record once the message won't be redelivered.
+func (a *attemptRecord) finish(ctx context.Context) error {
+	err := deleteObject(ctx, a.bucket, a.name, -1)
+	if isAPIError(err, http.StatusNotFound) {
+		return nil
+	}
+	return err
+}
+
+// transcriptURI returns the URI of the transcript among the outputs of a
+// run, if any.
+func transcriptURI(outputs runner.MultiSink) string {
+	for _, output := range outputs {
+		if transcript, ok := output.(*GCSSink); ok {
+			return transcript.URI()
+		}
+	}
+	return ""
+}
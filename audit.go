@@ -0,0 +1,231 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/rosmo/long-cloud-run/pkg/runner"
+)
+
+// Audit decisions.
+const (
+	AuditAllowed = "allowed"
+	AuditDenied  = "denied"
+)
+
+// secretArgRegex matches the names of arguments whose values are redacted in
+// the audit log, as in --password=x, TOKEN=x or --api-key x.
+var secretArgRegex = regexp.MustCompile(`(?i)(pass|secret|token|key|credential)`)
+
+// AuditEntry records an invocation of the service in AUDIT_LOG_NAME.
+type AuditEntry struct {
+	JobID     string     `json:"jobId,omitempty"`
+	Caller    string     `json:"caller"`
+	CallerIP  string     `json:"callerIp,omitempty"`
+	Trigger   string     `json:"trigger"`
+	Tenant    string     `json:"tenant,omitempty"`
+	Path      string     `json:"path,omitempty"`
+	MessageID string     `json:"messageId,omitempty"`
+	Decision  string     `json:"decision"`
+	Reason    string     `json:"reason,omitempty"`
+	Command   string     `json:"command,omitempty"`
+	Args      []string   `json:"args,omitempty"`
+	Jobs      []auditJob `json:"jobs,omitempty"`
+	Status    string     `json:"status,omitempty"`
+	ExitCode  *int       `json:"exitCode,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	Duration  float64    `json:"durationSeconds,omitempty"`
+	timestamp time.Time
+}
+
+// auditJob is a job of an audited batch.
+type auditJob struct {
+	Name     string   `json:"name"`
+	Command  string   `json:"command"`
+	Args     []string `json:"args,omitempty"`
+	Status   string   `json:"status"`
+	ExitCode int      `json:"exitCode"`
+}
+
+// newAuditEntry returns the audit entry of a request, with the identity of
+// the caller.
+func newAuditEntry(r *http.Request, trigger string) *AuditEntry {
+	entry := &AuditEntry{
+		Caller:    callerIdentity(r),
+		CallerIP:  callerIP(r),
+		Trigger:   trigger,
+		Path:      r.URL.Path,
+		Decision:  AuditAllowed,
+		timestamp: time.Now(),
+	}
+	if entry.Caller == "" {
+		entry.Caller = entry.CallerIP
+	}
+	return entry
+}
+
+// callerIdentity returns the email (or subject) of the OIDC token of the
+// request, which Cloud Run has verified when the service requires
+// authentication, or "api-key" for requests authenticated with AUTH_TOKEN.
+// It's only recorded: the token isn't verified here, see verifiedCaller.
+func callerIdentity(r *http.Request) string {
+	if len(AUTH_TOKEN) > 0 && validToken(requestToken(r)) {
+		return "api-key"
+	}
+	parts := strings.Split(requestToken(r), ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ""
+	}
+	var claims struct {
+		Email   string `json:"email"`
+		Subject string `json:"sub"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+	if claims.Email != "" {
+		return claims.Email
+	}
+	return claims.Subject
+}
+
+// callerIP returns the address of the client, as forwarded by the Cloud Run
+// frontend.
+func callerIP(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// redactArgs returns the arguments with the values of secret-looking
+// arguments replaced.
+func redactArgs(args []string) []string {
+	redacted := make([]string, len(args))
+	secretNext := false
+	for i, arg := range args {
+		switch {
+		case secretNext:
+			redacted[i] = "[REDACTED]"
+			secretNext = false
+		case strings.Contains(arg, "=") && secretArgRegex.MatchString(strings.SplitN(arg, "=", 2)[0]):
+			redacted[i] = strings.SplitN(arg, "=", 2)[0] + "=[REDACTED]"
+		default:
+			redacted[i] = arg
+			secretNext = strings.HasPrefix(arg, "-") && secretArgRegex.MatchString(arg)
+		}
+	}
+	return redacted
+}
+
+// Deny records that the invocation was refused.
+func (a *AuditEntry) Deny(reason string) {
+	a.Decision = AuditDenied
+	a.Reason = reason
+	a.write()
+}
+
+// Finish records the outcome of a run.
+func (a *AuditEntry) Finish(result runner.Result, err error) {
+	a.Command = result.Command
+	a.Args = redactArgs(result.Args)
+	a.Status = result.Status
+	a.ExitCode = &result.ExitCode
+	a.Duration = result.Duration.Seconds()
+	if err != nil {
+		a.Error = err.Error()
+	}
+	a.write()
+}
+
+// FinishBatch records the outcome of the jobs of a batch.
+func (a *AuditEntry) FinishBatch(batch *BatchRequest, results []BatchResult, err error) {
+	a.Command = "batch"
+	a.Status = runner.StatusSucceeded
+	for i, job := range batch.Jobs {
+		result := results[i]
+		a.Jobs = append(a.Jobs, auditJob{
+			Name:     job.Name,
+			Command:  job.Command,
+			Args:     redactArgs(job.Args),
+			Status:   result.Status,
+			ExitCode: result.ExitCode,
+		})
+	}
+	if err != nil {
+		a.Status = runner.StatusFailed
+		a.Error = err.Error()
+	}
+	a.Duration = time.Since(a.timestamp).Seconds()
+	a.write()
+}
+
+// write writes the entry to AUDIT_LOG_NAME in the background.
+func (a *AuditEntry) write() {
+	if AUDIT_LOG_NAME == "" {
+		return
+	}
+	entry := *a
+	go func() {
+		if err := writeAuditEntry(context.Background(), &entry); err != nil {
+			log.Printf("Failed to write audit log entry: %v", err)
+		}
+	}()
+}
+
+func writeAuditEntry(ctx context.Context, entry *AuditEntry) error {
+	project, err := projectID(ctx)
+	if err != nil {
+		return err
+	}
+	severity := "NOTICE"
+	if entry.Decision == AuditDenied {
+		severity = "WARNING"
+	}
+	request := map[string]interface{}{
+		"logName":  fmt.Sprintf("projects/%s/logs/%s", project, AUDIT_LOG_NAME),
+		"resource": cloudRunResource(ctx, project),
+		"entries": []map[string]interface{}{{
+			"severity":    severity,
+			"timestamp":   entry.timestamp.UTC().Format(time.RFC3339Nano),
+			"jsonPayload": entry,
+			"labels": map[string]string{
+				"trigger":  entry.Trigger,
+				"decision": entry.Decision,
+			},
+		}},
+	}
+	return callAPI(ctx, "POST", loggingAPI+"entries:write", request, nil)
+}
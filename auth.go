@@ -0,0 +1,130 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Authentication requirements of routes.
+const (
+	AuthToken = "token"
+	AuthNone  = "none"
+)
+
+// Route sets the requirements of a path of the service in the config file.
+type Route struct {
+	Path string `json:"path"`
+	// Auth is "token" to require AUTH_TOKEN and a signature with
+	// REQUEST_SIGNING_KEY, or "none". By default every route except /ready
+	// requires them when they're set.
+	Auth string `json:"auth,omitempty"`
+}
+
+func (r *Route) parse() error {
+	switch r.Auth {
+	case "", AuthToken, AuthNone:
+		return nil
+	}
+	return fmt.Errorf("unknown auth: %s (must be token or none)", r.Auth)
+}
+
+// routeAuth returns the authentication requirement of a route.
+func routeAuth(path string) string {
+	for _, route := range currentConfig().Routes {
+		if route.Path == path && route.Auth != "" {
+			return route.Auth
+		}
+	}
+	// probes don't send credentials
+	switch path {
+	case "/ready", healthCheckPath, healthWatchPath:
+		return AuthNone
+	}
+	return AuthToken
+}
+
+// tenantRoutes are the routes that accept the tokens of tenants, in
+// addition to AUTH_TOKEN: runs, and the jobs and history of the tenant.
+var tenantRoutes = map[string]bool{"/": true, jobsPath: true, "/history": true}
+
+// requestToken returns the token of a request, from the X-Api-Key header or
+// a bearer token in the Authorization header.
+func requestToken(r *http.Request) string {
+	if token := r.Header.Get("X-Api-Key"); token != "" {
+		return token
+	}
+	authorization := r.Header.Get("Authorization")
+	if len(authorization) > 7 && strings.EqualFold(authorization[:7], "Bearer ") {
+		return authorization[7:]
+	}
+	return ""
+}
+
+// validToken returns true if the token is one of AUTH_TOKEN. Every token is
+// compared in constant time.
+func validToken(token string) bool {
+	valid := false
+	for _, expected := range AUTH_TOKEN {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// withAuth requires a valid token and signature for the route, if AUTH_TOKEN
+// or REQUEST_SIGNING_KEY are set and the route isn't public.
+func withAuth(path string, handler http.HandlerFunc) http.HandlerFunc {
+	if len(AUTH_TOKEN) == 0 && len(REQUEST_SIGNING_KEY) == 0 {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if routeAuth(path) == AuthNone {
+			handler(w, r)
+			return
+		}
+		if len(REQUEST_SIGNING_KEY) > 0 {
+			if err := verifySignature(r, time.Now()); err != nil {
+				if errors.Is(err, errBodyTooLarge) {
+					log.Printf("Failed to read request body: %v", err)
+					http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+					return
+				}
+				log.Printf("Unauthorized request to %s from %s: %v", r.URL.Path, r.RemoteAddr, err)
+				newAuditEntry(r, "http").Deny(err.Error())
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		token := requestToken(r)
+		if len(AUTH_TOKEN) > 0 && !validToken(token) && !(tenantRoutes[path] && tenantToken(token)) && !(path == "/" && isTaskAccount(r.Context(), verifiedCaller(r, time.Now()))) {
+			log.Printf("Unauthorized request to %s from %s", r.URL.Path, r.RemoteAddr)
+			newAuditEntry(r, "http").Deny("invalid token")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="long-cloud-run"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
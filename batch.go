@@ -0,0 +1,426 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rosmo/long-cloud-run/pkg/runner"
+)
+
+// BatchRequest runs several jobs in one request, either from the request
+// body or the data of a Pub/Sub message.
+type BatchRequest struct {
+	Jobs []*JobSpec `json:"jobs"`
+	// Parallelism is the number of jobs run at the same time, by default
+	// the jobs are run one after another.
+	Parallelism int `json:"parallelism,omitempty"`
+	// OnFailure is what happens when a job fails or times out: "continue"
+	// (default) runs the jobs that don't depend on it, "abort" terminates
+	// the running jobs and skips the rest.
+	OnFailure string `json:"onFailure,omitempty"`
+
+	// jobID is the run ID of the request, shared by its jobs.
+	jobID string
+}
+
+// BatchResult is the result of a job in a batch.
+type BatchResult struct {
+	Name string `json:"name"`
+	runner.Result
+	// Output is the last line of output of the job.
+	Output string `json:"output,omitempty"`
+	// Item is the matrix item the job ran for.
+	Item interface{} `json:"item,omitempty"`
+}
+
+// parseBatch returns the batch request in the body or message, or nil if
+// there isn't one.
+func parseBatch(body []byte, m *PubSubMessage) (*BatchRequest, error) {
+	data := bytes.TrimSpace(requestPayload(body, m))
+	if len(data) == 0 || data[0] != '{' {
+		return nil, nil
+	}
+	var batch BatchRequest
+	if err := json.Unmarshal(data, &batch); err != nil || batch.Jobs == nil {
+		return nil, nil
+	}
+	if len(batch.Jobs) == 0 {
+		return nil, fmt.Errorf("no jobs in batch")
+	}
+	if batch.Parallelism < 1 {
+		batch.Parallelism = 1
+	}
+	switch batch.OnFailure {
+	case "":
+		batch.OnFailure = "continue"
+	case "continue", "abort":
+	default:
+		return nil, fmt.Errorf("invalid onFailure: %s", batch.OnFailure)
+	}
+	if err := batch.expandMatrices(); err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	for i, job := range batch.Jobs {
+		defaultName := job.Name == ""
+		if err := job.resolve(); err != nil {
+			return nil, fmt.Errorf("invalid job %d: %w", i, err)
+		}
+		if names[job.Name] {
+			if !defaultName {
+				return nil, fmt.Errorf("duplicate job name: %s", job.Name)
+			}
+			job.Name = fmt.Sprintf("%s-%d", job.Name, i+1)
+		}
+		names[job.Name] = true
+	}
+	if err := batch.checkDependencies(); err != nil {
+		return nil, err
+	}
+	return &batch, nil
+}
+
+// expandMatrices replaces the jobs with a matrix by a job per item. Jobs
+// depending on a matrix job depend on all of its items.
+func (b *BatchRequest) expandMatrices() error {
+	var jobs []*JobSpec
+	expanded := make(map[string][]string)
+	for i, job := range b.Jobs {
+		if job.Matrix == nil {
+			jobs = append(jobs, job)
+			continue
+		}
+		if job.Name == "" {
+			return fmt.Errorf("matrix job %d has no name", i)
+		}
+		items, err := job.expandMatrix()
+		if err != nil {
+			return fmt.Errorf("invalid job %s: %w", job.Name, err)
+		}
+		expanded[job.Name] = nil
+		for _, item := range items {
+			expanded[job.Name] = append(expanded[job.Name], item.Name)
+		}
+		jobs = append(jobs, items...)
+	}
+	if len(expanded) == 0 {
+		return nil
+	}
+	for _, job := range jobs {
+		var dependsOn []string
+		for _, name := range job.DependsOn {
+			if items, ok := expanded[name]; ok {
+				dependsOn = append(dependsOn, items...)
+			} else {
+				dependsOn = append(dependsOn, name)
+			}
+		}
+		job.DependsOn = dependsOn
+	}
+	b.Jobs = jobs
+	return nil
+}
+
+// commands returns the distinct commands of the jobs.
+func (b *BatchRequest) commands() []string {
+	var commands []string
+	seen := make(map[string]bool)
+	for _, job := range b.Jobs {
+		if !seen[job.Command] {
+			seen[job.Command] = true
+			commands = append(commands, job.Command)
+		}
+	}
+	return commands
+}
+
+// checkDependencies checks that the jobs depended on exist and that there
+// are no cycles.
+func (b *BatchRequest) checkDependencies() error {
+	jobs := make(map[string]*JobSpec)
+	for _, job := range b.Jobs {
+		jobs[job.Name] = job
+	}
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int)
+	var visit func(job *JobSpec) error
+	visit = func(job *JobSpec) error {
+		switch state[job.Name] {
+		case visiting:
+			return fmt.Errorf("dependency cycle at job %s", job.Name)
+		case visited:
+			return nil
+		}
+		state[job.Name] = visiting
+		for _, name := range job.DependsOn {
+			dependency, ok := jobs[name]
+			if !ok {
+				return fmt.Errorf("job %s depends on unknown job %s", job.Name, name)
+			}
+			if err := visit(dependency); err != nil {
+				return err
+			}
+		}
+		state[job.Name] = visited
+		return nil
+	}
+	for _, job := range b.Jobs {
+		if err := visit(job); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncResponseWriter serializes the writes of jobs running in parallel, so
+// that their output lines are interleaved but not mixed up.
+type syncResponseWriter struct {
+	http.ResponseWriter
+	flusher http.Flusher
+	mu      sync.Mutex
+}
+
+func (w *syncResponseWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *syncResponseWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.flusher.Flush()
+}
+
+// prefixSink prefixes every line written with the job name.
+type prefixSink struct {
+	runner.OutputSink
+	prefix string
+}
+
+func (s *prefixSink) WriteLine(line string) error {
+	return s.OutputSink.WriteLine(s.prefix + line)
+}
+
+// runBatch runs the jobs of a batch in dependency order, with at most
+// Parallelism jobs at a time, and writes a table and a JSON array of the
+// results of all jobs at the end. The output sink has to be safe for
+// concurrent use. The error is set if any job failed, other
+// than those that can continue on error.
+func runBatch(ctx context.Context, output runner.OutputSink, deadline time.Time, trigger string, batch *BatchRequest) ([]BatchResult, error) {
+	results := make([]BatchResult, len(batch.Jobs))
+	errors := make([]error, len(batch.Jobs))
+	index := make(map[string]int)
+	for i, job := range batch.Jobs {
+		index[job.Name] = i
+	}
+
+	// Aborting cancels the request of the running jobs, which terminates them
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	aborted := false
+
+	started := make([]bool, len(batch.Jobs))
+	completed := make([]bool, len(batch.Jobs))
+	finished := make(chan int)
+	running, remaining := 0, len(batch.Jobs)
+	for remaining > 0 {
+		progress := false
+		for i, job := range batch.Jobs {
+			if started[i] || (!aborted && !dependenciesCompleted(job, index, completed)) {
+				continue
+			}
+			run, err := false, error(nil)
+			if !aborted {
+				run, err = batch.shouldRun(job, index, results)
+			}
+			if err != nil || !run {
+				started[i], completed[i] = true, true
+				remaining--
+				progress = true
+				results[i] = BatchResult{Name: job.Name, Result: runner.Result{Command: job.Command, Args: job.Args}, Item: job.item}
+				if err != nil {
+					results[i].Finish(err)
+					errors[i] = err
+				} else {
+					results[i].Status = runner.StatusSkipped
+					output.WriteLine(fmt.Sprintf("[%s] Skipping job", job.Name))
+				}
+				continue
+			}
+			if running >= batch.Parallelism {
+				continue
+			}
+			started[i] = true
+			running++
+			go func(i int, job *JobSpec) {
+				var lastLine string
+				command := job.newCommand(ctx, &prefixSink{output, fmt.Sprintf("[%s] ", job.Name)})
+				setJobID(command, batch.jobID)
+				command.Timeout = time.Until(deadline)
+				if job.Timeout.Duration > 0 && job.Timeout.Duration < command.Timeout {
+					command.Timeout = job.Timeout.Duration
+				}
+				command.OnOutput = func(line string) {
+					lastLine = line
+				}
+				errors[i] = command.Run(ctx)
+				results[i] = BatchResult{Name: job.Name, Result: command.Result, Output: lastLine, Item: job.item}
+				reportResult(trigger, command.Result, errors[i])
+				finished <- i
+			}(i, job)
+		}
+		if progress {
+			continue
+		}
+		if running == 0 {
+			break
+		}
+		i := <-finished
+		running--
+		remaining--
+		completed[i] = true
+		if errors[i] != nil && !batch.Jobs[i].ContinueOnError && batch.OnFailure == "abort" && !aborted {
+			output.WriteLine(fmt.Sprintf("[Job %s %s, aborting batch]", batch.Jobs[i].Name, results[i].Status))
+			aborted = true
+			cancel()
+		}
+	}
+
+	succeeded, skipped, failed := 0, 0, 0
+	for i, job := range batch.Jobs {
+		switch results[i].Status {
+		case runner.StatusSucceeded:
+			succeeded++
+		case runner.StatusSkipped:
+			skipped++
+		}
+		if errors[i] != nil {
+			log.Printf("Job %s failed: %v", job.Name, errors[i])
+			if !job.ContinueOnError {
+				failed++
+			}
+		}
+	}
+	summary, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return results, err
+	}
+	var report bytes.Buffer
+	fmt.Fprintf(&report, "[Batch results: %d of %d jobs succeeded, %d skipped]\n", succeeded, len(batch.Jobs), skipped)
+	table := tabwriter.NewWriter(&report, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "JOB\tSTATUS\tEXIT CODE\tDURATION")
+	for _, result := range results {
+		fmt.Fprintf(table, "%s\t%s\t%d\t%s\n", result.Name, result.Status, result.ExitCode, result.Duration.Round(time.Millisecond))
+	}
+	table.Flush()
+	writeMatrixSummaries(&report, batch, results)
+	report.Write(summary)
+	for _, line := range strings.Split(strings.TrimSuffix(report.String(), "\n"), "\n") {
+		output.WriteLine(line)
+	}
+	if failed > 0 {
+		return results, fmt.Errorf("%d of %d jobs failed", failed, len(batch.Jobs))
+	}
+	return results, nil
+}
+
+// writeMatrixSummaries writes how many items of each matrix job succeeded.
+func writeMatrixSummaries(w io.Writer, batch *BatchRequest, results []BatchResult) {
+	var matrixJobs []string
+	items := make(map[string]int)
+	succeeded := make(map[string]int)
+	for i, job := range batch.Jobs {
+		if job.matrixJob == "" {
+			continue
+		}
+		if _, ok := items[job.matrixJob]; !ok {
+			matrixJobs = append(matrixJobs, job.matrixJob)
+		}
+		items[job.matrixJob]++
+		if results[i].Status == runner.StatusSucceeded {
+			succeeded[job.matrixJob]++
+		}
+	}
+	for _, name := range matrixJobs {
+		status := runner.StatusSucceeded
+		if succeeded[name] < items[name] {
+			status = runner.StatusFailed
+		}
+		fmt.Fprintf(w, "[Matrix %s %s: %d of %d items succeeded]\n", name, status, succeeded[name], items[name])
+	}
+}
+
+func dependenciesCompleted(job *JobSpec, index map[string]int, completed []bool) bool {
+	for _, name := range job.DependsOn {
+		if !completed[index[name]] {
+			return false
+		}
+	}
+	return true
+}
+
+// shouldRun decides whether a job whose dependencies have completed runs:
+// if it has a condition, when the condition evaluates to true, otherwise
+// when its dependencies succeeded or can continue on error.
+func (b *BatchRequest) shouldRun(job *JobSpec, index map[string]int, results []BatchResult) (bool, error) {
+	if job.condition != nil {
+		jobs := make(map[string]BatchResult)
+		for _, result := range results {
+			if result.Name != "" {
+				jobs[result.Name] = result
+			}
+		}
+		var out bytes.Buffer
+		if err := job.condition.Execute(&out, map[string]interface{}{"Jobs": jobs}); err != nil {
+			return false, fmt.Errorf("failed to evaluate if: %w", err)
+		}
+		return strings.TrimSpace(out.String()) == "true", nil
+	}
+	for _, name := range job.DependsOn {
+		dependency := results[index[name]]
+		if dependency.Status != runner.StatusSucceeded && !b.Jobs[index[name]].ContinueOnError {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// batchRetryable returns true if any of the failed jobs of a batch should
+// be retried.
+func batchRetryable(results []BatchResult) bool {
+	for _, result := range results {
+		if result.Status != runner.StatusSucceeded && isRetryable(result.Result) {
+			return true
+		}
+	}
+	return false
+}
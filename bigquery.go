@@ -0,0 +1,187 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rosmo/long-cloud-run/pkg/runner"
+)
+
+const bigQueryAPI = "https://bigquery.googleapis.com/bigquery/v2/"
+
+// bigQueryLinesBatch is the maximum number of output lines per insert.
+const bigQueryLinesBatch = 500
+
+// tableURL returns the insertAll URL of a table, given as
+// [project.]dataset.table.
+func tableURL(ctx context.Context, table string) (string, error) {
+	parts := strings.Split(table, ".")
+	if len(parts) == 2 {
+		project, err := projectID(ctx)
+		if err != nil {
+			return "", err
+		}
+		parts = append([]string{project}, parts...)
+	}
+	if len(parts) != 3 {
+		return "", fmt.Errorf("invalid BigQuery table: %s", table)
+	}
+	return fmt.Sprintf("%sprojects/%s/datasets/%s/tables/%s/insertAll", bigQueryAPI, parts[0], parts[1], parts[2]), nil
+}
+
+func insertId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// insertRows streams rows into a BigQuery table.
+func insertRows(ctx context.Context, table string, rows []map[string]interface{}) error {
+	u, err := tableURL(ctx, table)
+	if err != nil {
+		return err
+	}
+	// Unknown values are ignored, so that tables created before a column
+	// was added keep working.
+	request := struct {
+		Rows                []map[string]interface{} `json:"rows"`
+		IgnoreUnknownValues bool                     `json:"ignoreUnknownValues"`
+	}{IgnoreUnknownValues: true}
+	for _, row := range rows {
+		request.Rows = append(request.Rows, map[string]interface{}{"insertId": insertId(), "json": row})
+	}
+	var response struct {
+		InsertErrors []struct {
+			Index  int `json:"index"`
+			Errors []struct {
+				Message string `json:"message"`
+			} `json:"errors"`
+		} `json:"insertErrors"`
+	}
+	if err := callAPI(ctx, "POST", u, request, &response); err != nil {
+		return fmt.Errorf("error inserting into %s: %w", table, err)
+	}
+	if len(response.InsertErrors) > 0 && len(response.InsertErrors[0].Errors) > 0 {
+		return fmt.Errorf("error inserting into %s: %d rows failed: %s", table, len(response.InsertErrors), response.InsertErrors[0].Errors[0].Message)
+	}
+	return nil
+}
+
+// insertRunResult streams a row for a run into BIGQUERY_TABLE.
+func insertRunResult(ctx context.Context, trigger string, result runner.Result) error {
+	return insertRows(ctx, BIGQUERY_TABLE, []map[string]interface{}{{
+		"jobId":           result.JobID,
+		"command":         result.Command,
+		"trigger":         trigger,
+		"argsHash":        result.ArgsHash(),
+		"status":          result.Status,
+		"exitCode":        result.ExitCode,
+		"error":           result.Error,
+		"startTime":       result.StartTime.UTC().Format(time.RFC3339Nano),
+		"endTime":         result.EndTime.UTC().Format(time.RFC3339Nano),
+		"durationSeconds": result.Duration.Seconds(),
+		"revision":        os.Getenv("K_REVISION"),
+	}})
+}
+
+// BigQueryLineWriter streams output lines of a run into a BigQuery table
+// in batches, in the background.
+type BigQueryLineWriter struct {
+	Table     string
+	Command   string
+	JobID     string
+	StartTime time.Time
+
+	lines      chan map[string]interface{}
+	done       chan struct{}
+	lineNumber int64
+	untrack    func()
+}
+
+func NewBigQueryLineWriter(table string, command string, jobID string) *BigQueryLineWriter {
+	w := &BigQueryLineWriter{
+		Table:     table,
+		Command:   command,
+		JobID:     jobID,
+		StartTime: time.Now(),
+		lines:     make(chan map[string]interface{}, bigQueryLinesBatch),
+		done:      make(chan struct{}),
+	}
+	w.untrack = trackQueue("bigQueryLines "+jobID, func() int { return len(w.lines) })
+	go w.run()
+	return w
+}
+
+// WriteLine queues an output line for inserting.
+func (w *BigQueryLineWriter) WriteLine(line string) {
+	w.lineNumber++
+	w.lines <- map[string]interface{}{
+		"jobId":        w.JobID,
+		"command":      w.Command,
+		"runStartTime": w.StartTime.UTC().Format(time.RFC3339Nano),
+		"lineNumber":   w.lineNumber,
+		"timestamp":    time.Now().UTC().Format(time.RFC3339Nano),
+		"line":         line,
+	}
+}
+
+// Close inserts the remaining lines.
+func (w *BigQueryLineWriter) Close() {
+	close(w.lines)
+	<-w.done
+	w.untrack()
+}
+
+func (w *BigQueryLineWriter) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	var batch []map[string]interface{}
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := insertRows(context.Background(), w.Table, batch); err != nil {
+			log.Printf("Failed to insert output lines: %v", err)
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case line, ok := <-w.lines:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, line)
+			if len(batch) >= bigQueryLinesBatch {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
@@ -0,0 +1,99 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+var errBodyTooLarge = errors.New("request body too large")
+
+// envelopeError is returned by readBody, with the raw body, when the body
+// isn't a valid JSON document.
+type envelopeError struct {
+	err error
+}
+
+func (e *envelopeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *envelopeError) Unwrap() error {
+	return e.err
+}
+
+// readBody reads the request body, up to MAX_BODY_BYTES, and decodes it into
+// the Pub/Sub envelope as it's read. For Pub/Sub invocations the raw body
+// isn't returned, so that only the message is kept while the command runs.
+// Cloud Scheduler requests are never wrapped and aren't decoded.
+func readBody(r *http.Request, m *PubSubMessage) ([]byte, error) {
+	reader := io.Reader(r.Body)
+	if MAX_BODY_BYTES > 0 {
+		reader = &limitReader{r: r.Body, remaining: MAX_BODY_BYTES + 1, err: errBodyTooLarge}
+	}
+	if isCloudScheduler(r) {
+		return ioutil.ReadAll(reader)
+	}
+
+	var raw bytes.Buffer
+	tee := io.TeeReader(reader, &raw)
+	decoder := json.NewDecoder(tee)
+	decodeErr := decoder.Decode(m)
+	if _, err := io.Copy(ioutil.Discard, tee); err != nil {
+		return nil, err
+	}
+	if decodeErr == io.EOF {
+		return raw.Bytes(), nil
+	}
+	if decodeErr != nil {
+		return raw.Bytes(), &envelopeError{decodeErr}
+	}
+	if len(bytes.TrimSpace(raw.Bytes()[decoder.InputOffset():])) > 0 {
+		return raw.Bytes(), &envelopeError{errors.New("invalid data after top-level value")}
+	}
+	if m.Subscription != "" {
+		return nil, nil
+	}
+	return raw.Bytes(), nil
+}
+
+// limitReader fails with err once more than remaining bytes have been read.
+type limitReader struct {
+	r         io.Reader
+	remaining int64
+	err       error
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.remaining <= 0 {
+		return 0, l.err
+	}
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining <= 0 {
+		return n, l.err
+	}
+	return n, err
+}
@@ -0,0 +1,126 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rosmo/long-cloud-run/pkg/runner"
+)
+
+// CacheRule declares a command idempotent: its successful results are
+// reused for TTL by invocations with the same arguments, instead of running
+// it again.
+type CacheRule struct {
+	Command string   `json:"command"`
+	TTL     Duration `json:"ttl"`
+}
+
+func (c *CacheRule) parse() error {
+	if c.Command == "" {
+		return fmt.Errorf("no command set")
+	}
+	if c.TTL.Duration <= 0 {
+		return fmt.Errorf("ttl must be positive")
+	}
+	return nil
+}
+
+// cacheTTL returns how long the results of a command are cached, matching
+// the rules by the path or the base name of the command.
+func cacheTTL(command string) time.Duration {
+	for _, rule := range currentConfig().Cache {
+		if rule.Command == command || rule.Command == filepath.Base(command) {
+			return rule.TTL.Duration
+		}
+	}
+	return 0
+}
+
+// cachedResult is the result of a run and the location of its transcript.
+type cachedResult struct {
+	Result     runner.Result
+	Transcript string
+	expires    time.Time
+}
+
+// resultCache holds the successful results of idempotent commands on the
+// instance.
+type resultCache struct {
+	mu      sync.Mutex
+	results map[string]cachedResult
+}
+
+var cache = &resultCache{results: make(map[string]cachedResult)}
+
+// resultCacheKey identifies a run by everything that determines its
+// outcome: the tenant, the command, its arguments, the standard input and
+// the options. Tenants never share results.
+func resultCacheKey(tenant *Tenant, command string, args []string, stdin string, options ...CommandOptions) string {
+	name := ""
+	if tenant != nil {
+		name = tenant.Name
+	}
+	data, _ := json.Marshal(struct {
+		Tenant  string           `json:"tenant,omitempty"`
+		Command string           `json:"command"`
+		Args    []string         `json:"args"`
+		Stdin   string           `json:"stdin"`
+		Options []CommandOptions `json:"options"`
+	}{name, command, args, stdin, options})
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// get returns the cached result for the key, unless it has expired.
+func (c *resultCache) get(key string, now time.Time) (cachedResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached, ok := c.results[key]
+	if ok && !now.Before(cached.expires) {
+		delete(c.results, key)
+		return cachedResult{}, false
+	}
+	return cached, ok
+}
+
+// put caches a result for ttl, and drops the expired results.
+func (c *resultCache) put(key string, result runner.Result, transcript string, ttl time.Duration, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, cached := range c.results {
+		if !now.Before(cached.expires) {
+			delete(c.results, k)
+		}
+	}
+	c.results[key] = cachedResult{Result: result, Transcript: transcript, expires: now.Add(ttl)}
+}
+
+// message describes the cached result to the client.
+func (c cachedResult) message() string {
+	message := fmt.Sprintf("[Cached result of run %s at %s: %s]", c.Result.JobID, c.Result.EndTime.UTC().Format(time.RFC3339), c.Result.Status)
+	if c.Transcript != "" {
+		message += fmt.Sprintf("\n[Transcript: %s]", c.Transcript)
+	}
+	return message
+}
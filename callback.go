@@ -0,0 +1,75 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rosmo/long-cloud-run/pkg/runner"
+)
+
+// callbackField is the field of a JSON body with the callback URL, for
+// callers like Workflows that can't easily set query parameters or headers.
+const callbackField = "callbackUrl"
+
+// requestCallback returns the URL to call with the result of the run, given
+// as the callback query parameter or Pub/Sub message attribute, the
+// X-Callback-Url header or the callbackUrl field of a JSON body, or "". The
+// URL has to start with one of CALLBACK_URL_PREFIXES, since it's called
+// with an access token of the service account.
+func requestCallback(r *http.Request, m *PubSubMessage, invocation *Invocation) (string, error) {
+	callback := r.URL.Query().Get("callback")
+	if callback == "" {
+		callback = m.Message.Attributes["callback"]
+	}
+	if callback == "" {
+		callback = r.Header.Get("X-Callback-Url")
+	}
+	if body, ok := invocation.Body.(map[string]interface{}); ok && callback == "" {
+		callback, _ = body[callbackField].(string)
+	}
+	if callback == "" {
+		return "", nil
+	}
+	for _, prefix := range CALLBACK_URL_PREFIXES {
+		if strings.HasPrefix(callback, prefix) {
+			return callback, nil
+		}
+	}
+	return "", fmt.Errorf("callback URL not allowed: %s", callback)
+}
+
+// sendCallback posts the result JSON of a run to a callback URL with an
+// access token of the service account, eg. to resume a Workflows execution
+// waiting with events.await_callback.
+func sendCallback(callback string, trigger string, result runner.Result) error {
+	body, err := newResultMessage(trigger, result)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if _, err := callAPIRaw(ctx, "POST", callback, "application/json", bytes.NewReader(body)); err != nil {
+		return fmt.Errorf("failed to call back %s: %w", callback, err)
+	}
+	return nil
+}
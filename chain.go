@@ -0,0 +1,103 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/rosmo/long-cloud-run/pkg/runner"
+)
+
+// chainAudience returns the audience of the identity token for CHAIN_URL:
+// CHAIN_AUDIENCE, or the origin of the URL, which is what Cloud Run
+// services expect. It's empty if CHAIN_AUDIENCE is none.
+func chainAudience() string {
+	if CHAIN_AUDIENCE == "none" {
+		return ""
+	}
+	if CHAIN_AUDIENCE != "" {
+		return CHAIN_AUDIENCE
+	}
+	u, err := url.Parse(CHAIN_URL)
+	if err != nil {
+		return CHAIN_URL
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// callChain posts the result of a run to CHAIN_URL, if its status matches
+// CHAIN_ON, with an identity token of the service account. The response is
+// read to the end, so that a chained service of this kind runs its command
+// to completion, and a failure in its X-Command-Status trailer is returned.
+func callChain(ctx context.Context, trigger string, result runner.Result) error {
+	if !resultMatches(CHAIN_ON, result) {
+		return nil
+	}
+	body, err := newResultMessage(trigger, result)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, REQUEST_TIMEOUT)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", CHAIN_URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if result.JobID != "" {
+		req.Header.Set("X-Chained-From", result.JobID)
+	}
+	if audience := chainAudience(); audience != "" {
+		token, err := identityToken(ctx, audience)
+		if err != nil {
+			return fmt.Errorf("failed to get identity token for %s: %w", audience, err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := streamClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
+		return fmt.Errorf("chained call to %s failed: %w", CHAIN_URL, err)
+	}
+	status := resp.StatusCode
+	if trailer, err := strconv.Atoi(resp.Trailer.Get("X-Command-Status")); err == nil {
+		status = trailer
+	}
+	if status < 200 || status > 299 {
+		return fmt.Errorf("chained call to %s returned %d", CHAIN_URL, status)
+	}
+	return nil
+}
+
+func init() {
+	registerResultSink("chain", resultSinkFuncs{
+		enabled: func() bool { return CHAIN_URL != "" },
+		report: func(ctx context.Context, trigger string, result runner.Result, err error) error {
+			return callChain(ctx, trigger, result)
+		},
+	})
+}
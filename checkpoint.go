@@ -0,0 +1,93 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/rosmo/long-cloud-run/pkg/runner"
+)
+
+// Pub/Sub message attributes of continuation messages.
+const (
+	checkpointAttribute   = "checkpoint"
+	continuationAttribute = "continuation"
+)
+
+// continuation is the data of a continuation message: the data of the
+// original message, and the checkpoint to resume from.
+type continuation struct {
+	Data       []byte `json:"data,omitempty"`
+	Checkpoint []byte `json:"checkpoint"`
+}
+
+// unwrapContinuation restores the data of the original message in a
+// continuation message, and returns the checkpoint to resume from, or nil
+// if the message isn't a continuation message.
+func unwrapContinuation(m *PubSubMessage) ([]byte, error) {
+	if m.Message.Attributes[checkpointAttribute] != "true" {
+		return nil, nil
+	}
+	var c continuation
+	if err := json.Unmarshal(m.Message.Data, &c); err != nil {
+		return nil, fmt.Errorf("invalid continuation message: %w", err)
+	}
+	m.Message.Data = c.Data
+	if c.Checkpoint == nil {
+		c.Checkpoint = []byte{}
+	}
+	return c.Checkpoint, nil
+}
+
+// newCheckpoint returns the checkpoint settings for an invocation, resuming
+// from the checkpoint of a continuation message (see unwrapContinuation).
+// Checkpoints are published to CHECKPOINT_TOPIC as continuation messages,
+// with the data and attributes of the original message.
+func newCheckpoint(m *PubSubMessage, resume []byte) *runner.Checkpoint {
+	if CHECKPOINT_FILE == "" {
+		return nil
+	}
+	checkpoint := &runner.Checkpoint{
+		File:   CHECKPOINT_FILE,
+		Margin: CHECKPOINT_MARGIN,
+		Signal: CHECKPOINT_SIGNAL,
+	}
+	if resume != nil {
+		checkpoint.Resume = resume
+		checkpoint.Continuation, _ = strconv.Atoi(m.Message.Attributes[continuationAttribute])
+	}
+	checkpoint.Requeue = func(ctx context.Context, data []byte) (string, error) {
+		body, err := json.Marshal(continuation{Data: m.Message.Data, Checkpoint: data})
+		if err != nil {
+			return "", err
+		}
+		attributes := map[string]string{
+			checkpointAttribute:   "true",
+			continuationAttribute: strconv.Itoa(checkpoint.Continuation + 1),
+		}
+		for name, value := range m.Message.Attributes {
+			if _, ok := attributes[name]; !ok {
+				attributes[name] = value
+			}
+		}
+		return publishMessage(ctx, CHECKPOINT_TOPIC, body, attributes)
+	}
+	return checkpoint
+}
@@ -0,0 +1,140 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/rosmo/long-cloud-run/pkg/runner"
+)
+
+// CircuitOpenError is returned for invocations of a command whose circuit is
+// open after repeated failures.
+type CircuitOpenError struct {
+	Command    string
+	Failures   int
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("Circuit open after %d consecutive failures of %s, retry after %s", e.Failures, e.Command, e.RetryAfter.Round(time.Second))
+}
+
+// circuit counts the consecutive failures of a command.
+type circuit struct {
+	failures  int
+	openUntil time.Time
+	// trialStart is set while a trial run is in progress, after the
+	// cooldown has passed.
+	trialStart time.Time
+}
+
+// circuitBreaker stops running commands that have failed
+// CIRCUIT_BREAKER_THRESHOLD times in a row, for CIRCUIT_BREAKER_COOLDOWN.
+// After the cooldown, one run is let through: if it succeeds the circuit is
+// closed, otherwise it opens again.
+type circuitBreaker struct {
+	mu       sync.Mutex
+	circuits map[string]*circuit
+}
+
+var breaker = &circuitBreaker{circuits: make(map[string]*circuit)}
+
+// allow returns an error if the circuit of the command is open.
+func (b *circuitBreaker) allow(command string, now time.Time) error {
+	if CIRCUIT_BREAKER_THRESHOLD <= 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.circuits[command]
+	if !ok || c.failures < CIRCUIT_BREAKER_THRESHOLD {
+		return nil
+	}
+	if now.Before(c.openUntil) {
+		return &CircuitOpenError{Command: command, Failures: c.failures, RetryAfter: c.openUntil.Sub(now)}
+	}
+	if !c.trialStart.IsZero() && now.Sub(c.trialStart) < REQUEST_TIMEOUT {
+		return &CircuitOpenError{Command: command, Failures: c.failures, RetryAfter: CIRCUIT_BREAKER_COOLDOWN}
+	}
+	log.Printf("Circuit of %s half-open, trying a run.", command)
+	c.trialStart = now
+	return nil
+}
+
+// release ends the trial run that allow started at the given time, if its
+// outcome wasn't recorded, so that a run rejected or abandoned after allow
+// doesn't keep other runs out until REQUEST_TIMEOUT. It's a no-op for runs
+// that weren't trials.
+func (b *circuitBreaker) release(command string, allowed time.Time) {
+	if CIRCUIT_BREAKER_THRESHOLD <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c, ok := b.circuits[command]; ok && c.trialStart.Equal(allowed) {
+		c.trialStart = time.Time{}
+	}
+}
+
+// isOpen returns true if the circuit of the command is open, without
+// starting a trial run like allow.
+func (b *circuitBreaker) isOpen(command string, now time.Time) bool {
+	if CIRCUIT_BREAKER_THRESHOLD <= 0 {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.circuits[command]
+	return ok && c.failures >= CIRCUIT_BREAKER_THRESHOLD && now.Before(c.openUntil)
+}
+
+// record records the outcome of a run. Cancelled runs don't count as
+// failures.
+func (b *circuitBreaker) record(command string, err error, now time.Time) {
+	if CIRCUIT_BREAKER_THRESHOLD <= 0 {
+		return
+	}
+	var canceledErr *runner.CanceledError
+	if errors.As(err, &canceledErr) {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		if c, ok := b.circuits[command]; ok && c.failures >= CIRCUIT_BREAKER_THRESHOLD {
+			log.Printf("Circuit of %s closed.", command)
+		}
+		delete(b.circuits, command)
+		return
+	}
+	c, ok := b.circuits[command]
+	if !ok {
+		c = &circuit{}
+		b.circuits[command] = c
+	}
+	c.failures++
+	c.trialStart = time.Time{}
+	if c.failures >= CIRCUIT_BREAKER_THRESHOLD {
+		c.openUntil = now.Add(CIRCUIT_BREAKER_COOLDOWN)
+		log.Printf("Circuit of %s opened after %d consecutive failures, until %s.", command, c.failures, c.openUntil.Format(time.RFC3339))
+	}
+}
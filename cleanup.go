@@ -0,0 +1,52 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// startCleanup runs CLEANUP_CMD every CLEANUP_INTERVAL in the background,
+// once the self-check and the startup command have finished. Runs never
+// overlap, and each is limited to the interval.
+func startCleanup() {
+	go func() {
+		selfCheck.Wait(context.Background())
+		log.Printf("Running cleanup command every %s: %s", CLEANUP_INTERVAL, CLEANUP_CMD)
+		ticker := time.NewTicker(CLEANUP_INTERVAL)
+		defer ticker.Stop()
+		for range ticker.C {
+			runCleanupCommand(context.Background())
+		}
+	}()
+}
+
+// runCleanupCommand runs CLEANUP_CMD once, logging its output.
+func runCleanupCommand(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, CLEANUP_INTERVAL)
+	defer cancel()
+	command := newShellCommand("cleanup", CLEANUP_CMD, CLEANUP_INTERVAL)
+	setJobID(command, newJobID())
+	defer trackRun(command.JobID, "cleanup", "cleanup")()
+	err := command.Run(ctx)
+	if err != nil {
+		log.Printf("Cleanup command failed: %v", err)
+	}
+	return err
+}
@@ -0,0 +1,113 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rosmo/long-cloud-run/pkg/runner"
+)
+
+// What happens to a run when its client is gone, see CLIENT_GONE.
+const (
+	ClientGoneTerminate = "terminate"
+	ClientGoneContinue  = "continue"
+	ClientGoneDetach    = "detach"
+)
+
+// clientGuard streams the output to the client until a write fails, and
+// then drops it, calling onGone once with the reason.
+type clientGuard struct {
+	sink   runner.OutputSink
+	onGone func(reason string)
+
+	once sync.Once
+	gone int32
+}
+
+func (g *clientGuard) WriteLine(line string) error {
+	if atomic.LoadInt32(&g.gone) == 1 {
+		return nil
+	}
+	if err := g.sink.WriteLine(line); err != nil {
+		g.lost(fmt.Sprintf("failed to write to the client: %v", err))
+	}
+	return nil
+}
+
+// lost stops writing to the client.
+func (g *clientGuard) lost(reason string) {
+	g.once.Do(func() {
+		atomic.StoreInt32(&g.gone, 1)
+		if g.onGone != nil {
+			g.onGone(reason)
+		}
+	})
+}
+
+// watch calls lost when the client closes the connection, until the
+// returned function is called.
+func (g *clientGuard) watch(ctx context.Context) func() {
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			g.lost("the client closed the connection")
+		case <-stop:
+		}
+	}()
+	return func() { close(stop) }
+}
+
+// detachedContext keeps the values of a request context without being
+// cancelled with it, for runs that continue after their client is gone.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// runContext returns the context of a run for a request: cancelled with the
+// request with CLIENT_GONE=terminate, and otherwise only when the returned
+// function is called.
+func runContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if CLIENT_GONE != ClientGoneTerminate {
+		ctx = detachedContext{ctx}
+	}
+	return context.WithCancel(ctx)
+}
+
+// clientGone handles a run whose client is gone as set with CLIENT_GONE.
+func clientGone(reason string, jobID string, cancel context.CancelFunc, job *jobTracker) {
+	switch CLIENT_GONE {
+	case ClientGoneContinue:
+		log.Printf("Client of %s is gone (%s), the command continues with its output only logged.", jobID, reason)
+	case ClientGoneDetach:
+		log.Printf("Client of %s is gone (%s), the command continues detached, see %s%s.", jobID, reason, jobsPath, jobID)
+		job.detach()
+	default:
+		log.Printf("Client of %s is gone (%s), command terminating.", jobID, reason)
+		cancel()
+	}
+}
@@ -0,0 +1,910 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rosmo/long-cloud-run/pkg/runner"
+)
+
+// CONFIG_FILE is an optional JSON configuration file, see ConfigFile. If it
+// fails to load, configFileError fails the self-check.
+var CONFIG_FILE string
+var CONFIG = &ConfigFile{}
+var configFileError error
+
+// PROGRESS_REGEX is matched against every output line of the command. The
+// first capture group (or the whole match) is parsed as a percentage.
+var PROGRESS_REGEX *regexp.Regexp
+
+// PLAIN_TRIGGER accepts request bodies that aren't Pub/Sub push messages,
+// such as the arbitrary bodies of Cloud Scheduler HTTP targets, instead of
+// rejecting them.
+var PLAIN_TRIGGER bool = false
+
+// PAYLOAD_SCHEMA is a JSON Schema file that the request body or message data
+// of single commands is validated with.
+var PAYLOAD_SCHEMA *Schema
+
+// TEMPLATE_ARGS renders the arguments of the command as templates with the
+// request body or message data as .Body.
+var TEMPLATE_ARGS bool = false
+
+// STDOUT_CONTENT_TYPE streams the standard output of the command byte for
+// byte as the response body with this Content-Type, instead of the output
+// lines and progress messages, which are only logged.
+var STDOUT_CONTENT_TYPE string
+
+// KEEPALIVE_INTERVAL writes a keep-alive to the client when there has been
+// no output for this long, padded to KEEPALIVE_PADDING bytes. Padding turns
+// off compression, which would shrink it.
+var KEEPALIVE_INTERVAL time.Duration
+var KEEPALIVE_PADDING int
+
+// COLLAPSE_REPEATS relays consecutive identical output lines once, followed
+// by how many times the line was repeated.
+var COLLAPSE_REPEATS bool = false
+
+// MAX_LINES_PER_SECOND limits the standard output lines relayed per second.
+// Above the limit every LINE_SAMPLE_EVERY-th line is relayed, followed by
+// how many were omitted.
+var MAX_LINES_PER_SECOND int64
+var LINE_SAMPLE_EVERY int64 = 100
+
+// PREFIX_JOB_ID prefixes the lines streamed to the client with the run ID.
+var PREFIX_JOB_ID bool = false
+
+// STARTUP_CMD is a shell command run once when the container starts, for
+// example to restore a cache. Requests wait for it to finish.
+var STARTUP_CMD string
+
+// STARTUP_TIMEOUT limits the run of STARTUP_CMD.
+var STARTUP_TIMEOUT time.Duration = 10 * time.Minute
+
+// STARTUP_FAILURE_POLICY is what happens when STARTUP_CMD fails: fail the
+// readiness checks, exit the container or ignore it.
+var STARTUP_FAILURE_POLICY string = StartupFailureFail
+
+// CPU_THROTTLING_POLICY is what the self-check does when schedules or
+// CLEANUP_CMD are enabled on a service that only has CPU during requests or
+// can scale to zero: warn, or fail so that the revision doesn't become
+// ready.
+var CPU_THROTTLING_POLICY string = CPUThrottlingWarn
+
+// MAX_CONCURRENT_RUNS limits the runs in progress on an instance. Further
+// runs wait in a queue ordered by their priority. 0 disables the limit.
+var MAX_CONCURRENT_RUNS int = 0
+
+// ALLOW_QUERY_ARGS appends the arg query parameters of requests to the
+// arguments, if they are in QUERY_ARGS_ALLOWLIST.
+var ALLOW_QUERY_ARGS bool = false
+
+// QUERY_ARGS_ALLOWLIST are the arguments allowed as query parameters. An
+// entry ending with * allows any argument it prefixes, like --table=*.
+var QUERY_ARGS_ALLOWLIST []string
+
+// STDIN_GCS_URI is the gs:// URI of an object that is streamed to the
+// standard input of the command, without being stored locally. With
+// TEMPLATE_ARGS it's rendered like the arguments.
+var STDIN_GCS_URI string
+
+// OUTPUT_STDOUT_GCS_URI is the gs:// URI of an object that the standard
+// output of the command is uploaded to as it's written, without being stored
+// locally. With TEMPLATE_ARGS it's rendered like the arguments.
+var OUTPUT_STDOUT_GCS_URI string
+
+// DISK_PATHS are the directories whose usage is monitored. On Cloud Run the
+// filesystem is in memory and counts against the memory limit.
+var DISK_PATHS []string = []string{os.TempDir()}
+
+// DISK_WARN_BYTES warns in the heartbeats, and prunes DISK_PATHS with
+// DISK_PRUNE_AGE, when the files in DISK_PATHS use more. 0 disables it.
+var DISK_WARN_BYTES int64 = 0
+
+// DISK_LIMIT_BYTES refuses new runs while the files in DISK_PATHS use more.
+// 0 disables it.
+var DISK_LIMIT_BYTES int64 = 0
+
+// DISK_PRUNE_AGE is the age after which the entries of DISK_PATHS are
+// removed, once the usage is over DISK_WARN_BYTES. 0 disables pruning.
+var DISK_PRUNE_AGE time.Duration = 0
+
+// DISK_CHECK_INTERVAL is how often the disk usage is measured.
+var DISK_CHECK_INTERVAL time.Duration = 30 * time.Second
+
+// CLEANUP_CMD is a shell command run every CLEANUP_INTERVAL in the
+// background, for housekeeping like pruning the working directory.
+var CLEANUP_CMD string
+
+// CLEANUP_INTERVAL is how often CLEANUP_CMD runs.
+var CLEANUP_INTERVAL time.Duration = 10 * time.Minute
+
+// MAX_BODY_BYTES is the maximum size of a request body other than an
+// upload. Larger requests are rejected with 413. 0 disables the limit.
+var MAX_BODY_BYTES int64 = 16 << 20
+
+// READ_HEADER_TIMEOUT limits how long the server waits for the request
+// headers. The request body and response aren't limited, as runs stream for
+// up to REQUEST_TIMEOUT.
+var READ_HEADER_TIMEOUT time.Duration = 10 * time.Second
+
+// IDLE_TIMEOUT closes keep-alive connections that have been idle this long.
+var IDLE_TIMEOUT time.Duration = 10 * time.Minute
+
+// ENABLE_H2C serves HTTP/2 without TLS, as sent by Cloud Run with
+// --use-http2 and by local HTTP/2 proxies.
+var ENABLE_H2C bool = false
+
+// ENABLE_DEBUG serves /debug/pprof/ and /debug/vars, with the goroutines,
+// runs in progress and queue depths.
+var ENABLE_DEBUG bool = false
+
+// BINARY_OUTPUT relays output that isn't text, which would be corrupted as
+// lines, encoded as base64 or hex.
+var BINARY_OUTPUT string
+
+// DISABLE_GZIP turns off response compression, for proxies that buffer
+// compressed streams.
+var DISABLE_GZIP bool = false
+
+// MAX_OUTPUT_BYTES and MAX_OUTPUT_LINES limit how much output is relayed,
+// zero means unlimited. KILL_ON_OUTPUT_LIMIT terminates the command once
+// either limit has been reached.
+var MAX_OUTPUT_BYTES int64 = 0
+var MAX_OUTPUT_LINES int64 = 0
+var KILL_ON_OUTPUT_LIMIT bool = false
+
+// MEMORY_LIMIT_PERCENT terminates the command when memory usage exceeds this
+// percentage of MEMORY_LIMIT_BYTES (by default, the container's memory limit).
+// Zero disables the memory watchdog.
+var MEMORY_LIMIT_PERCENT int64 = 0
+var MEMORY_LIMIT_BYTES int64 = 0
+var MEMORY_CHECK_INTERVAL time.Duration = 5 * time.Second
+
+// RESOURCE_LIMITS are applied to every spawned command.
+var RESOURCE_LIMITS runner.ResourceLimits
+
+// SUBREAPER makes us adopt orphaned descendants of the command, and
+// KILL_ORPHANS kills any processes left behind when the command exits.
+var SUBREAPER bool = false
+var KILL_ORPHANS bool = true
+
+// RUN_AS runs the command as an unprivileged user, set from RUN_AS_USER
+// (or RUN_AS_UID) and RUN_AS_GID.
+var RUN_AS *runner.RunAs
+
+// WORKING_DIR is the working directory of the command. If CHROOT is set,
+// the command is confined to that directory and WORKING_DIR is relative to it.
+var WORKING_DIR string
+var CHROOT string
+
+// SPILL_ARG_BYTES writes the arguments longer than this to files in
+// UPLOAD_DIR, and passes the paths of the files instead.
+var SPILL_ARG_BYTES int64
+
+// UPLOAD_DIR is where the files of multipart/form-data requests are staged,
+// up to MAX_UPLOAD_BYTES per request. With CHROOT it has to be inside the
+// chroot.
+var UPLOAD_DIR string
+var MAX_UPLOAD_BYTES int64 = 32 << 20
+
+// HANDOFF_TO_JOB runs the command as a Cloud Run job of this name, instead
+// of in the request. JOB_TIMEOUT is the task timeout of the job.
+var HANDOFF_TO_JOB string
+var JOB_TIMEOUT time.Duration = 24 * time.Hour
+
+// LOCK_BUCKET enables a distributed lock (an object in this bucket) keyed
+// by LOCK_KEY or the name of the command run, so that only one instance
+// runs the command at a time. With
+// LOCK_MODE "reject" concurrent invocations fail, with "wait" they wait for
+// the lock.
+var LOCK_BUCKET string
+var LOCK_KEY string
+var LOCK_MODE string = "reject"
+
+// HISTORY_COLLECTION enables persisting the results of runs in this
+// Firestore collection, and the /history API.
+var HISTORY_COLLECTION string
+
+// ANOMALY_FACTOR warns when a run takes this many times longer than the
+// median of the last ANOMALY_HISTORY_RUNS successful runs (at least
+// ANOMALY_MIN_RUNS are needed). Alerts are also sent to ANOMALY_TOPIC and
+// ANOMALY_WEBHOOK_URL, if set. Requires HISTORY_COLLECTION.
+var ANOMALY_FACTOR float64 = 2
+var ANOMALY_HISTORY_RUNS int = 20
+var ANOMALY_MIN_RUNS int = 3
+var ANOMALY_TOPIC string
+var ANOMALY_WEBHOOK_URL string
+
+// BIGQUERY_TABLE streams a row per run into this table, and
+// BIGQUERY_LINES_TABLE a row per output line ([project.]dataset.table).
+var BIGQUERY_TABLE string
+var BIGQUERY_LINES_TABLE string
+
+// TRANSCRIPT_GCS_URI uploads the output of every run as an object under this
+// gs://bucket/prefix/, and LOGGING_LOG_NAME writes it to this Cloud Logging
+// log.
+var TRANSCRIPT_GCS_URI string
+var LOGGING_LOG_NAME string
+
+// METRICS_PREFIX enables writing custom metrics to Cloud Monitoring, as
+// custom.googleapis.com/<prefix>/<metric>, with METRICS_LABELS (k=v,...)
+// added to every metric.
+var METRICS_PREFIX string
+var METRICS_LABELS map[string]string
+
+// ATTEMPTS_GCS_URI records the attempts at running Pub/Sub messages under
+// this gs://bucket/prefix, so that redeliveries can pass the previous
+// attempt to the command.
+var ATTEMPTS_GCS_URI string
+
+// RESULT_TOPIC receives the result of every run as a JSON message.
+var RESULT_TOPIC string
+
+// RESULT_GCS_URI writes the result of every run as a JSON object under this
+// gs://bucket/prefix.
+var RESULT_GCS_URI string
+
+// NOTIFY_WEBHOOK_URL is a Google Chat or Slack incoming webhook to post
+// messages to on the events in NOTIFY_ON, rendered with NOTIFY_TEMPLATE.
+var NOTIFY_WEBHOOK_URL string
+var NOTIFY_ON map[string]bool
+
+// GOOGLE_CLOUD_PROJECT and GOOGLE_CLOUD_REGION override the project and
+// region from the metadata server.
+var GOOGLE_CLOUD_PROJECT string
+var GOOGLE_CLOUD_REGION string
+
+// REQUEST_TIMEOUT is the request timeout of the Cloud Run service (from
+// REQUEST_TIMEOUT_SECONDS). Commands are terminated DEADLINE_MARGIN before
+// the request deadline, to leave time for reporting the result.
+var REQUEST_TIMEOUT time.Duration = 60 * time.Minute
+var DEADLINE_MARGIN time.Duration = 30 * time.Second
+
+// TERMINATION_SIGNAL is sent to commands that time out or whose request is
+// cancelled, and they are killed if still running after TERMINATION_GRACE.
+var TERMINATION_SIGNAL syscall.Signal = syscall.SIGTERM
+var TERMINATION_GRACE time.Duration = 10 * time.Second
+
+// CORE_DUMP_GCS_URI uploads the core files of commands that dump core,
+// from WORKING_DIR, under this gs://bucket/prefix.
+var CORE_DUMP_GCS_URI string
+
+// STALL_TIMEOUT warns, and notifies the stall event, when a command hasn't
+// written any output for this long. STALL_SIGNAL is then sent to the
+// command, eg. SIGQUIT for a stack dump, and KILL_ON_STALL terminates it.
+var STALL_TIMEOUT time.Duration
+var STALL_SIGNAL syscall.Signal
+var KILL_ON_STALL bool
+
+// CHECKPOINT_FILE enables checkpointing: CHECKPOINT_SIGNAL is sent to the
+// command CHECKPOINT_MARGIN before the deadline, and the checkpoint it writes
+// is published to CHECKPOINT_TOPIC to continue the command. Every run writes
+// its checkpoint to a file of the same name in its own directory.
+var CHECKPOINT_FILE string
+var CHECKPOINT_TOPIC string
+var CHECKPOINT_MARGIN time.Duration = 5 * time.Minute
+var CHECKPOINT_SIGNAL syscall.Signal = syscall.SIGTERM
+
+// RETRYABLE_EXIT_CODES are the exit codes of transient failures, which are
+// answered with a 5xx so that Pub/Sub redelivers the message. Other failures
+// are answered with PERMANENT_FAILURE_STATUS. nil means any exit code.
+var RETRYABLE_EXIT_CODES []int
+var PERMANENT_FAILURE_STATUS int = http.StatusUnprocessableEntity
+
+// MAX_DELIVERY_ATTEMPTS is the maximum delivery attempts of the dead-letter
+// policy of the subscription. The last attempt is final: its failure is
+// published to FAILURE_TOPIC even if it's retryable, and the command gets
+// FINAL_DELIVERY=1.
+var MAX_DELIVERY_ATTEMPTS int
+
+// ALLOWED_EXIT_CODES are the exit codes that count as success, CAN_FAIL makes
+// any failure count as success and SHOW_OUTPUT=false only logs the output of
+// commands instead of streaming it to the client. Jobs, schedules and
+// requests can override them.
+var ALLOWED_EXIT_CODES []int = []int{0}
+var CAN_FAIL bool
+var SHOW_OUTPUT bool = true
+
+// ERROR_STATUS overrides the HTTP status of failed runs by error type
+// (start, timeout, canceled, terminated) or exit code, eg. timeout=504,24=200.
+var ERROR_STATUS map[string]int
+
+// AUTH_TOKEN requires requests to have one of these comma-separated tokens
+// in the X-Api-Key header or as a bearer token, for services that have to
+// allow unauthenticated invocations.
+var AUTH_TOKEN []string
+
+// AUDIT_LOG_NAME writes an audit entry for every invocation, with the
+// caller, the command and the outcome, to this Cloud Logging log.
+var AUDIT_LOG_NAME string
+
+// RATE_LIMIT limits the invocations of each route and command in this
+// instance, like 10/m, and RATE_LIMIT_PER_CALLER those of each caller.
+var RATE_LIMIT *RateLimit
+var RATE_LIMIT_PER_CALLER *RateLimit
+
+// CIRCUIT_BREAKER_THRESHOLD rejects invocations of a command for
+// CIRCUIT_BREAKER_COOLDOWN after it has failed this many times in a row.
+var CIRCUIT_BREAKER_THRESHOLD int
+var CIRCUIT_BREAKER_COOLDOWN time.Duration = 10 * time.Minute
+
+// ALLOWED_COMMANDS are the commands that jobs given in requests can run,
+// besides the command of the service.
+var ALLOWED_COMMANDS []string
+
+// DRY_RUN makes requests only write the plan of what they would run, unless
+// they set ?dryRun=false.
+var DRY_RUN bool
+
+// REQUIRED_ENV are environment variables, such as secrets, that the
+// self-check requires to be set.
+var REQUIRED_ENV []string
+
+// CALLBACK_URL_PREFIXES are the prefixes of the callback URLs that requests
+// can give to be called with the result of their run.
+var CALLBACK_URL_PREFIXES = []string{"https://workflowexecutions.googleapis.com/"}
+
+// OIDC_AUDIENCES are the audiences that the OIDC tokens of tenant callers
+// can have. By default they're URLs of the host of the request.
+var OIDC_AUDIENCES []string
+
+// REQUEST_SIGNING_KEY requires requests to be signed with one of these
+// comma-separated keys, with a timestamp and nonce against replays.
+var REQUEST_SIGNING_KEY []string
+
+// SIGNATURE_MAX_AGE is how far the timestamp of a signed request can be from
+// the current time.
+var SIGNATURE_MAX_AGE = 5 * time.Minute
+
+// JOB_STORE keeps the state of runs for /-/jobs/: memory (the default),
+// gs://bucket/prefix, firestore://collection or redis://host:port.
+var JOB_STORE string
+var jobStore JobStore = &memoryJobStore{jobs: make(map[string]*JobState)}
+
+// JOB_STORE_TTL is how long the state of runs is kept.
+var JOB_STORE_TTL = 24 * time.Hour
+
+// JOB_STORE_INTERVAL is how often the output of runs in progress is stored.
+var JOB_STORE_INTERVAL = 10 * time.Second
+
+// JOB_STORE_LINES is the number of output lines kept with the state.
+var JOB_STORE_LINES int = 100
+
+// CLIENT_GONE is what happens to a run when its client closes the
+// connection or a write to it fails: terminate, continue or detach.
+var CLIENT_GONE = ClientGoneTerminate
+
+// MANIFEST_GCS_URI is where a manifest of every run is written, with the
+// executable, arguments, environment variable names and the checksums of the
+// inputs and outputs: gs://bucket/prefix.
+var MANIFEST_GCS_URI string
+
+// MANIFEST_VERSION_ARG is the argument that makes the command print its
+// version for the manifest, or none.
+var MANIFEST_VERSION_ARG = "--version"
+
+// CHAIN_URL is called with the result of every run whose status matches
+// CHAIN_ON, with an identity token for CHAIN_AUDIENCE, to trigger the next
+// service of a pipeline.
+var CHAIN_URL string
+var CHAIN_ON string = "succeeded"
+var CHAIN_AUDIENCE string
+
+// FOLLOWUP_QUEUE is a Cloud Tasks queue used to schedule follow-up runs of
+// this service, FOLLOWUP_DELAY after a run whose status matches FOLLOWUP_ON.
+// Messages can request a follow-up with the followup and followupOn
+// attributes. FOLLOWUP_COMMAND and FOLLOWUP_ARGS (a JSON array) run another
+// command as the follow-up, for example to clean up after a backup.
+var FOLLOWUP_QUEUE string
+var FOLLOWUP_URL string
+var FOLLOWUP_DELAY time.Duration
+var FOLLOWUP_ON string = "always"
+var FOLLOWUP_COMMAND string
+var FOLLOWUP_ARGS []string
+var FOLLOWUP_SERVICE_ACCOUNT string
+
+// FAILURE_TOPIC receives the original message, the failure details and the
+// last FAILURE_TAIL_LINES lines of output when a run fails permanently.
+var FAILURE_TOPIC string
+var FAILURE_TAIL_LINES int = 50
+
+// OUTPUT_DRAIN_TIME is how long output is still read after the command has
+// exited, in case a background process is holding stdout or stderr open.
+var OUTPUT_DRAIN_TIME time.Duration = 5 * time.Second
+
+// loadConfig reads the configuration from environment variables.
+func loadConfig() {
+	CONFIG_FILE = os.Getenv("CONFIG_FILE")
+	if CONFIG_FILE != "" {
+		config, err := loadConfigFile(CONFIG_FILE)
+		if err != nil {
+			log.Printf("Invalid CONFIG_FILE: %v", err)
+			configFileError = err
+		} else {
+			CONFIG = config
+		}
+	}
+	if progressRegex := os.Getenv("PROGRESS_REGEX"); progressRegex != "" {
+		re, err := regexp.Compile(progressRegex)
+		if err != nil {
+			log.Fatalf("Invalid PROGRESS_REGEX: %v", err)
+		}
+		PROGRESS_REGEX = re
+	}
+	DISABLE_GZIP = envBool("DISABLE_GZIP", DISABLE_GZIP)
+	MAX_OUTPUT_BYTES = envInt("MAX_OUTPUT_BYTES", MAX_OUTPUT_BYTES)
+	MAX_OUTPUT_LINES = envInt("MAX_OUTPUT_LINES", MAX_OUTPUT_LINES)
+	KILL_ON_OUTPUT_LIMIT = envBool("KILL_ON_OUTPUT_LIMIT", KILL_ON_OUTPUT_LIMIT)
+	MEMORY_LIMIT_PERCENT = envInt("MEMORY_LIMIT_PERCENT", MEMORY_LIMIT_PERCENT)
+	MEMORY_LIMIT_BYTES = envInt("MEMORY_LIMIT_BYTES", MEMORY_LIMIT_BYTES)
+	MEMORY_CHECK_INTERVAL = envDuration("MEMORY_CHECK_INTERVAL", MEMORY_CHECK_INTERVAL)
+	if MEMORY_LIMIT_PERCENT > 0 && MEMORY_LIMIT_BYTES == 0 {
+		limit, err := runner.CgroupMemoryLimit()
+		if err != nil || limit == 0 {
+			log.Fatalf("MEMORY_LIMIT_PERCENT is set, but container memory limit could not be determined (set MEMORY_LIMIT_BYTES)")
+		}
+		MEMORY_LIMIT_BYTES = limit
+	}
+	RESOURCE_LIMITS = runner.ResourceLimits{
+		AddressSpace:    uint64(envInt("RLIMIT_AS", 0)),
+		OpenFiles:       uint64(envInt("RLIMIT_NOFILE", 0)),
+		Nice:            int(envInt("CHILD_NICE", 0)),
+		Cgroup:          os.Getenv("CHILD_CGROUP"),
+		CgroupMemoryMax: envInt("CHILD_CGROUP_MEMORY_MAX", 0),
+		CgroupCPUWeight: envInt("CHILD_CGROUP_CPU_WEIGHT", 0),
+	}
+	SUBREAPER = envBool("SUBREAPER", SUBREAPER)
+	KILL_ORPHANS = envBool("KILL_ORPHANS", KILL_ORPHANS)
+	OUTPUT_DRAIN_TIME = envDuration("OUTPUT_DRAIN_TIME", OUTPUT_DRAIN_TIME)
+	HANDOFF_TO_JOB = os.Getenv("HANDOFF_TO_JOB")
+	JOB_TIMEOUT = envDuration("JOB_TIMEOUT", JOB_TIMEOUT)
+	LOCK_BUCKET = os.Getenv("LOCK_BUCKET")
+	LOCK_KEY = os.Getenv("LOCK_KEY")
+	if mode := os.Getenv("LOCK_MODE"); mode != "" {
+		if mode != "reject" && mode != "wait" {
+			log.Fatalf("Invalid LOCK_MODE: %s (must be reject or wait)", mode)
+		}
+		LOCK_MODE = mode
+	}
+	HISTORY_COLLECTION = os.Getenv("HISTORY_COLLECTION")
+	ANOMALY_FACTOR = envFloat("ANOMALY_FACTOR", ANOMALY_FACTOR)
+	ANOMALY_HISTORY_RUNS = int(envInt("ANOMALY_HISTORY_RUNS", int64(ANOMALY_HISTORY_RUNS)))
+	ANOMALY_MIN_RUNS = int(envInt("ANOMALY_MIN_RUNS", int64(ANOMALY_MIN_RUNS)))
+	ANOMALY_TOPIC = os.Getenv("ANOMALY_TOPIC")
+	ANOMALY_WEBHOOK_URL = os.Getenv("ANOMALY_WEBHOOK_URL")
+	BIGQUERY_TABLE = os.Getenv("BIGQUERY_TABLE")
+	BIGQUERY_LINES_TABLE = os.Getenv("BIGQUERY_LINES_TABLE")
+	TRANSCRIPT_GCS_URI = os.Getenv("TRANSCRIPT_GCS_URI")
+	if TRANSCRIPT_GCS_URI != "" && !strings.HasPrefix(TRANSCRIPT_GCS_URI, "gs://") {
+		log.Fatalf("Invalid TRANSCRIPT_GCS_URI: %s (must be gs://bucket/prefix)", TRANSCRIPT_GCS_URI)
+	}
+	LOGGING_LOG_NAME = os.Getenv("LOGGING_LOG_NAME")
+	METRICS_PREFIX = os.Getenv("METRICS_PREFIX")
+	METRICS_LABELS = envMap("METRICS_LABELS")
+	RESULT_TOPIC = os.Getenv("RESULT_TOPIC")
+	ATTEMPTS_GCS_URI = os.Getenv("ATTEMPTS_GCS_URI")
+	if ATTEMPTS_GCS_URI != "" {
+		if _, _, err := parseGCSPrefix(ATTEMPTS_GCS_URI); err != nil {
+			log.Fatalf("Invalid ATTEMPTS_GCS_URI: %v", err)
+		}
+	}
+	RESULT_GCS_URI = os.Getenv("RESULT_GCS_URI")
+	if RESULT_GCS_URI != "" {
+		if _, _, err := parseGCSPrefix(RESULT_GCS_URI); err != nil {
+			log.Fatalf("Invalid RESULT_GCS_URI: %v", err)
+		}
+	}
+	NOTIFY_WEBHOOK_URL = os.Getenv("NOTIFY_WEBHOOK_URL")
+	notifyOn := os.Getenv("NOTIFY_ON")
+	if notifyOn == "" {
+		notifyOn = "success,failure"
+	}
+	events, err := parseNotifyEvents(notifyOn)
+	if err != nil {
+		log.Fatalf("Invalid NOTIFY_ON: %v", err)
+	}
+	NOTIFY_ON = events
+	if notifyTemplate, err = parseNotifyTemplate(os.Getenv("NOTIFY_TEMPLATE")); err != nil {
+		log.Fatalf("Invalid NOTIFY_TEMPLATE: %v", err)
+	}
+	GOOGLE_CLOUD_PROJECT = os.Getenv("GOOGLE_CLOUD_PROJECT")
+	GOOGLE_CLOUD_REGION = os.Getenv("GOOGLE_CLOUD_REGION")
+	REQUEST_TIMEOUT = time.Duration(envInt("REQUEST_TIMEOUT_SECONDS", int64(REQUEST_TIMEOUT.Seconds()))) * time.Second
+	DEADLINE_MARGIN = envDuration("DEADLINE_MARGIN", DEADLINE_MARGIN)
+	if DEADLINE_MARGIN >= REQUEST_TIMEOUT {
+		log.Fatalf("DEADLINE_MARGIN must be shorter than the request timeout")
+	}
+	if signal := os.Getenv("TERMINATION_SIGNAL"); signal != "" {
+		s, err := runner.SignalByName(signal)
+		if err != nil {
+			log.Fatalf("Invalid TERMINATION_SIGNAL: %v", err)
+		}
+		TERMINATION_SIGNAL = s
+	}
+	TERMINATION_GRACE = envDuration("TERMINATION_GRACE", TERMINATION_GRACE)
+	if TERMINATION_GRACE >= DEADLINE_MARGIN {
+		log.Fatalf("TERMINATION_GRACE must be shorter than DEADLINE_MARGIN")
+	}
+	CORE_DUMP_GCS_URI = os.Getenv("CORE_DUMP_GCS_URI")
+	if CORE_DUMP_GCS_URI != "" {
+		if _, _, err := parseGCSPrefix(CORE_DUMP_GCS_URI); err != nil {
+			log.Fatalf("Invalid CORE_DUMP_GCS_URI: %v", err)
+		}
+	}
+	STALL_TIMEOUT = envDuration("STALL_TIMEOUT", STALL_TIMEOUT)
+	if STALL_TIMEOUT < 0 {
+		log.Fatalf("Invalid STALL_TIMEOUT: %s", STALL_TIMEOUT)
+	}
+	if signal := os.Getenv("STALL_SIGNAL"); signal != "" {
+		s, err := runner.SignalByName(signal)
+		if err != nil {
+			log.Fatalf("Invalid STALL_SIGNAL: %v", err)
+		}
+		STALL_SIGNAL = s
+	}
+	KILL_ON_STALL = envBool("KILL_ON_STALL", KILL_ON_STALL)
+	CHECKPOINT_FILE = os.Getenv("CHECKPOINT_FILE")
+	CHECKPOINT_TOPIC = os.Getenv("CHECKPOINT_TOPIC")
+	CHECKPOINT_MARGIN = envDuration("CHECKPOINT_MARGIN", CHECKPOINT_MARGIN)
+	if signal := os.Getenv("CHECKPOINT_SIGNAL"); signal != "" {
+		s, err := runner.SignalByName(signal)
+		if err != nil {
+			log.Fatalf("Invalid CHECKPOINT_SIGNAL: %v", err)
+		}
+		CHECKPOINT_SIGNAL = s
+	}
+	if CHECKPOINT_FILE != "" && CHECKPOINT_TOPIC == "" {
+		log.Fatalf("CHECKPOINT_FILE requires CHECKPOINT_TOPIC to be set")
+	}
+	retryableExitCodes := os.Getenv("RETRYABLE_EXIT_CODES")
+	if retryableExitCodes == "" {
+		retryableExitCodes = "*"
+	}
+	exitCodes, err := parseExitCodes(retryableExitCodes)
+	if err != nil {
+		log.Fatalf("Invalid RETRYABLE_EXIT_CODES: %v", err)
+	}
+	RETRYABLE_EXIT_CODES = exitCodes
+	PERMANENT_FAILURE_STATUS = int(envInt("PERMANENT_FAILURE_STATUS", int64(PERMANENT_FAILURE_STATUS)))
+	if PERMANENT_FAILURE_STATUS < 200 || PERMANENT_FAILURE_STATUS >= 500 {
+		log.Fatalf("PERMANENT_FAILURE_STATUS must be a 2xx or 4xx status")
+	}
+	MAX_DELIVERY_ATTEMPTS = int(envInt("MAX_DELIVERY_ATTEMPTS", 0))
+	if MAX_DELIVERY_ATTEMPTS < 0 {
+		log.Fatalf("Invalid MAX_DELIVERY_ATTEMPTS: %d", MAX_DELIVERY_ATTEMPTS)
+	}
+	if codes := os.Getenv("ALLOWED_EXIT_CODES"); codes != "" {
+		if ALLOWED_EXIT_CODES, err = parseExitCodes(codes); err != nil || ALLOWED_EXIT_CODES == nil {
+			log.Fatalf("Invalid ALLOWED_EXIT_CODES: %s", codes)
+		}
+	}
+	CAN_FAIL = envBool("CAN_FAIL", CAN_FAIL)
+	SHOW_OUTPUT = envBool("SHOW_OUTPUT", SHOW_OUTPUT)
+	if ERROR_STATUS, err = parseErrorStatus(envMap("ERROR_STATUS")); err != nil {
+		log.Fatalf("Invalid ERROR_STATUS: %v", err)
+	}
+	AUDIT_LOG_NAME = os.Getenv("AUDIT_LOG_NAME")
+	STDOUT_CONTENT_TYPE = os.Getenv("STDOUT_CONTENT_TYPE")
+	KEEPALIVE_INTERVAL = envDuration("KEEPALIVE_INTERVAL", KEEPALIVE_INTERVAL)
+	KEEPALIVE_PADDING = int(envInt("KEEPALIVE_PADDING", int64(KEEPALIVE_PADDING)))
+	if KEEPALIVE_PADDING < 0 {
+		log.Fatalf("Invalid KEEPALIVE_PADDING: %d", KEEPALIVE_PADDING)
+	}
+	MAX_LINES_PER_SECOND = envInt("MAX_LINES_PER_SECOND", MAX_LINES_PER_SECOND)
+	LINE_SAMPLE_EVERY = envInt("LINE_SAMPLE_EVERY", LINE_SAMPLE_EVERY)
+	if MAX_LINES_PER_SECOND < 0 || LINE_SAMPLE_EVERY < 0 {
+		log.Fatalf("Invalid MAX_LINES_PER_SECOND or LINE_SAMPLE_EVERY: %d, %d", MAX_LINES_PER_SECOND, LINE_SAMPLE_EVERY)
+	}
+	STARTUP_CMD = os.Getenv("STARTUP_CMD")
+	STARTUP_TIMEOUT = envDuration("STARTUP_TIMEOUT", STARTUP_TIMEOUT)
+	if policy := os.Getenv("STARTUP_FAILURE_POLICY"); policy != "" {
+		STARTUP_FAILURE_POLICY = policy
+	}
+	switch STARTUP_FAILURE_POLICY {
+	case StartupFailureFail, StartupFailureExit, StartupFailureIgnore:
+	default:
+		log.Fatalf("Invalid STARTUP_FAILURE_POLICY: %s", STARTUP_FAILURE_POLICY)
+	}
+	if policy := os.Getenv("CPU_THROTTLING_POLICY"); policy != "" {
+		CPU_THROTTLING_POLICY = policy
+	}
+	switch CPU_THROTTLING_POLICY {
+	case CPUThrottlingWarn, CPUThrottlingFail:
+	default:
+		log.Fatalf("Invalid CPU_THROTTLING_POLICY: %s", CPU_THROTTLING_POLICY)
+	}
+	MAX_CONCURRENT_RUNS = int(envInt("MAX_CONCURRENT_RUNS", int64(MAX_CONCURRENT_RUNS)))
+	ALLOW_QUERY_ARGS = envBool("ALLOW_QUERY_ARGS", ALLOW_QUERY_ARGS)
+	for _, arg := range strings.Split(os.Getenv("QUERY_ARGS_ALLOWLIST"), ",") {
+		if arg = strings.TrimSpace(arg); arg != "" {
+			QUERY_ARGS_ALLOWLIST = append(QUERY_ARGS_ALLOWLIST, arg)
+		}
+	}
+	if ALLOW_QUERY_ARGS && len(QUERY_ARGS_ALLOWLIST) == 0 {
+		log.Fatal("ALLOW_QUERY_ARGS requires QUERY_ARGS_ALLOWLIST")
+	}
+	STDIN_GCS_URI = os.Getenv("STDIN_GCS_URI")
+	OUTPUT_STDOUT_GCS_URI = os.Getenv("OUTPUT_STDOUT_GCS_URI")
+	if paths := os.Getenv("DISK_PATHS"); paths != "" {
+		DISK_PATHS = nil
+		for _, path := range strings.Split(paths, ",") {
+			if path = strings.TrimSpace(path); path != "" {
+				DISK_PATHS = append(DISK_PATHS, path)
+			}
+		}
+	}
+	DISK_WARN_BYTES = envInt("DISK_WARN_BYTES", DISK_WARN_BYTES)
+	DISK_LIMIT_BYTES = envInt("DISK_LIMIT_BYTES", DISK_LIMIT_BYTES)
+	DISK_PRUNE_AGE = envDuration("DISK_PRUNE_AGE", DISK_PRUNE_AGE)
+	DISK_CHECK_INTERVAL = envDuration("DISK_CHECK_INTERVAL", DISK_CHECK_INTERVAL)
+	if DISK_CHECK_INTERVAL <= 0 {
+		log.Fatalf("Invalid DISK_CHECK_INTERVAL: %s", DISK_CHECK_INTERVAL)
+	}
+	CLEANUP_CMD = os.Getenv("CLEANUP_CMD")
+	CLEANUP_INTERVAL = envDuration("CLEANUP_INTERVAL", CLEANUP_INTERVAL)
+	if CLEANUP_INTERVAL <= 0 {
+		log.Fatalf("Invalid CLEANUP_INTERVAL: %s", CLEANUP_INTERVAL)
+	}
+	MAX_BODY_BYTES = envInt("MAX_BODY_BYTES", MAX_BODY_BYTES)
+	READ_HEADER_TIMEOUT = envDuration("READ_HEADER_TIMEOUT", READ_HEADER_TIMEOUT)
+	IDLE_TIMEOUT = envDuration("IDLE_TIMEOUT", IDLE_TIMEOUT)
+	ENABLE_H2C = envBool("ENABLE_H2C", ENABLE_H2C)
+	ENABLE_DEBUG = envBool("ENABLE_DEBUG", ENABLE_DEBUG)
+	PREFIX_JOB_ID = envBool("PREFIX_JOB_ID", PREFIX_JOB_ID)
+	COLLAPSE_REPEATS = envBool("COLLAPSE_REPEATS", COLLAPSE_REPEATS)
+	BINARY_OUTPUT = os.Getenv("BINARY_OUTPUT")
+	switch BINARY_OUTPUT {
+	case "", runner.BinaryBase64, runner.BinaryHex:
+	default:
+		log.Fatalf("Invalid BINARY_OUTPUT: %s (must be base64 or hex)", BINARY_OUTPUT)
+	}
+	PLAIN_TRIGGER = envBool("PLAIN_TRIGGER", PLAIN_TRIGGER)
+	TEMPLATE_ARGS = envBool("TEMPLATE_ARGS", TEMPLATE_ARGS)
+	if path := os.Getenv("PAYLOAD_SCHEMA"); path != "" {
+		if PAYLOAD_SCHEMA, err = loadSchema(path); err != nil {
+			log.Fatalf("Invalid PAYLOAD_SCHEMA: %v", err)
+		}
+	}
+	CIRCUIT_BREAKER_THRESHOLD = int(envInt("CIRCUIT_BREAKER_THRESHOLD", int64(CIRCUIT_BREAKER_THRESHOLD)))
+	CIRCUIT_BREAKER_COOLDOWN = envDuration("CIRCUIT_BREAKER_COOLDOWN", CIRCUIT_BREAKER_COOLDOWN)
+	if RATE_LIMIT, err = parseRateLimit(os.Getenv("RATE_LIMIT")); err != nil {
+		log.Fatalf("Invalid RATE_LIMIT: %v", err)
+	}
+	if RATE_LIMIT_PER_CALLER, err = parseRateLimit(os.Getenv("RATE_LIMIT_PER_CALLER")); err != nil {
+		log.Fatalf("Invalid RATE_LIMIT_PER_CALLER: %v", err)
+	}
+	for _, token := range strings.Split(os.Getenv("AUTH_TOKEN"), ",") {
+		if token = strings.TrimSpace(token); token != "" {
+			AUTH_TOKEN = append(AUTH_TOKEN, token)
+		}
+	}
+	for _, command := range strings.Split(os.Getenv("ALLOWED_COMMANDS"), ",") {
+		if command = strings.TrimSpace(command); command != "" {
+			ALLOWED_COMMANDS = append(ALLOWED_COMMANDS, command)
+		}
+	}
+	DRY_RUN = envBool("DRY_RUN", DRY_RUN)
+	for _, name := range strings.Split(os.Getenv("REQUIRED_ENV"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			REQUIRED_ENV = append(REQUIRED_ENV, name)
+		}
+	}
+	FOLLOWUP_QUEUE = os.Getenv("FOLLOWUP_QUEUE")
+	FOLLOWUP_URL = os.Getenv("FOLLOWUP_URL")
+	FOLLOWUP_DELAY = envDuration("FOLLOWUP_DELAY", FOLLOWUP_DELAY)
+	if prefixes := os.Getenv("CALLBACK_URL_PREFIXES"); prefixes != "" {
+		CALLBACK_URL_PREFIXES = nil
+		for _, prefix := range strings.Split(prefixes, ",") {
+			if prefix = strings.TrimSpace(prefix); prefix != "" {
+				if !strings.HasPrefix(prefix, "https://") || strings.Count(prefix, "/") < 3 {
+					log.Fatalf("Invalid CALLBACK_URL_PREFIXES: %s (must be https://host/...)", prefix)
+				}
+				CALLBACK_URL_PREFIXES = append(CALLBACK_URL_PREFIXES, prefix)
+			}
+		}
+	}
+	for _, audience := range strings.Split(os.Getenv("OIDC_AUDIENCES"), ",") {
+		if audience = strings.TrimSpace(audience); audience != "" {
+			OIDC_AUDIENCES = append(OIDC_AUDIENCES, audience)
+		}
+	}
+	for _, key := range strings.Split(os.Getenv("REQUEST_SIGNING_KEY"), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			REQUEST_SIGNING_KEY = append(REQUEST_SIGNING_KEY, key)
+		}
+	}
+	SIGNATURE_MAX_AGE = envDuration("SIGNATURE_MAX_AGE", SIGNATURE_MAX_AGE)
+	if SIGNATURE_MAX_AGE <= 0 {
+		log.Fatalf("Invalid SIGNATURE_MAX_AGE: %v (must be positive)", SIGNATURE_MAX_AGE)
+	}
+	JOB_STORE = os.Getenv("JOB_STORE")
+	store, err := newJobStore(JOB_STORE)
+	if err != nil {
+		log.Fatalf("Invalid JOB_STORE: %v", err)
+	}
+	jobStore = store
+	JOB_STORE_TTL = envDuration("JOB_STORE_TTL", JOB_STORE_TTL)
+	JOB_STORE_INTERVAL = envDuration("JOB_STORE_INTERVAL", JOB_STORE_INTERVAL)
+	if JOB_STORE_TTL <= 0 || JOB_STORE_INTERVAL <= 0 {
+		log.Fatalf("Invalid JOB_STORE_TTL or JOB_STORE_INTERVAL: %v, %v (must be positive)", JOB_STORE_TTL, JOB_STORE_INTERVAL)
+	}
+	JOB_STORE_LINES = int(envInt("JOB_STORE_LINES", int64(JOB_STORE_LINES)))
+	if JOB_STORE_LINES < 0 {
+		log.Fatalf("Invalid JOB_STORE_LINES: %d", JOB_STORE_LINES)
+	}
+	if mode := os.Getenv("CLIENT_GONE"); mode != "" {
+		switch mode {
+		case ClientGoneTerminate, ClientGoneContinue, ClientGoneDetach:
+			CLIENT_GONE = mode
+		default:
+			log.Fatalf("Invalid CLIENT_GONE: %s (must be terminate, continue or detach)", mode)
+		}
+	}
+	MANIFEST_GCS_URI = os.Getenv("MANIFEST_GCS_URI")
+	if MANIFEST_GCS_URI != "" {
+		if _, _, err := parseGCSPrefix(MANIFEST_GCS_URI); err != nil {
+			log.Fatalf("Invalid MANIFEST_GCS_URI: %v", err)
+		}
+	}
+	if arg := os.Getenv("MANIFEST_VERSION_ARG"); arg != "" {
+		MANIFEST_VERSION_ARG = arg
+	}
+	CHAIN_URL = os.Getenv("CHAIN_URL")
+	if CHAIN_URL != "" {
+		if u, err := url.Parse(CHAIN_URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Fatalf("Invalid CHAIN_URL: %s", CHAIN_URL)
+		}
+	}
+	if chainOn := os.Getenv("CHAIN_ON"); chainOn != "" {
+		if !validFollowupOn(chainOn) {
+			log.Fatalf("Invalid CHAIN_ON: %s", chainOn)
+		}
+		CHAIN_ON = chainOn
+	}
+	CHAIN_AUDIENCE = os.Getenv("CHAIN_AUDIENCE")
+	if followupOn := os.Getenv("FOLLOWUP_ON"); followupOn != "" {
+		if !validFollowupOn(followupOn) {
+			log.Fatalf("Invalid FOLLOWUP_ON: %s", followupOn)
+		}
+		FOLLOWUP_ON = followupOn
+	}
+	FOLLOWUP_SERVICE_ACCOUNT = os.Getenv("FOLLOWUP_SERVICE_ACCOUNT")
+	FOLLOWUP_COMMAND = os.Getenv("FOLLOWUP_COMMAND")
+	if args := os.Getenv("FOLLOWUP_ARGS"); args != "" {
+		if err := json.Unmarshal([]byte(args), &FOLLOWUP_ARGS); err != nil {
+			log.Fatalf("Invalid FOLLOWUP_ARGS: %v", err)
+		}
+	}
+	if len(FOLLOWUP_ARGS) > 0 && FOLLOWUP_COMMAND == "" {
+		log.Fatalf("FOLLOWUP_ARGS requires FOLLOWUP_COMMAND")
+	}
+	if FOLLOWUP_COMMAND != "" && !commandAllowed(FOLLOWUP_COMMAND) {
+		log.Fatalf("FOLLOWUP_COMMAND is not allowed: %s", FOLLOWUP_COMMAND)
+	}
+	FAILURE_TOPIC = os.Getenv("FAILURE_TOPIC")
+	FAILURE_TAIL_LINES = int(envInt("FAILURE_TAIL_LINES", int64(FAILURE_TAIL_LINES)))
+	if FAILURE_TAIL_LINES < 0 {
+		log.Fatalf("Invalid FAILURE_TAIL_LINES: %d", FAILURE_TAIL_LINES)
+	}
+	WORKING_DIR = os.Getenv("WORKING_DIR")
+	CHROOT = os.Getenv("CHROOT")
+	UPLOAD_DIR = os.Getenv("UPLOAD_DIR")
+	SPILL_ARG_BYTES = envInt("SPILL_ARG_BYTES", 0)
+	if SPILL_ARG_BYTES < 0 {
+		log.Fatalf("Invalid SPILL_ARG_BYTES: %d", SPILL_ARG_BYTES)
+	}
+	if CHROOT != "" && UPLOAD_DIR == "" {
+		UPLOAD_DIR = filepath.Join(CHROOT, "tmp")
+	}
+	if CHROOT != "" && !strings.HasPrefix(filepath.Clean(UPLOAD_DIR)+"/", filepath.Clean(CHROOT)+"/") {
+		log.Fatalf("Invalid UPLOAD_DIR: %s is not inside CHROOT", UPLOAD_DIR)
+	}
+	MAX_UPLOAD_BYTES = envInt("MAX_UPLOAD_BYTES", MAX_UPLOAD_BYTES)
+
+	runAsUser := os.Getenv("RUN_AS_USER")
+	if runAsUser == "" {
+		runAsUser = os.Getenv("RUN_AS_UID")
+	}
+	if runAsUser != "" {
+		runAs, err := runner.LookupRunAs(runAsUser, os.Getenv("RUN_AS_GID"))
+		if err != nil {
+			log.Fatalf("Invalid RUN_AS_USER: %v", err)
+		}
+		RUN_AS = runAs
+	} else if os.Getenv("RUN_AS_GID") != "" {
+		log.Fatalf("RUN_AS_GID requires RUN_AS_USER or RUN_AS_UID to be set")
+	}
+	if CHROOT != "" && RUN_AS == nil {
+		log.Print("Warning: CHROOT without RUN_AS_USER, a command running as root can escape the chroot.")
+	}
+}
+
+func envBool(name string, defaultValue bool) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", name, err)
+	}
+	return b
+}
+
+func envInt(name string, defaultValue int64) int64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	i, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", name, err)
+	}
+	return i
+}
+
+func envFloat(name string, defaultValue float64) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", name, err)
+	}
+	return f
+}
+
+// envMap parses a comma-separated list of key=value pairs.
+func envMap(name string) map[string]string {
+	values := make(map[string]string)
+	for _, pair := range strings.Split(os.Getenv(name), ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			log.Fatalf("Invalid %s: %s is not key=value", name, pair)
+		}
+		values[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return values
+}
+
+func envDuration(name string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", name, err)
+	}
+	return d
+}
@@ -0,0 +1,152 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// ConfigFile is the optional JSON configuration file set with CONFIG_FILE,
+// for settings that don't fit in environment variables.
+type ConfigFile struct {
+	Schedules  []*Schedule      `json:"schedules,omitempty"`
+	Routes     []*Route         `json:"routes,omitempty"`
+	RateLimits []*RateLimitRule `json:"rateLimits,omitempty"`
+	Dispatch   []*DispatchRule  `json:"dispatch,omitempty"`
+	Sidecars   []*Sidecar       `json:"sidecars,omitempty"`
+	Cache      []*CacheRule     `json:"cache,omitempty"`
+	Extractors []*LineExtractor `json:"extractors,omitempty"`
+	Tenants    []*Tenant        `json:"tenants,omitempty"`
+	Pins       []*CommandPin    `json:"pins,omitempty"`
+	Expect     []*ExpectRule    `json:"expect,omitempty"`
+	Windows    []*RunWindow     `json:"windows,omitempty"`
+}
+
+// Duration is a time.Duration that is given as a string like "1m30s" in
+// JSON.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"1m30s\": %s", b)
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// loadConfigFile reads and validates a configuration file.
+func loadConfigFile(path string) (*ConfigFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &ConfigFile{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", path, err)
+	}
+	names := make(map[string]bool)
+	for i, schedule := range config.Schedules {
+		if schedule.Name == "" {
+			return nil, fmt.Errorf("schedule %d has no name", i)
+		}
+		if names[schedule.Name] {
+			return nil, fmt.Errorf("duplicate schedule name: %s", schedule.Name)
+		}
+		names[schedule.Name] = true
+		if err := schedule.parse(); err != nil {
+			return nil, fmt.Errorf("invalid schedule %s: %w", schedule.Name, err)
+		}
+	}
+	for _, route := range config.Routes {
+		if err := route.parse(); err != nil {
+			return nil, fmt.Errorf("invalid route %s: %w", route.Path, err)
+		}
+	}
+	for i, rule := range config.RateLimits {
+		if err := rule.parse(); err != nil {
+			return nil, fmt.Errorf("invalid rate limit %d: %w", i, err)
+		}
+	}
+	for i, rule := range config.Dispatch {
+		if err := rule.parse(); err != nil {
+			return nil, fmt.Errorf("invalid dispatch rule %d: %w", i, err)
+		}
+	}
+	sidecars := make(map[string]bool)
+	for i, sidecar := range config.Sidecars {
+		if sidecar.Name == "" {
+			return nil, fmt.Errorf("sidecar %d has no name", i)
+		}
+		if sidecars[sidecar.Name] {
+			return nil, fmt.Errorf("duplicate sidecar name: %s", sidecar.Name)
+		}
+		sidecars[sidecar.Name] = true
+		if err := sidecar.parse(); err != nil {
+			return nil, fmt.Errorf("invalid sidecar %s: %w", sidecar.Name, err)
+		}
+	}
+	for i, rule := range config.Cache {
+		if err := rule.parse(); err != nil {
+			return nil, fmt.Errorf("invalid cache rule %d: %w", i, err)
+		}
+	}
+	for i, extractor := range config.Extractors {
+		if err := extractor.parse(); err != nil {
+			return nil, fmt.Errorf("invalid extractor %d: %w", i, err)
+		}
+	}
+	tenants := make(map[string]bool)
+	for _, tenant := range config.Tenants {
+		if tenants[tenant.Name] {
+			return nil, fmt.Errorf("duplicate tenant name: %s", tenant.Name)
+		}
+		tenants[tenant.Name] = true
+		if err := tenant.parse(); err != nil {
+			return nil, fmt.Errorf("invalid tenant %s: %w", tenant.Name, err)
+		}
+	}
+	for i, pin := range config.Pins {
+		if err := pin.parse(); err != nil {
+			return nil, fmt.Errorf("invalid pin %d: %w", i, err)
+		}
+	}
+	for i, rule := range config.Expect {
+		if err := rule.parse(); err != nil {
+			return nil, fmt.Errorf("invalid expect rule %d: %w", i, err)
+		}
+	}
+	for i, window := range config.Windows {
+		if err := window.parse(); err != nil {
+			return nil, fmt.Errorf("invalid window %d: %w", i, err)
+		}
+	}
+	return config, nil
+}
@@ -0,0 +1,96 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rosmo/long-cloud-run/pkg/runner"
+)
+
+// findCoreDump returns the newest core file, named core or core.<pid>,
+// written in dir since the run started.
+func findCoreDump(dir string, result runner.Result) (string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	var newest os.FileInfo
+	for _, file := range files {
+		if file.Name() != "core" && !strings.HasPrefix(file.Name(), "core.") {
+			continue
+		}
+		if !file.Mode().IsRegular() || file.ModTime().Before(result.StartTime) {
+			continue
+		}
+		if newest == nil || file.ModTime().After(newest.ModTime()) {
+			newest = file
+		}
+	}
+	if newest == nil {
+		return "", fmt.Errorf("no core file found in %s", dir)
+	}
+	return filepath.Join(dir, newest.Name()), nil
+}
+
+// uploadCoreDump uploads the core file of a run that dumped core under
+// CORE_DUMP_GCS_URI, named like its transcript, and removes it so that it
+// doesn't fill the in-memory file system.
+func uploadCoreDump(ctx context.Context, result runner.Result) error {
+	if !result.CoreDump {
+		return nil
+	}
+	dir := WORKING_DIR
+	if dir == "" {
+		dir = "."
+	}
+	path, err := findCoreDump(dir, result)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+	bucket, prefix, err := parseGCSPrefix(CORE_DUMP_GCS_URI)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	name := runObjectName(prefix, result.Command, result.JobID, result.StartTime) + ".core"
+	if _, err := uploadObjectFrom(ctx, bucket, name, "application/octet-stream", file, -1); err != nil {
+		return err
+	}
+	log.Printf("Uploaded the core dump of %s to gs://%s/%s.", result.Command, bucket, name)
+	return nil
+}
+
+func init() {
+	registerResultSink("coredump", resultSinkFuncs{
+		enabled: func() bool { return CORE_DUMP_GCS_URI != "" },
+		report: func(ctx context.Context, trigger string, result runner.Result, err error) error {
+			return uploadCoreDump(ctx, result)
+		},
+	})
+}
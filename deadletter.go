@@ -0,0 +1,88 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/rosmo/long-cloud-run/pkg/runner"
+)
+
+// failureMessage is published to FAILURE_TOPIC when a run fails permanently.
+type failureMessage struct {
+	JobID           string            `json:"jobId,omitempty"`
+	Subscription    string            `json:"subscription,omitempty"`
+	MessageID       string            `json:"messageId,omitempty"`
+	Data            []byte            `json:"data,omitempty"`
+	Attributes      map[string]string `json:"attributes,omitempty"`
+	DeliveryAttempt int               `json:"deliveryAttempt,omitempty"`
+	Command         string            `json:"command"`
+	Args            []string          `json:"args"`
+	Status          string            `json:"status"`
+	ExitCode        int               `json:"exitCode"`
+	Error           string            `json:"error,omitempty"`
+	StartTime       time.Time         `json:"startTime"`
+	DurationSeconds float64           `json:"durationSeconds"`
+	LastLines       []string          `json:"lastLines"`
+}
+
+// publishFailure publishes the original message together with the failure
+// details and the last lines of output to FAILURE_TOPIC.
+func publishFailure(ctx context.Context, m *PubSubMessage, result runner.Result, lastLines []string) error {
+	message := failureMessage{
+		JobID:           result.JobID,
+		Subscription:    m.Subscription,
+		MessageID:       m.Message.ID,
+		Data:            m.Message.Data,
+		Attributes:      m.Message.Attributes,
+		DeliveryAttempt: m.DeliveryAttempt,
+		Command:         result.Command,
+		Args:            result.Args,
+		Status:          result.Status,
+		ExitCode:        result.ExitCode,
+		Error:           result.Error,
+		StartTime:       result.StartTime,
+		DurationSeconds: result.Duration.Seconds(),
+		LastLines:       lastLines,
+	}
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	attributes := map[string]string{
+		"command":  commandLabel(result.Command),
+		"status":   result.Status,
+		"exitCode": strconv.Itoa(result.ExitCode),
+	}
+	if m.Message.ID != "" {
+		attributes["messageId"] = m.Message.ID
+	}
+	if result.JobID != "" {
+		attributes["jobId"] = result.JobID
+	}
+	messageId, err := publishMessage(ctx, FAILURE_TOPIC, data, attributes)
+	if err != nil {
+		return fmt.Errorf("failed to publish failure to %s: %w", FAILURE_TOPIC, err)
+	}
+	log.Printf("Published failure as message %s to %s.", messageId, FAILURE_TOPIC)
+	return nil
+}
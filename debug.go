@@ -0,0 +1,105 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// activeRun is a run in progress, listed in /debug/vars.
+type activeRun struct {
+	JobID     string    `json:"jobId"`
+	Command   string    `json:"command"`
+	Trigger   string    `json:"trigger"`
+	StartTime time.Time `json:"startTime"`
+}
+
+// debugState tracks the runs in progress and the depths of the queues of
+// the background writers, for /debug/vars.
+var debugState = struct {
+	mu     sync.Mutex
+	runs   map[string]activeRun
+	queues map[string]func() int
+}{
+	runs:   make(map[string]activeRun),
+	queues: make(map[string]func() int),
+}
+
+// trackRun lists a run as in progress until the returned function is
+// called.
+func trackRun(jobID string, command string, trigger string) func() {
+	debugState.mu.Lock()
+	defer debugState.mu.Unlock()
+	debugState.runs[jobID] = activeRun{JobID: jobID, Command: command, Trigger: trigger, StartTime: time.Now()}
+	return func() {
+		debugState.mu.Lock()
+		defer debugState.mu.Unlock()
+		delete(debugState.runs, jobID)
+	}
+}
+
+// trackQueue reports the depth of a queue until the returned function is
+// called.
+func trackQueue(name string, depth func() int) func() {
+	debugState.mu.Lock()
+	defer debugState.mu.Unlock()
+	debugState.queues[name] = depth
+	return func() {
+		debugState.mu.Lock()
+		defer debugState.mu.Unlock()
+		delete(debugState.queues, name)
+	}
+}
+
+func init() {
+	expvar.Publish("goroutines", expvar.Func(func() interface{} {
+		return runtime.NumGoroutine()
+	}))
+	expvar.Publish("runs", expvar.Func(func() interface{} {
+		debugState.mu.Lock()
+		defer debugState.mu.Unlock()
+		runs := make([]activeRun, 0, len(debugState.runs))
+		for _, run := range debugState.runs {
+			runs = append(runs, run)
+		}
+		return runs
+	}))
+	expvar.Publish("queues", expvar.Func(func() interface{} {
+		debugState.mu.Lock()
+		defer debugState.mu.Unlock()
+		queues := make(map[string]int, len(debugState.queues))
+		for name, depth := range debugState.queues {
+			queues[name] = depth()
+		}
+		return queues
+	}))
+}
+
+// registerDebugHandlers adds /debug/pprof/ and /debug/vars to the mux.
+func registerDebugHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", withAuth("/debug/pprof/", pprof.Index))
+	mux.HandleFunc("/debug/pprof/cmdline", withAuth("/debug/pprof/", pprof.Cmdline))
+	mux.HandleFunc("/debug/pprof/profile", withAuth("/debug/pprof/", pprof.Profile))
+	mux.HandleFunc("/debug/pprof/symbol", withAuth("/debug/pprof/", pprof.Symbol))
+	mux.HandleFunc("/debug/pprof/trace", withAuth("/debug/pprof/", pprof.Trace))
+	mux.HandleFunc("/debug/vars", withAuth("/debug/vars", expvar.Handler().ServeHTTP))
+}
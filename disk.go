@@ -0,0 +1,199 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rosmo/long-cloud-run/pkg/runner"
+)
+
+// DiskFullError is returned when the files in DISK_PATHS use more than
+// DISK_LIMIT_BYTES, so that new runs are refused.
+type DiskFullError struct {
+	Used  int64
+	Limit int64
+}
+
+func (e *DiskFullError) Error() string {
+	return fmt.Sprintf("disk usage %s is over the limit of %s", runner.FormatBytes(e.Used), runner.FormatBytes(e.Limit))
+}
+
+// diskMonitor tracks the space used by the files in DISK_PATHS. On Cloud Run
+// the filesystem is in memory and counts against the memory limit.
+type diskMonitor struct {
+	mu   sync.Mutex
+	used int64
+	// active are the paths used by runs in progress, which aren't pruned.
+	active map[string]int
+}
+
+var disk = &diskMonitor{}
+
+// startDiskMonitor checks the disk usage every DISK_CHECK_INTERVAL in the
+// background.
+func startDiskMonitor() {
+	disk.check(time.Now())
+	go func() {
+		ticker := time.NewTicker(DISK_CHECK_INTERVAL)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			disk.check(now)
+		}
+	}()
+}
+
+// check measures the disk usage and, when it's over DISK_WARN_BYTES, prunes
+// the entries older than DISK_PRUNE_AGE.
+func (d *diskMonitor) check(now time.Time) int64 {
+	used := diskUsage(DISK_PATHS)
+	if DISK_WARN_BYTES > 0 && used > DISK_WARN_BYTES && DISK_PRUNE_AGE > 0 {
+		for _, path := range DISK_PATHS {
+			d.prune(path, now.Add(-DISK_PRUNE_AGE))
+		}
+		used = diskUsage(DISK_PATHS)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.used = used
+	return used
+}
+
+// use marks the paths as used by a run until release is called, so that
+// they aren't pruned.
+func (d *diskMonitor) use(paths ...string) (release func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.active == nil {
+		d.active = make(map[string]int)
+	}
+	for _, path := range paths {
+		d.active[filepath.Clean(path)]++
+	}
+	return func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		for _, path := range paths {
+			path = filepath.Clean(path)
+			if d.active[path]--; d.active[path] <= 0 {
+				delete(d.active, path)
+			}
+		}
+	}
+}
+
+// inUse returns true if the path is, contains or is inside WORKING_DIR or
+// a path used by a run.
+func (d *diskMonitor) inUse(path string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	paths := []string{WORKING_DIR}
+	for active := range d.active {
+		paths = append(paths, active)
+	}
+	for _, active := range paths {
+		if active != "" && (withinDir(path, active) || withinDir(active, path)) {
+			return true
+		}
+	}
+	return false
+}
+
+// withinDir returns true if path is dir or inside it.
+func withinDir(path string, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Used returns the disk usage at the last check.
+func (d *diskMonitor) Used() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.used
+}
+
+// Allow returns a DiskFullError if the disk usage is over DISK_LIMIT_BYTES.
+func (d *diskMonitor) Allow() error {
+	if used := d.Used(); DISK_LIMIT_BYTES > 0 && used > DISK_LIMIT_BYTES {
+		return &DiskFullError{Used: used, Limit: DISK_LIMIT_BYTES}
+	}
+	return nil
+}
+
+// heartbeatDetails warns in the heartbeats when the disk usage is over
+// DISK_WARN_BYTES.
+func (d *diskMonitor) heartbeatDetails() []string {
+	if used := d.Used(); DISK_WARN_BYTES > 0 && used > DISK_WARN_BYTES {
+		return []string{fmt.Sprintf("warning: %s disk used", runner.FormatBytes(used))}
+	}
+	return nil
+}
+
+// diskUsage returns the size of the files in the paths.
+func diskUsage(paths []string) int64 {
+	var used int64
+	for _, path := range paths {
+		filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() {
+				used += info.Size()
+			}
+			return nil
+		})
+	}
+	return used
+}
+
+// prune removes the entries of a directory in which nothing has been
+// modified since before, unless they are in use.
+func (d *diskMonitor) prune(dir string, before time.Time) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		modified := lastModified(path)
+		if modified.IsZero() || !modified.Before(before) || d.inUse(path) {
+			continue
+		}
+		if err := os.RemoveAll(path); err != nil {
+			log.Printf("Failed to prune %s: %v", path, err)
+			continue
+		}
+		log.Printf("Pruned %s, last modified %s.", path, modified.Format(time.RFC3339))
+	}
+}
+
+// lastModified returns the newest modification time of a file, or of a
+// directory and everything in it.
+func lastModified(path string) time.Time {
+	var newest time.Time
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+		return nil
+	})
+	return newest
+}
@@ -0,0 +1,81 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DispatchRule runs a command for the Pub/Sub messages whose attributes
+// match, so that one subscription can dispatch a family of related tasks.
+type DispatchRule struct {
+	Name string `json:"name,omitempty"`
+	// Attributes the message must have, with these values. A rule without
+	// attributes matches any message.
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Command    string            `json:"command"`
+	Args       []string          `json:"args,omitempty"`
+	// Timeout limits how long the command runs, within the timeout of the
+	// request.
+	Timeout Duration `json:"timeout,omitempty"`
+	// Schema validates the message data instead of PAYLOAD_SCHEMA.
+	Schema *Schema `json:"schema,omitempty"`
+	CommandOptions
+}
+
+func (d *DispatchRule) parse() error {
+	if d.Command == "" {
+		return fmt.Errorf("no command set")
+	}
+	if d.Name == "" {
+		d.Name = filepath.Base(d.Command)
+	}
+	return nil
+}
+
+func (d *DispatchRule) matches(attributes map[string]string) bool {
+	for key, value := range d.Attributes {
+		if actual, ok := attributes[key]; !ok || actual != value {
+			return false
+		}
+	}
+	return true
+}
+
+// dispatchRule returns the first dispatch rule that matches the attributes
+// of the message, or nil if there are no rules. Messages that no rule
+// matches are rejected.
+func dispatchRule(m *PubSubMessage) (*DispatchRule, error) {
+	rules := currentConfig().Dispatch
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	for _, rule := range rules {
+		if rule.matches(m.Message.Attributes) {
+			return rule, nil
+		}
+	}
+	attributes := make([]string, 0, len(m.Message.Attributes))
+	for key, value := range m.Message.Attributes {
+		attributes = append(attributes, key+"="+value)
+	}
+	sort.Strings(attributes)
+	return nil, fmt.Errorf("no dispatch rule matches the message attributes: %s", strings.Join(attributes, ","))
+}
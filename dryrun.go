@@ -0,0 +1,153 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// isDryRun returns true if the request asks for a dry run with
+// ?dryRun=true, or DRY_RUN is set and the request doesn't turn it off.
+func isDryRun(r *http.Request) bool {
+	if value := r.URL.Query().Get("dryRun"); value != "" {
+		dryRun, err := strconv.ParseBool(value)
+		return err == nil && dryRun
+	}
+	return DRY_RUN
+}
+
+// dryRun writes the plan of what the request would run and checks that the
+// commands exist and the Cloud Storage inputs in their arguments are
+// readable, without running anything.
+func dryRun(ctx context.Context, w io.Writer, batch *BatchRequest, command string, args []string, timeout time.Duration) error {
+	jobs := []*JobSpec{}
+	if batch != nil {
+		jobs = batch.Jobs
+		fmt.Fprintf(w, "[Dry run: %d jobs, parallelism %d, on failure %s]\n", len(jobs), batch.Parallelism, batch.OnFailure)
+	} else {
+		jobs = append(jobs, &JobSpec{Name: filepath.Base(command), Command: command, Args: args})
+		if HANDOFF_TO_JOB != "" {
+			fmt.Fprintf(w, "[Dry run: handing off to Cloud Run job %s]\n", HANDOFF_TO_JOB)
+		} else {
+			fmt.Fprintf(w, "[Dry run: 1 job]\n")
+		}
+	}
+	fmt.Fprintf(w, "Timeout: %s\n", timeout.Round(time.Second))
+
+	problems := 0
+	check := func(description string, err error) {
+		if err != nil {
+			problems++
+			fmt.Fprintf(w, "  ERROR %s: %v\n", description, err)
+		} else {
+			fmt.Fprintf(w, "  OK    %s\n", description)
+		}
+	}
+	for _, job := range jobs {
+		fmt.Fprintln(w, strings.TrimSpace(fmt.Sprintf("%s: %s %s", job.Name, job.Command, quoteArgs(job.Args))))
+		if job.Timeout.Duration > 0 {
+			fmt.Fprintf(w, "  timeout: %s\n", job.Timeout)
+		}
+		if len(job.DependsOn) > 0 {
+			fmt.Fprintf(w, "  depends on: %s\n", strings.Join(job.DependsOn, ", "))
+		}
+		if job.If != "" {
+			fmt.Fprintf(w, "  if: %s\n", job.If)
+		}
+		if job.ContinueOnError {
+			fmt.Fprintf(w, "  continue on error\n")
+		}
+		path, err := findExecutable(job.Command)
+		if path == "" {
+			path = job.Command
+		}
+		check("executable "+path, err)
+		for _, arg := range job.Args {
+			if strings.HasPrefix(arg, "gs://") {
+				check("input "+arg, checkGCSInput(ctx, arg))
+			}
+		}
+	}
+	if problems > 0 {
+		return fmt.Errorf("dry run found %d problems", problems)
+	}
+	fmt.Fprintln(w, "[Dry run: plan is valid]")
+	return nil
+}
+
+// findExecutable returns the path the command would be run from, inside
+// CHROOT and relative to WORKING_DIR if they are set.
+func findExecutable(command string) (string, error) {
+	if CHROOT == "" && WORKING_DIR == "" {
+		return exec.LookPath(command)
+	}
+	path := command
+	if !strings.Contains(command, "/") {
+		for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+			candidate := filepath.Join(CHROOT, dir, command)
+			if isExecutable(candidate) {
+				return strings.TrimPrefix(candidate, filepath.Clean(CHROOT)), nil
+			}
+		}
+		return command, fmt.Errorf("not found in PATH")
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(WORKING_DIR, path)
+	}
+	if !isExecutable(filepath.Join(CHROOT, path)) {
+		return path, fmt.Errorf("not an executable file")
+	}
+	return path, nil
+}
+
+func isExecutable(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir() && info.Mode()&0111 != 0
+}
+
+// checkGCSInput checks that a gs:// URI exists and can be read. Prefixes
+// ending in / are checked as buckets.
+func checkGCSInput(ctx context.Context, uri string) error {
+	if strings.HasSuffix(uri, "/") {
+		bucket := strings.SplitN(strings.TrimPrefix(uri, "gs://"), "/", 2)[0]
+		return callAPI(ctx, "GET", storageAPI+"b/"+url.PathEscape(bucket), nil, nil)
+	}
+	bucket, name, err := parseGCSURI(uri)
+	if err != nil {
+		return err
+	}
+	_, err = getObject(ctx, bucket, name)
+	return err
+}
+
+func quoteArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = strconv.Quote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
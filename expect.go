@@ -0,0 +1,115 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/rosmo/long-cloud-run/pkg/runner"
+)
+
+const secretManagerAPI = "https://secretmanager.googleapis.com/v1/"
+
+// secretVersionRegex matches the names of secrets and their versions in
+// Secret Manager.
+var secretVersionRegex = regexp.MustCompile(`^projects/[^/]+/secrets/[^/]+(/versions/[^/]+)?$`)
+
+// ExpectRule answers a prompt of a command that insists on interactive
+// input: when its output matches Prompt, Response or the value of Secret is
+// written to its standard input. An empty Command matches any.
+type ExpectRule struct {
+	Command  string `json:"command,omitempty"`
+	Prompt   string `json:"prompt"`
+	Response string `json:"response,omitempty"`
+	// Secret is a secret in Secret Manager, as in
+	// projects/p/secrets/s/versions/latest, whose value is the response.
+	Secret string `json:"secret,omitempty"`
+	// Times is how many times the prompt is answered in a run, zero meaning
+	// every time.
+	Times int `json:"times,omitempty"`
+
+	prompt *regexp.Regexp
+}
+
+func (e *ExpectRule) parse() error {
+	prompt, err := regexp.Compile(e.Prompt)
+	if err != nil {
+		return err
+	}
+	if prompt.MatchString("") {
+		return fmt.Errorf("prompt matches empty output: %s", e.Prompt)
+	}
+	if e.Secret != "" {
+		if e.Response != "" {
+			return fmt.Errorf("both response and secret set")
+		}
+		if !secretVersionRegex.MatchString(e.Secret) {
+			return fmt.Errorf("invalid secret: %s", e.Secret)
+		}
+		if !strings.Contains(e.Secret, "/versions/") {
+			e.Secret += "/versions/latest"
+		}
+	}
+	if e.Times < 0 {
+		return fmt.Errorf("times must not be negative")
+	}
+	e.prompt = prompt
+	return nil
+}
+
+// expectations returns the answers to the prompts of a command, matching the
+// rules by the path or the base name of the command, with the values of
+// their secrets.
+func expectations(ctx context.Context, command string) ([]runner.Expectation, error) {
+	var expect []runner.Expectation
+	for _, rule := range currentConfig().Expect {
+		if rule.Command != "" && rule.Command != command && rule.Command != filepath.Base(command) {
+			continue
+		}
+		response := rule.Response
+		if rule.Secret != "" {
+			var err error
+			if response, err = accessSecret(ctx, rule.Secret); err != nil {
+				return nil, fmt.Errorf("failed to access %s: %w", rule.Secret, err)
+			}
+		}
+		expect = append(expect, runner.Expectation{Pattern: rule.prompt, Response: response, Times: rule.Times})
+	}
+	return expect, nil
+}
+
+// accessSecret returns the value of a secret version in Secret Manager.
+func accessSecret(ctx context.Context, name string) (string, error) {
+	var version struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	if err := callAPI(ctx, "GET", secretManagerAPI+name+":access", nil, &version); err != nil {
+		return "", err
+	}
+	data, err := base64.StdEncoding.DecodeString(version.Payload.Data)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
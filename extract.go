@@ -0,0 +1,128 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// LineExtractor parses output lines of a command into structured fields with
+// the named groups of a regular expression, for the NDJSON output and Cloud
+// Logging. An empty Command matches any.
+type LineExtractor struct {
+	Command string `json:"command,omitempty"`
+	Regex   string `json:"regex"`
+	// Numbers are the fields given as numbers instead of strings, like
+	// record counts.
+	Numbers []string `json:"numbers,omitempty"`
+
+	regex *regexp.Regexp
+}
+
+func (e *LineExtractor) parse() error {
+	regex, err := regexp.Compile(e.Regex)
+	if err != nil {
+		return err
+	}
+	named := false
+	for _, name := range regex.SubexpNames() {
+		named = named || name != ""
+	}
+	if !named {
+		return fmt.Errorf("regex has no named groups: %s", e.Regex)
+	}
+	e.regex = regex
+	return nil
+}
+
+// extract adds the fields of a matching line that aren't set yet.
+func (e *LineExtractor) extract(line string, fields map[string]interface{}) {
+	match := e.regex.FindStringSubmatch(line)
+	if match == nil {
+		return
+	}
+	for i, name := range e.regex.SubexpNames() {
+		if name == "" || match[i] == "" {
+			continue
+		}
+		if _, ok := fields[name]; ok {
+			continue
+		}
+		fields[name] = match[i]
+		for _, number := range e.Numbers {
+			if number != name {
+				continue
+			}
+			if f, err := strconv.ParseFloat(strings.ReplaceAll(match[i], ",", ""), 64); err == nil {
+				fields[name] = f
+			}
+		}
+	}
+}
+
+// lineFields returns the function parsing the output lines of a command with
+// the extractors of the config file, or nil if none match the command.
+func lineFields(command string) func(line string) map[string]interface{} {
+	var extractors []*LineExtractor
+	for _, extractor := range currentConfig().Extractors {
+		if extractor.Command == "" || extractor.Command == command || extractor.Command == filepath.Base(command) {
+			extractors = append(extractors, extractor)
+		}
+	}
+	if len(extractors) == 0 {
+		return nil
+	}
+	return func(line string) map[string]interface{} {
+		fields := make(map[string]interface{})
+		for _, extractor := range extractors {
+			extractor.extract(line, fields)
+		}
+		if len(fields) == 0 {
+			return nil
+		}
+		return fields
+	}
+}
+
+// logSeverity returns the Cloud Logging severity of a level field, or "" if
+// it isn't a known level.
+func logSeverity(level interface{}) string {
+	s, _ := level.(string)
+	switch strings.ToUpper(s) {
+	case "TRACE", "DEBUG", "FINE", "FINER", "FINEST":
+		return "DEBUG"
+	case "INFO":
+		return "INFO"
+	case "NOTICE":
+		return "NOTICE"
+	case "WARN", "WARNING":
+		return "WARNING"
+	case "ERR", "ERROR", "SEVERE":
+		return "ERROR"
+	case "CRIT", "CRITICAL", "FATAL":
+		return "CRITICAL"
+	case "ALERT":
+		return "ALERT"
+	case "EMERG", "EMERGENCY", "PANIC":
+		return "EMERGENCY"
+	}
+	return ""
+}
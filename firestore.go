@@ -0,0 +1,189 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const firestoreAPI = "https://firestore.googleapis.com/v1/"
+
+// firestoreDocuments returns the documents root of the default database.
+func firestoreDocuments(ctx context.Context) (string, error) {
+	project, err := projectID(ctx)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("projects/%s/databases/(default)/documents", project), nil
+}
+
+// toFirestoreValue encodes a value in the Firestore REST format.
+func toFirestoreValue(value interface{}) map[string]interface{} {
+	switch v := value.(type) {
+	case nil:
+		return map[string]interface{}{"nullValue": nil}
+	case string:
+		return map[string]interface{}{"stringValue": v}
+	case bool:
+		return map[string]interface{}{"booleanValue": v}
+	case int:
+		return map[string]interface{}{"integerValue": strconv.Itoa(v)}
+	case int64:
+		return map[string]interface{}{"integerValue": strconv.FormatInt(v, 10)}
+	case float64:
+		return map[string]interface{}{"doubleValue": v}
+	case time.Time:
+		return map[string]interface{}{"timestampValue": v.UTC().Format(time.RFC3339Nano)}
+	case []string:
+		values := make([]interface{}, len(v))
+		for i, s := range v {
+			values[i] = toFirestoreValue(s)
+		}
+		return map[string]interface{}{"arrayValue": map[string]interface{}{"values": values}}
+	case map[string]interface{}:
+		return map[string]interface{}{"mapValue": map[string]interface{}{"fields": toFirestoreFields(v)}}
+	}
+	return map[string]interface{}{"stringValue": fmt.Sprint(value)}
+}
+
+func toFirestoreFields(values map[string]interface{}) map[string]interface{} {
+	fields := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		fields[k] = toFirestoreValue(v)
+	}
+	return fields
+}
+
+// firestoreValue is a value in the Firestore REST format.
+type firestoreValue struct {
+	NullValue      *string  `json:"nullValue,omitempty"`
+	StringValue    *string  `json:"stringValue,omitempty"`
+	BooleanValue   *bool    `json:"booleanValue,omitempty"`
+	IntegerValue   *string  `json:"integerValue,omitempty"`
+	DoubleValue    *float64 `json:"doubleValue,omitempty"`
+	TimestampValue *string  `json:"timestampValue,omitempty"`
+	ArrayValue     *struct {
+		Values []firestoreValue `json:"values"`
+	} `json:"arrayValue,omitempty"`
+	MapValue *struct {
+		Fields map[string]firestoreValue `json:"fields"`
+	} `json:"mapValue,omitempty"`
+}
+
+// decode returns the value as a plain Go value.
+func (v firestoreValue) decode() interface{} {
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BooleanValue != nil:
+		return *v.BooleanValue
+	case v.IntegerValue != nil:
+		i, _ := strconv.ParseInt(*v.IntegerValue, 10, 64)
+		return i
+	case v.DoubleValue != nil:
+		return *v.DoubleValue
+	case v.TimestampValue != nil:
+		return *v.TimestampValue
+	case v.ArrayValue != nil:
+		values := make([]interface{}, len(v.ArrayValue.Values))
+		for i, value := range v.ArrayValue.Values {
+			values[i] = value.decode()
+		}
+		return values
+	case v.MapValue != nil:
+		return decodeFirestoreFields(v.MapValue.Fields)
+	}
+	return nil
+}
+
+func decodeFirestoreFields(fields map[string]firestoreValue) map[string]interface{} {
+	values := make(map[string]interface{}, len(fields))
+	for k, v := range fields {
+		values[k] = v.decode()
+	}
+	return values
+}
+
+type firestoreDocument struct {
+	Name   string                    `json:"name,omitempty"`
+	Fields map[string]firestoreValue `json:"fields"`
+}
+
+// createDocument creates a document in a collection (relative to the
+// documents root) with an automatically assigned ID.
+func createDocument(ctx context.Context, collection string, values map[string]interface{}) error {
+	root, err := firestoreDocuments(ctx)
+	if err != nil {
+		return err
+	}
+	document := map[string]interface{}{"fields": toFirestoreFields(values)}
+	return callAPI(ctx, "POST", firestoreAPI+root+"/"+collection, document, nil)
+}
+
+// queryDocuments returns the newest documents of a collection (relative to
+// the documents root) whose string fields have the values in where, ordered
+// by a field.
+func queryDocuments(ctx context.Context, collection string, where map[string]string, orderBy string, limit int) ([]map[string]interface{}, error) {
+	root, err := firestoreDocuments(ctx)
+	if err != nil {
+		return nil, err
+	}
+	parent, collectionId := root, collection
+	if i := strings.LastIndex(collection, "/"); i >= 0 {
+		parent, collectionId = root+"/"+collection[:i], collection[i+1:]
+	}
+	query := map[string]interface{}{
+		"structuredQuery": map[string]interface{}{
+			"from": []map[string]interface{}{{"collectionId": collectionId}},
+			"orderBy": []map[string]interface{}{{
+				"field":     map[string]interface{}{"fieldPath": orderBy},
+				"direction": "DESCENDING",
+			}},
+			"limit": limit,
+		},
+	}
+	var filters []map[string]interface{}
+	for field, value := range where {
+		filters = append(filters, map[string]interface{}{"fieldFilter": map[string]interface{}{
+			"field": map[string]interface{}{"fieldPath": field},
+			"op":    "EQUAL",
+			"value": toFirestoreValue(value),
+		}})
+	}
+	if len(filters) > 0 {
+		query["structuredQuery"].(map[string]interface{})["where"] = map[string]interface{}{
+			"compositeFilter": map[string]interface{}{"op": "AND", "filters": filters},
+		}
+	}
+	var results []struct {
+		Document *firestoreDocument `json:"document"`
+	}
+	if err := callAPI(ctx, "POST", firestoreAPI+parent+":runQuery", query, &results); err != nil {
+		return nil, err
+	}
+	var documents []map[string]interface{}
+	for _, result := range results {
+		if result.Document != nil {
+			documents = append(documents, decodeFirestoreFields(result.Document.Fields))
+		}
+	}
+	return documents, nil
+}
@@ -0,0 +1,313 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rosmo/long-cloud-run/pkg/runner"
+)
+
+const cloudTasksAPI = "https://cloudtasks.googleapis.com/v2/"
+
+// Message attributes to request a follow-up run.
+const (
+	followupAttribute        = "followup"
+	followupOnAttribute      = "followupOn"
+	followupOfAttribute      = "followupOf"
+	followupCommandAttribute = "followupCommand"
+	followupArgsAttribute    = "followupArgs"
+)
+
+// Followup is a run scheduled with Cloud Tasks after the current run has
+// completed, for example to re-run a check or to clean up after a backup.
+// Without a Command, the follow-up runs with the data of the current run.
+type Followup struct {
+	Queue string
+	URL   string
+	Delay time.Duration
+	On    string
+	Data  []byte
+	Of    string
+	// Command and Args are the command the follow-up runs instead.
+	Command string
+	Args    []string
+	// Attributes are the attributes of the original message, and Headers
+	// the headers of the request carried over, see replayHeaders.
+	Attributes map[string]string
+	Headers    map[string]string
+}
+
+// newFollowup returns the follow-up requested by the message attributes or
+// by FOLLOWUP_DELAY, or nil. Follow-up runs don't schedule further
+// follow-ups.
+func newFollowup(r *http.Request, body []byte, m *PubSubMessage) (*Followup, error) {
+	if FOLLOWUP_QUEUE == "" || m.Message.Attributes[followupOfAttribute] != "" {
+		return nil, nil
+	}
+	followup := &Followup{
+		Queue: FOLLOWUP_QUEUE,
+		URL:   FOLLOWUP_URL,
+		Delay: FOLLOWUP_DELAY,
+		On:    FOLLOWUP_ON,
+		Data:  requestPayload(body, m),
+		Of:    m.Message.ID,
+
+		Command: FOLLOWUP_COMMAND,
+		Args:    FOLLOWUP_ARGS,
+
+		Attributes: m.Message.Attributes,
+	}
+	if delay := m.Message.Attributes[followupAttribute]; delay != "" {
+		d, err := time.ParseDuration(delay)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s attribute: %w", followupAttribute, err)
+		}
+		followup.Delay = d
+	}
+	if on := m.Message.Attributes[followupOnAttribute]; on != "" {
+		followup.On = on
+	}
+	if command := m.Message.Attributes[followupCommandAttribute]; command != "" {
+		if !commandAllowed(command) {
+			return nil, fmt.Errorf("invalid %s attribute: command not allowed: %s", followupCommandAttribute, command)
+		}
+		followup.Command = command
+		followup.Args = nil
+	}
+	if args := m.Message.Attributes[followupArgsAttribute]; args != "" {
+		if followup.Command == "" {
+			return nil, fmt.Errorf("invalid %s attribute: no follow-up command, set %s or FOLLOWUP_COMMAND", followupArgsAttribute, followupCommandAttribute)
+		}
+		if err := json.Unmarshal([]byte(args), &followup.Args); err != nil {
+			return nil, fmt.Errorf("invalid %s attribute: %w", followupArgsAttribute, err)
+		}
+	}
+	if followup.Delay <= 0 {
+		return nil, nil
+	}
+	if !validFollowupOn(followup.On) {
+		return nil, fmt.Errorf("invalid %s attribute: %s", followupOnAttribute, followup.On)
+	}
+	if err := checkReplay(r); err != nil {
+		return nil, fmt.Errorf("can't schedule a follow-up: %w", err)
+	}
+	followup.Headers = replayHeaders(r)
+	followup.Headers["Content-Type"] = "application/json"
+	if followup.URL == "" {
+		followup.URL = "https://" + r.Host + "/"
+	}
+	if followup.Of == "" {
+		followup.Of = "http"
+	}
+	return followup, nil
+}
+
+func validFollowupOn(on string) bool {
+	switch on {
+	case "always", runner.StatusSucceeded, runner.StatusFailed:
+		return true
+	}
+	return false
+}
+
+// resultMatches returns true if the status of a result matches on: always,
+// succeeded or failed. Checkpointed runs haven't completed yet and never
+// match.
+func resultMatches(on string, result runner.Result) bool {
+	switch {
+	case result.Status == runner.StatusCheckpointed:
+		return false
+	case on == runner.StatusSucceeded:
+		return result.Status == runner.StatusSucceeded
+	case on == runner.StatusFailed:
+		return result.Status != runner.StatusSucceeded
+	}
+	return true
+}
+
+// Schedule creates the Cloud Task for the follow-up run, if it applies to
+// the result of the current run.
+func (f *Followup) Schedule(ctx context.Context, result runner.Result) error {
+	if !resultMatches(f.On, result) {
+		return nil
+	}
+	body, err := f.message()
+	if err != nil {
+		return err
+	}
+	scheduleTime := time.Now().Add(f.Delay)
+	name, err := createTask(ctx, f.Queue, f.URL, strings.TrimSuffix(f.URL, "/"), f.Headers, body, scheduleTime)
+	if err != nil {
+		return fmt.Errorf("error creating follow-up task: %w", err)
+	}
+	log.Printf("Scheduled follow-up run at %s: %s", scheduleTime.Format(time.RFC3339), name)
+	return nil
+}
+
+// message returns the Pub/Sub push message the follow-up task delivers.
+func (f *Followup) message() ([]byte, error) {
+	var payload PubSubMessage
+	payload.Message.Data = f.Data
+	if f.Command != "" {
+		// run the command as a batch of one job
+		data, err := json.Marshal(BatchRequest{Jobs: []*JobSpec{{Command: f.Command, Args: f.Args}}})
+		if err != nil {
+			return nil, err
+		}
+		payload.Message.Data = data
+	}
+	payload.Message.Attributes = map[string]string{followupOfAttribute: f.Of}
+	for name, value := range f.Attributes {
+		switch name {
+		case followupAttribute, followupOnAttribute, followupOfAttribute, followupCommandAttribute, followupArgsAttribute, checkpointAttribute, continuationAttribute:
+		default:
+			payload.Message.Attributes[name] = value
+		}
+	}
+	return json.Marshal(payload)
+}
+
+// replayTenantHeader names the tenant of a request replayed by a Cloud
+// Task. It's only trusted from taskAccount.
+const replayTenantHeader = "X-Replay-Tenant"
+
+// checkReplay returns an error if a request can't be replayed later by a
+// Cloud Task: request signatures expire.
+func checkReplay(r *http.Request) error {
+	if len(REQUEST_SIGNING_KEY) > 0 {
+		return fmt.Errorf("signed requests can't be replayed")
+	}
+	return nil
+}
+
+// replayHeaders returns the headers a Cloud Task replaying the request
+// needs: its content type, its tenant and the settings of the run. The
+// token of the request isn't stored in the task, which authenticates with
+// its OIDC token instead.
+func replayHeaders(r *http.Request) map[string]string {
+	headers := make(map[string]string)
+	for _, name := range []string{"Content-Type", "X-Command-Timeout", "X-Priority"} {
+		if value := r.Header.Get(name); value != "" {
+			headers[name] = value
+		}
+	}
+	if tenant, err := requestTenant(r, verifiedCaller(r, time.Now())); err == nil && tenant != nil {
+		headers[replayTenantHeader] = tenant.Name
+	}
+	return headers
+}
+
+var defaultServiceAccount struct {
+	sync.Mutex
+	email string
+}
+
+// taskAccount returns the service account of the OIDC tokens of the Cloud
+// Tasks of this service: FOLLOWUP_SERVICE_ACCOUNT, or the service's own.
+func taskAccount(ctx context.Context) (string, error) {
+	if FOLLOWUP_SERVICE_ACCOUNT != "" {
+		return FOLLOWUP_SERVICE_ACCOUNT, nil
+	}
+	defaultServiceAccount.Lock()
+	defer defaultServiceAccount.Unlock()
+	if defaultServiceAccount.email == "" {
+		email, err := metadata(ctx, "instance/service-accounts/default/email")
+		if err != nil {
+			return "", err
+		}
+		defaultServiceAccount.email = email
+	}
+	return defaultServiceAccount.email, nil
+}
+
+// isTaskAccount returns true if the verified caller of a request is
+// taskAccount, that is the request was sent by a Cloud Task of this service.
+func isTaskAccount(ctx context.Context, caller string) bool {
+	if caller == "" {
+		return false
+	}
+	account, err := taskAccount(ctx)
+	return err == nil && caller == account
+}
+
+// createTask creates a Cloud Task in the queue that POSTs the body with the
+// headers to the URL at scheduleTime, with an OIDC token of taskAccount for
+// the audience, and returns its name.
+func createTask(ctx context.Context, queue string, url string, audience string, headers map[string]string, body []byte, scheduleTime time.Time) (string, error) {
+	queue, err := queueName(ctx, queue)
+	if err != nil {
+		return "", err
+	}
+	serviceAccount, err := taskAccount(ctx)
+	if err != nil {
+		return "", err
+	}
+	// Cloud Tasks allows at most 30 minutes for HTTP targets to respond
+	dispatchDeadline := REQUEST_TIMEOUT
+	if dispatchDeadline > 30*time.Minute {
+		dispatchDeadline = 30 * time.Minute
+	}
+	request := map[string]interface{}{
+		"task": map[string]interface{}{
+			"scheduleTime":     scheduleTime.UTC().Format(time.RFC3339),
+			"dispatchDeadline": fmt.Sprintf("%ds", int(dispatchDeadline.Seconds())),
+			"httpRequest": map[string]interface{}{
+				"url":        url,
+				"httpMethod": "POST",
+				"headers":    headers,
+				"body":       body,
+				"oidcToken": map[string]string{
+					"serviceAccountEmail": serviceAccount,
+					"audience":            audience,
+				},
+			},
+		},
+	}
+	var task struct {
+		Name string `json:"name"`
+	}
+	if err := callAPI(ctx, "POST", cloudTasksAPI+queue+"/tasks", request, &task); err != nil {
+		return "", fmt.Errorf("error creating task in %s: %w", queue, err)
+	}
+	return task.Name, nil
+}
+
+// queueName returns the full name of a queue, which can be given either as
+// projects/<project>/locations/<location>/queues/<queue> or just the queue
+// name in the region of the service.
+func queueName(ctx context.Context, queue string) (string, error) {
+	if strings.HasPrefix(queue, "projects/") {
+		return queue, nil
+	}
+	project, err := projectID(ctx)
+	if err != nil {
+		return "", err
+	}
+	location, err := region(ctx)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("projects/%s/locations/%s/queues/%s", project, location, queue), nil
+}
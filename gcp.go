@@ -0,0 +1,231 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Google Cloud APIs are called directly over REST, using credentials from
+// the metadata server of the Cloud Run instance.
+const metadataURL = "http://metadata.google.internal/computeMetadata/v1/"
+
+var metadataClient = &http.Client{Timeout: 10 * time.Second}
+
+// metadata returns a value from the metadata server.
+func metadata(ctx context.Context, path string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", metadataURL+path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := metadataClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error querying metadata server: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata server returned %s for %s", resp.Status, path)
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// projectID returns the project of the instance, or GOOGLE_CLOUD_PROJECT.
+func projectID(ctx context.Context) (string, error) {
+	if GOOGLE_CLOUD_PROJECT != "" {
+		return GOOGLE_CLOUD_PROJECT, nil
+	}
+	return metadata(ctx, "project/project-id")
+}
+
+// region returns the region of the instance, or GOOGLE_CLOUD_REGION.
+func region(ctx context.Context) (string, error) {
+	if GOOGLE_CLOUD_REGION != "" {
+		return GOOGLE_CLOUD_REGION, nil
+	}
+	// Returned as projects/<number>/regions/<region>
+	region, err := metadata(ctx, "instance/region")
+	if err != nil {
+		return "", err
+	}
+	return region[strings.LastIndex(region, "/")+1:], nil
+}
+
+var token = struct {
+	sync.Mutex
+	value   string
+	expires time.Time
+}{}
+
+// accessToken returns an OAuth2 access token of the instance's service
+// account, refreshing it when it's about to expire.
+func accessToken(ctx context.Context) (string, error) {
+	token.Lock()
+	defer token.Unlock()
+	if token.value != "" && time.Until(token.expires) > time.Minute {
+		return token.value, nil
+	}
+	value, err := metadata(ctx, "instance/service-accounts/default/token")
+	if err != nil {
+		return "", err
+	}
+	var t struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal([]byte(value), &t); err != nil {
+		return "", fmt.Errorf("error parsing access token: %w", err)
+	}
+	token.value = t.AccessToken
+	token.expires = time.Now().Add(time.Duration(t.ExpiresIn) * time.Second)
+	return token.value, nil
+}
+
+var identityTokens = struct {
+	sync.Mutex
+	values  map[string]string
+	expires map[string]time.Time
+}{values: make(map[string]string), expires: make(map[string]time.Time)}
+
+// identityToken returns an OIDC identity token of the instance's service
+// account for the audience, such as the URL of a Cloud Run service. Tokens
+// are valid for an hour and reused for 55 minutes.
+func identityToken(ctx context.Context, audience string) (string, error) {
+	identityTokens.Lock()
+	defer identityTokens.Unlock()
+	if value := identityTokens.values[audience]; value != "" && time.Now().Before(identityTokens.expires[audience]) {
+		return value, nil
+	}
+	value, err := metadata(ctx, "instance/service-accounts/default/identity?format=full&audience="+url.QueryEscape(audience))
+	if err != nil {
+		return "", err
+	}
+	identityTokens.values[audience] = value
+	identityTokens.expires[audience] = time.Now().Add(55 * time.Minute)
+	return value, nil
+}
+
+// APIError is a non-successful response from a Google Cloud API.
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("API returned %d: %s", e.StatusCode, e.Message)
+}
+
+// isAPIError returns true if the error is an API response with the status.
+func isAPIError(err error, statusCode int) bool {
+	apiErr, ok := err.(*APIError)
+	return ok && apiErr.StatusCode == statusCode
+}
+
+var apiClient = &http.Client{Timeout: 60 * time.Second}
+
+// callAPI sends a request with a JSON body (if not nil) to a Google Cloud
+// API and decodes the JSON response into result (if not nil).
+func callAPI(ctx context.Context, method string, url string, body interface{}, result interface{}) error {
+	var reqBody io.Reader
+	contentType := ""
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(b)
+		contentType = "application/json"
+	}
+	respBody, err := callAPIRaw(ctx, method, url, contentType, reqBody)
+	if err != nil {
+		return err
+	}
+	if result != nil && len(respBody) > 0 {
+		return json.Unmarshal(respBody, result)
+	}
+	return nil
+}
+
+// callAPIRaw sends a request with an arbitrary body to a Google Cloud API and
+// returns the response body.
+func callAPIRaw(ctx context.Context, method string, url string, contentType string, body io.Reader) ([]byte, error) {
+	resp, err := sendAPIRequest(ctx, apiClient, method, url, contentType, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+// streamClient has no timeout, for responses that are streamed for as long
+// as the command runs. They are limited by the request context instead.
+var streamClient = &http.Client{}
+
+// sendAPIRequest sends a request to a Google Cloud API with the client and
+// returns the response, or an APIError if it isn't successful. The caller
+// has to close the response body.
+func sendAPIRequest(ctx context.Context, client *http.Client, method string, url string, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	accessToken, err := accessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		respBody, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		var apiErr struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		message := strings.TrimSpace(string(respBody))
+		if json.Unmarshal(respBody, &apiErr) == nil && apiErr.Error.Message != "" {
+			message = apiErr.Error.Message
+		}
+		return nil, &APIError{StatusCode: resp.StatusCode, Message: message}
+	}
+	return resp, nil
+}
@@ -0,0 +1,322 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+)
+
+const storageAPI = "https://storage.googleapis.com/storage/v1/"
+const storageUploadAPI = "https://storage.googleapis.com/upload/storage/v1/"
+
+// storageObject is the metadata of a Cloud Storage object.
+type storageObject struct {
+	Bucket     string `json:"bucket"`
+	Name       string `json:"name"`
+	Generation string `json:"generation"`
+	Size       string `json:"size"`
+	MD5Hash    string `json:"md5Hash"`
+}
+
+// parseGCSURI splits a gs://bucket/object URI into the bucket and object.
+func parseGCSURI(uri string) (string, string, error) {
+	if !strings.HasPrefix(uri, "gs://") {
+		return "", "", fmt.Errorf("not a gs:// URI: %s", uri)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(uri, "gs://"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid Cloud Storage URI: %s", uri)
+	}
+	return parts[0], parts[1], nil
+}
+
+func objectURL(api string, bucket string, name string) string {
+	return api + "b/" + url.PathEscape(bucket) + "/o/" + url.PathEscape(name)
+}
+
+// uploadObject uploads data to an object. If ifGenerationMatch is not
+// negative, the upload only succeeds if the object's current generation
+// matches it (zero meaning that the object must not exist).
+func uploadObject(ctx context.Context, bucket string, name string, contentType string, data []byte, ifGenerationMatch int64) (storageObject, error) {
+	return uploadObjectFrom(ctx, bucket, name, contentType, bytes.NewReader(data), ifGenerationMatch)
+}
+
+// uploadObjectFrom uploads the contents of a reader to an object, like
+// uploadObject.
+func uploadObjectFrom(ctx context.Context, bucket string, name string, contentType string, data io.Reader, ifGenerationMatch int64) (storageObject, error) {
+	query := url.Values{}
+	query.Set("uploadType", "media")
+	query.Set("name", name)
+	if ifGenerationMatch >= 0 {
+		query.Set("ifGenerationMatch", strconv.FormatInt(ifGenerationMatch, 10))
+	}
+	var object storageObject
+	body, err := callAPIRaw(ctx, "POST", storageUploadAPI+"b/"+url.PathEscape(bucket)+"/o?"+query.Encode(), contentType, data)
+	if err != nil {
+		return object, err
+	}
+	err = json.Unmarshal(body, &object)
+	return object, err
+}
+
+// getObject returns the metadata of an object.
+func getObject(ctx context.Context, bucket string, name string) (storageObject, error) {
+	var object storageObject
+	err := callAPI(ctx, "GET", objectURL(storageAPI, bucket, name), nil, &object)
+	return object, err
+}
+
+// downloadObject returns the contents of an object.
+func downloadObject(ctx context.Context, bucket string, name string) ([]byte, error) {
+	return callAPIRaw(ctx, "GET", objectURL(storageAPI, bucket, name)+"?alt=media", "", nil)
+}
+
+// objectReader streams the contents of the object at a gs:// URI, which is
+// opened on the first read so that it's only downloaded as it's consumed.
+type objectReader struct {
+	ctx  context.Context
+	uri  string
+	body io.ReadCloser
+	err  error
+}
+
+func newObjectReader(ctx context.Context, uri string) *objectReader {
+	return &objectReader{ctx: ctx, uri: uri}
+}
+
+func (r *objectReader) Read(p []byte) (int, error) {
+	if r.body == nil && r.err == nil {
+		r.err = r.open()
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+	return r.body.Read(p)
+}
+
+func (r *objectReader) open() error {
+	bucket, name, err := parseGCSURI(r.uri)
+	if err != nil {
+		return err
+	}
+	resp, err := sendAPIRequest(r.ctx, streamClient, "GET", objectURL(storageAPI, bucket, name)+"?alt=media", "", nil)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", r.uri, err)
+	}
+	r.body = resp.Body
+	return nil
+}
+
+// Close closes the download, if it has been started.
+func (r *objectReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	return r.body.Close()
+}
+
+// resumableChunkSize is the size of the chunks of resumable uploads, which
+// has to be a multiple of 256 KiB.
+const resumableChunkSize = 8 << 20
+
+// uploadRetryTime limits how long the upload of a chunk is retried.
+var uploadRetryTime = 2 * time.Minute
+
+// objectWriter uploads what's written to it to the object at a gs:// URI
+// with a resumable upload, a chunk at a time, so that it's never stored
+// locally. The object is only created once the writer is closed.
+type objectWriter struct {
+	ctx      context.Context
+	uri      string
+	session  string
+	buf      []byte
+	uploaded int64
+	err      error
+}
+
+func newObjectWriter(ctx context.Context, uri string) *objectWriter {
+	return &objectWriter{ctx: ctx, uri: uri}
+}
+
+func (w *objectWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.buf = append(w.buf, p...)
+	for len(w.buf) >= resumableChunkSize {
+		if w.err = w.upload(w.buf[:resumableChunkSize], false); w.err != nil {
+			return 0, w.err
+		}
+		w.buf = append(w.buf[:0], w.buf[resumableChunkSize:]...)
+	}
+	return len(p), nil
+}
+
+// Close uploads the rest of the data and finalizes the object.
+func (w *objectWriter) Close() error {
+	if w.err == nil {
+		w.err = w.upload(w.buf, true)
+		w.buf = nil
+	}
+	return w.err
+}
+
+// Uploaded returns the number of bytes uploaded so far.
+func (w *objectWriter) Uploaded() int64 {
+	return atomic.LoadInt64(&w.uploaded)
+}
+
+// upload uploads a chunk, starting the upload session first if needed.
+// Failed requests are retried with backoff, from the offset the upload
+// session reports as persisted.
+func (w *objectWriter) upload(chunk []byte, final bool) error {
+	if w.session == "" {
+		bucket, name, err := parseGCSURI(w.uri)
+		if err != nil {
+			return err
+		}
+		query := url.Values{}
+		query.Set("uploadType", "resumable")
+		query.Set("name", name)
+		resp, err := sendAPIRequest(w.ctx, apiClient, "POST", storageUploadAPI+"b/"+url.PathEscape(bucket)+"/o?"+query.Encode(), "", nil)
+		if err != nil {
+			return fmt.Errorf("failed to start upload to %s: %w", w.uri, err)
+		}
+		resp.Body.Close()
+		if w.session = resp.Header.Get("Location"); w.session == "" {
+			return fmt.Errorf("failed to start upload to %s: no session URI", w.uri)
+		}
+	}
+
+	start := w.Uploaded()
+	end := start + int64(len(chunk))
+	total := "*"
+	if final {
+		total = strconv.FormatInt(end, 10)
+	}
+	failed := false
+	operation := func() error {
+		if failed {
+			// ask the session how much it has persisted
+			complete, err := w.put(nil, "bytes */"+total)
+			if err != nil {
+				return err
+			}
+			failed = false
+			if complete {
+				return w.complete(final, end)
+			}
+		}
+		offset := w.Uploaded()
+		if offset < start || offset > end {
+			return backoff.Permanent(fmt.Errorf("failed to upload to %s: session persisted %d bytes, expected %d to %d", w.uri, offset, start, end))
+		}
+		if offset == end && !final {
+			return nil
+		}
+		contentRange := "bytes */" + total
+		if offset < end {
+			contentRange = fmt.Sprintf("bytes %d-%d/%s", offset, end-1, total)
+		}
+		complete, err := w.put(chunk[offset-start:], contentRange)
+		if err != nil {
+			failed = true
+			return err
+		}
+		if complete {
+			return w.complete(final, end)
+		}
+		if w.Uploaded() == end && !final {
+			return nil
+		}
+		return fmt.Errorf("failed to upload to %s: session persisted %d of %d bytes", w.uri, w.Uploaded(), end)
+	}
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = uploadRetryTime
+	return backoff.Retry(operation, backoff.WithContext(b, w.ctx))
+}
+
+// complete records that the upload session has created the object, which
+// only the final chunk does.
+func (w *objectWriter) complete(final bool, end int64) error {
+	if !final {
+		return backoff.Permanent(fmt.Errorf("failed to upload to %s: upload completed before the final chunk", w.uri))
+	}
+	atomic.StoreInt64(&w.uploaded, end)
+	return nil
+}
+
+// put sends a request to the upload session and returns true if the upload
+// is complete. Otherwise, it records the number of bytes persisted so far
+// from the Range header of the 308 Resume Incomplete response.
+func (w *objectWriter) put(data []byte, contentRange string) (bool, error) {
+	req, err := http.NewRequestWithContext(w.ctx, "PUT", w.session, bytes.NewReader(data))
+	if err != nil {
+		return false, backoff.Permanent(err)
+	}
+	req.Header.Set("Content-Range", contentRange)
+	resp, err := apiClient.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("failed to upload to %s: %w", w.uri, err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode/100 == 2:
+		return true, nil
+	case resp.StatusCode == http.StatusPermanentRedirect:
+		var persisted int64
+		if value := resp.Header.Get("Range"); value != "" {
+			var first, last int64
+			if _, err := fmt.Sscanf(value, "bytes=%d-%d", &first, &last); err != nil {
+				return false, backoff.Permanent(fmt.Errorf("failed to upload to %s: invalid Range: %s", w.uri, value))
+			}
+			persisted = last + 1
+		}
+		atomic.StoreInt64(&w.uploaded, persisted)
+		return false, nil
+	}
+	message, _ := ioutil.ReadAll(resp.Body)
+	err = fmt.Errorf("failed to upload to %s: %w", w.uri, &APIError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(message))})
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+		return false, backoff.Permanent(err)
+	}
+	return false, err
+}
+
+// deleteObject deletes an object, if its generation matches (unless
+// ifGenerationMatch is negative).
+func deleteObject(ctx context.Context, bucket string, name string, ifGenerationMatch int64) error {
+	u := objectURL(storageAPI, bucket, name)
+	if ifGenerationMatch >= 0 {
+		u += "?ifGenerationMatch=" + strconv.FormatInt(ifGenerationMatch, 10)
+	}
+	_, err := callAPIRaw(ctx, "DELETE", u, "", nil)
+	return err
+}
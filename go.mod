@@ -1,5 +1,9 @@
-module main
+module github.com/rosmo/long-cloud-run
 
 go 1.16
 
-require github.com/cenkalti/backoff/v4 v4.1.2
+require (
+	github.com/cenkalti/backoff/v4 v4.1.2
+	golang.org/x/net v0.12.0
+	golang.org/x/sys v0.10.0
+)
@@ -0,0 +1,71 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// gzipResponseWriter compresses the streamed response. Every Flush() also
+// flushes the compressor, so that each line reaches the client immediately.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz      *gzip.Writer
+	flusher http.Flusher
+}
+
+func newGzipResponseWriter(w http.ResponseWriter, flusher http.Flusher) *gzipResponseWriter {
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Add("Vary", "Accept-Encoding")
+	w.Header().Del("Content-Length")
+	return &gzipResponseWriter{
+		ResponseWriter: w,
+		gz:             gzip.NewWriter(w),
+		flusher:        flusher,
+	}
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	return w.gz.Write(b)
+}
+
+func (w *gzipResponseWriter) Flush() {
+	w.gz.Flush()
+	w.flusher.Flush()
+}
+
+func (w *gzipResponseWriter) Close() error {
+	return w.gz.Close()
+}
+
+// acceptsGzip returns true if the client sent gzip in Accept-Encoding.
+func acceptsGzip(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		if i := strings.Index(encoding, ";"); i >= 0 {
+			if strings.TrimSpace(encoding[i+1:]) == "q=0" {
+				continue
+			}
+			encoding = encoding[:i]
+		}
+		if strings.TrimSpace(encoding) == "gzip" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,3427 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/rosmo/long-cloud-run/pkg/runner"
+	"golang.org/x/net/http2"
+)
+
+// fakeExecutor starts fake processes, which write lines and exit with
+// exitCode, or block until they are killed if block is set.
+type fakeExecutor struct {
+	lines    []string
+	exitCode int
+	block    bool
+	killed   chan os.Signal
+	args     []string
+	env      []string
+	stdin    io.Reader
+	// exitCodes and blocking override exitCode and block for the runs with
+	// the first argument, like the jobs of a batch, and calls records the
+	// arguments of every run.
+	exitCodes map[string]int
+	blocking  map[string]bool
+	calls     [][]string
+	// checkpoint is written to CHECKPOINT_FILE when a blocked process is
+	// signalled.
+	checkpoint []byte
+	mu         sync.Mutex
+}
+
+func (e *fakeExecutor) Start(ctx context.Context, c *runner.Command, env []string, stdout io.WriteCloser, stderr io.WriteCloser) (runner.Process, error) {
+	e.mu.Lock()
+	e.args = c.Args
+	e.env = env
+	e.stdin = c.Stdin
+	e.calls = append(e.calls, c.Args)
+	exitCode, block := e.exitCode, e.block
+	if len(c.Args) > 0 {
+		if code, ok := e.exitCodes[c.Args[0]]; ok {
+			exitCode = code
+		}
+		block = block || e.blocking[c.Args[0]]
+	}
+	e.mu.Unlock()
+	p := &fakeProcess{signals: e.killed, exited: make(chan struct{}), stop: make(chan struct{})}
+	if p.signals == nil {
+		p.signals = make(chan os.Signal, 1)
+	}
+	go func() {
+		defer close(p.exited)
+		defer stdout.Close()
+		defer stderr.Close()
+		for _, line := range e.lines {
+			fmt.Fprintln(stdout, line)
+		}
+		p.exitCode = exitCode
+		if block {
+			<-p.stop
+			p.exitCode = -1
+			for _, v := range env {
+				if e.checkpoint != nil && strings.HasPrefix(v, "CHECKPOINT_FILE=") {
+					ioutil.WriteFile(strings.TrimPrefix(v, "CHECKPOINT_FILE="), e.checkpoint, 0600)
+					p.exitCode = 0
+				}
+			}
+		}
+	}()
+	return p, nil
+}
+
+type fakeProcess struct {
+	signals  chan os.Signal
+	exited   chan struct{}
+	exitCode int
+	stop     chan struct{}
+}
+
+func (p *fakeProcess) Pid() int                             { return 42 }
+func (p *fakeProcess) Usage() (runner.ResourceUsage, error) { return runner.ResourceUsage{}, nil }
+func (p *fakeProcess) MemoryUsage() int64                   { return 0 }
+
+func (p *fakeProcess) Signal(sig os.Signal) error {
+	select {
+	case p.signals <- sig:
+		close(p.stop)
+	default:
+	}
+	return nil
+}
+
+func (p *fakeProcess) Kill() error {
+	return p.Signal(os.Kill)
+}
+
+func (p *fakeProcess) Wait() (int, error) {
+	<-p.exited
+	return p.exitCode, nil
+}
+
+func TestMain(m *testing.M) {
+	os.Args = []string{os.Args[0], "sh", "-c", "true"}
+	log.SetOutput(ioutil.Discard)
+	selfCheck.Run(context.Background())
+	os.Exit(m.Run())
+}
+
+func setExecutor(t *testing.T, e runner.Executor) {
+	previous := executor
+	executor = e
+	t.Cleanup(func() { executor = previous })
+}
+
+func TestHandlerStreamsOutput(t *testing.T) {
+	setExecutor(t, &fakeExecutor{lines: []string{"hello", "world"}})
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	response, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, _ := ioutil.ReadAll(response.Body)
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d", response.StatusCode)
+	}
+	for _, want := range []string{"Running command: sh\n", "hello\nworld\n", "Command completed in"} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("response doesn't contain %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestHandlerGzip(t *testing.T) {
+	setExecutor(t, &fakeExecutor{lines: []string{"hello", "world"}})
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	// setting Accept-Encoding turns off the transparent decompression of
+	// the client
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	request.Header.Set("Accept-Encoding", "gzip")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if got := response.Header.Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", got)
+	}
+	reader, err := gzip.NewReader(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(reader)
+	if err != nil || !strings.Contains(string(body), "hello\nworld\n") {
+		t.Errorf("response %q, %v, want the compressed output", body, err)
+	}
+
+	defer func() { DISABLE_GZIP = false }()
+	DISABLE_GZIP = true
+	response, err = http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, _ = ioutil.ReadAll(response.Body)
+	if got := response.Header.Get("Content-Encoding"); got != "" || !strings.Contains(string(body), "hello\nworld\n") {
+		t.Errorf("Content-Encoding = %q, response %q, want the plain output with DISABLE_GZIP", got, body)
+	}
+}
+
+func TestHandlerServerSentEvents(t *testing.T) {
+	setExecutor(t, &fakeExecutor{lines: []string{"hello"}})
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	request.Header.Set("Accept", "text/event-stream")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, _ := ioutil.ReadAll(response.Body)
+	if got := response.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Errorf("Content-Type = %s", got)
+	}
+	if !strings.Contains(string(body), "data: hello\n\n") {
+		t.Errorf("response doesn't contain the event:\n%s", body)
+	}
+}
+
+func TestHandlerPubSub(t *testing.T) {
+	RETRYABLE_EXIT_CODES = []int{75}
+	defer func() { RETRYABLE_EXIT_CODES = nil }()
+	tests := []struct {
+		name     string
+		body     string
+		exitCode int
+		status   int
+	}{
+		{"succeeded", `{"message":{"data":"aGVsbG8=","messageId":"1"},"subscription":"projects/p/subscriptions/s"}`, 0, http.StatusOK},
+		{"permanent failure", `{"message":{"messageId":"2"},"subscription":"projects/p/subscriptions/s"}`, 1, http.StatusUnprocessableEntity},
+		{"retryable failure", `{"message":{"messageId":"3"},"subscription":"projects/p/subscriptions/s"}`, 75, http.StatusServiceUnavailable},
+		{"invalid JSON", `{"message":`, 0, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setExecutor(t, &fakeExecutor{lines: []string{"output"}, exitCode: test.exitCode})
+			recorder := httptest.NewRecorder()
+			handler(recorder, httptest.NewRequest("POST", "/", strings.NewReader(test.body)))
+			if recorder.Code != test.status {
+				t.Errorf("status = %d, want %d", recorder.Code, test.status)
+			}
+			if test.status == http.StatusOK && recorder.Body.Len() > 0 {
+				t.Errorf("output streamed to Pub/Sub: %s", recorder.Body)
+			}
+		})
+	}
+}
+
+func TestHandlerDisconnect(t *testing.T) {
+	killed := make(chan os.Signal, 1)
+	setExecutor(t, &fakeExecutor{lines: []string{"started"}, block: true, killed: killed})
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	request, _ := http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	reader := bufio.NewReader(response.Body)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("stream ended before output: %v", err)
+		}
+		if line == "started\n" {
+			break
+		}
+	}
+	cancel()
+
+	select {
+	case sig := <-killed:
+		if sig != TERMINATION_SIGNAL {
+			t.Errorf("command got %v, want %v", sig, TERMINATION_SIGNAL)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("command wasn't terminated after the client disconnected")
+	}
+}
+
+// failingWriter fails every write, like a response to a client that is gone.
+type failingWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (w failingWriter) Write(b []byte) (int, error) {
+	return 0, syscall.EPIPE
+}
+
+func TestHandlerClientGone(t *testing.T) {
+	killed := make(chan os.Signal, 1)
+	setExecutor(t, &fakeExecutor{lines: []string{"started"}, block: true, killed: killed})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler(failingWriter{httptest.NewRecorder()}, httptest.NewRequest("POST", "/", strings.NewReader("{}")))
+	}()
+	select {
+	case <-killed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("command wasn't terminated after a write to the client failed")
+	}
+	<-done
+
+	defer func() { CLIENT_GONE = ClientGoneTerminate }()
+	CLIENT_GONE = ClientGoneDetach
+	setExecutor(t, &fakeExecutor{lines: []string{"started", "done"}})
+	w := failingWriter{httptest.NewRecorder()}
+	handler(w, httptest.NewRequest("POST", "/", strings.NewReader("{}")))
+	state, err := jobStore.Get(context.Background(), w.Header().Get("X-Job-Id"))
+	if err != nil || state == nil || !state.Detached || state.Status != runner.StatusSucceeded || len(state.Output) != 2 {
+		t.Errorf("job state %+v, %v, want a detached run that completed", state, err)
+	}
+}
+
+func TestHandlerBatch(t *testing.T) {
+	setExecutor(t, &fakeExecutor{lines: []string{"done"}})
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	body := `{"jobs":[{"name":"first"},{"name":"second","dependsOn":["first"]}]}`
+	response, err := http.Post(server.URL, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	output, _ := ioutil.ReadAll(response.Body)
+	if !strings.Contains(string(output), "[first] done\n") || !strings.Contains(string(output), "[second] done\n") {
+		t.Errorf("missing job output:\n%s", output)
+	}
+	results := output[strings.LastIndex(string(output), "\n[\n")+1:]
+	var batchResults []BatchResult
+	if err := json.Unmarshal(results, &batchResults); err != nil {
+		t.Fatalf("invalid results: %v\n%s", err, output)
+	}
+	if len(batchResults) != 2 || batchResults[1].Status != runner.StatusSucceeded || batchResults[1].Output != "done" {
+		t.Errorf("unexpected results: %+v", batchResults)
+	}
+}
+
+// postBatch runs a batch request and returns its output and the results of
+// its jobs by name.
+func postBatch(t *testing.T, body string) (string, map[string]BatchResult) {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+	response, err := http.Post(server.URL, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	output, _ := ioutil.ReadAll(response.Body)
+	var batchResults []BatchResult
+	if err := json.Unmarshal(output[strings.LastIndex(string(output), "\n[\n")+1:], &batchResults); err != nil {
+		t.Fatalf("invalid results: %v\n%s", err, output)
+	}
+	results := make(map[string]BatchResult)
+	for _, result := range batchResults {
+		results[result.Name] = result
+	}
+	return string(output), results
+}
+
+func TestHandlerBatchConditions(t *testing.T) {
+	e := &fakeExecutor{exitCodes: map[string]int{"check": 3, "migrate": 1}}
+	setExecutor(t, e)
+	_, results := postBatch(t, `{"jobs":[
+		{"name":"check","args":["check"],"continueOnError":true},
+		{"name":"repair","args":["repair"],"dependsOn":["check"],"if":"{{eq .Jobs.check.ExitCode 3}}"},
+		{"name":"report","args":["report"],"dependsOn":["check"],"if":"{{eq .Jobs.check.Status \"succeeded\"}}"},
+		{"name":"verify","args":["verify"],"dependsOn":["repair"]},
+		{"name":"migrate","args":["migrate"]},
+		{"name":"switch","args":["switch"],"dependsOn":["migrate"]},
+		{"name":"rollback","args":["rollback"],"dependsOn":["migrate"],"if":"{{eq .Jobs.migrate.Status \"failed\"}}"}
+	]}`)
+	want := map[string]string{
+		"check":    runner.StatusFailed,
+		"repair":   runner.StatusSucceeded,
+		"report":   runner.StatusSkipped,
+		"verify":   runner.StatusSucceeded,
+		"migrate":  runner.StatusFailed,
+		"switch":   runner.StatusSkipped,
+		"rollback": runner.StatusSucceeded,
+	}
+	for name, status := range want {
+		if results[name].Status != status {
+			t.Errorf("%s: status = %s, want %s", name, results[name].Status, status)
+		}
+	}
+	if len(e.calls) != 5 {
+		t.Errorf("ran %q, want the jobs that weren't skipped", e.calls)
+	}
+
+	if _, err := parseBatch([]byte(`{"jobs":[{"name":"a","if":"{{eq .Jobs"}]}`), &PubSubMessage{}); err == nil {
+		t.Errorf("parseBatch() = nil for an invalid condition")
+	}
+	if _, err := parseBatch([]byte(`{"jobs":[{"name":"a","dependsOn":["b"]},{"name":"b","dependsOn":["a"]}]}`), &PubSubMessage{}); err == nil {
+		t.Errorf("parseBatch() = nil for a dependency cycle")
+	}
+}
+
+func TestHandlerBatchMatrix(t *testing.T) {
+	e := &fakeExecutor{exitCodes: map[string]int{"gs://bucket/b": 1}}
+	setExecutor(t, e)
+	output, results := postBatch(t, `{"parallelism":2,"jobs":[
+		{"name":"copy","matrix":["gs://bucket/a","gs://bucket/b","gs://bucket/c"],"args":["{{.Item}}","--index={{.Index}}"]},
+		{"name":"index","args":["index"],"dependsOn":["copy"]}
+	]}`)
+	for i, item := range []string{"gs://bucket/a", "gs://bucket/b", "gs://bucket/c"} {
+		result := results[fmt.Sprintf("copy[%d]", i)]
+		wantArgs := []string{item, fmt.Sprintf("--index=%d", i)}
+		if result.Item != item || !reflect.DeepEqual(result.Args, wantArgs) {
+			t.Errorf("copy[%d]: item %v, args %q, want %s, %q", i, result.Item, result.Args, item, wantArgs)
+		}
+	}
+	if results["copy[1]"].Status != runner.StatusFailed || results["copy[2]"].Status != runner.StatusSucceeded {
+		t.Errorf("items: %+v", results)
+	}
+	// depending on a matrix job depends on all of its items
+	if results["index"].Status != runner.StatusSkipped {
+		t.Errorf("index: status = %s, want skipped after a failed item", results["index"].Status)
+	}
+	if !strings.Contains(output, "[Matrix copy failed: 2 of 3 items succeeded]") {
+		t.Errorf("missing matrix summary:\n%s", output)
+	}
+
+	for _, body := range []string{
+		`{"jobs":[{"matrix":["a"],"args":["{{.Item}}"]}]}`,
+		`{"jobs":[{"name":"m","matrix":["a"],"args":["{{.Item.missing}}"]}]}`,
+	} {
+		if _, err := parseBatch([]byte(body), &PubSubMessage{}); err == nil {
+			t.Errorf("parseBatch(%s) = nil, want an error", body)
+		}
+	}
+}
+
+func TestHandlerBatchStepTimeout(t *testing.T) {
+	for _, onFailure := range []string{"continue", "abort"} {
+		t.Run(onFailure, func(t *testing.T) {
+			e := &fakeExecutor{blocking: map[string]bool{"slow": true}}
+			setExecutor(t, e)
+			start := time.Now()
+			output, results := postBatch(t, `{"onFailure":"`+onFailure+`","jobs":[
+				{"name":"slow","args":["slow"],"timeout":"100ms"},
+				{"name":"next","args":["next"]}
+			]}`)
+			if elapsed := time.Since(start); elapsed > REQUEST_TIMEOUT/2 {
+				t.Errorf("batch took %s, want the step timeout to end it", elapsed)
+			}
+			if results["slow"].Status != runner.StatusTimeout {
+				t.Errorf("slow: status = %s, want timeout:\n%s", results["slow"].Status, output)
+			}
+			want := runner.StatusSucceeded
+			if onFailure == "abort" {
+				want = runner.StatusSkipped
+			}
+			if results["next"].Status != want {
+				t.Errorf("next: status = %s, want %s", results["next"].Status, want)
+			}
+		})
+	}
+}
+
+func TestHandlerDryRun(t *testing.T) {
+	e := &fakeExecutor{}
+	setExecutor(t, e)
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+	dryRun := func() string {
+		t.Helper()
+		response, err := http.Post(server.URL+"/?dryRun=true", "application/json", strings.NewReader(`{"jobs":[
+			{"name":"dump","args":["dump"]},
+			{"name":"load","args":["load"],"dependsOn":["dump"]}
+		]}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		output, _ := ioutil.ReadAll(response.Body)
+		return string(output)
+	}
+
+	output := dryRun()
+	for _, want := range []string{"[Dry run: 2 jobs", "OK    executable", "depends on: dump", "[Dry run: plan is valid]"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, output)
+		}
+	}
+	if len(e.calls) != 0 {
+		t.Errorf("calls = %q, want nothing to run", e.calls)
+	}
+
+	defer func() { CHROOT = "" }()
+	CHROOT = t.TempDir()
+	output = dryRun()
+	if !strings.Contains(output, "ERROR executable sh") || !strings.Contains(output, "[dry run found 2 problems]") {
+		t.Errorf("output doesn't report the missing executable:\n%s", output)
+	}
+}
+
+func TestHandlerStatusTrailer(t *testing.T) {
+	setExecutor(t, &fakeExecutor{exitCode: 3})
+	ERROR_STATUS = map[string]int{"3": http.StatusConflict}
+	defer func() { ERROR_STATUS = nil }()
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	response, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	ioutil.ReadAll(response.Body)
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want streamed 200", response.StatusCode)
+	}
+	if got := response.Trailer.Get("X-Command-Status"); got != "409" {
+		t.Errorf("X-Command-Status = %q, want 409", got)
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	RETRYABLE_EXIT_CODES = []int{75}
+	ERROR_STATUS = map[string]int{"timeout": http.StatusGatewayTimeout, "24": http.StatusOK}
+	defer func() { RETRYABLE_EXIT_CODES, ERROR_STATUS = nil, nil }()
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{nil, http.StatusOK},
+		{&runner.ExitCodeError{ExitCode: 1}, http.StatusUnprocessableEntity},
+		{&runner.ExitCodeError{ExitCode: 75}, http.StatusServiceUnavailable},
+		{&runner.ExitCodeError{ExitCode: 24}, http.StatusOK},
+		{&runner.TimeoutError{}, http.StatusGatewayTimeout},
+		{&runner.CanceledError{Err: context.Canceled}, http.StatusServiceUnavailable},
+		{&runner.StartError{Err: os.ErrNotExist}, http.StatusUnprocessableEntity},
+		{fmt.Errorf("wrapped: %w", &runner.ExitCodeError{ExitCode: 75}), http.StatusServiceUnavailable},
+	}
+	for _, test := range tests {
+		if got := errorStatus(test.err); got != test.want {
+			t.Errorf("errorStatus(%v) = %d, want %d", test.err, got, test.want)
+		}
+	}
+}
+
+func TestHandlerRequestOptions(t *testing.T) {
+	setExecutor(t, &fakeExecutor{lines: []string{"secret"}, exitCode: 24})
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	response, err := http.Get(server.URL + "/?allowedExitCodes=0,24&showOutput=false")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, _ := ioutil.ReadAll(response.Body)
+	if got := response.Trailer.Get("X-Command-Status"); got != "200" {
+		t.Errorf("X-Command-Status = %q, want 200", got)
+	}
+	if strings.Contains(string(body), "secret") {
+		t.Errorf("hidden output was streamed:\n%s", body)
+	}
+
+	response, err = http.Get(server.URL + "/?canFail=maybe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", response.StatusCode)
+	}
+}
+
+func TestHandlerTimeoutHeader(t *testing.T) {
+	setExecutor(t, &fakeExecutor{block: true})
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	request.Header.Set("X-Command-Timeout", "100ms")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, _ := ioutil.ReadAll(response.Body)
+	if !strings.Contains(string(body), "Command timed out") {
+		t.Errorf("command didn't time out:\n%s", body)
+	}
+	if got := response.Trailer.Get("X-Command-Status"); got != "503" {
+		t.Errorf("X-Command-Status = %q, want 503", got)
+	}
+}
+
+func TestAuthToken(t *testing.T) {
+	AUTH_TOKEN = []string{"s3cret"}
+	defer func() { AUTH_TOKEN = nil }()
+	protected := withAuth("/", func(w http.ResponseWriter, r *http.Request) {})
+	tests := []struct {
+		header string
+		value  string
+		status int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"X-Api-Key", "wrong", http.StatusUnauthorized},
+		{"X-Api-Key", "s3cret", http.StatusOK},
+		{"Authorization", "Bearer s3cret", http.StatusOK},
+		{"Authorization", "Basic s3cret", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest("GET", "/", nil)
+		if test.header != "" {
+			request.Header.Set(test.header, test.value)
+		}
+		recorder := httptest.NewRecorder()
+		protected(recorder, request)
+		if recorder.Code != test.status {
+			t.Errorf("%s: %s = %d, want %d", test.header, test.value, recorder.Code, test.status)
+		}
+	}
+
+	for _, path := range []string{"/ready", healthCheckPath, healthWatchPath} {
+		recorder := httptest.NewRecorder()
+		withAuth(path, func(w http.ResponseWriter, r *http.Request) {})(recorder, httptest.NewRequest("POST", path, nil))
+		if recorder.Code != http.StatusOK {
+			t.Errorf("%s = %d without a token, want 200", path, recorder.Code)
+		}
+	}
+}
+
+func TestRequestSignature(t *testing.T) {
+	REQUEST_SIGNING_KEY = []string{"old", "s3cret"}
+	defer func() { REQUEST_SIGNING_KEY = nil }()
+	var received string
+	protected := withAuth("/", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received = string(body)
+	})
+	now := time.Now()
+	signed := func(key string, timestamp time.Time, nonce string, body string) *http.Request {
+		request := httptest.NewRequest("POST", "/?arg=1", strings.NewReader(body))
+		ts := strconv.FormatInt(timestamp.Unix(), 10)
+		request.Header.Set(signatureTimestampHeader, ts)
+		request.Header.Set(signatureNonceHeader, nonce)
+		request.Header.Set(signatureHeader, requestSignature(key, signedPayload(ts, nonce, request, []byte(body))))
+		return request
+	}
+	tests := []struct {
+		name    string
+		request *http.Request
+		status  int
+	}{
+		{"unsigned", httptest.NewRequest("POST", "/", strings.NewReader("{}")), http.StatusUnauthorized},
+		{"signed", signed("s3cret", now, "n1", `{"a":1}`), http.StatusOK},
+		{"replayed", signed("s3cret", now, "n1", `{"a":1}`), http.StatusUnauthorized},
+		{"wrong key", signed("wrong", now, "n2", `{"a":1}`), http.StatusUnauthorized},
+		{"stale", signed("s3cret", now.Add(-time.Hour), "n3", `{"a":1}`), http.StatusUnauthorized},
+		{"rotated key", signed("old", now, "n4", `{"a":1}`), http.StatusOK},
+	}
+	for _, test := range tests {
+		received = ""
+		recorder := httptest.NewRecorder()
+		protected(recorder, test.request)
+		if recorder.Code != test.status {
+			t.Errorf("%s: status = %d, want %d", test.name, recorder.Code, test.status)
+		}
+		if test.status == http.StatusOK && received != `{"a":1}` {
+			t.Errorf("%s: handler read body %q", test.name, received)
+		}
+	}
+
+	tampered := signed("s3cret", now, "n5", `{"a":1}`)
+	tampered.URL.RawQuery = "arg=2"
+	recorder := httptest.NewRecorder()
+	protected(recorder, tampered)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("tampered query: status = %d, want 401", recorder.Code)
+	}
+}
+
+func TestRedactArgs(t *testing.T) {
+	args := []string{"--user", "admin", "--password", "hunter2", "API_KEY=abc", "--token=xyz", "file.txt"}
+	want := []string{"--user", "admin", "--password", "[REDACTED]", "API_KEY=[REDACTED]", "--token=[REDACTED]", "file.txt"}
+	if got := redactArgs(args); !reflect.DeepEqual(got, want) {
+		t.Errorf("redactArgs() = %q, want %q", got, want)
+	}
+}
+
+func TestCallerIdentity(t *testing.T) {
+	claims := base64.RawURLEncoding.EncodeToString([]byte(`{"email":"pusher@project.iam.gserviceaccount.com","sub":"123"}`))
+	request := httptest.NewRequest("POST", "/", nil)
+	request.Header.Set("Authorization", "Bearer header."+claims+".signature")
+	request.Header.Set("X-Forwarded-For", "203.0.113.1, 10.0.0.1")
+	entry := newAuditEntry(request, "pubsub")
+	if entry.Caller != "pusher@project.iam.gserviceaccount.com" || entry.CallerIP != "203.0.113.1" {
+		t.Errorf("caller = %s (%s)", entry.Caller, entry.CallerIP)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	limit, err := parseRateLimit("2/m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &rateLimiter{buckets: make(map[string]*tokenBucket)}
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.take("key", limit, now); !ok {
+			t.Fatalf("request %d was limited", i)
+		}
+	}
+	ok, retryAfter := l.take("key", limit, now)
+	if ok || retryAfter != 30*time.Second {
+		t.Errorf("take() = %v, %s, want limited for 30s", ok, retryAfter)
+	}
+	if ok, _ := l.take("other", limit, now); !ok {
+		t.Error("other key was limited")
+	}
+	if ok, _ := l.take("key", limit, now.Add(30*time.Second)); !ok {
+		t.Error("token wasn't refilled")
+	}
+}
+
+func TestHandlerRateLimitPerCaller(t *testing.T) {
+	defer func(limit *RateLimit, l *rateLimiter) { RATE_LIMIT_PER_CALLER, limiter = limit, l }(RATE_LIMIT_PER_CALLER, limiter)
+	RATE_LIMIT_PER_CALLER, _ = parseRateLimit("1/h")
+	limiter = &rateLimiter{buckets: make(map[string]*tokenBucket)}
+	setExecutor(t, &fakeExecutor{})
+	// the caller of an unverified token and the first X-Forwarded-For
+	// entries are chosen by the client
+	unverified := func(email string) string {
+		return "Bearer e30." + base64.RawURLEncoding.EncodeToString([]byte(`{"email":"`+email+`"}`)) + ".c2ln"
+	}
+	tests := []struct {
+		forwarded     string
+		authorization string
+		status        int
+	}{
+		{"192.0.2.1, 10.0.0.1", unverified("a@example.com"), http.StatusOK},
+		{"192.0.2.2, 10.0.0.1", unverified("b@example.com"), http.StatusTooManyRequests},
+		{"10.0.0.2", "", http.StatusOK},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest("POST", "/", strings.NewReader("{}"))
+		request.Header.Set("X-Forwarded-For", test.forwarded)
+		request.Header.Set("Authorization", test.authorization)
+		recorder := httptest.NewRecorder()
+		handler(recorder, request)
+		if recorder.Code != test.status {
+			t.Errorf("%s: status = %d, want %d", test.forwarded, recorder.Code, test.status)
+		}
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	defer func(threshold int) { CIRCUIT_BREAKER_THRESHOLD = threshold }(CIRCUIT_BREAKER_THRESHOLD)
+	CIRCUIT_BREAKER_THRESHOLD = 2
+	b := &circuitBreaker{circuits: make(map[string]*circuit)}
+	now := time.Now()
+	failure := &runner.ExitCodeError{ExitCode: 1}
+	b.record("cmd", failure, now)
+	if err := b.allow("cmd", now); err != nil {
+		t.Fatalf("circuit opened after one failure: %v", err)
+	}
+	b.record("cmd", &runner.CanceledError{}, now)
+	b.record("cmd", failure, now)
+	err := b.allow("cmd", now)
+	var circuitErr *CircuitOpenError
+	if !errors.As(err, &circuitErr) || circuitErr.Failures != 2 {
+		t.Fatalf("allow() = %v, want circuit open after 2 failures", err)
+	}
+	if status := errorStatus(err); status != http.StatusServiceUnavailable {
+		t.Errorf("errorStatus() = %d, want 503", status)
+	}
+	later := now.Add(CIRCUIT_BREAKER_COOLDOWN)
+	if err := b.allow("cmd", later); err != nil {
+		t.Fatalf("trial run rejected: %v", err)
+	}
+	if err := b.allow("cmd", later); err == nil {
+		t.Fatal("second run allowed during trial")
+	}
+	b.record("cmd", nil, later)
+	if err := b.allow("cmd", later); err != nil {
+		t.Errorf("circuit not closed after success: %v", err)
+	}
+}
+
+func TestHandlerCircuitTrialReleased(t *testing.T) {
+	defer func(threshold int, b *circuitBreaker) { CIRCUIT_BREAKER_THRESHOLD, breaker = threshold, b }(CIRCUIT_BREAKER_THRESHOLD, breaker)
+	CIRCUIT_BREAKER_THRESHOLD = 1
+	breaker = &circuitBreaker{circuits: make(map[string]*circuit)}
+	breaker.record("sh", &runner.ExitCodeError{ExitCode: 1}, time.Now().Add(-CIRCUIT_BREAKER_COOLDOWN))
+
+	// the trial run is rejected because another instance holds the lock
+	storage := setFakeStorage(t)
+	defer func(bucket string, mode string) { LOCK_BUCKET, LOCK_MODE = bucket, mode }(LOCK_BUCKET, LOCK_MODE)
+	LOCK_BUCKET, LOCK_MODE = "locks", "reject"
+	held, _ := json.Marshal(lockInfo{Holder: "other", Acquired: time.Now(), ExpiresAt: time.Now().Add(time.Hour)})
+	storage.objects["locks/sh.lock"], storage.generation["locks/sh.lock"] = held, 1
+	e := &fakeExecutor{}
+	setExecutor(t, e)
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("POST", "/", nil))
+	if recorder.Code != http.StatusConflict || e.args != nil {
+		t.Fatalf("status = %d, want 409 without running", recorder.Code)
+	}
+	if err := breaker.allow("sh", time.Now()); err != nil {
+		t.Errorf("allow() = %v, want the trial of the rejected run to be released", err)
+	}
+}
+
+func TestHandlerCloudScheduler(t *testing.T) {
+	setExecutor(t, &fakeExecutor{lines: []string{"output"}})
+	request := httptest.NewRequest("POST", "/", strings.NewReader("not a Pub/Sub message"))
+	request.Header.Set("X-CloudScheduler", "true")
+	recorder := httptest.NewRecorder()
+	handler(recorder, request)
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), "output") {
+		t.Errorf("status = %d, body = %q, want the output", recorder.Code, recorder.Body)
+	}
+}
+
+func TestRenderArgs(t *testing.T) {
+	TEMPLATE_ARGS = true
+	defer func() { TEMPLATE_ARGS = false }()
+	request := httptest.NewRequest("POST", "/", nil)
+	request.Header.Set("X-CloudScheduler-JobName", "backup")
+	invocation := newInvocation(request, "cloudscheduler", []byte(`{"table":"users","rows":1000000}`), &PubSubMessage{})
+	args, err := renderArgs([]string{"--table={{.Body.table}}", "--rows={{.Body.rows}}", "--job={{.Job}}"}, invocation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"--table=users", "--rows=1000000", "--job=backup"}
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("renderArgs() = %q, want %q", args, want)
+	}
+	if _, err := renderArgs([]string{"{{.Body.missing}}"}, invocation); err == nil {
+		t.Error("missing field didn't fail")
+	}
+	invocation = newInvocation(request, "http", []byte("plain text"), &PubSubMessage{})
+	if args, _ := renderArgs([]string{"{{.Body}}"}, invocation); args[0] != "plain text" {
+		t.Errorf("renderArgs() = %q, want the plain body", args)
+	}
+}
+
+func TestTemplateFuncs(t *testing.T) {
+	TEMPLATE_ARGS = true
+	defer func() { TEMPLATE_ARGS = false }()
+	os.Setenv("TEMPLATE_TEST_BUCKET", "backups")
+	defer os.Unsetenv("TEMPLATE_TEST_BUCKET")
+	invocation := newInvocation(httptest.NewRequest("POST", "/", nil), "http", []byte(`{"mode":""}`), &PubSubMessage{})
+	args, err := renderArgs([]string{
+		`--output=backup-{{date "20060102"}}.sql.gz`,
+		`{{env "TEMPLATE_TEST_BUCKET"}}`,
+		`{{default "full" .Body.mode}},{{default "all" (index .Body "tables")}}`,
+		`{{uuid}}`,
+		`{{now.Year}}`,
+	}, invocation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	if args[0] != "--output=backup-"+now.Format("20060102")+".sql.gz" {
+		t.Errorf("date = %q", args[0])
+	}
+	if args[1] != "backups" || args[2] != "full,all" || args[4] != strconv.Itoa(now.Year()) {
+		t.Errorf("renderArgs() = %q", args)
+	}
+	if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(args[3]) {
+		t.Errorf("uuid = %q", args[3])
+	}
+
+	job := &JobSpec{Name: "export", Args: []string{`{{env "HOME"}}`}, Matrix: []interface{}{1}}
+	if _, err := job.expandMatrix(); err == nil {
+		t.Error("env is available to batch request templates")
+	}
+}
+
+func TestDispatch(t *testing.T) {
+	defer func(dispatch []*DispatchRule) { CONFIG.Dispatch = dispatch }(CONFIG.Dispatch)
+	CONFIG.Dispatch = []*DispatchRule{
+		{Attributes: map[string]string{"job": "backup"}, Command: "backup"},
+		{Attributes: map[string]string{"job": "reindex"}, Command: "reindex"},
+	}
+	m := &PubSubMessage{}
+	m.Message.Attributes = map[string]string{"job": "reindex", "other": "x"}
+	rule, err := dispatchRule(m)
+	if err != nil || rule.Command != "reindex" {
+		t.Errorf("dispatchRule() = %v, %v, want reindex", rule, err)
+	}
+
+	setExecutor(t, &fakeExecutor{})
+	recorder := httptest.NewRecorder()
+	body := `{"message":{"attributes":{"job":"unknown"},"messageId":"1"},"subscription":"projects/p/subscriptions/s"}`
+	handler(recorder, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400 for an unmatched message", recorder.Code)
+	}
+}
+
+func TestSchema(t *testing.T) {
+	schema := &Schema{}
+	err := json.Unmarshal([]byte(`{
+		"type": "object",
+		"required": ["table", "rows"],
+		"properties": {
+			"table": {"type": "string", "pattern": "^[a-z]+$"},
+			"rows": {"type": "integer", "minimum": 1},
+			"tags": {"type": "array", "items": {"enum": ["a", "b"]}}
+		},
+		"additionalProperties": false
+	}`), schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := httptest.NewRequest("POST", "/", nil)
+	valid := newInvocation(request, "http", []byte(`{"table":"users","rows":10,"tags":["a"]}`), &PubSubMessage{})
+	if err := schema.Validate(valid.Body); err != nil {
+		t.Errorf("valid payload rejected: %v", err)
+	}
+	invalid := newInvocation(request, "http", []byte(`{"table":"Users","rows":1.5,"tags":["c"],"extra":true}`), &PubSubMessage{})
+	var schemaErr *SchemaError
+	if err := schema.Validate(invalid.Body); !errors.As(err, &schemaErr) || len(schemaErr.Problems) != 4 {
+		t.Errorf("Validate() = %v, want 4 problems", err)
+	}
+}
+
+func TestHandlerUpload(t *testing.T) {
+	e := &fakeExecutor{lines: []string{"output"}}
+	setExecutor(t, e)
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	writer.WriteField("table", "users")
+	file, _ := writer.CreateFormFile("input", "../data.csv")
+	file.Write([]byte("a,b\n"))
+	writer.Close()
+	request := httptest.NewRequest("POST", "/run", &body)
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+	recorder := httptest.NewRecorder()
+	handler(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %q", recorder.Code, recorder.Body)
+	}
+	var path string
+	for _, variable := range e.env {
+		if strings.HasPrefix(variable, "UPLOAD_INPUT=") {
+			path = strings.TrimPrefix(variable, "UPLOAD_INPUT=")
+		}
+	}
+	if filepath.Base(path) != "data.csv" {
+		t.Errorf("env = %q, want UPLOAD_INPUT with the path of data.csv", e.env)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("upload %s wasn't removed: %v", path, err)
+	}
+
+	defer func(max int64) { MAX_UPLOAD_BYTES = max }(MAX_UPLOAD_BYTES)
+	MAX_UPLOAD_BYTES = 10
+	body.Reset()
+	writer = multipart.NewWriter(&body)
+	file, _ = writer.CreateFormFile("input", "data.csv")
+	file.Write([]byte("more than ten bytes"))
+	writer.Close()
+	request = httptest.NewRequest("POST", "/run", &body)
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+	recorder = httptest.NewRecorder()
+	handler(recorder, request)
+	if recorder.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want 413", recorder.Code)
+	}
+}
+
+func TestHandlerStdoutPassthrough(t *testing.T) {
+	defer func() { STDOUT_CONTENT_TYPE = "" }()
+	STDOUT_CONTENT_TYPE = "application/sql"
+	setExecutor(t, &fakeExecutor{lines: []string{"CREATE TABLE users;"}})
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("GET", "/", nil))
+	if got := recorder.Header().Get("Content-Type"); got != "application/sql" {
+		t.Errorf("Content-Type = %s", got)
+	}
+	if recorder.Body.String() != "CREATE TABLE users;\n" {
+		t.Errorf("body = %q, want only the standard output", recorder.Body)
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	defer func() { KEEPALIVE_INTERVAL, KEEPALIVE_PADDING = 0, 0 }()
+	KEEPALIVE_INTERVAL, KEEPALIVE_PADDING = 10*time.Millisecond, 64
+	recorder := httptest.NewRecorder()
+	keeper := newKeepAliveWriter(recorder, recorder, FormatSSE)
+	time.Sleep(35 * time.Millisecond)
+	keeper.Stop()
+	body := recorder.Body.String()
+	if !strings.HasPrefix(body, ": keep-alive") || len(body)%64 != 0 {
+		t.Errorf("body = %q, want padded SSE comments", body)
+	}
+}
+
+func TestRequestTrace(t *testing.T) {
+	request := httptest.NewRequest("GET", "/", nil)
+	request.Header.Set("X-Cloud-Trace-Context", "105445aa7843bc8bf206b12000100000/1;o=1")
+	if trace := requestTrace(request); trace != "105445aa7843bc8bf206b12000100000" {
+		t.Errorf("requestTrace() = %s", trace)
+	}
+	request = httptest.NewRequest("GET", "/", nil)
+	request.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if trace := requestTrace(request); trace != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("requestTrace() = %s", trace)
+	}
+	if id := newJobID(); !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(id) {
+		t.Errorf("newJobID() = %s, want a UUID", id)
+	}
+}
+
+func TestHandlerJobID(t *testing.T) {
+	defer func() { PREFIX_JOB_ID = false }()
+	PREFIX_JOB_ID = true
+	e := &fakeExecutor{lines: []string{"output"}}
+	setExecutor(t, e)
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("GET", "/", nil))
+	jobID := recorder.Header().Get("X-Job-Id")
+	if jobID == "" {
+		t.Fatal("missing X-Job-Id")
+	}
+	if !strings.Contains(recorder.Body.String(), "["+jobID+"] output\n") {
+		t.Errorf("output not prefixed with the job ID: %q", recorder.Body)
+	}
+	found := false
+	for _, variable := range e.env {
+		found = found || variable == "JOB_ID="+jobID
+	}
+	if !found {
+		t.Errorf("env = %q, want JOB_ID=%s", e.env, jobID)
+	}
+}
+
+func TestDebugVars(t *testing.T) {
+	untrackRun := trackRun("run-1", "echo", "http")
+	untrackQueue := trackQueue("cloudLogging run-1", func() int { return 3 })
+	vars := func() map[string]json.RawMessage {
+		recorder := httptest.NewRecorder()
+		expvar.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/debug/vars", nil))
+		var vars map[string]json.RawMessage
+		if err := json.Unmarshal(recorder.Body.Bytes(), &vars); err != nil {
+			t.Fatal(err)
+		}
+		return vars
+	}
+	got := vars()
+	if _, ok := got["goroutines"]; !ok {
+		t.Error("missing goroutines")
+	}
+	if !strings.Contains(string(got["runs"]), `"jobId":"run-1"`) {
+		t.Errorf("runs = %s, want run-1", got["runs"])
+	}
+	if string(got["queues"]) != `{"cloudLogging run-1":3}` {
+		t.Errorf("queues = %s", got["queues"])
+	}
+	untrackRun()
+	untrackQueue()
+	got = vars()
+	if string(got["runs"]) != "[]" || string(got["queues"]) != "{}" {
+		t.Errorf("runs = %s, queues = %s after untracking", got["runs"], got["queues"])
+	}
+}
+
+func TestServerH2C(t *testing.T) {
+	defer func() { ENABLE_H2C = false }()
+	ENABLE_H2C = true
+	server := httptest.NewUnstartedServer(nil)
+	server.Config = newServer("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Proto)
+	}))
+	server.Start()
+	defer server.Close()
+
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "HTTP/2.0" {
+		t.Errorf("protocol = %q, want HTTP/2.0", body)
+	}
+}
+
+func TestHandlerMaxBodyBytes(t *testing.T) {
+	defer func(max int64) { MAX_BODY_BYTES = max }(MAX_BODY_BYTES)
+	MAX_BODY_BYTES = 16
+	setExecutor(t, &fakeExecutor{})
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("POST", "/", strings.NewReader(`{"message":{"data":"aGVsbG8gd29ybGQ="}}`)))
+	if recorder.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want 413", recorder.Code)
+	}
+}
+
+func TestReadBody(t *testing.T) {
+	tests := []struct {
+		body     string
+		wantBody string
+		wantErr  bool
+	}{
+		{"", "", false},
+		{`{"subscription":"s","message":{"data":"aGk="}}`, "", false},
+		{`{"table":"users"}`, `{"table":"users"}`, false},
+		{`{"table":"users"} trailing`, `{"table":"users"} trailing`, true},
+		{"plain text", "plain text", true},
+	}
+	for _, test := range tests {
+		var m PubSubMessage
+		body, err := readBody(httptest.NewRequest("POST", "/", strings.NewReader(test.body)), &m)
+		var envelopeErr *envelopeError
+		if (err != nil) != test.wantErr || (err != nil && !errors.As(err, &envelopeErr)) {
+			t.Errorf("readBody(%q) error = %v", test.body, err)
+		}
+		if string(body) != test.wantBody {
+			t.Errorf("readBody(%q) = %q, want %q", test.body, body, test.wantBody)
+		}
+	}
+}
+
+func TestStartupCommand(t *testing.T) {
+	defer func() {
+		STARTUP_CMD = ""
+		STARTUP_FAILURE_POLICY = StartupFailureFail
+	}()
+	STARTUP_CMD = "restore-cache"
+	setExecutor(t, &fakeExecutor{exitCode: 1})
+	check := &SelfCheck{done: make(chan struct{})}
+	check.Run(context.Background())
+	if err := check.Wait(context.Background()); err == nil || !strings.Contains(err.Error(), "ERROR startup command") {
+		t.Errorf("Wait() = %v, want startup command error", err)
+	}
+
+	STARTUP_FAILURE_POLICY = StartupFailureIgnore
+	check = &SelfCheck{done: make(chan struct{})}
+	check.Run(context.Background())
+	if err := check.Wait(context.Background()); err != nil {
+		t.Errorf("Wait() = %v with %s policy", err, StartupFailureIgnore)
+	}
+}
+
+func TestSelfCheckBuckets(t *testing.T) {
+	setFakeStorage(t)
+	defer func() {
+		LOCK_BUCKET, TRANSCRIPT_GCS_URI, RESULT_GCS_URI, OUTPUT_STDOUT_GCS_URI = "", "", "", ""
+		STDIN_GCS_URI, JOB_STORE = "", ""
+	}()
+	LOCK_BUCKET = "locks"
+	TRANSCRIPT_GCS_URI = "gs://runs/transcripts"
+	RESULT_GCS_URI = "gs://runs/results/"
+	OUTPUT_STDOUT_GCS_URI = "gs://{{.Args}}/stdout"
+	STDIN_GCS_URI = "gs://inputs/dump.sql"
+	JOB_STORE = "gs://jobs/state"
+	if buckets, err := configuredBuckets(); err != nil || !reflect.DeepEqual(buckets, []string{"locks", "runs", "inputs", "jobs"}) {
+		t.Errorf("configuredBuckets() = %q, %v, want every bucket once", buckets, err)
+	}
+
+	// the fake storage has no buckets
+	defer func(check *SelfCheck) { selfCheck = check }(selfCheck)
+	selfCheck = &SelfCheck{done: make(chan struct{})}
+	selfCheck.Run(context.Background())
+	err := selfCheck.Wait(context.Background())
+	for _, want := range []string{"ERROR bucket locks", "ERROR bucket runs", "ERROR bucket inputs", "ERROR bucket jobs"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Wait() = %v, want %q", err, want)
+		}
+	}
+
+	// the report is only served with authentication
+	defer func() { AUTH_TOKEN = nil }()
+	AUTH_TOKEN = []string{"s3cret"}
+	recorder := httptest.NewRecorder()
+	withAuth("/ready", readyHandler)(recorder, httptest.NewRequest("GET", "/ready", nil))
+	if recorder.Code != http.StatusServiceUnavailable || strings.Contains(recorder.Body.String(), "bucket") {
+		t.Errorf("/ready = %d, %q, want 503 without the report", recorder.Code, recorder.Body.String())
+	}
+	recorder = httptest.NewRecorder()
+	withAuth(selfCheckPath, selfCheckHandler)(recorder, httptest.NewRequest("GET", selfCheckPath, nil))
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("%s = %d without a token, want 401", selfCheckPath, recorder.Code)
+	}
+	request := httptest.NewRequest("GET", selfCheckPath, nil)
+	request.Header.Set("X-Api-Key", "s3cret")
+	recorder = httptest.NewRecorder()
+	withAuth(selfCheckPath, selfCheckHandler)(recorder, request)
+	if recorder.Code != http.StatusServiceUnavailable || !strings.Contains(recorder.Body.String(), "ERROR bucket locks") {
+		t.Errorf("%s = %d, %q, want the report", selfCheckPath, recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestSelfCheckCPUAllocation(t *testing.T) {
+	defer func(cmd string, policy string, project string, region string) {
+		CLEANUP_CMD, CPU_THROTTLING_POLICY, GOOGLE_CLOUD_PROJECT, GOOGLE_CLOUD_REGION = cmd, policy, project, region
+	}(CLEANUP_CMD, CPU_THROTTLING_POLICY, GOOGLE_CLOUD_PROJECT, GOOGLE_CLOUD_REGION)
+	CLEANUP_CMD, GOOGLE_CLOUD_PROJECT, GOOGLE_CLOUD_REGION = "rm -rf /tmp/cache", "p", "r"
+	defer os.Unsetenv("K_SERVICE")
+	os.Setenv("K_SERVICE", "runner")
+	defer func() { AUTH_TOKEN = nil }()
+	AUTH_TOKEN = []string{"s3cret"}
+	defer func(check *SelfCheck) { selfCheck = check }(selfCheck)
+	service := `{"template":{"containers":[{"resources":{"cpuIdle":true}}]}}`
+	setTransport(t, fakeAPI(func(r *http.Request) (int, string) {
+		if r.URL.Path != "/v2/projects/p/locations/r/services/runner" {
+			return http.StatusNotFound, `{}`
+		}
+		return http.StatusOK, service
+	}))
+	check := func() (int, string) {
+		selfCheck = &SelfCheck{done: make(chan struct{})}
+		selfCheck.Run(context.Background())
+		recorder := httptest.NewRecorder()
+		withAuth("/ready", readyHandler)(recorder, httptest.NewRequest("GET", "/ready", nil))
+		request := httptest.NewRequest("GET", selfCheckPath, nil)
+		request.Header.Set("X-Api-Key", "s3cret")
+		report := httptest.NewRecorder()
+		withAuth(selfCheckPath, selfCheckHandler)(report, request)
+		return recorder.Code, report.Body.String()
+	}
+
+	tests := []struct {
+		policy  string
+		service string
+		status  int
+		report  string
+	}{
+		{CPUThrottlingWarn, service, http.StatusOK, "WARN  CPU allocation for CLEANUP_CMD: the service can scale to zero (set --min-instances=1), CPU is only allocated during requests (set --no-cpu-throttling)"},
+		{CPUThrottlingFail, service, http.StatusServiceUnavailable, "ERROR CPU allocation for CLEANUP_CMD: the service can scale to zero"},
+		{CPUThrottlingFail, `{"template":{"scaling":{"minInstanceCount":1},"containers":[{"resources":{"cpuIdle":false}}]}}`, http.StatusOK, "OK    CPU allocation for CLEANUP_CMD"},
+	}
+	for _, test := range tests {
+		CPU_THROTTLING_POLICY, service = test.policy, test.service
+		if status, report := check(); status != test.status || !strings.Contains(report, test.report) {
+			t.Errorf("%s: /ready = %d, report %q, want %d and %q", test.policy, status, report, test.status, test.report)
+		}
+	}
+}
+
+func TestCleanupCommand(t *testing.T) {
+	defer func() { CLEANUP_CMD = "" }()
+	CLEANUP_CMD = "rm -rf /tmp/cache"
+	e := &fakeExecutor{}
+	setExecutor(t, e)
+	if err := runCleanupCommand(context.Background()); err != nil {
+		t.Errorf("runCleanupCommand() = %v", err)
+	}
+	e.exitCode = 1
+	if err := runCleanupCommand(context.Background()); err == nil {
+		t.Error("runCleanupCommand() succeeded for a failing command")
+	}
+}
+
+func TestDiskMonitor(t *testing.T) {
+	defer func(paths []string) {
+		DISK_PATHS = paths
+		DISK_WARN_BYTES, DISK_LIMIT_BYTES, DISK_PRUNE_AGE = 0, 0, 0
+		disk = &diskMonitor{}
+	}(DISK_PATHS)
+	dir := t.TempDir()
+	DISK_PATHS = []string{dir}
+	DISK_WARN_BYTES, DISK_LIMIT_BYTES = 100, 150
+	now := time.Now()
+	for name, age := range map[string]time.Duration{"old": 2 * time.Hour, "new": 0} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, make([]byte, 100), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, now.Add(-age), now.Add(-age))
+	}
+
+	if used := disk.check(now); used != 200 {
+		t.Errorf("used = %d, want 200", used)
+	}
+	var diskErr *DiskFullError
+	if err := disk.Allow(); !errors.As(err, &diskErr) || errorStatus(err) != http.StatusServiceUnavailable {
+		t.Errorf("Allow() = %v, want DiskFullError", err)
+	}
+	if details := disk.heartbeatDetails(); len(details) != 1 {
+		t.Errorf("heartbeatDetails() = %q, want a warning", details)
+	}
+
+	DISK_PRUNE_AGE = time.Hour
+	if used := disk.check(now); used != 100 {
+		t.Errorf("used = %d after pruning, want 100", used)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "old")); !os.IsNotExist(err) {
+		t.Errorf("old file not pruned: %v", err)
+	}
+	if err := disk.Allow(); err != nil {
+		t.Errorf("Allow() = %v after pruning", err)
+	}
+
+	// directories of runs in progress, or with recent changes, are kept
+	DISK_WARN_BYTES = 50
+	old := now.Add(-2 * time.Hour)
+	for _, name := range []string{"upload-1", "cache", "stale"} {
+		os.Mkdir(filepath.Join(dir, name), 0755)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "cache", "recent"), nil, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "stale", "file"), nil, 0644)
+	os.Chtimes(filepath.Join(dir, "stale", "file"), old, old)
+	for _, name := range []string{"upload-1", "cache", "stale"} {
+		os.Chtimes(filepath.Join(dir, name), old, old)
+	}
+	release := disk.use(filepath.Join(dir, "upload-1"))
+	disk.check(now)
+	for name, kept := range map[string]bool{"upload-1": true, "cache": true, "stale": false} {
+		if _, err := os.Stat(filepath.Join(dir, name)); os.IsNotExist(err) == kept {
+			t.Errorf("%s: kept = %v, want %v", name, !kept, kept)
+		}
+	}
+	release()
+	disk.check(now)
+	if _, err := os.Stat(filepath.Join(dir, "upload-1")); !os.IsNotExist(err) {
+		t.Errorf("upload-1 not pruned after the run: %v", err)
+	}
+}
+
+func TestHandlerStdin(t *testing.T) {
+	defer func() {
+		STDIN_GCS_URI = ""
+		TEMPLATE_ARGS = false
+	}()
+	STDIN_GCS_URI = "gs://backups/{{.Body.backup}}"
+	TEMPLATE_ARGS = true
+	tests := []struct {
+		query      string
+		wantStatus int
+		wantURI    string
+	}{
+		{"", http.StatusOK, "gs://backups/db.sql"},
+		{"?stdin=gs://other/dump.sql", http.StatusOK, "gs://other/dump.sql"},
+		{"?stdin=/etc/passwd", http.StatusBadRequest, ""},
+	}
+	for _, test := range tests {
+		e := &fakeExecutor{}
+		setExecutor(t, e)
+		recorder := httptest.NewRecorder()
+		handler(recorder, httptest.NewRequest("POST", "/"+test.query, strings.NewReader(`{"backup":"db.sql"}`)))
+		if recorder.Code != test.wantStatus {
+			t.Errorf("%s: status = %d, want %d", test.query, recorder.Code, test.wantStatus)
+			continue
+		}
+		if test.wantURI == "" {
+			continue
+		}
+		if stdin, ok := e.stdin.(*objectReader); !ok || stdin.uri != test.wantURI {
+			t.Errorf("%s: stdin = %#v, want %s", test.query, e.stdin, test.wantURI)
+		}
+	}
+}
+
+func TestObjectWriter(t *testing.T) {
+	var ranges []string
+	var received int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received += len(body)
+		ranges = append(ranges, r.Header.Get("Content-Range"))
+		if strings.HasSuffix(r.Header.Get("Content-Range"), "/*") {
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", received-1))
+			w.WriteHeader(http.StatusPermanentRedirect)
+		}
+	}))
+	defer server.Close()
+
+	upload := newObjectWriter(context.Background(), "gs://bucket/dump.sql")
+	upload.session = server.URL
+	for i := 0; i < 3; i++ {
+		if _, err := upload.Write(make([]byte, resumableChunkSize/2+1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := upload.Uploaded(); got != resumableChunkSize {
+		t.Errorf("Uploaded() = %d before Close, want %d", got, resumableChunkSize)
+	}
+	if err := upload.Close(); err != nil {
+		t.Fatal(err)
+	}
+	total := 3 * (resumableChunkSize/2 + 1)
+	want := []string{
+		fmt.Sprintf("bytes 0-%d/*", resumableChunkSize-1),
+		fmt.Sprintf("bytes %d-%d/%d", resumableChunkSize, total-1, total),
+	}
+	if !reflect.DeepEqual(ranges, want) || received != total {
+		t.Errorf("ranges = %q, received %d, want %q, %d", ranges, received, want, total)
+	}
+}
+
+func TestObjectWriterResumes(t *testing.T) {
+	defer func(retryTime time.Duration) { uploadRetryTime = retryTime }(uploadRetryTime)
+	uploadRetryTime = 10 * time.Second
+	// the session persists half of the first request, fails the second
+	// and answers the query of the offset with what it has
+	var persisted []byte
+	var ranges []string
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		contentRange := r.Header.Get("Content-Range")
+		ranges = append(ranges, contentRange)
+		requests++
+		switch requests {
+		case 1:
+			persisted = append(persisted, body[:len(body)/2]...)
+		case 2:
+			persisted = append(persisted, body[:10]...)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		default:
+			persisted = append(persisted, body...)
+		}
+		if strings.HasSuffix(contentRange, "/*") {
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(persisted)-1))
+			w.WriteHeader(http.StatusPermanentRedirect)
+		}
+	}))
+	defer server.Close()
+
+	upload := newObjectWriter(context.Background(), "gs://bucket/dump.sql")
+	upload.session = server.URL
+	data := make([]byte, resumableChunkSize+100)
+	rand.Read(data)
+	if _, err := upload.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := upload.Close(); err != nil {
+		t.Fatal(err)
+	}
+	half := resumableChunkSize / 2
+	want := []string{
+		fmt.Sprintf("bytes 0-%d/*", resumableChunkSize-1),
+		fmt.Sprintf("bytes %d-%d/*", half, resumableChunkSize-1),
+		"bytes */*",
+		fmt.Sprintf("bytes %d-%d/*", half+10, resumableChunkSize-1),
+		fmt.Sprintf("bytes %d-%d/%d", resumableChunkSize, len(data)-1, len(data)),
+	}
+	if !reflect.DeepEqual(ranges, want) || !bytes.Equal(persisted, data) {
+		t.Errorf("ranges = %q, want %q, data intact %v", ranges, want, bytes.Equal(persisted, data))
+	}
+	if upload.Uploaded() != int64(len(data)) {
+		t.Errorf("Uploaded() = %d, want %d", upload.Uploaded(), len(data))
+	}
+}
+
+func TestSidecar(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	e := &fakeExecutor{block: true, killed: make(chan os.Signal, 1)}
+	setExecutor(t, e)
+	sidecar := &Sidecar{Name: "proxy", Command: "proxy", Port: listener.Addr().(*net.TCPAddr).Port}
+	if err := sidecar.parse(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a quiet sidecar isn't stalled
+	defer func() { STALL_TIMEOUT, KILL_ON_STALL = 0, false }()
+	STALL_TIMEOUT, KILL_ON_STALL = 50*time.Millisecond, true
+	if err := sidecar.acquire(context.Background()); err != nil {
+		t.Fatalf("acquire() = %v", err)
+	}
+	time.Sleep(150 * time.Millisecond)
+	run := sidecar.run
+	if err := sidecar.acquire(context.Background()); err != nil || sidecar.run != run {
+		t.Fatalf("second acquire() = %v, started another process", err)
+	}
+	sidecar.release()
+	select {
+	case sig := <-e.killed:
+		t.Fatalf("sidecar got %v while still in use", sig)
+	default:
+	}
+	sidecar.release()
+	select {
+	case <-e.killed:
+	default:
+		t.Error("sidecar not stopped after the last release")
+	}
+
+	listener.Close()
+	sidecar.ReadyTimeout.Duration = 200 * time.Millisecond
+	e.killed = make(chan os.Signal, 1)
+	if err := sidecar.acquire(context.Background()); err == nil || !strings.Contains(err.Error(), "not ready") {
+		t.Errorf("acquire() = %v, want port not ready", err)
+	}
+	if sidecar.users != 0 || sidecar.run != nil {
+		t.Errorf("sidecar still has %d users after failing", sidecar.users)
+	}
+}
+
+func TestHandlerQueryArgs(t *testing.T) {
+	defer func() {
+		ALLOW_QUERY_ARGS = false
+		QUERY_ARGS_ALLOWLIST = nil
+	}()
+	ALLOW_QUERY_ARGS = true
+	QUERY_ARGS_ALLOWLIST = []string{"--verbose", "--table=*"}
+	tests := []struct {
+		query      string
+		wantStatus int
+		wantArgs   []string
+	}{
+		{"", http.StatusOK, []string{"-c", "true"}},
+		{"?arg=--verbose&arg=--table=users", http.StatusOK, []string{"-c", "true", "--verbose", "--table=users"}},
+		{"?arg=--verbose&arg=--drop", http.StatusBadRequest, nil},
+	}
+	for _, test := range tests {
+		e := &fakeExecutor{}
+		setExecutor(t, e)
+		recorder := httptest.NewRecorder()
+		handler(recorder, httptest.NewRequest("GET", "/"+test.query, nil))
+		if recorder.Code != test.wantStatus {
+			t.Errorf("%s: status = %d, want %d", test.query, recorder.Code, test.wantStatus)
+		}
+		if test.wantArgs != nil && !reflect.DeepEqual(e.args, test.wantArgs) {
+			t.Errorf("%s: args = %q, want %q", test.query, e.args, test.wantArgs)
+		}
+	}
+}
+
+func TestRunQueue(t *testing.T) {
+	defer func(poll time.Duration) {
+		MAX_CONCURRENT_RUNS = 0
+		POLL_TIME = poll
+	}(POLL_TIME)
+	MAX_CONCURRENT_RUNS = 1
+	POLL_TIME = 10 * time.Millisecond
+	q := &runQueue{}
+	if err := q.acquire(context.Background(), 0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan string, 2)
+	positions := make(chan int, 10)
+	for _, run := range []struct {
+		name     string
+		priority int
+	}{{"routine", 0}, {"urgent", 5}} {
+		run := run
+		go func() {
+			q.acquire(context.Background(), run.priority, func(position int) {
+				if run.name == "routine" {
+					positions <- position
+				}
+			})
+			started <- run.name
+		}()
+		for q.Waiting() < 1 || (run.name == "urgent" && q.Waiting() < 2) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if position := <-positions; position != 1 {
+		t.Errorf("routine run queued at %d, want 1", position)
+	}
+	for position := <-positions; position != 2; position = <-positions {
+	}
+
+	q.release()
+	if first := <-started; first != "urgent" {
+		t.Errorf("%s run started first, want urgent", first)
+	}
+	q.release()
+	if second := <-started; second != "routine" {
+		t.Errorf("%s run started second, want routine", second)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := q.acquire(ctx, 0, func(int) {}); err == nil {
+		t.Error("cancelled run acquired the queue")
+	}
+	if q.Waiting() != 0 {
+		t.Errorf("%d runs still waiting", q.Waiting())
+	}
+}
+
+type recordingSink struct {
+	enabled bool
+	results []runner.Result
+	errs    []error
+}
+
+func (s *recordingSink) Enabled() bool {
+	return s.enabled
+}
+
+func (s *recordingSink) Report(ctx context.Context, trigger string, result runner.Result, err error) error {
+	s.results = append(s.results, result)
+	s.errs = append(s.errs, err)
+	return nil
+}
+
+func TestResultSinks(t *testing.T) {
+	sink := &recordingSink{}
+	registerResultSink("test", sink)
+	defer func() {
+		resultSinks = resultSinks[:len(resultSinks)-1]
+	}()
+
+	setExecutor(t, &fakeExecutor{exitCode: 2})
+	handler(httptest.NewRecorder(), httptest.NewRequest("POST", "/", nil))
+	if len(sink.results) != 0 {
+		t.Fatalf("disabled sink got %d results", len(sink.results))
+	}
+
+	sink.enabled = true
+	handler(httptest.NewRecorder(), httptest.NewRequest("POST", "/", nil))
+	if len(sink.results) != 1 {
+		t.Fatalf("got %d results, want 1", len(sink.results))
+	}
+	if result := sink.results[0]; result.ExitCode != 2 || result.Status != runner.StatusFailed || sink.errs[0] == nil {
+		t.Errorf("result = %+v, %v, want a failure with exit code 2", result, sink.errs[0])
+	}
+	if got := enabledResultSinks(); len(got) != 1 || got[0] != "test" {
+		t.Errorf("enabled sinks = %v, want [test]", got)
+	}
+}
+
+func TestAttemptRecord(t *testing.T) {
+	m := &PubSubMessage{Subscription: "projects/p/subscriptions/jobs"}
+	m.Message.ID = "123"
+	if a := newAttemptRecord(m); a != nil {
+		t.Errorf("record = %+v without ATTEMPTS_GCS_URI", a)
+	}
+	defer func() {
+		ATTEMPTS_GCS_URI = ""
+	}()
+	ATTEMPTS_GCS_URI = "gs://bucket/attempts"
+	a := newAttemptRecord(m)
+	if a == nil || a.bucket != "bucket" || a.name != "attempts/jobs/123.json" {
+		t.Errorf("record = %+v, want gs://bucket/attempts/jobs/123.json", a)
+	}
+}
+
+func TestHandlerDeliveryAttempt(t *testing.T) {
+	defer func() {
+		MAX_DELIVERY_ATTEMPTS = 0
+	}()
+	MAX_DELIVERY_ATTEMPTS = 5
+	tests := []struct {
+		attempt int
+		want    []string
+	}{
+		{0, nil},
+		{2, []string{"DELIVERY_ATTEMPT=2"}},
+		{5, []string{"DELIVERY_ATTEMPT=5", "FINAL_DELIVERY=1"}},
+	}
+	for _, test := range tests {
+		e := &fakeExecutor{}
+		setExecutor(t, e)
+		body := fmt.Sprintf(`{"message":{"messageId":"1"},"subscription":"projects/p/subscriptions/s","deliveryAttempt":%d}`, test.attempt)
+		handler(httptest.NewRecorder(), httptest.NewRequest("POST", "/", strings.NewReader(body)))
+		var got []string
+		for _, env := range e.env {
+			if strings.HasPrefix(env, "DELIVERY_ATTEMPT=") || strings.HasPrefix(env, "FINAL_DELIVERY=") {
+				got = append(got, env)
+			}
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("attempt %d: environment = %q, want %q", test.attempt, got, test.want)
+		}
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	defer func() {
+		ENABLE_H2C = false
+		MAX_CONCURRENT_RUNS = 0
+	}()
+	ENABLE_H2C = true
+	MAX_CONCURRENT_RUNS = 1
+	server := httptest.NewUnstartedServer(nil)
+	server.Config = newServer("", http.HandlerFunc(healthHandler))
+	server.Start()
+	defer server.Close()
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	check := func(service string) (string, []byte) {
+		// HealthCheckRequest with the service as field 1.
+		request := append([]byte{0x0a, byte(len(service))}, service...)
+		resp, err := client.Post(server.URL+healthCheckPath, "application/grpc", bytes.NewReader(grpcFrame(request)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.Trailer.Get("Grpc-Status"), body
+	}
+
+	if status, body := check("runs"); status != "0" || !bytes.Equal(body, grpcFrame([]byte{0x08, healthServing})) {
+		t.Errorf("runs: status %s, response %x, want serving", status, body)
+	}
+	if err := runs.acquire(context.Background(), 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if status, body := check("runs"); status != "0" || !bytes.Equal(body, grpcFrame([]byte{0x08, healthNotServing})) {
+		t.Errorf("runs: status %s, response %x, want not serving", status, body)
+	}
+	runs.release()
+	if status, _ := check("unknown"); status != "5" {
+		t.Errorf("unknown: status %s, want 5", status)
+	}
+}
+
+func TestHandlerCache(t *testing.T) {
+	defer func(rules []*CacheRule) { CONFIG.Cache = rules }(CONFIG.Cache)
+	CONFIG.Cache = []*CacheRule{{Command: "sh", TTL: Duration{time.Hour}}}
+	defer func() { cache = &resultCache{results: make(map[string]cachedResult)} }()
+
+	run := func(query string) (*fakeExecutor, *httptest.ResponseRecorder) {
+		e := &fakeExecutor{lines: []string{"exported"}}
+		setExecutor(t, e)
+		recorder := httptest.NewRecorder()
+		handler(recorder, httptest.NewRequest("POST", "/"+query, nil))
+		return e, recorder
+	}
+	e, first := run("")
+	if e.args == nil {
+		t.Fatal("first invocation didn't run")
+	}
+	e, second := run("")
+	if e.args != nil {
+		t.Error("second invocation ran instead of using the cached result")
+	}
+	if got, want := second.Header().Get("X-Cached-Job-Id"), first.Header().Get("X-Job-Id"); got != want {
+		t.Errorf("X-Cached-Job-Id = %q, want %q", got, want)
+	}
+	if !strings.Contains(second.Body.String(), "[Cached result of run") {
+		t.Errorf("body = %q, want the cached result", second.Body.String())
+	}
+	if e, _ := run("?canFail=true"); e.args == nil {
+		t.Error("invocation with other options used the cached result")
+	}
+	if resultCacheKey(&Tenant{Name: "a"}, "sh", nil, "") == resultCacheKey(&Tenant{Name: "b"}, "sh", nil, "") {
+		t.Error("tenants share the cache key of a run")
+	}
+}
+
+func TestHandlerCacheCheckpoint(t *testing.T) {
+	defer func(rules []*CacheRule) { CONFIG.Cache = rules }(CONFIG.Cache)
+	CONFIG.Cache = []*CacheRule{{Command: "sh", TTL: Duration{time.Hour}}}
+	defer func() { cache = &resultCache{results: make(map[string]cachedResult)} }()
+	defer func(file string, topic string, margin time.Duration) {
+		CHECKPOINT_FILE, CHECKPOINT_TOPIC, CHECKPOINT_MARGIN = file, topic, margin
+	}(CHECKPOINT_FILE, CHECKPOINT_TOPIC, CHECKPOINT_MARGIN)
+	CHECKPOINT_FILE = filepath.Join(t.TempDir(), "state")
+	CHECKPOINT_TOPIC, CHECKPOINT_MARGIN = "projects/p/topics/continue", 200*time.Millisecond
+	var published struct {
+		Messages []struct {
+			Data       []byte            `json:"data"`
+			Attributes map[string]string `json:"attributes"`
+		} `json:"messages"`
+	}
+	setTransport(t, fakeAPI(func(r *http.Request) (int, string) {
+		json.NewDecoder(r.Body).Decode(&published)
+		return http.StatusOK, `{"messageIds":["7"]}`
+	}))
+
+	// the first run is checkpointed and its partial result isn't cached
+	setExecutor(t, &fakeExecutor{block: true, checkpoint: []byte("state")})
+	request := httptest.NewRequest("POST", "/", strings.NewReader(`{"message":{"data":"aGVsbG8=","messageId":"1"},"subscription":"projects/p/subscriptions/s"}`))
+	request.Header.Set("X-Command-Timeout", "300ms")
+	handler(httptest.NewRecorder(), request)
+	if len(published.Messages) != 1 || len(cache.results) != 0 {
+		t.Fatalf("published %+v, cached %d results, want the continuation and no cached result", published, len(cache.results))
+	}
+
+	// the continuation resumes instead of being answered from the cache
+	e := &fakeExecutor{}
+	setExecutor(t, e)
+	message, _ := json.Marshal(map[string]interface{}{
+		"message":      map[string]interface{}{"data": published.Messages[0].Data, "attributes": published.Messages[0].Attributes, "messageId": "7"},
+		"subscription": "projects/p/subscriptions/s",
+	})
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("POST", "/", bytes.NewReader(message)))
+	if recorder.Code != http.StatusOK || !strings.Contains(strings.Join(e.env, "\n"), "RESUME_FROM_CHECKPOINT=1") {
+		t.Errorf("status = %d, env %q, want the continuation to resume", recorder.Code, e.env)
+	}
+	if len(cache.results) != 0 {
+		t.Errorf("cached %d results, want continuations not to be cached", len(cache.results))
+	}
+}
+
+func TestHandlerLargeArgs(t *testing.T) {
+	defer func(args []string) {
+		os.Args = args
+		TEMPLATE_ARGS = false
+		SPILL_ARG_BYTES = 0
+	}(os.Args)
+	os.Args = []string{os.Args[0], "cat", "{{.Body.data}}"}
+	TEMPLATE_ARGS = true
+	payload := `{"data":"` + strings.Repeat("x", 8<<20) + `"}`
+
+	setExecutor(t, &fakeExecutor{})
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("POST", "/", strings.NewReader(payload)))
+	if recorder.Code != http.StatusRequestEntityTooLarge || !strings.Contains(recorder.Body.String(), "over the limit") {
+		t.Errorf("status = %d, body %q, want 413", recorder.Code, recorder.Body.String())
+	}
+
+	SPILL_ARG_BYTES = 1024
+	e := &fakeExecutor{}
+	setExecutor(t, e)
+	recorder = httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("POST", "/", strings.NewReader(payload)))
+	if recorder.Code != http.StatusOK || len(e.args) != 1 || !strings.HasPrefix(filepath.Base(e.args[0]), "arg-") {
+		t.Fatalf("status = %d, args %.100q, want a file", recorder.Code, e.args)
+	}
+	if _, err := os.Stat(e.args[0]); !os.IsNotExist(err) {
+		t.Errorf("spilled argument %s not removed: %v", e.args[0], err)
+	}
+}
+
+func TestFindCoreDump(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Now().Add(-time.Minute)
+	for name, modTime := range map[string]time.Time{
+		"core.1":   start.Add(-time.Minute),
+		"core.2":   start.Add(time.Second),
+		"core.3":   start.Add(2 * time.Second),
+		"corefile": start.Add(3 * time.Second),
+	} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte("core"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path, err := findCoreDump(dir, runner.Result{StartTime: start})
+	if err != nil || filepath.Base(path) != "core.3" {
+		t.Errorf("findCoreDump() = %s, %v, want core.3", path, err)
+	}
+	if _, err := findCoreDump(dir, runner.Result{StartTime: time.Now()}); err == nil {
+		t.Error("findCoreDump() found a core file older than the run")
+	}
+}
+
+func TestCallChain(t *testing.T) {
+	var received map[string]interface{}
+	var chainedFrom string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chainedFrom = r.Header.Get("X-Chained-From")
+		json.NewDecoder(r.Body).Decode(&received)
+		w.Header().Set("Trailer", "X-Command-Status")
+		fmt.Fprintln(w, "running")
+		w.Header().Set("X-Command-Status", r.URL.Query().Get("status"))
+	}))
+	defer server.Close()
+	defer func() {
+		CHAIN_URL = ""
+		CHAIN_AUDIENCE = ""
+	}()
+	CHAIN_URL = server.URL + "?status=200"
+	CHAIN_AUDIENCE = "none"
+
+	result := runner.Result{JobID: "job-1", Command: "export", Status: runner.StatusSucceeded}
+	if err := callChain(context.Background(), "http", result); err != nil {
+		t.Fatalf("callChain() = %v", err)
+	}
+	if chainedFrom != "job-1" || received["jobId"] != "job-1" || received["trigger"] != "http" {
+		t.Errorf("X-Chained-From %q, body %v, want the result of job-1", chainedFrom, received)
+	}
+
+	received = nil
+	result.Status = runner.StatusFailed
+	if err := callChain(context.Background(), "http", result); err != nil || received != nil {
+		t.Errorf("callChain() = %v, body %v for a failed run with CHAIN_ON=succeeded", err, received)
+	}
+
+	CHAIN_URL = server.URL + "?status=422"
+	result.Status = runner.StatusSucceeded
+	if err := callChain(context.Background(), "http", result); err == nil || !strings.Contains(err.Error(), "returned 422") {
+		t.Errorf("callChain() = %v, want the failure of the chained run", err)
+	}
+}
+
+func TestHandlerCallback(t *testing.T) {
+	var received map[string]interface{}
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		json.NewDecoder(r.Body).Decode(&received)
+	}))
+	defer server.Close()
+	defer func(prefixes []string) {
+		CALLBACK_URL_PREFIXES = prefixes
+		token.value = ""
+	}(CALLBACK_URL_PREFIXES)
+	token.value, token.expires = "token", time.Now().Add(time.Hour)
+
+	setExecutor(t, &fakeExecutor{})
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("POST", "/", strings.NewReader(`{"callbackUrl":"`+server.URL+`/callback"}`)))
+	if recorder.Code != http.StatusBadRequest || received != nil {
+		t.Errorf("status = %d, callback %v, want 400 for a callback URL that isn't allowed", recorder.Code, received)
+	}
+
+	CALLBACK_URL_PREFIXES = []string{server.URL + "/"}
+	recorder = httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("POST", "/", strings.NewReader(`{"callbackUrl":"`+server.URL+`/callback"}`)))
+	if recorder.Code != http.StatusOK || received["status"] != "succeeded" || authorization != "Bearer token" {
+		t.Errorf("status = %d, callback %v with %q, want the result", recorder.Code, received, authorization)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	write := func(config string) {
+		if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"schedules": [
+		{"name": "nightly", "schedule": "0 3 * * *"},
+		{"name": "weekly", "schedule": "0 3 * * 0"}
+	]}`)
+	defer func(path string, config *ConfigFile) {
+		CONFIG_FILE = path
+		CONFIG = config
+	}(CONFIG_FILE, CONFIG)
+	CONFIG_FILE = path
+	config, err := loadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	CONFIG = config
+	nightly := config.Schedules[0]
+
+	write(`{"schedules": [
+		{"name": "nightly", "schedule": "0 3 * * *"},
+		{"name": "hourly", "schedule": "0 * * * *"}
+	], "cache": [{"command": "sh", "ttl": "1h"}]}`)
+	recorder := httptest.NewRecorder()
+	reloadHandler(recorder, httptest.NewRequest("POST", reloadPath, nil))
+	want := "added schedule hourly\nremoved schedule weekly\nchanged cache\n"
+	if recorder.Code != http.StatusOK || recorder.Body.String() != want {
+		t.Errorf("status = %d, changes %q, want %q", recorder.Code, recorder.Body.String(), want)
+	}
+	if currentConfig().Schedules[0] != nightly || cacheTTL("sh") != time.Hour {
+		t.Errorf("reloaded config %+v, want the unchanged schedule kept and the cache rule", currentConfig())
+	}
+	select {
+	case <-config.Schedules[1].stopped:
+	default:
+		t.Errorf("removed schedule not stopped")
+	}
+
+	write(`{"schedules": [{"name": "nightly"}]}`)
+	recorder = httptest.NewRecorder()
+	reloadHandler(recorder, httptest.NewRequest("POST", reloadPath, nil))
+	if recorder.Code != http.StatusInternalServerError || cacheTTL("sh") != time.Hour {
+		t.Errorf("status = %d, want 500 and the previous config for an invalid file", recorder.Code)
+	}
+	for _, schedule := range currentConfig().Schedules {
+		schedule.stop()
+	}
+}
+
+func TestReloadWaitsForReplacedRuns(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	write := func(config string) {
+		if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"schedules": [{"name": "nightly", "schedule": "0 3 * * *"}],
+		"sidecars": [{"name": "proxy", "command": "proxy", "args": ["--port=5432"]}]}`)
+	defer func(path string, config *ConfigFile) {
+		CONFIG_FILE = path
+		CONFIG = config
+	}(CONFIG_FILE, CONFIG)
+	CONFIG_FILE = path
+	config, err := loadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	CONFIG = config
+	e := &fakeExecutor{block: true}
+	setExecutor(t, e)
+	// sidecars without a port are ready before their process has started
+	started := func(want int) bool {
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			e.mu.Lock()
+			n := len(e.calls)
+			e.mu.Unlock()
+			if n == want {
+				return true
+			}
+		}
+		return false
+	}
+
+	// the old schedule and sidecar are in use
+	nightly, proxy := config.Schedules[0], config.Sidecars[0]
+	nightly.running, nightly.idle = true, make(chan struct{})
+	if err := proxy.acquire(context.Background()); err != nil || !started(1) {
+		t.Fatalf("acquire() = %v, want the sidecar started", err)
+	}
+
+	write(`{"schedules": [{"name": "nightly", "schedule": "0 4 * * *"}],
+		"sidecars": [{"name": "proxy", "command": "proxy", "args": ["--port=5433"]}]}`)
+	changes, err := reloadConfig()
+	if err != nil || !reflect.DeepEqual(changes, []string{"changed schedule nightly", "changed sidecar proxy"}) {
+		t.Fatalf("reloadConfig() = %q, %v", changes, err)
+	}
+	schedule, sidecar := currentConfig().Schedules[0], currentConfig().Sidecars[0]
+	defer schedule.stop()
+	select {
+	case <-schedule.replaces.finished():
+		t.Error("the replacement schedule doesn't wait for the run of the old one")
+	default:
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := sidecar.acquire(ctx); err != context.DeadlineExceeded || !started(1) {
+		t.Errorf("acquire() = %v, want to wait for the old sidecar", err)
+	}
+
+	nightly.mu.Lock()
+	nightly.running = false
+	close(nightly.idle)
+	nightly.mu.Unlock()
+	select {
+	case <-schedule.replaces.finished():
+	case <-time.After(5 * time.Second):
+		t.Error("the replacement schedule still waits after the old run is over")
+	}
+	proxy.release()
+	if err := sidecar.acquire(context.Background()); err != nil || !started(2) {
+		t.Errorf("acquire() = %v, want the replacement started", err)
+	}
+	sidecar.release()
+}
+
+func TestJobStore(t *testing.T) {
+	setExecutor(t, &fakeExecutor{lines: []string{"hello", "world"}})
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("POST", "/", strings.NewReader("{}")))
+	jobID := recorder.Header().Get("X-Job-Id")
+
+	recorder = httptest.NewRecorder()
+	jobHandler(recorder, httptest.NewRequest("GET", jobsPath+jobID, nil))
+	var state JobState
+	json.NewDecoder(recorder.Body).Decode(&state)
+	if recorder.Code != http.StatusOK || state.Status != runner.StatusSucceeded || !reflect.DeepEqual(state.Output, []string{"hello", "world"}) {
+		t.Errorf("status = %d, state %+v, want the result and output of %s", recorder.Code, state, jobID)
+	}
+	recorder = httptest.NewRecorder()
+	jobHandler(recorder, httptest.NewRequest("GET", jobsPath+"unknown", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("status = %d for an unknown job, want 404", recorder.Code)
+	}
+}
+
+func TestJobStoreHiddenOutput(t *testing.T) {
+	defer func() { SHOW_OUTPUT = true }()
+	SHOW_OUTPUT = false
+	setExecutor(t, &fakeExecutor{lines: []string{"password=hunter2"}})
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("POST", "/", strings.NewReader("{}")))
+	jobID := recorder.Header().Get("X-Job-Id")
+
+	recorder = httptest.NewRecorder()
+	jobHandler(recorder, httptest.NewRequest("GET", jobsPath+jobID, nil))
+	var state JobState
+	json.NewDecoder(recorder.Body).Decode(&state)
+	if state.Status != runner.StatusSucceeded || len(state.Output) != 0 {
+		t.Errorf("state %+v, want the result without the output that isn't shown", state)
+	}
+}
+
+func TestJobStoreProgress(t *testing.T) {
+	defer func(progressRegex *regexp.Regexp) { PROGRESS_REGEX = progressRegex }(PROGRESS_REGEX)
+	PROGRESS_REGEX = regexp.MustCompile(`(\d+)%`)
+	setExecutor(t, &fakeExecutor{lines: []string{"10% done", "55% done", "finishing"}})
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("POST", "/", strings.NewReader("{}")))
+	jobID := recorder.Header().Get("X-Job-Id")
+
+	recorder = httptest.NewRecorder()
+	jobHandler(recorder, httptest.NewRequest("GET", jobsPath+jobID, nil))
+	var state JobState
+	json.NewDecoder(recorder.Body).Decode(&state)
+	if state.Progress == nil || *state.Progress != 55 {
+		t.Errorf("progress = %v, want 55", state.Progress)
+	}
+}
+
+func TestRedisJobStore(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	values := make(map[string]string)
+	var mu sync.Mutex
+	var commands []string
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			reader := bufio.NewReader(conn)
+			for {
+				var n int
+				if _, err := fmt.Fscanf(reader, "*%d\r\n", &n); err != nil {
+					break
+				}
+				args := make([]string, n)
+				for i := range args {
+					var size int
+					fmt.Fscanf(reader, "$%d\r\n", &size)
+					data := make([]byte, size+2)
+					io.ReadFull(reader, data)
+					args[i] = string(data[:size])
+				}
+				mu.Lock()
+				commands = append(commands, args[0])
+				mu.Unlock()
+				switch args[0] {
+				case "SET":
+					values[args[1]] = args[2]
+					fmt.Fprint(conn, "+OK\r\n")
+				case "GET":
+					if value, ok := values[args[1]]; ok {
+						fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(value), value)
+					} else {
+						fmt.Fprint(conn, "$-1\r\n")
+					}
+				default:
+					fmt.Fprint(conn, "+OK\r\n")
+				}
+			}
+			conn.Close()
+		}
+	}()
+
+	store, err := newJobStore("redis://:pw@" + listener.Addr().String() + "/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := store.Put(ctx, &JobState{JobID: "job-1", Status: JobStatusRunning}); err != nil {
+		t.Fatalf("Put() = %v", err)
+	}
+	state, err := store.Get(ctx, "job-1")
+	if err != nil || state == nil || state.Status != JobStatusRunning {
+		t.Errorf("Get() = %+v, %v, want the stored state", state, err)
+	}
+	if state, err := store.Get(ctx, "job-2"); state != nil || err != nil {
+		t.Errorf("Get() = %+v, %v for an unknown job, want nil", state, err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := "AUTH SELECT SET AUTH SELECT GET AUTH SELECT GET"; strings.Join(commands, " ") != want {
+		t.Errorf("commands %q, want %q", commands, want)
+	}
+}
+
+func TestLineExtractors(t *testing.T) {
+	extractors := []*LineExtractor{
+		{Command: "sh", Regex: `^(?P<level>[A-Z]+) \[(?P<component>\w+)\]`},
+		{Regex: `(?P<records>[\d,]+) records`, Numbers: []string{"records"}},
+		{Command: "other", Regex: `(?P<other>.+)`},
+	}
+	for _, extractor := range extractors {
+		if err := extractor.parse(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func(extractors []*LineExtractor) { CONFIG.Extractors = extractors }(CONFIG.Extractors)
+	CONFIG.Extractors = extractors
+
+	setExecutor(t, &fakeExecutor{lines: []string{"WARN [loader] skipped 1,200 records", "done"}})
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("POST", "/", strings.NewReader("{}"))
+	request.Header.Set("Accept", "application/x-ndjson")
+	handler(recorder, request)
+	var events []map[string]interface{}
+	decoder := json.NewDecoder(recorder.Body)
+	for {
+		var event map[string]interface{}
+		if decoder.Decode(&event) != nil {
+			break
+		}
+		events = append(events, event)
+	}
+	want := map[string]interface{}{"level": "WARN", "component": "loader", "records": float64(1200)}
+	found := false
+	for _, event := range events {
+		switch event["line"] {
+		case "WARN [loader] skipped 1,200 records":
+			found = true
+			if !reflect.DeepEqual(event["fields"], want) {
+				t.Errorf("fields = %v, want %v", event["fields"], want)
+			}
+		case "done":
+			if event["fields"] != nil {
+				t.Errorf("fields = %v for a line that no extractor matches", event["fields"])
+			}
+		}
+	}
+	if !found {
+		t.Errorf("events %v, want the output line", events)
+	}
+	if logSeverity("warn") != "WARNING" || logSeverity("verbose") != "" {
+		t.Errorf("logSeverity() doesn't map the levels")
+	}
+}
+
+func TestRunManifest(t *testing.T) {
+	input := filepath.Join(t.TempDir(), "input.csv")
+	if err := ioutil.WriteFile(input, []byte("a,b\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	setExecutor(t, &fakeExecutor{lines: []string{"tool 1.2.3", "(c) someone"}})
+	command := newCommand(nil, "/bin/tool", "--password", "hunter2", input)
+	command.JobID = "job-1"
+	command.Env = []string{"DELIVERY_ATTEMPT=2"}
+	manifest := newRunManifest(context.Background(), "http", command, []string{input})
+	manifest.finish(context.Background(), runner.Result{Status: runner.StatusSucceeded, Duration: time.Second}, nil)
+
+	if manifest.Version != "tool 1.2.3" {
+		t.Errorf("version = %q, want the first line of --version", manifest.Version)
+	}
+	if !reflect.DeepEqual(manifest.Args, []string{"--password", "[REDACTED]", input}) {
+		t.Errorf("args = %q, want the secret redacted", manifest.Args)
+	}
+	if i := sort.SearchStrings(manifest.Env, "DELIVERY_ATTEMPT"); i == len(manifest.Env) || manifest.Env[i] != "DELIVERY_ATTEMPT" {
+		t.Errorf("env = %q, want DELIVERY_ATTEMPT", manifest.Env)
+	}
+	sum := sha256.Sum256([]byte("a,b\n"))
+	want := []ManifestArtifact{{URI: input, Size: 4, SHA256: hex.EncodeToString(sum[:])}}
+	if !reflect.DeepEqual(manifest.Inputs, want) {
+		t.Errorf("inputs = %+v, want %+v", manifest.Inputs, want)
+	}
+	if manifest.Status != runner.StatusSucceeded || manifest.DurationSeconds != 1 {
+		t.Errorf("manifest %+v, want the result", manifest)
+	}
+}
+
+func TestCommandVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tool")
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\necho tool 1.0\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if version := commandVersion(context.Background(), path); version != "tool 1.0" {
+		t.Fatalf("commandVersion() = %q", version)
+	}
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\necho tool 1.10\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if version := commandVersion(context.Background(), path); version != "tool 1.10" {
+		t.Errorf("commandVersion() = %q after replacing the executable, want tool 1.10", version)
+	}
+}
+
+func TestTenants(t *testing.T) {
+	tenants := []*Tenant{
+		{Name: "a", Tokens: []string{"token-a"}, Command: "sh", Args: []string{"-c", "tenant-a"}, RateLimit: "1/h"},
+		{Name: "b", Callers: []string{"b@example.com"}},
+	}
+	for _, tenant := range tenants {
+		if err := tenant.parse(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func(tenants []*Tenant) { CONFIG.Tenants = tenants }(CONFIG.Tenants)
+	CONFIG.Tenants = tenants
+
+	tests := []struct {
+		name   string
+		path   string
+		token  string
+		status int
+		args   []string
+	}{
+		{"no tenant", "/", "", http.StatusForbidden, nil},
+		{"token", "/", "token-a", http.StatusOK, []string{"-c", "tenant-a"}},
+		{"rate limit", "/", "token-a", http.StatusTooManyRequests, nil},
+		{"other tenant", "/tenants/b", "token-a", http.StatusForbidden, nil},
+		{"unknown tenant", "/tenants/c", "token-a", http.StatusForbidden, nil},
+	}
+	for _, test := range tests {
+		e := &fakeExecutor{}
+		setExecutor(t, e)
+		request := httptest.NewRequest("POST", test.path, strings.NewReader("{}"))
+		if test.token != "" {
+			request.Header.Set("X-Api-Key", test.token)
+		}
+		recorder := httptest.NewRecorder()
+		handler(recorder, request)
+		if recorder.Code != test.status || !reflect.DeepEqual(e.args, test.args) {
+			t.Errorf("%s: status = %d, args %q, want %d and %q", test.name, recorder.Code, e.args, test.status, test.args)
+		}
+	}
+
+	if err := tenants[1].checkURI("gs://bucket/b/input"); err != nil {
+		t.Errorf("checkURI() = %v without a prefix", err)
+	}
+	tenants[1].GCSPrefix = "gs://bucket/b/"
+	if err := tenants[1].checkURI("gs://bucket/a/input"); err == nil {
+		t.Errorf("checkURI() = nil for an object of another tenant")
+	}
+}
+
+func TestVerifyExecutable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tool.sh")
+	script := []byte("#!/bin/sh\necho 1.0\n")
+	if err := ioutil.WriteFile(path, script, 0755); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(script)
+	pin := &CommandPin{Command: path, SHA256: strings.ToUpper(hex.EncodeToString(sum[:]))}
+	if err := pin.parse(); err != nil {
+		t.Fatal(err)
+	}
+	defer func(pins []*CommandPin) { CONFIG.Pins = pins }(CONFIG.Pins)
+	CONFIG.Pins = []*CommandPin{pin}
+
+	if err := verifyExecutable(path); err != nil {
+		t.Errorf("verifyExecutable() = %v for the pinned executable", err)
+	}
+	if err := verifyExecutable("sh"); err != nil {
+		t.Errorf("verifyExecutable() = %v for an executable without a pin", err)
+	}
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\necho 2.0\nexit 1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyExecutable(path); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("verifyExecutable() = %v for a changed executable", err)
+	}
+
+	// a change of the same size, with the modification time set back
+	ioutil.WriteFile(path, script, 0755)
+	if err := verifyExecutable(path); err != nil {
+		t.Fatalf("verifyExecutable() = %v for the restored executable", err)
+	}
+	info, _ := os.Stat(path)
+	ioutil.WriteFile(path, []byte("#!/bin/sh\necho 6.6\n"), 0755)
+	os.Chtimes(path, info.ModTime(), info.ModTime())
+	if err := verifyExecutable(path); err == nil {
+		t.Errorf("verifyExecutable() = nil for an executable changed in place")
+	}
+	if err := (&CommandPin{Command: "sh", SHA256: "abc"}).parse(); err == nil {
+		t.Errorf("parse() = nil for an invalid sha256")
+	}
+}
+
+func TestExpectRules(t *testing.T) {
+	for _, rule := range []*ExpectRule{
+		{Prompt: "("},
+		{Prompt: ".*", Response: "y"},
+		{Prompt: `\?`, Response: "y", Secret: "projects/p/secrets/s"},
+		{Prompt: `\?`, Secret: "secrets/s"},
+	} {
+		if err := rule.parse(); err == nil {
+			t.Errorf("parse() = nil for %+v", rule)
+		}
+	}
+	secret := &ExpectRule{Prompt: "Passphrase:", Secret: "projects/p/secrets/s"}
+	if err := secret.parse(); err != nil || secret.Secret != "projects/p/secrets/s/versions/latest" {
+		t.Errorf("parse() = %v, secret %s", err, secret.Secret)
+	}
+
+	rule := &ExpectRule{Command: "sh", Prompt: `\[y/N\]`, Response: "y", Times: 1}
+	if err := rule.parse(); err != nil {
+		t.Fatal(err)
+	}
+	defer func(rules []*ExpectRule) { CONFIG.Expect = rules }(CONFIG.Expect)
+	CONFIG.Expect = []*ExpectRule{rule}
+	expect, err := expectations(context.Background(), "/bin/sh")
+	if err != nil || len(expect) != 1 || expect[0].Response != "y" || expect[0].Times != 1 {
+		t.Errorf("expectations() = %+v, %v", expect, err)
+	}
+
+	e := &fakeExecutor{}
+	setExecutor(t, e)
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("POST", "/", strings.NewReader("{}")))
+	if _, ok := e.stdin.(*os.File); recorder.Code != http.StatusOK || !ok {
+		t.Errorf("status = %d, stdin %#v, want the pipe of the answers", recorder.Code, e.stdin)
+	}
+	recorder = httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("POST", "/?stdin=gs://bucket/input", strings.NewReader("{}")))
+	if recorder.Code != http.StatusBadRequest || !strings.Contains(recorder.Body.String(), "expect rules") {
+		t.Errorf("status = %d with stdin, want 400", recorder.Code)
+	}
+}
+
+func TestRunWindows(t *testing.T) {
+	blackout := &RunWindow{Name: "office hours", Start: "08:00", End: "20:00", TimeZone: "Europe/Helsinki", Blackout: true}
+	nights := &RunWindow{Command: "sh", Start: "22:00", End: "06:00", Days: []string{"mon", "tue", "wed", "thu", "fri"}, TimeZone: "Europe/Helsinki"}
+	for _, window := range []*RunWindow{blackout, nights} {
+		if err := window.parse(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, window := range []*RunWindow{
+		{Start: "8:00", End: "25:00"},
+		{Start: "08:00", End: "08:00"},
+		{Start: "08:00", End: "20:00", Days: []string{"someday"}},
+		{Start: "08:00", End: "20:00", Action: "ignore"},
+	} {
+		if err := window.parse(); err == nil {
+			t.Errorf("parse() = nil for %+v", window)
+		}
+	}
+	helsinki, _ := time.LoadLocation("Europe/Helsinki")
+	at := func(day, hour, minute int) time.Time {
+		// 2024-06-03 is a Monday
+		return time.Date(2024, 6, day, hour, minute, 0, 0, helsinki)
+	}
+	tests := []struct {
+		name    string
+		windows []*RunWindow
+		t       time.Time
+		closed  *RunWindow
+		opens   time.Time
+	}{
+		{"before the blackout", []*RunWindow{blackout}, at(3, 7, 59), nil, time.Time{}},
+		{"in the blackout", []*RunWindow{blackout}, at(3, 12, 0), blackout, at(3, 20, 0)},
+		{"friday night", []*RunWindow{nights}, at(8, 1, 0), nil, time.Time{}},
+		{"saturday", []*RunWindow{nights}, at(8, 12, 0), nights, at(10, 22, 0)},
+		{"both", []*RunWindow{blackout, nights}, at(4, 21, 0), nights, at(4, 22, 0)},
+	}
+	for _, test := range tests {
+		closed := closedBy(test.windows, test.t)
+		if closed != test.closed {
+			t.Errorf("%s: closedBy() = %v, want %v", test.name, closed, test.closed)
+		}
+		if closed == nil {
+			continue
+		}
+		if opens := nextOpening(test.windows, test.t); !opens.Equal(test.opens) {
+			t.Errorf("%s: nextOpening() = %s, want %s", test.name, opens, test.opens)
+		}
+	}
+
+	defer func(windows []*RunWindow) { CONFIG.Windows = windows }(CONFIG.Windows)
+	CONFIG.Windows = []*RunWindow{{Start: "00:00", End: "23:59", Blackout: true}}
+	if err := CONFIG.Windows[0].parse(); err != nil {
+		t.Fatal(err)
+	}
+	if time.Now().UTC().Format("15:04") == "23:59" {
+		t.Skip("the blackout is just over")
+	}
+	e := &fakeExecutor{}
+	setExecutor(t, e)
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("POST", "/", strings.NewReader("{}")))
+	if recorder.Code != http.StatusServiceUnavailable || recorder.Header().Get("Retry-After") == "" || e.args != nil {
+		t.Errorf("status = %d, Retry-After %q, want 503 in the blackout", recorder.Code, recorder.Header().Get("Retry-After"))
+	}
+}
+
+// setOIDCKeys serves the key that verifies the OIDC tokens signed by
+// signIDToken with it.
+func setOIDCKeys(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kid": "key-1",
+			"kty": "RSA",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	}))
+	url := googleCertsURL
+	t.Cleanup(func() {
+		server.Close()
+		googleCertsURL, oidcKeys = url, &keyCache{}
+	})
+	googleCertsURL, oidcKeys = server.URL, &keyCache{}
+	return key
+}
+
+func signIDToken(t *testing.T, claims string, signer *rsa.PrivateKey) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","kid":"key-1"}`)) + "." + base64.RawURLEncoding.EncodeToString([]byte(claims))
+	hash := sha256.Sum256([]byte(payload))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, signer, crypto.SHA256, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestVerifiedCaller(t *testing.T) {
+	key := setOIDCKeys(t)
+	now := time.Now()
+	sign := func(claims string, signer *rsa.PrivateKey) string {
+		return signIDToken(t, claims, signer)
+	}
+	claims := func(aud string, exp time.Time) string {
+		return fmt.Sprintf(`{"iss":"https://accounts.google.com","aud":%q,"exp":%d,"email":"b@example.com","email_verified":true}`, aud, exp.Unix())
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		header string
+		token  string
+		want   string
+	}{
+		{"valid", "Authorization", sign(claims("https://run.example.com", now.Add(time.Hour)), key), "b@example.com"},
+		{"push endpoint", "X-Serverless-Authorization", sign(claims("https://run.example.com/push", now.Add(time.Hour)), key), "b@example.com"},
+		{"forged", "Authorization", sign(claims("https://run.example.com", now.Add(time.Hour)), other), ""},
+		{"unsigned", "Authorization", strings.Join(strings.Split(sign(claims("https://run.example.com", now.Add(time.Hour)), key), ".")[:2], ".") + ".", ""},
+		{"expired", "Authorization", sign(claims("https://run.example.com", now.Add(-time.Minute)), key), ""},
+		{"other audience", "Authorization", sign(claims("https://run.example.com.evil", now.Add(time.Hour)), key), ""},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest("POST", "https://run.example.com/", nil)
+		request.Header.Set(test.header, "Bearer "+test.token)
+		if caller := verifiedCaller(request, now); caller != test.want {
+			t.Errorf("%s: verifiedCaller() = %q, want %q", test.name, caller, test.want)
+		}
+	}
+
+	// Cloud Run verifies X-Serverless-Authorization and passes Authorization
+	// through
+	request := httptest.NewRequest("POST", "https://run.example.com/", nil)
+	request.Header.Set("X-Serverless-Authorization", "Bearer "+sign(claims("https://run.example.com", now.Add(time.Hour)), other))
+	request.Header.Set("Authorization", "Bearer "+sign(claims("https://run.example.com", now.Add(time.Hour)), key))
+	if caller := verifiedCaller(request, now); caller != "" {
+		t.Errorf("verifiedCaller() = %q with a forged X-Serverless-Authorization", caller)
+	}
+}
+
+func TestTenantRoutes(t *testing.T) {
+	tenants := []*Tenant{{Name: "a", Tokens: []string{"token-a"}}, {Name: "b", Tokens: []string{"token-b"}}}
+	for _, tenant := range tenants {
+		if err := tenant.parse(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func(tenants []*Tenant) { CONFIG.Tenants = tenants }(CONFIG.Tenants)
+	CONFIG.Tenants = tenants
+	AUTH_TOKEN = []string{"s3cret"}
+	defer func() { AUTH_TOKEN = nil }()
+	if err := jobStore.Put(context.Background(), &JobState{JobID: "job-of-b", Tenant: "b", Updated: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	tests := []struct {
+		name    string
+		path    string
+		handler http.HandlerFunc
+		token   string
+		status  int
+	}{
+		{"reload", reloadPath, ok, "token-a", http.StatusUnauthorized},
+		{"debug", "/debug/pprof/", ok, "token-a", http.StatusUnauthorized},
+		{"reload as admin", reloadPath, ok, "s3cret", http.StatusOK},
+		{"job of another tenant", jobsPath, jobHandler, "token-a", http.StatusNotFound},
+		{"own job", jobsPath, jobHandler, "token-b", http.StatusOK},
+		{"job as admin", jobsPath, jobHandler, "s3cret", http.StatusOK},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest("GET", test.path, nil)
+		if test.path == jobsPath {
+			request = httptest.NewRequest("GET", jobsPath+"job-of-b", nil)
+		}
+		request.Header.Set("X-Api-Key", test.token)
+		recorder := httptest.NewRecorder()
+		withAuth(test.path, test.handler)(recorder, request)
+		if recorder.Code != test.status {
+			t.Errorf("%s: status = %d, want %d", test.name, recorder.Code, test.status)
+		}
+	}
+
+	tenants[0].GCSPrefix = "gs://bucket/a/"
+	e := &fakeExecutor{}
+	setExecutor(t, e)
+	request := httptest.NewRequest("POST", "/?stdin=gs://bucket/b/input", strings.NewReader("{}"))
+	request.Header.Set("X-Api-Key", "token-a")
+	recorder := httptest.NewRecorder()
+	handler(recorder, request)
+	if recorder.Code != http.StatusForbidden || e.args != nil {
+		t.Errorf("status = %d, want 403 for the stdin of another tenant", recorder.Code)
+	}
+}
+
+func TestUnwrapContinuation(t *testing.T) {
+	defer func(file string) { CHECKPOINT_FILE = file }(CHECKPOINT_FILE)
+	CHECKPOINT_FILE = "checkpoint"
+	var m PubSubMessage
+	m.Message.Data = []byte(`{"data":"eyJqb2JzIjpbXX0=","checkpoint":"c3RhdGU="}`)
+	m.Message.Attributes = map[string]string{checkpointAttribute: "true", continuationAttribute: "2", "region": "eu"}
+	resume, err := unwrapContinuation(&m)
+	if err != nil {
+		t.Fatalf("unwrapContinuation() = %v", err)
+	}
+	if string(resume) != "state" || string(m.Message.Data) != `{"jobs":[]}` {
+		t.Errorf("checkpoint = %q, data = %q, want the checkpoint and the original data", resume, m.Message.Data)
+	}
+	checkpoint := newCheckpoint(&m, resume)
+	if checkpoint.Continuation != 2 || string(checkpoint.Resume) != "state" {
+		t.Errorf("checkpoint = %+v, want continuation 2 resuming from the state", checkpoint)
+	}
+
+	m.Message.Attributes = nil
+	if resume, err := unwrapContinuation(&m); resume != nil || err != nil {
+		t.Errorf("unwrapContinuation() = %q, %v for a message that isn't a continuation", resume, err)
+	}
+}
+
+func TestLockKey(t *testing.T) {
+	defer func(key string) { LOCK_KEY = key }(LOCK_KEY)
+	LOCK_KEY = ""
+	if key := lockKey("/usr/bin/backup"); key != "backup" {
+		t.Errorf("lockKey() = %q, want the name of the command", key)
+	}
+	LOCK_KEY = "nightly"
+	if key := lockKey("/usr/bin/backup"); key != "nightly" {
+		t.Errorf("lockKey() = %q, want LOCK_KEY", key)
+	}
+}
+
+// fakeStorage answers the Cloud Storage requests of the lock from memory.
+type fakeStorage struct {
+	mu         sync.Mutex
+	objects    map[string][]byte
+	generation map[string]int64
+}
+
+func (s *fakeStorage) RoundTrip(r *http.Request) (*http.Response, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	recorder := httptest.NewRecorder()
+	query := r.URL.Query()
+	name := query.Get("name")
+	if i := strings.Index(r.URL.Path, "/o/"); i >= 0 {
+		name = r.URL.Path[i+3:]
+	}
+	match, matched := int64(-1), query.Get("ifGenerationMatch") != ""
+	if matched {
+		match, _ = strconv.ParseInt(query.Get("ifGenerationMatch"), 10, 64)
+	}
+	_, exists := s.objects[name]
+	current := int64(0)
+	if exists {
+		current = s.generation[name]
+	}
+	switch {
+	case matched && match != current:
+		recorder.WriteHeader(http.StatusPreconditionFailed)
+	case r.Method == "POST":
+		s.objects[name], _ = ioutil.ReadAll(r.Body)
+		s.generation[name]++
+		json.NewEncoder(recorder).Encode(storageObject{Name: name, Generation: strconv.FormatInt(s.generation[name], 10)})
+	case !exists:
+		recorder.WriteHeader(http.StatusNotFound)
+	case r.Method == "DELETE":
+		delete(s.objects, name)
+	case query.Get("alt") == "media":
+		recorder.Write(s.objects[name])
+	default:
+		json.NewEncoder(recorder).Encode(storageObject{Name: name, Generation: strconv.FormatInt(s.generation[name], 10)})
+	}
+	return recorder.Result(), nil
+}
+
+func setFakeStorage(t *testing.T) *fakeStorage {
+	storage := &fakeStorage{objects: map[string][]byte{}, generation: map[string]int64{}}
+	setTransport(t, storage)
+	return storage
+}
+
+// fakeAPI answers the requests to Google Cloud APIs with a status and body.
+type fakeAPI func(r *http.Request) (int, string)
+
+func (f fakeAPI) RoundTrip(r *http.Request) (*http.Response, error) {
+	status, body := f(r)
+	recorder := httptest.NewRecorder()
+	recorder.WriteHeader(status)
+	recorder.WriteString(body)
+	return recorder.Result(), nil
+}
+
+// setTransport sends the requests to Google Cloud APIs to transport, with
+// an access token that doesn't need the metadata server.
+func setTransport(t *testing.T, transport http.RoundTripper) {
+	previous := apiClient.Transport
+	apiClient.Transport = transport
+	token.value, token.expires = "token", time.Now().Add(time.Hour)
+	t.Cleanup(func() {
+		apiClient.Transport = previous
+		token.value = ""
+	})
+}
+
+func TestLock(t *testing.T) {
+	storage := setFakeStorage(t)
+	ctx := context.Background()
+	first, second := NewLock("locks", "backup"), NewLock("locks", "backup")
+	if acquired, _, err := first.TryAcquire(ctx, time.Hour); err != nil || !acquired {
+		t.Fatalf("TryAcquire() = %v, %v, want the free lock", acquired, err)
+	}
+	if acquired, holder, err := second.TryAcquire(ctx, time.Hour); err != nil || acquired || !strings.HasPrefix(holder, lockHolder()+" since ") {
+		t.Errorf("TryAcquire() = %v, %q, %v, want the lock to be held by the first", acquired, holder, err)
+	}
+	if err := first.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if acquired, _, err := second.TryAcquire(ctx, -time.Second); err != nil || !acquired {
+		t.Errorf("TryAcquire() = %v, %v, want the released lock", acquired, err)
+	}
+
+	// the second holder died without releasing the lock, which has expired
+	if acquired, _, err := first.TryAcquire(ctx, time.Hour); err != nil || !acquired {
+		t.Errorf("TryAcquire() = %v, %v, want the expired lock", acquired, err)
+	}
+	if err := second.Release(ctx); err != nil || storage.objects["locks/backup.lock"] == nil {
+		t.Errorf("Release() = %v, want the lock taken over by another holder to be kept", err)
+	}
+}
+
+func TestHandlerLock(t *testing.T) {
+	storage := setFakeStorage(t)
+	defer func(bucket string, mode string) { LOCK_BUCKET, LOCK_MODE = bucket, mode }(LOCK_BUCKET, LOCK_MODE)
+	LOCK_BUCKET, LOCK_MODE = "locks", "reject"
+	e := &fakeExecutor{blocking: map[string]bool{"-c": true}}
+	setExecutor(t, e)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler(httptest.NewRecorder(), httptest.NewRequest("POST", "/", nil).WithContext(ctx))
+	}()
+	for started := 0; started == 0; time.Sleep(10 * time.Millisecond) {
+		e.mu.Lock()
+		started = len(e.calls)
+		e.mu.Unlock()
+	}
+	second := httptest.NewRecorder()
+	handler(second, httptest.NewRequest("POST", "/", nil))
+	if second.Code != http.StatusConflict {
+		t.Errorf("status = %d, want 409 while the command runs", second.Code)
+	}
+	cancel()
+	<-done
+	if lock := storage.objects["locks/sh.lock"]; lock != nil {
+		t.Errorf("lock %s, want it to be released after the run", lock)
+	}
+}
+
+// fakeRun answers the Cloud Run Admin API for a job whose executions
+// complete once finished is set, and the Cloud Storage API with storage.
+type fakeRun struct {
+	storage *fakeStorage
+
+	mu       sync.Mutex
+	run      map[string]interface{}
+	finished bool
+}
+
+func (f *fakeRun) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.URL.Host != "run.googleapis.com" {
+		return f.storage.RoundTrip(r)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	recorder := httptest.NewRecorder()
+	switch {
+	case strings.Contains(r.URL.Path, "/services/"):
+		recorder.WriteString(`{"template":{"containers":[{"image":"gcr.io/p/runner"}]}}`)
+	case strings.HasSuffix(r.URL.Path, ":run"):
+		json.NewDecoder(r.Body).Decode(&f.run)
+		recorder.WriteString(`{"name":"operations/2","done":true,"metadata":{"name":"projects/p/locations/r/jobs/backup/executions/backup-1"}}`)
+	case strings.Contains(r.URL.Path, "/executions/"):
+		execution := runExecution{Name: "projects/p/locations/r/jobs/backup/executions/backup-1", TaskCount: 1, RunningCount: 1}
+		if f.finished {
+			execution.RunningCount, execution.SucceededCount, execution.CompletionTime = 0, 1, time.Now().Format(time.RFC3339)
+		}
+		json.NewEncoder(recorder).Encode(execution)
+	default:
+		recorder.WriteString(`{"name":"operations/1","done":true}`)
+	}
+	return recorder.Result(), nil
+}
+
+func (f *fakeRun) finish() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.finished = true
+}
+
+func setFakeRun(t *testing.T) *fakeRun {
+	f := &fakeRun{storage: &fakeStorage{objects: map[string][]byte{}, generation: map[string]int64{}}}
+	setTransport(t, f)
+	job, project, region, poll, maxPoll := HANDOFF_TO_JOB, GOOGLE_CLOUD_PROJECT, GOOGLE_CLOUD_REGION, POLL_TIME, MAX_POLL_TIME
+	t.Cleanup(func() {
+		HANDOFF_TO_JOB, GOOGLE_CLOUD_PROJECT, GOOGLE_CLOUD_REGION, POLL_TIME, MAX_POLL_TIME = job, project, region, poll, maxPoll
+	})
+	HANDOFF_TO_JOB, GOOGLE_CLOUD_PROJECT, GOOGLE_CLOUD_REGION = "backup", "p", "r"
+	POLL_TIME, MAX_POLL_TIME = 10*time.Millisecond, 10*time.Millisecond
+	return f
+}
+
+func TestHandlerHandoffOptions(t *testing.T) {
+	f := setFakeRun(t)
+	f.finish()
+	defer func(uri string) { STDIN_GCS_URI, TEMPLATE_ARGS = uri, false }(STDIN_GCS_URI)
+	STDIN_GCS_URI, TEMPLATE_ARGS = "gs://inputs/{{.Job}}.sql", true
+	request := httptest.NewRequest("POST", "/?canFail=true", nil)
+	request.Header.Set("X-CloudScheduler-JobName", "nightly")
+	recorder := httptest.NewRecorder()
+	handler(recorder, request)
+	if !strings.Contains(recorder.Body.String(), "Job execution completed") {
+		t.Fatalf("body = %q, want the execution to complete", recorder.Body)
+	}
+	env := f.run["overrides"].(map[string]interface{})["containerOverrides"].([]interface{})[0].(map[string]interface{})["env"].([]interface{})
+	var options CommandOptions
+	for _, v := range env {
+		if v.(map[string]interface{})["name"] == "JOB_OPTIONS" {
+			json.Unmarshal([]byte(v.(map[string]interface{})["value"].(string)), &options)
+		}
+	}
+	if options.Stdin != "gs://inputs/nightly.sql" || options.CanFail == nil || !*options.CanFail {
+		t.Errorf("JOB_OPTIONS = %+v, want the rendered stdin and the request's options", options)
+	}
+}
+
+func TestHandlerHandoffKeepsLock(t *testing.T) {
+	f := setFakeRun(t)
+	defer func(bucket string, mode string) { LOCK_BUCKET, LOCK_MODE = bucket, mode }(LOCK_BUCKET, LOCK_MODE)
+	LOCK_BUCKET, LOCK_MODE = "locks", "reject"
+	locked := func() bool {
+		f.storage.mu.Lock()
+		defer f.storage.mu.Unlock()
+		return f.storage.objects["locks/sh.lock"] != nil
+	}
+
+	// the client stops waiting while the execution runs
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("POST", "/", nil).WithContext(ctx))
+	if !strings.Contains(recorder.Body.String(), "it continues running") || !locked() {
+		t.Fatalf("body = %q, want the lock to be kept for the running execution", recorder.Body)
+	}
+	second := httptest.NewRecorder()
+	handler(second, httptest.NewRequest("POST", "/", nil))
+	if second.Code != http.StatusConflict {
+		t.Errorf("status = %d, want 409 while the execution runs", second.Code)
+	}
+
+	f.finish()
+	for deadline := time.Now().Add(5 * time.Second); locked() && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if locked() {
+		t.Error("lock kept after the execution completed")
+	}
+}
+
+func TestFollowupCommand(t *testing.T) {
+	defer func(queue string, delay time.Duration) { FOLLOWUP_QUEUE, FOLLOWUP_DELAY = queue, delay }(FOLLOWUP_QUEUE, FOLLOWUP_DELAY)
+	FOLLOWUP_QUEUE, FOLLOWUP_DELAY = "followups", 0
+	var m PubSubMessage
+	m.Message.ID = "42"
+	m.Message.Data = []byte(`{"jobs":[{"command":"backup"}]}`)
+	m.Message.Attributes = map[string]string{
+		followupAttribute:        "24h",
+		followupCommandAttribute: os.Args[1],
+		followupArgsAttribute:    `["cleanup","--all"]`,
+		"region":                 "eu",
+	}
+	followup, err := newFollowup(httptest.NewRequest("POST", "/", nil), nil, &m)
+	if err != nil {
+		t.Fatalf("newFollowup() = %v", err)
+	}
+	body, err := followup.message()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var payload PubSubMessage
+	json.Unmarshal(body, &payload)
+	batch, err := parseBatch(nil, &payload)
+	if err != nil || batch == nil || batch.Jobs[0].Command != os.Args[1] || !reflect.DeepEqual(batch.Jobs[0].Args, []string{"cleanup", "--all"}) {
+		t.Errorf("follow-up data = %s, want a job running the follow-up command", payload.Message.Data)
+	}
+	want := map[string]string{followupOfAttribute: "42", "region": "eu"}
+	if !reflect.DeepEqual(payload.Message.Attributes, want) {
+		t.Errorf("follow-up attributes = %v, want %v", payload.Message.Attributes, want)
+	}
+
+	m.Message.Attributes[followupCommandAttribute] = "/bin/rm"
+	if _, err := newFollowup(httptest.NewRequest("POST", "/", nil), nil, &m); err == nil {
+		t.Errorf("newFollowup() = nil for a command that isn't allowed")
+	}
+	delete(m.Message.Attributes, followupCommandAttribute)
+	if _, err := newFollowup(httptest.NewRequest("POST", "/", nil), nil, &m); err == nil {
+		t.Errorf("newFollowup() = nil for arguments without a follow-up command")
+	}
+}
+
+func TestReplayHeaders(t *testing.T) {
+	defer func() { AUTH_TOKEN, REQUEST_SIGNING_KEY = nil, nil }()
+	AUTH_TOKEN = []string{"s3cret"}
+	request := httptest.NewRequest("POST", "/", nil)
+	request.Header.Set("Authorization", "Bearer s3cret")
+	request.Header.Set("X-Command-Timeout", "10m")
+	request.Header.Set("X-Priority", "5")
+	if err := checkReplay(request); err != nil {
+		t.Errorf("checkReplay() = %v", err)
+	}
+	want := map[string]string{"X-Command-Timeout": "10m", "X-Priority": "5"}
+	if headers := replayHeaders(request); !reflect.DeepEqual(headers, want) {
+		t.Errorf("replayHeaders() = %v, want %v without the token", headers, want)
+	}
+
+	defer func(tenants []*Tenant) { CONFIG.Tenants = tenants }(CONFIG.Tenants)
+	CONFIG.Tenants = []*Tenant{{Name: "a", Tokens: []string{"token-a"}}}
+	request.Header.Set("Authorization", "Bearer token-a")
+	want[replayTenantHeader] = "a"
+	if headers := replayHeaders(request); !reflect.DeepEqual(headers, want) {
+		t.Errorf("replayHeaders() = %v, want %v for a tenant", headers, want)
+	}
+
+	REQUEST_SIGNING_KEY = []string{"key"}
+	if err := checkReplay(request); err == nil {
+		t.Errorf("checkReplay() = nil for a signed request")
+	}
+}
+
+func TestReplayedByTask(t *testing.T) {
+	key := setOIDCKeys(t)
+	defer func(account string) { FOLLOWUP_SERVICE_ACCOUNT, AUTH_TOKEN = account, nil }(FOLLOWUP_SERVICE_ACCOUNT)
+	FOLLOWUP_SERVICE_ACCOUNT, AUTH_TOKEN = "tasks@p.iam.gserviceaccount.com", []string{"s3cret"}
+	defer func(tenants []*Tenant) { CONFIG.Tenants = tenants }(CONFIG.Tenants)
+	CONFIG.Tenants = []*Tenant{{Name: "a", Tokens: []string{"token-a"}}}
+	e := &fakeExecutor{}
+	setExecutor(t, e)
+	replay := func(email string) *httptest.ResponseRecorder {
+		claims := fmt.Sprintf(`{"iss":"https://accounts.google.com","aud":"https://run.example.com","exp":%d,"email":%q,"email_verified":true}`, time.Now().Add(time.Hour).Unix(), email)
+		request := httptest.NewRequest("POST", "https://run.example.com/", strings.NewReader("{}"))
+		request.Header.Set("Authorization", "Bearer "+signIDToken(t, claims, key))
+		request.Header.Set(replayTenantHeader, "a")
+		recorder := httptest.NewRecorder()
+		withAuth("/", handler)(recorder, request)
+		return recorder
+	}
+
+	if recorder := replay(FOLLOWUP_SERVICE_ACCOUNT); recorder.Code != http.StatusOK || e.args == nil {
+		t.Errorf("status = %d, want the task to run for its tenant", recorder.Code)
+	}
+	e.args = nil
+	if recorder := replay("someone@example.com"); recorder.Code != http.StatusUnauthorized || e.args != nil {
+		t.Errorf("status = %d, want 401 for another caller", recorder.Code)
+	}
+	AUTH_TOKEN = nil
+	if recorder := replay("someone@example.com"); recorder.Code != http.StatusForbidden || e.args != nil {
+		t.Errorf("status = %d, want 403 for the tenant header of another caller", recorder.Code)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	var mu sync.Mutex
+	var texts []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		mu.Lock()
+		texts = append(texts, body["text"])
+		mu.Unlock()
+	}))
+	defer server.Close()
+	defer func(url string, on map[string]bool, template *template.Template) {
+		NOTIFY_WEBHOOK_URL, NOTIFY_ON, notifyTemplate = url, on, template
+	}(NOTIFY_WEBHOOK_URL, NOTIFY_ON, notifyTemplate)
+	NOTIFY_WEBHOOK_URL = server.URL
+	NOTIFY_ON = map[string]bool{EventStart: true}
+	var err error
+	if notifyTemplate, err = parseNotifyTemplate("{{.Event}} {{.JobID}}"); err != nil {
+		t.Fatal(err)
+	}
+	setExecutor(t, &fakeExecutor{})
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("POST", "/", strings.NewReader("{}")))
+	mu.Lock()
+	if want := []string{"start " + recorder.Header().Get("X-Job-Id")}; !reflect.DeepEqual(texts, want) {
+		t.Errorf("notifications = %q, want %q", texts, want)
+	}
+	texts = nil
+	mu.Unlock()
+
+	if notifyTemplate, err = parseNotifyTemplate(""); err != nil {
+		t.Fatal(err)
+	}
+	notify(context.Background(), EventStart, runner.Result{Command: "backup", Transcript: "gs://logs/backup/run.log"})
+	want := ":arrow_forward: Started: backup\n<https://console.cloud.google.com/storage/browser/_details/logs/backup/run.log|Transcript>"
+	if len(texts) != 1 || texts[0] != want {
+		t.Errorf("notifications = %q, want %q", texts, want)
+	}
+}
+
+func TestParseCronField(t *testing.T) {
+	bits := func(values ...int) uint64 {
+		var b uint64
+		for _, v := range values {
+			b |= 1 << uint(v)
+		}
+		return b
+	}
+	tests := []struct {
+		field string
+		min   int
+		max   int
+		names []string
+		want  uint64
+		err   bool
+	}{
+		{"5", 0, 59, nil, bits(5), false},
+		{"1,15,30", 0, 59, nil, bits(1, 15, 30), false},
+		{"*", 0, 6, nil, bits(0, 1, 2, 3, 4, 5, 6), false},
+		{"?", 1, 3, nil, bits(1, 2, 3), false},
+		{"10-13", 0, 23, nil, bits(10, 11, 12, 13), false},
+		{"*/15", 0, 59, nil, bits(0, 15, 30, 45), false},
+		{"5/20", 0, 59, nil, bits(5, 25, 45), false},
+		{"1-10/3", 1, 31, nil, bits(1, 4, 7, 10), false},
+		{"1-3,20-21", 1, 31, nil, bits(1, 2, 3, 20, 21), false},
+		{"jan", 1, 12, cronMonths, bits(1), false},
+		{"MAR-MAY,Dec", 1, 12, cronMonths, bits(3, 4, 5, 12), false},
+		{"MON-FRI", 0, 7, cronDays, bits(1, 2, 3, 4, 5), false},
+		{"SUN,sat", 0, 7, cronDays, bits(0, 6), false},
+		{"60", 0, 59, nil, 0, true},
+		{"0", 1, 31, nil, 0, true},
+		{"5-2", 0, 59, nil, 0, true},
+		{"*/0", 0, 59, nil, 0, true},
+		{"*/x", 0, 59, nil, 0, true},
+		{"1-", 0, 59, nil, 0, true},
+		{"JAN", 0, 59, nil, 0, true},
+		{"MONDAY", 0, 7, cronDays, 0, true},
+		{"", 0, 59, nil, 0, true},
+	}
+	for _, test := range tests {
+		got, err := parseCronField(test.field, test.min, test.max, test.names)
+		if (err != nil) != test.err || got != test.want {
+			t.Errorf("parseCronField(%q) = %b, %v, want %b, error %v", test.field, got, err, test.want, test.err)
+		}
+	}
+}
+
+func TestParseCron(t *testing.T) {
+	for _, expr := range []string{"* * * *", "* * * * * *", "61 * * * *", "* 24 * * *", "* * 32 * *", "* * * 13 *", "* * * * 8", "@often"} {
+		if _, err := parseCron(expr, time.UTC); err == nil {
+			t.Errorf("parseCron(%q) = nil, want an error", expr)
+		}
+	}
+	s, err := parseCron("0 0 * * 7", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.dow != 1|1<<7 {
+		t.Errorf("day of week = %b, want Sunday as 0 and 7", s.dow)
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	// Wednesday
+	from := time.Date(2021, 6, 16, 10, 30, 45, 0, time.UTC)
+	tests := []struct {
+		expr     string
+		location *time.Location
+		want     time.Time
+	}{
+		{"* * * * *", time.UTC, time.Date(2021, 6, 16, 10, 31, 0, 0, time.UTC)},
+		{"30 10 * * *", time.UTC, time.Date(2021, 6, 17, 10, 30, 0, 0, time.UTC)},
+		{"*/20 * * * *", time.UTC, time.Date(2021, 6, 16, 10, 40, 0, 0, time.UTC)},
+		{"0 9-17 * * *", time.UTC, time.Date(2021, 6, 16, 11, 0, 0, 0, time.UTC)},
+		{"@hourly", time.UTC, time.Date(2021, 6, 16, 11, 0, 0, 0, time.UTC)},
+		{"@daily", time.UTC, time.Date(2021, 6, 17, 0, 0, 0, 0, time.UTC)},
+		{"@weekly", time.UTC, time.Date(2021, 6, 20, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.UTC, time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", time.UTC, time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 8 * * MON-FRI", time.UTC, time.Date(2021, 6, 17, 8, 0, 0, 0, time.UTC)},
+		{"0 0 * * sat", time.UTC, time.Date(2021, 6, 19, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 DEC *", time.UTC, time.Date(2021, 12, 1, 0, 0, 0, 0, time.UTC)},
+		// day of month or day of week, when both are restricted
+		{"0 0 20 * MON", time.UTC, time.Date(2021, 6, 20, 0, 0, 0, 0, time.UTC)},
+		{"0 0 25 * MON", time.UTC, time.Date(2021, 6, 21, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.UTC, time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 2 *", time.UTC, time.Time{}},
+		{"0 9 * * *", newYork, time.Date(2021, 6, 16, 13, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		s, err := parseCron(test.expr, test.location)
+		if err != nil {
+			t.Errorf("parseCron(%q) = %v", test.expr, err)
+			continue
+		}
+		if got := s.Next(from); !got.Equal(test.want) {
+			t.Errorf("%s: Next() = %s, want %s", test.expr, got, test.want)
+		}
+	}
+}
+
+func TestHistoryKey(t *testing.T) {
+	if key := historyKey("backup"); key != "backup" {
+		t.Errorf("historyKey(backup) = %q", key)
+	}
+	first, second := historyKey("/opt/a/backup"), historyKey("/opt/b/backup")
+	if first == second || !strings.HasPrefix(first, "backup-") || strings.Contains(first, "/") {
+		t.Errorf("historyKey() = %q, %q, want distinct IDs for commands with the same base name", first, second)
+	}
+}
+
+func TestSummarizeHistory(t *testing.T) {
+	summary := summarizeHistory([]HistoryEntry{
+		{Status: runner.StatusSucceeded, DurationSeconds: 30},
+		{Status: runner.StatusFailed, DurationSeconds: 1},
+		{Status: runner.StatusSucceeded, DurationSeconds: 10},
+		{Status: runner.StatusSucceeded, DurationSeconds: 20},
+	})
+	if want := (HistorySummary{Runs: 4, Succeeded: 3, SuccessRate: 0.75, MedianDurationSeconds: 20}); summary != want {
+		t.Errorf("summarizeHistory() = %+v, want %+v", summary, want)
+	}
+}
+
+func TestHistoryHandlerTenant(t *testing.T) {
+	defer func(collection string, project string) {
+		HISTORY_COLLECTION, GOOGLE_CLOUD_PROJECT = collection, project
+	}(HISTORY_COLLECTION, GOOGLE_CLOUD_PROJECT)
+	HISTORY_COLLECTION, GOOGLE_CLOUD_PROJECT = "history", "p"
+	tenant := &Tenant{Name: "a", Tokens: []string{"token-a"}}
+	if err := tenant.parse(); err != nil {
+		t.Fatal(err)
+	}
+	defer func(tenants []*Tenant) { CONFIG.Tenants = tenants }(CONFIG.Tenants)
+	CONFIG.Tenants = []*Tenant{tenant}
+	var path string
+	var query struct {
+		StructuredQuery struct {
+			Where struct {
+				CompositeFilter struct {
+					Filters []struct {
+						FieldFilter struct {
+							Field struct {
+								FieldPath string `json:"fieldPath"`
+							} `json:"field"`
+							Value firestoreValue `json:"value"`
+						} `json:"fieldFilter"`
+					} `json:"filters"`
+				} `json:"compositeFilter"`
+			} `json:"where"`
+			Limit int `json:"limit"`
+		} `json:"structuredQuery"`
+	}
+	setTransport(t, fakeAPI(func(r *http.Request) (int, string) {
+		path = r.URL.Path
+		json.NewDecoder(r.Body).Decode(&query)
+		return http.StatusOK, `[{"document":{"fields":{"tenant":{"stringValue":"a"},"status":{"stringValue":"succeeded"},"durationSeconds":{"doubleValue":5}}}}]`
+	}))
+
+	request := httptest.NewRequest("GET", "/history?command=/opt/backup&limit=1", nil)
+	request.Header.Set("X-Api-Key", "token-a")
+	recorder := httptest.NewRecorder()
+	withAuth("/history", historyHandler)(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %q", recorder.Code, recorder.Body)
+	}
+	if want := "/v1/projects/p/databases/(default)/documents/history/" + historyKey("/opt/backup") + ":runQuery"; path != want {
+		t.Errorf("queried %s, want %s", path, want)
+	}
+	filters := query.StructuredQuery.Where.CompositeFilter.Filters
+	if query.StructuredQuery.Limit != 1 || len(filters) != 1 || filters[0].FieldFilter.Field.FieldPath != "tenant" || filters[0].FieldFilter.Value.decode() != "a" {
+		t.Errorf("query = %+v, want the limit applied to the runs of the tenant", query)
+	}
+	var response struct {
+		Runs []HistoryEntry `json:"runs"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil || len(response.Runs) != 1 || response.Runs[0].Tenant != "a" {
+		t.Errorf("response = %s, want the run of the tenant", recorder.Body)
+	}
+}
+
+func TestHandlerDurationAnomaly(t *testing.T) {
+	defer func(collection string, project string, webhook string) {
+		HISTORY_COLLECTION, GOOGLE_CLOUD_PROJECT, ANOMALY_WEBHOOK_URL = collection, project, webhook
+	}(HISTORY_COLLECTION, GOOGLE_CLOUD_PROJECT, ANOMALY_WEBHOOK_URL)
+	HISTORY_COLLECTION, GOOGLE_CLOUD_PROJECT = "history", "p"
+	// the median of the recent successful runs is 50ms
+	setTransport(t, fakeAPI(func(r *http.Request) (int, string) {
+		if !strings.HasSuffix(r.URL.Path, ":runQuery") {
+			return http.StatusOK, `{}`
+		}
+		run := `{"document":{"fields":{"status":{"stringValue":"succeeded"},"durationSeconds":{"doubleValue":%s}}}}`
+		return http.StatusOK, "[" + fmt.Sprintf(run, "0.04") + "," + fmt.Sprintf(run, "0.05") + "," + fmt.Sprintf(run, "0.06") + "]"
+	}))
+	alerts := make(chan durationAnomaly, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var anomaly durationAnomaly
+		json.NewDecoder(r.Body).Decode(&anomaly)
+		alerts <- anomaly
+	}))
+	defer server.Close()
+	ANOMALY_WEBHOOK_URL = server.URL
+	setExecutor(t, &fakeExecutor{block: true})
+
+	request := httptest.NewRequest("POST", "/", nil)
+	request.Header.Set("X-Command-Timeout", "300ms")
+	recorder := httptest.NewRecorder()
+	handler(recorder, request)
+	if !strings.Contains(recorder.Body.String(), "longer than usual") {
+		t.Errorf("body = %q, want a warning after twice the median duration", recorder.Body)
+	}
+	select {
+	case anomaly := <-alerts:
+		if anomaly.Command != "sh" || anomaly.MedianDurationSeconds != 0.05 || anomaly.Factor != ANOMALY_FACTOR {
+			t.Errorf("alert = %+v", anomaly)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("no duration alert sent")
+	}
+}
+
+func TestHandlerBigQuery(t *testing.T) {
+	defer func(table string, lines string, project string) {
+		BIGQUERY_TABLE, BIGQUERY_LINES_TABLE, GOOGLE_CLOUD_PROJECT = table, lines, project
+	}(BIGQUERY_TABLE, BIGQUERY_LINES_TABLE, GOOGLE_CLOUD_PROJECT)
+	BIGQUERY_TABLE, BIGQUERY_LINES_TABLE, GOOGLE_CLOUD_PROJECT = "runs.results", "other.runs.lines", "p"
+	var mu sync.Mutex
+	inserted := map[string][]map[string]interface{}{}
+	setTransport(t, fakeAPI(func(r *http.Request) (int, string) {
+		var request struct {
+			Rows []struct {
+				InsertID string                 `json:"insertId"`
+				JSON     map[string]interface{} `json:"json"`
+			} `json:"rows"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		mu.Lock()
+		defer mu.Unlock()
+		for _, row := range request.Rows {
+			inserted[r.URL.Path] = append(inserted[r.URL.Path], row.JSON)
+		}
+		return http.StatusOK, `{}`
+	}))
+	setExecutor(t, &fakeExecutor{lines: []string{"hello", "world"}, exitCode: 3})
+
+	handler(httptest.NewRecorder(), httptest.NewRequest("POST", "/", nil))
+	mu.Lock()
+	defer mu.Unlock()
+	runs := inserted["/bigquery/v2/projects/p/datasets/runs/tables/results/insertAll"]
+	if len(runs) != 1 || runs[0]["command"] != "sh" || runs[0]["status"] != runner.StatusFailed || runs[0]["exitCode"] != 3.0 {
+		t.Errorf("inserted runs %v, want the failed run", runs)
+	}
+	lines := inserted["/bigquery/v2/projects/other/datasets/runs/tables/lines/insertAll"]
+	if len(lines) != 2 || lines[0]["line"] != "hello" || lines[1]["line"] != "world" || lines[1]["lineNumber"] != 2.0 {
+		t.Errorf("inserted lines %v, want the output in order", lines)
+	}
+}
+
+func TestHandlerMetrics(t *testing.T) {
+	defer func(prefix string, labels map[string]string, project string, region string) {
+		METRICS_PREFIX, METRICS_LABELS, GOOGLE_CLOUD_PROJECT, GOOGLE_CLOUD_REGION = prefix, labels, project, region
+	}(METRICS_PREFIX, METRICS_LABELS, GOOGLE_CLOUD_PROJECT, GOOGLE_CLOUD_REGION)
+	METRICS_PREFIX, METRICS_LABELS = "runner", map[string]string{"env": "test"}
+	GOOGLE_CLOUD_PROJECT, GOOGLE_CLOUD_REGION = "p", "r"
+	defer func(transport http.RoundTripper) { metadataClient.Transport = transport }(metadataClient.Transport)
+	metadataClient.Transport = fakeAPI(func(r *http.Request) (int, string) { return http.StatusNotFound, "" })
+	type timeSeries struct {
+		Metric struct {
+			Type   string            `json:"type"`
+			Labels map[string]string `json:"labels"`
+		} `json:"metric"`
+		MetricKind string `json:"metricKind"`
+		Points     []struct {
+			Value map[string]interface{} `json:"value"`
+		} `json:"points"`
+	}
+	var mu sync.Mutex
+	var written [][]timeSeries
+	setTransport(t, fakeAPI(func(r *http.Request) (int, string) {
+		var request struct {
+			TimeSeries []timeSeries `json:"timeSeries"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Path == "/v3/projects/p/timeSeries" {
+			written = append(written, request.TimeSeries)
+		}
+		return http.StatusOK, `{}`
+	}))
+	setExecutor(t, &fakeExecutor{block: true})
+
+	for i := 0; i < 2; i++ {
+		request := httptest.NewRequest("POST", "/", nil)
+		request.Header.Set("X-Command-Timeout", "100ms")
+		handler(httptest.NewRecorder(), request)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(written) != 2 || len(written[1]) != 3 {
+		t.Fatalf("wrote %+v, want the runs, timeouts and duration of both runs", written)
+	}
+	runs, timeouts, duration := written[1][0], written[1][1], written[1][2]
+	if runs.Metric.Type != "custom.googleapis.com/runner/runs" || runs.MetricKind != "CUMULATIVE" || runs.Points[0].Value["int64Value"] != "2" {
+		t.Errorf("runs = %+v, want the cumulative count of 2", runs)
+	}
+	if labels := runs.Metric.Labels; labels["command"] != "sh" || labels["status"] != runner.StatusTimeout || labels["env"] != "test" {
+		t.Errorf("runs labels = %v", labels)
+	}
+	if timeouts.Metric.Type != "custom.googleapis.com/runner/timeouts" || timeouts.Points[0].Value["int64Value"] != "2" {
+		t.Errorf("timeouts = %+v, want the cumulative count of 2", timeouts)
+	}
+	if duration.Metric.Type != "custom.googleapis.com/runner/duration_seconds" || duration.MetricKind != "GAUGE" || duration.Points[0].Value["doubleValue"].(float64) <= 0 {
+		t.Errorf("duration = %+v", duration)
+	}
+}
+
+func TestHandlerFailureTopic(t *testing.T) {
+	defer func(topic string, lines int, codes []int, attempts int) {
+		FAILURE_TOPIC, FAILURE_TAIL_LINES, RETRYABLE_EXIT_CODES, MAX_DELIVERY_ATTEMPTS = topic, lines, codes, attempts
+	}(FAILURE_TOPIC, FAILURE_TAIL_LINES, RETRYABLE_EXIT_CODES, MAX_DELIVERY_ATTEMPTS)
+	FAILURE_TOPIC, FAILURE_TAIL_LINES = "projects/p/topics/failures", 2
+	RETRYABLE_EXIT_CODES, MAX_DELIVERY_ATTEMPTS = []int{75}, 5
+	var mu sync.Mutex
+	var published []failureMessage
+	setTransport(t, fakeAPI(func(r *http.Request) (int, string) {
+		var request struct {
+			Messages []struct {
+				Data       []byte            `json:"data"`
+				Attributes map[string]string `json:"attributes"`
+			} `json:"messages"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Path == "/v1/projects/p/topics/failures:publish" {
+			for _, message := range request.Messages {
+				var failure failureMessage
+				json.Unmarshal(message.Data, &failure)
+				published = append(published, failure)
+			}
+		}
+		return http.StatusOK, `{"messageIds":["1"]}`
+	}))
+	deliver := func(exitCode int, attempt int) int {
+		setExecutor(t, &fakeExecutor{lines: []string{"one", "two", "three"}, exitCode: exitCode})
+		body := fmt.Sprintf(`{"message":{"data":"aGVsbG8=","messageId":"42"},"subscription":"projects/p/subscriptions/s","deliveryAttempt":%d}`, attempt)
+		recorder := httptest.NewRecorder()
+		handler(recorder, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+		mu.Lock()
+		defer mu.Unlock()
+		return len(published)
+	}
+
+	if n := deliver(1, 1); n != 1 {
+		t.Fatalf("published %d failures, want the permanent failure", n)
+	}
+	failure := published[0]
+	if failure.MessageID != "42" || string(failure.Data) != "hello" || failure.ExitCode != 1 || !reflect.DeepEqual(failure.LastLines, []string{"two", "three"}) {
+		t.Errorf("failure = %+v, want the message, exit code and last lines", failure)
+	}
+	if n := deliver(75, 1); n != 1 {
+		t.Errorf("published %d failures, want none for a retryable failure before the last attempt", n-1)
+	}
+	if n := deliver(75, 5); n != 2 {
+		t.Errorf("published %d failures, want the retryable failure of the last attempt", n-1)
+	}
+}
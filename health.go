@@ -0,0 +1,183 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Statuses of the grpc.health.v1 HealthCheckResponse.
+const (
+	healthServing        = 1
+	healthNotServing     = 2
+	healthServiceUnknown = 3
+)
+
+// gRPC status codes.
+const (
+	grpcOK            = 0
+	grpcInvalidArg    = 3
+	grpcNotFound      = 5
+	grpcUnimplemented = 12
+)
+
+// Paths of the grpc.health.v1.Health methods.
+const (
+	healthCheckPath = "/grpc.health.v1.Health/Check"
+	healthWatchPath = "/grpc.health.v1.Health/Watch"
+)
+
+// healthStatus returns the status of a service of the health checking
+// protocol: "" is the instance, which serves once the self-check has
+// passed, "runs" doesn't serve while MAX_CONCURRENT_RUNS runs are in
+// progress, and "circuit" while the circuit of the command is open.
+func healthStatus(service string) int {
+	serving := func(ok bool) int {
+		if ok {
+			return healthServing
+		}
+		return healthNotServing
+	}
+	switch service {
+	case "":
+		select {
+		case <-selfCheck.done:
+			return serving(selfCheck.failed == 0)
+		default:
+			return healthNotServing
+		}
+	case "runs":
+		return serving(!runs.Full())
+	case "circuit":
+		return serving(len(os.Args) < 2 || !breaker.isOpen(os.Args[1], time.Now()))
+	}
+	return healthServiceUnknown
+}
+
+// healthHandler implements the Check method of the gRPC health checking
+// protocol (grpc.health.v1.Health) for gRPC health checks and load
+// balancers, which need HTTP/2 and so ENABLE_H2C. Watch is unimplemented.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/grpc")
+	if r.URL.Path != healthCheckPath {
+		setGRPCStatus(w, grpcUnimplemented, "unimplemented")
+		return
+	}
+	message, err := readGRPCMessage(r.Body)
+	if err != nil {
+		setGRPCStatus(w, grpcInvalidArg, err.Error())
+		return
+	}
+	service, err := protoString(message, 1)
+	if err != nil {
+		setGRPCStatus(w, grpcInvalidArg, err.Error())
+		return
+	}
+	status := healthStatus(service)
+	if status == healthServiceUnknown {
+		setGRPCStatus(w, grpcNotFound, "unknown service")
+		return
+	}
+	// HealthCheckResponse with the status as field 1, a varint.
+	w.Write(grpcFrame([]byte{0x08, byte(status)}))
+	setGRPCStatus(w, grpcOK, "")
+}
+
+// setGRPCStatus sends the status of the call as trailers.
+func setGRPCStatus(w http.ResponseWriter, code int, message string) {
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", message)
+	}
+}
+
+// readGRPCMessage reads a length-prefixed, uncompressed gRPC message.
+func readGRPCMessage(body io.Reader) ([]byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(body, header[:]); err != nil {
+		return nil, fmt.Errorf("invalid message: %w", err)
+	}
+	if header[0] != 0 {
+		return nil, errors.New("compressed messages are not supported")
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > 1<<16 {
+		return nil, errors.New("message too large")
+	}
+	message, err := ioutil.ReadAll(io.LimitReader(body, int64(length)))
+	if err == nil && len(message) != int(length) {
+		err = io.ErrUnexpectedEOF
+	}
+	return message, err
+}
+
+// grpcFrame prefixes a message with its length.
+func grpcFrame(message []byte) []byte {
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	return append(frame, message...)
+}
+
+// protoString returns the string field with the number from a protocol
+// buffer message, skipping the other fields.
+func protoString(message []byte, number uint64) (string, error) {
+	value := ""
+	for len(message) > 0 {
+		key, n := binary.Uvarint(message)
+		if n <= 0 {
+			return "", errors.New("invalid message")
+		}
+		message = message[n:]
+		var size uint64
+		switch key & 7 {
+		case 0:
+			if _, n = binary.Uvarint(message); n <= 0 {
+				return "", errors.New("invalid message")
+			}
+			size = uint64(n)
+		case 1:
+			size = 8
+		case 2:
+			length, n := binary.Uvarint(message)
+			if n <= 0 || length > uint64(len(message)-n) {
+				return "", errors.New("invalid message")
+			}
+			message = message[n:]
+			size = length
+			if key>>3 == number {
+				value = string(message[:length])
+			}
+		case 5:
+			size = 4
+		default:
+			return "", errors.New("invalid message")
+		}
+		if size > uint64(len(message)) {
+			return "", errors.New("invalid message")
+		}
+		message = message[size:]
+	}
+	return value, nil
+}
@@ -0,0 +1,220 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rosmo/long-cloud-run/pkg/runner"
+)
+
+// HistoryEntry is the metadata of a run persisted in Firestore, under
+// <HISTORY_COLLECTION>/<command>/runs.
+type HistoryEntry struct {
+	JobID           string  `json:"jobId,omitempty"`
+	Command         string  `json:"command"`
+	Trigger         string  `json:"trigger"`
+	ArgsHash        string  `json:"argsHash"`
+	Status          string  `json:"status"`
+	ExitCode        int64   `json:"exitCode"`
+	StartTime       string  `json:"startTime"`
+	EndTime         string  `json:"endTime"`
+	DurationSeconds float64 `json:"durationSeconds"`
+	LogURL          string  `json:"logUrl"`
+	Revision        string  `json:"revision,omitempty"`
+	Tenant          string  `json:"tenant,omitempty"`
+	OutputLines     int64   `json:"outputLines,omitempty"`
+	OutputBytes     int64   `json:"outputBytes,omitempty"`
+	MaxRSSBytes     int64   `json:"maxRssBytes,omitempty"`
+}
+
+// HistorySummary summarizes the runs returned by the history API.
+type HistorySummary struct {
+	Runs                  int     `json:"runs"`
+	Succeeded             int     `json:"succeeded"`
+	SuccessRate           float64 `json:"successRate"`
+	MedianDurationSeconds float64 `json:"medianDurationSeconds"`
+}
+
+// historyKey returns the document ID used for a command: its name, or for
+// a path, which can't be an ID, its base name and a hash of the path, so
+// that commands with the same base name don't share their history.
+func historyKey(command string) string {
+	if !strings.Contains(command, "/") {
+		return command
+	}
+	hash := sha256.Sum256([]byte(command))
+	return filepath.Base(command) + "-" + hex.EncodeToString(hash[:4])
+}
+
+// commandLabel returns the name of a command in labels and attributes.
+func commandLabel(command string) string {
+	return filepath.Base(command)
+}
+
+// logsURL links to the Cloud Logging entries of this service for a time
+// range.
+func logsURL(project string, start time.Time, end time.Time) string {
+	query := fmt.Sprintf("resource.type=\"cloud_run_revision\"\nresource.labels.service_name=\"%s\"", os.Getenv("K_SERVICE"))
+	timeRange := start.UTC().Format(time.RFC3339) + "/" + end.UTC().Add(time.Second).Format(time.RFC3339)
+	return fmt.Sprintf("https://console.cloud.google.com/logs/query;query=%s;timeRange=%s?project=%s",
+		url.PathEscape(query), url.PathEscape(timeRange), url.QueryEscape(project))
+}
+
+// recordHistory persists the result of a run.
+func recordHistory(ctx context.Context, trigger string, result runner.Result) error {
+	project, err := projectID(ctx)
+	if err != nil {
+		return err
+	}
+	entry := map[string]interface{}{
+		"jobId":           result.JobID,
+		"command":         result.Command,
+		"trigger":         trigger,
+		"argsHash":        result.ArgsHash(),
+		"status":          result.Status,
+		"exitCode":        result.ExitCode,
+		"startTime":       result.StartTime,
+		"endTime":         result.EndTime,
+		"durationSeconds": result.Duration.Seconds(),
+		"logUrl":          logsURL(project, result.StartTime, result.EndTime),
+		"revision":        os.Getenv("K_REVISION"),
+	}
+	if tenant := result.Labels["tenant"]; tenant != "" {
+		entry["tenant"] = tenant
+	}
+	entry["outputLines"] = result.Output.Lines
+	entry["outputBytes"] = result.Output.Bytes
+	if result.Usage != nil {
+		entry["maxRssBytes"] = result.Usage.MaxRSS
+	}
+	collection := fmt.Sprintf("%s/%s/runs", HISTORY_COLLECTION, historyKey(result.Command))
+	if err := createDocument(ctx, collection, entry); err != nil {
+		return fmt.Errorf("error recording history: %w", err)
+	}
+	return nil
+}
+
+// queryHistory returns the latest runs of a command, newest first, only
+// those of the tenant if it isn't empty.
+func queryHistory(ctx context.Context, command string, tenant string, limit int) ([]HistoryEntry, error) {
+	collection := fmt.Sprintf("%s/%s/runs", HISTORY_COLLECTION, historyKey(command))
+	var where map[string]string
+	if tenant != "" {
+		where = map[string]string{"tenant": tenant}
+	}
+	documents, err := queryDocuments(ctx, collection, where, "startTime", limit)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]HistoryEntry, 0, len(documents))
+	for _, document := range documents {
+		// Convert through JSON, as field names match the JSON tags
+		b, err := json.Marshal(document)
+		if err != nil {
+			return nil, err
+		}
+		var entry HistoryEntry
+		if err := json.Unmarshal(b, &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// summarizeHistory computes the success rate and median duration of runs.
+// Only succeeded runs count towards the median duration.
+func summarizeHistory(entries []HistoryEntry) HistorySummary {
+	summary := HistorySummary{Runs: len(entries)}
+	var durations []float64
+	for _, entry := range entries {
+		if entry.Status == runner.StatusSucceeded {
+			summary.Succeeded++
+			durations = append(durations, entry.DurationSeconds)
+		}
+	}
+	if summary.Runs > 0 {
+		summary.SuccessRate = float64(summary.Succeeded) / float64(summary.Runs)
+	}
+	if len(durations) > 0 {
+		sort.Float64s(durations)
+		middle := len(durations) / 2
+		if len(durations)%2 == 0 {
+			summary.MedianDurationSeconds = (durations[middle-1] + durations[middle]) / 2
+		} else {
+			summary.MedianDurationSeconds = durations[middle]
+		}
+	}
+	return summary
+}
+
+// historyHandler serves GET /history?command=...&limit=...
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	tenant, err := tenantScope(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	command := r.URL.Query().Get("command")
+	if command == "" && tenant != nil {
+		command = tenant.command()
+	} else if command == "" && len(os.Args) > 1 {
+		command = os.Args[1]
+	}
+	limit := 20
+	if l := r.URL.Query().Get("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 || limit > 1000 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var tenantName string
+	if tenant != nil {
+		tenantName = tenant.Name
+	}
+	entries, err := queryHistory(r.Context(), command, tenantName, limit)
+	if err != nil {
+		log.Printf("Failed to query history: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Command string         `json:"command"`
+		Summary HistorySummary `json:"summary"`
+		Runs    []HistoryEntry `json:"runs"`
+	}{command, summarizeHistory(entries), entries})
+}
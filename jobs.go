@@ -0,0 +1,349 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	backoff "github.com/cenkalti/backoff/v4"
+	"github.com/rosmo/long-cloud-run/pkg/runner"
+)
+
+const runAPI = "https://run.googleapis.com/v2/"
+
+type runContainer struct {
+	Image     string            `json:"image"`
+	Args      []string          `json:"args,omitempty"`
+	Env       []json.RawMessage `json:"env,omitempty"`
+	Resources json.RawMessage   `json:"resources,omitempty"`
+}
+
+type runService struct {
+	Template struct {
+		Containers     []runContainer `json:"containers"`
+		ServiceAccount string         `json:"serviceAccount"`
+	} `json:"template"`
+}
+
+type runJob struct {
+	Template struct {
+		TaskCount int `json:"taskCount"`
+		Template  struct {
+			Containers     []runContainer `json:"containers"`
+			Timeout        string         `json:"timeout"`
+			MaxRetries     int            `json:"maxRetries"`
+			ServiceAccount string         `json:"serviceAccount,omitempty"`
+		} `json:"template"`
+	} `json:"template"`
+}
+
+type runOperation struct {
+	Name     string          `json:"name"`
+	Done     bool            `json:"done"`
+	Metadata json.RawMessage `json:"metadata"`
+	Error    *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type runExecution struct {
+	Name           string `json:"name"`
+	TaskCount      int    `json:"taskCount"`
+	RunningCount   int    `json:"runningCount"`
+	SucceededCount int    `json:"succeededCount"`
+	FailedCount    int    `json:"failedCount"`
+	CancelledCount int    `json:"cancelledCount"`
+	CompletionTime string `json:"completionTime"`
+	LogURI         string `json:"logUri"`
+}
+
+func (e runExecution) status() string {
+	return fmt.Sprintf("%d running, %d succeeded, %d failed, %d cancelled", e.RunningCount, e.SucceededCount, e.FailedCount, e.CancelledCount)
+}
+
+// JobHandoff runs the command as a Cloud Run Job with the same image, instead
+// of in the request, so that it isn't limited by the request timeout.
+type JobHandoff struct {
+	JobName string
+	// JobID is passed to the job execution as JOB_ID, so that it keeps the
+	// run ID.
+	JobID string
+	Args  []string
+	// Options are the options of the request, with its rendered stdin,
+	// passed to the job execution as JOB_OPTIONS.
+	Options CommandOptions
+	// Lock, if set, is held until the job execution finishes, even when
+	// the request stops waiting for it, and released by Run.
+	Lock *Lock
+
+	Request  *http.Request
+	Response *http.ResponseWriter
+	Flusher  *http.Flusher
+	Logger   *log.Logger
+}
+
+func (j *JobHandoff) writeProgress(message string) {
+	j.Logger.Println(message)
+	fmt.Fprintln(*j.Response, message)
+	(*j.Flusher).Flush()
+}
+
+// waitForOperation polls a long-running operation until it's done.
+func waitForOperation(ctx context.Context, op runOperation) (runOperation, error) {
+	for !op.Done {
+		select {
+		case <-ctx.Done():
+			return op, ctx.Err()
+		case <-time.After(time.Second):
+		}
+		if err := callAPI(ctx, "GET", runAPI+op.Name, nil, &op); err != nil {
+			return op, err
+		}
+	}
+	if op.Error != nil {
+		return op, fmt.Errorf("operation %s failed: %s", op.Name, op.Error.Message)
+	}
+	return op, nil
+}
+
+// deployJob creates or updates the job from the template of this service.
+func (j *JobHandoff) deployJob(ctx context.Context, parent string) error {
+	var service runService
+	if err := callAPI(ctx, "GET", runAPI+parent+"/services/"+os.Getenv("K_SERVICE"), nil, &service); err != nil {
+		return fmt.Errorf("error getting service %s: %w", os.Getenv("K_SERVICE"), err)
+	}
+	if len(service.Template.Containers) == 0 {
+		return fmt.Errorf("service %s has no containers", os.Getenv("K_SERVICE"))
+	}
+
+	var job runJob
+	job.Template.TaskCount = 1
+	job.Template.Template.Containers = []runContainer{{
+		Image:     service.Template.Containers[0].Image,
+		Env:       service.Template.Containers[0].Env,
+		Resources: service.Template.Containers[0].Resources,
+	}}
+	job.Template.Template.Timeout = fmt.Sprintf("%ds", int(JOB_TIMEOUT.Seconds()))
+	job.Template.Template.ServiceAccount = service.Template.ServiceAccount
+
+	var op runOperation
+	err := callAPI(ctx, "POST", runAPI+parent+"/jobs?jobId="+j.JobName, job, &op)
+	if isAPIError(err, http.StatusConflict) {
+		err = callAPI(ctx, "PATCH", runAPI+parent+"/jobs/"+j.JobName, job, &op)
+	}
+	if err != nil {
+		return fmt.Errorf("error deploying job %s: %w", j.JobName, err)
+	}
+	_, err = waitForOperation(ctx, op)
+	return err
+}
+
+// Run starts a job execution and streams its status until it completes.
+func (j *JobHandoff) Run() error {
+	defer func() {
+		if j.Lock != nil {
+			j.Lock.Release(context.Background())
+		}
+	}()
+	ctx := j.Request.Context()
+	options, err := json.Marshal(j.Options)
+	if err != nil {
+		return err
+	}
+	project, err := projectID(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting project: %w", err)
+	}
+	region, err := region(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting region: %w", err)
+	}
+	parent := fmt.Sprintf("projects/%s/locations/%s", project, region)
+
+	j.writeProgress(fmt.Sprintf("Deploying Cloud Run job: %s", j.JobName))
+	if err := j.deployJob(ctx, parent); err != nil {
+		return err
+	}
+
+	run := map[string]interface{}{
+		"overrides": map[string]interface{}{
+			"containerOverrides": []map[string]interface{}{{
+				"args": j.Args,
+				"env": []map[string]string{
+					{"name": "JOB_ID", "value": j.JobID},
+					{"name": "JOB_OPTIONS", "value": string(options)},
+				},
+			}},
+		},
+	}
+	var op runOperation
+	if err := callAPI(ctx, "POST", runAPI+parent+"/jobs/"+j.JobName+":run", run, &op); err != nil {
+		return fmt.Errorf("error running job %s: %w", j.JobName, err)
+	}
+	var execution runExecution
+	if err := json.Unmarshal(op.Metadata, &execution); err != nil {
+		return fmt.Errorf("error parsing job execution: %w", err)
+	}
+	executionName := execution.Name[strings.LastIndex(execution.Name, "/")+1:]
+	j.writeProgress(fmt.Sprintf("Running command as Cloud Run job execution: %s %+q", executionName, j.Args))
+	if execution.LogURI != "" {
+		j.writeProgress(fmt.Sprintf("Logs: %s", execution.LogURI))
+	}
+
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = POLL_TIME
+	b.MaxInterval = MAX_POLL_TIME
+	b.MaxElapsedTime = 0
+	pollTimer := backoff.NewTicker(backoff.WithContext(b, ctx))
+	defer pollTimer.Stop()
+
+	startTime := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			j.writeProgress(fmt.Sprintf("Stopped waiting for job execution, it continues running: %s", executionName))
+			if j.Lock != nil {
+				go releaseWhenDone(execution.Name, j.Lock)
+				j.Lock = nil
+			}
+			return nil
+		case <-pollTimer.C:
+		}
+		if err := callAPI(ctx, "GET", runAPI+execution.Name, nil, &execution); err != nil {
+			return fmt.Errorf("error getting job execution %s: %w", executionName, err)
+		}
+		duration := time.Since(startTime).Truncate(time.Second).String()
+		if execution.CompletionTime != "" {
+			if execution.SucceededCount < execution.TaskCount {
+				return fmt.Errorf("Job execution %s failed in %s: %s", executionName, duration, execution.status())
+			}
+			j.writeProgress(fmt.Sprintf("Job execution completed in %s: %s", duration, executionName))
+			return nil
+		}
+		j.writeProgress(fmt.Sprintf("[Still waiting for job execution to complete: %s --- %s, %s]", executionName, duration, execution.status()))
+	}
+}
+
+// releaseWhenDone releases the lock once the job execution has completed,
+// or at the latest after JOB_TIMEOUT, when it can't be running anymore.
+func releaseWhenDone(name string, lock *Lock) {
+	ctx, cancel := context.WithTimeout(context.Background(), JOB_TIMEOUT)
+	defer cancel()
+	defer lock.Release(context.Background())
+	var execution runExecution
+	for execution.CompletionTime == "" {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(MAX_POLL_TIME):
+		}
+		err := callAPI(ctx, "GET", runAPI+name, nil, &execution)
+		if isAPIError(err, http.StatusNotFound) {
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to get job execution %s: %v", name, err)
+		}
+	}
+}
+
+// discardResponseWriter is used when there is no client to stream the
+// output to, the output is only logged.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w *discardResponseWriter) Header() http.Header {
+	if w.header == nil {
+		w.header = make(http.Header)
+	}
+	return w.header
+}
+
+func (w *discardResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (w *discardResponseWriter) WriteHeader(statusCode int) {
+}
+
+func (w *discardResponseWriter) Flush() {
+}
+
+// runAsJob runs the command directly when executing as a Cloud Run Job,
+// and exits with a non-zero status if it fails: the exit code of the
+// command, if it exited with one.
+func runAsJob() {
+	log.Printf("Running as Cloud Run job execution: %s", os.Getenv("CLOUD_RUN_EXECUTION"))
+	var commandArgs []string
+	if len(os.Args) > 2 {
+		commandArgs = os.Args[2:]
+	}
+	command := newCommand(nil, os.Args[1], commandArgs...)
+	// the job runs as long as its task timeout, not REQUEST_TIMEOUT
+	command.Timeout = JOB_TIMEOUT - DEADLINE_MARGIN
+	if command.Timeout <= 0 {
+		command.Timeout = JOB_TIMEOUT
+	}
+	jobID := os.Getenv("JOB_ID")
+	if jobID == "" {
+		jobID = newJobID()
+	}
+	setJobID(command, jobID)
+	options := CommandOptions{Stdin: STDIN_GCS_URI}
+	if value := os.Getenv("JOB_OPTIONS"); value != "" {
+		// the options of the request that handed the command off, with
+		// its rendered stdin
+		options = CommandOptions{}
+		if err := json.Unmarshal([]byte(value), &options); err != nil {
+			log.Fatalf("Invalid JOB_OPTIONS: %v", err)
+		}
+	}
+	options.apply(context.Background(), command)
+	finishUpload := func(err error) error { return err }
+	if OUTPUT_STDOUT_GCS_URI != "" {
+		finishUpload = uploadStdout(context.Background(), command, OUTPUT_STDOUT_GCS_URI)
+	}
+	if STARTUP_CMD != "" {
+		if err := startupCommandError(context.Background()); err != nil {
+			log.Fatal(err)
+		}
+	}
+	releaseSidecars, err := startSidecars(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = finishUpload(command.Run(context.Background()))
+	releaseSidecars()
+	if err != nil {
+		var exitErr *runner.ExitCodeError
+		if errors.As(err, &exitErr) && exitErr.ExitCode > 0 {
+			log.Print(err)
+			os.Exit(exitErr.ExitCode)
+		}
+		log.Fatal(err)
+	}
+	os.Exit(0)
+}
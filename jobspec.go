@@ -0,0 +1,136 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"text/template"
+
+	"github.com/rosmo/long-cloud-run/pkg/runner"
+)
+
+// JobSpec is a command to run, given in a request or the config file.
+type JobSpec struct {
+	Name    string   `json:"name"`
+	Command string   `json:"command,omitempty"`
+	Args    []string `json:"args,omitempty"`
+
+	// DependsOn are the names of jobs that have to complete before this
+	// job starts. By default the job only runs if they all succeeded.
+	DependsOn []string `json:"dependsOn,omitempty"`
+	// If is a template that decides whether the job runs, evaluated with
+	// the results of the completed jobs as .Jobs.<name>.
+	If string `json:"if,omitempty"`
+	// ContinueOnError lets the batch succeed, and the jobs depending on
+	// this one run, even if it fails.
+	ContinueOnError bool `json:"continueOnError,omitempty"`
+	// Timeout limits how long the job runs, within the timeout of the
+	// request.
+	Timeout Duration `json:"timeout,omitempty"`
+	// Matrix runs the job once per item, with the arguments rendered as
+	// templates with the item as .Item and its index as .Index.
+	Matrix []interface{} `json:"matrix,omitempty"`
+	CommandOptions
+
+	condition *template.Template
+	// matrixJob and item are set on the jobs expanded from a matrix.
+	matrixJob string
+	item      interface{}
+}
+
+// expandMatrix returns a job for each item of the matrix.
+func (j *JobSpec) expandMatrix() ([]*JobSpec, error) {
+	var templates []*template.Template
+	for _, arg := range j.Args {
+		t, err := template.New(j.Name).Option("missingkey=error").Funcs(templateFuncs).Parse(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid argument %q: %w", arg, err)
+		}
+		templates = append(templates, t)
+	}
+	jobs := make([]*JobSpec, 0, len(j.Matrix))
+	for i, item := range j.Matrix {
+		job := *j
+		job.Name = fmt.Sprintf("%s[%d]", j.Name, i)
+		job.Matrix = nil
+		job.matrixJob = j.Name
+		job.item = item
+		job.Args = make([]string, len(templates))
+		for k, t := range templates {
+			var arg bytes.Buffer
+			if err := t.Execute(&arg, map[string]interface{}{"Item": item, "Index": i}); err != nil {
+				return nil, fmt.Errorf("invalid argument %q for item %d: %w", j.Args[k], i, err)
+			}
+			job.Args[k] = arg.String()
+		}
+		jobs = append(jobs, &job)
+	}
+	return jobs, nil
+}
+
+// resolve fills in the defaults of the job spec and checks that the command
+// is allowed to run. The command defaults to the command of the service, any
+// other command has to be listed in ALLOWED_COMMANDS.
+func (j *JobSpec) resolve() error {
+	if j.Command == "" {
+		if len(os.Args) < 2 {
+			return fmt.Errorf("no command set")
+		}
+		j.Command = os.Args[1]
+	}
+	if j.Name == "" {
+		j.Name = filepath.Base(j.Command)
+	}
+	if !commandAllowed(j.Command) {
+		return fmt.Errorf("command not allowed: %s", j.Command)
+	}
+	if j.If != "" {
+		condition, err := template.New(j.Name).Option("missingkey=error").Funcs(templateFuncs).Parse(j.If)
+		if err != nil {
+			return fmt.Errorf("invalid if: %w", err)
+		}
+		j.condition = condition
+	}
+	return nil
+}
+
+func commandAllowed(command string) bool {
+	if len(os.Args) > 1 && command == os.Args[1] {
+		return true
+	}
+	for _, allowed := range ALLOWED_COMMANDS {
+		if command == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// newCommand returns the command of the job, logging and streaming its
+// output prefixed with the job name.
+func (j *JobSpec) newCommand(ctx context.Context, output runner.OutputSink) *runner.Command {
+	command := newCommand(output, j.Command, j.Args...)
+	j.CommandOptions.apply(ctx, command)
+	command.StdoutLogger = log.New(os.Stdout, fmt.Sprintf("[%s] ", j.Name), log.Ldate|log.Ltime)
+	command.StderrLogger = log.New(os.Stderr, fmt.Sprintf("[%s] ", j.Name), log.Ldate|log.Ltime)
+	return command
+}
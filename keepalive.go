@@ -0,0 +1,116 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keepAliveWriter writes a keep-alive to the response when nothing has been
+// written for KEEPALIVE_INTERVAL, so that proxies don't close the connection
+// during quiet phases of the command. Keep-alives are SSE comments for
+// server-sent events and otherwise blank lines, padded with spaces to
+// KEEPALIVE_PADDING bytes for proxies that buffer small chunks.
+type keepAliveWriter struct {
+	http.ResponseWriter
+	flusher  http.Flusher
+	interval time.Duration
+	// keepAlive is written when the response has been idle for interval.
+	keepAlive []byte
+
+	mu   sync.Mutex
+	last time.Time
+	stop chan struct{}
+}
+
+func newKeepAliveWriter(w http.ResponseWriter, flusher http.Flusher, format string) *keepAliveWriter {
+	k := &keepAliveWriter{
+		ResponseWriter: w,
+		flusher:        flusher,
+		interval:       KEEPALIVE_INTERVAL,
+		keepAlive:      []byte(keepAlive(format)),
+		last:           time.Now(),
+		stop:           make(chan struct{}),
+	}
+	go k.run()
+	return k
+}
+
+func (k *keepAliveWriter) Write(b []byte) (int, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.last = time.Now()
+	return k.ResponseWriter.Write(b)
+}
+
+func (k *keepAliveWriter) Flush() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.flusher.Flush()
+}
+
+// Stop stops writing keep-alives. It has to be called before the response
+// is completed.
+func (k *keepAliveWriter) Stop() {
+	close(k.stop)
+	k.mu.Lock()
+	defer k.mu.Unlock()
+}
+
+func (k *keepAliveWriter) run() {
+	timer := time.NewTimer(k.interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-k.stop:
+			return
+		case <-timer.C:
+		}
+		k.mu.Lock()
+		select {
+		case <-k.stop:
+			k.mu.Unlock()
+			return
+		default:
+		}
+		idle := time.Since(k.last)
+		if idle >= k.interval {
+			k.ResponseWriter.Write(k.keepAlive)
+			k.flusher.Flush()
+			k.last = time.Now()
+			idle = 0
+		}
+		k.mu.Unlock()
+		timer.Reset(k.interval - idle)
+	}
+}
+
+// keepAlive returns the keep-alive for the output format.
+func keepAlive(format string) string {
+	prefix, suffix := "", "\n"
+	if format == FormatSSE {
+		prefix, suffix = ": keep-alive", "\n\n"
+	}
+	padding := KEEPALIVE_PADDING - len(prefix) - len(suffix)
+	if padding < 0 {
+		padding = 0
+	}
+	return prefix + strings.Repeat(" ", padding) + suffix
+}
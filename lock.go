@@ -0,0 +1,169 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Lock is a distributed mutex, implemented as a Cloud Storage object that
+// is created only if it doesn't exist yet. Locks held by instances that died
+// without releasing them expire after their TTL.
+type Lock struct {
+	Bucket string
+	Name   string
+
+	generation int64
+}
+
+type lockInfo struct {
+	Holder    string    `json:"holder"`
+	Acquired  time.Time `json:"acquired"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+func NewLock(bucket string, key string) *Lock {
+	return &Lock{
+		Bucket: bucket,
+		Name:   fmt.Sprintf("locks/%s.lock", key),
+	}
+}
+
+// lockKey returns the key of the lock of a command: LOCK_KEY, or the name
+// of the command.
+func lockKey(command string) string {
+	if LOCK_KEY != "" {
+		return LOCK_KEY
+	}
+	return filepath.Base(command)
+}
+
+// lockHolder identifies this instance as the holder of the lock.
+func lockHolder() string {
+	holder, _ := os.Hostname()
+	if revision := os.Getenv("K_REVISION"); revision != "" {
+		holder = revision + "/" + holder
+	}
+	return holder
+}
+
+// TryAcquire tries to acquire the lock once, returning whether it was
+// acquired and who is holding it if it wasn't.
+func (l *Lock) TryAcquire(ctx context.Context, ttl time.Duration) (bool, string, error) {
+	info, err := json.Marshal(lockInfo{
+		Holder:    lockHolder(),
+		Acquired:  time.Now(),
+		ExpiresAt: time.Now().Add(ttl),
+	})
+	if err != nil {
+		return false, "", err
+	}
+
+	// The lock may disappear or expire while we look at it, so retry a
+	// couple of times
+	for attempt := 0; attempt < 3; attempt++ {
+		object, err := uploadObject(ctx, l.Bucket, l.Name, "application/json", info, 0)
+		if err == nil {
+			l.generation, _ = strconv.ParseInt(object.Generation, 10, 64)
+			return true, "", nil
+		}
+		if !isAPIError(err, http.StatusPreconditionFailed) {
+			return false, "", fmt.Errorf("error creating lock gs://%s/%s: %w", l.Bucket, l.Name, err)
+		}
+
+		// Lock exists, check if it has expired
+		object, err = getObject(ctx, l.Bucket, l.Name)
+		if isAPIError(err, http.StatusNotFound) {
+			continue
+		}
+		if err != nil {
+			return false, "", fmt.Errorf("error getting lock gs://%s/%s: %w", l.Bucket, l.Name, err)
+		}
+		contents, err := downloadObject(ctx, l.Bucket, l.Name)
+		if isAPIError(err, http.StatusNotFound) {
+			continue
+		}
+		if err != nil {
+			return false, "", fmt.Errorf("error reading lock gs://%s/%s: %w", l.Bucket, l.Name, err)
+		}
+		var held lockInfo
+		if err := json.Unmarshal(contents, &held); err == nil && time.Now().Before(held.ExpiresAt) {
+			return false, fmt.Sprintf("%s since %s", held.Holder, held.Acquired.Format(time.RFC3339)), nil
+		}
+		generation, _ := strconv.ParseInt(object.Generation, 10, 64)
+		err = deleteObject(ctx, l.Bucket, l.Name, generation)
+		if err != nil && !isAPIError(err, http.StatusPreconditionFailed) && !isAPIError(err, http.StatusNotFound) {
+			return false, "", fmt.Errorf("error removing expired lock gs://%s/%s: %w", l.Bucket, l.Name, err)
+		}
+	}
+	return false, "unknown", nil
+}
+
+// Release releases the lock, if it's still held by us.
+func (l *Lock) Release(ctx context.Context) error {
+	if l.generation == 0 {
+		return nil
+	}
+	err := deleteObject(ctx, l.Bucket, l.Name, l.generation)
+	l.generation = 0
+	if err != nil && !isAPIError(err, http.StatusPreconditionFailed) && !isAPIError(err, http.StatusNotFound) {
+		return fmt.Errorf("error releasing lock gs://%s/%s: %w", l.Bucket, l.Name, err)
+	}
+	return nil
+}
+
+// lockTTL returns how long a lock is held at most: a command handed off to
+// a job may run for JOB_TIMEOUT.
+func lockTTL() time.Duration {
+	if HANDOFF_TO_JOB != "" && JOB_TIMEOUT > REQUEST_TIMEOUT {
+		return JOB_TIMEOUT
+	}
+	return REQUEST_TIMEOUT
+}
+
+// waitForLock waits until the lock is acquired, reporting the wait to the
+// client.
+func waitForLock(ctx context.Context, lock *Lock, w http.ResponseWriter, flusher http.Flusher) error {
+	startTime := time.Now()
+	for {
+		acquired, holder, err := lock.TryAcquire(ctx, lockTTL())
+		if err != nil {
+			return err
+		}
+		if acquired {
+			return nil
+		}
+		message := fmt.Sprintf("[Waiting for lock %s held by %s --- %s]", lock.Name, holder, time.Since(startTime).Truncate(time.Second))
+		log.Println(message)
+		fmt.Fprintln(w, message)
+		flusher.Flush()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(POLL_TIME):
+		}
+	}
+}
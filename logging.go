@@ -0,0 +1,201 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const loggingAPI = "https://logging.googleapis.com/v2/"
+
+// Entries are written to Cloud Logging in batches of at most this many.
+const loggingBatch = 500
+
+// CloudLoggingSink writes the output of a run to a log with the Cloud
+// Logging API, in batches, in the background.
+type CloudLoggingSink struct {
+	LogName string
+	Labels  map[string]string
+	// Trace is the ID of the trace of the request, so that the entries are
+	// shown with the request log entry.
+	Trace string
+	// Fields returns structured fields parsed from a line. Lines with fields
+	// are written as a jsonPayload with the line as its message, and with
+	// the severity of a level field.
+	Fields func(line string) map[string]interface{}
+
+	entries chan map[string]interface{}
+	done    chan struct{}
+	untrack func()
+}
+
+// NewCloudLoggingSink returns a sink that writes to the log with the given
+// name in the project of the service.
+func NewCloudLoggingSink(logName string, labels map[string]string, trace string) *CloudLoggingSink {
+	s := &CloudLoggingSink{
+		LogName: logName,
+		Labels:  labels,
+		Trace:   trace,
+		entries: make(chan map[string]interface{}, loggingBatch),
+		done:    make(chan struct{}),
+	}
+	s.untrack = trackQueue("cloudLogging "+labels["jobId"], func() int { return len(s.entries) })
+	go s.run()
+	return s
+}
+
+// WriteLine queues a line for writing.
+func (s *CloudLoggingSink) WriteLine(line string) error {
+	entry := map[string]interface{}{
+		"textPayload": line,
+		"timestamp":   time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	if fields := s.fields(line); fields != nil {
+		delete(entry, "textPayload")
+		payload := map[string]interface{}{"message": line}
+		for name, value := range fields {
+			payload[name] = value
+		}
+		entry["jsonPayload"] = payload
+		if severity := logSeverity(fields["level"]); severity != "" {
+			entry["severity"] = severity
+		}
+	}
+	s.entries <- entry
+	return nil
+}
+
+func (s *CloudLoggingSink) fields(line string) map[string]interface{} {
+	if s.Fields == nil {
+		return nil
+	}
+	return s.Fields(line)
+}
+
+// Close writes the remaining lines.
+func (s *CloudLoggingSink) Close() error {
+	close(s.entries)
+	<-s.done
+	s.untrack()
+	return nil
+}
+
+func (s *CloudLoggingSink) run() {
+	defer close(s.done)
+	ctx := context.Background()
+	project, err := projectID(ctx)
+	if err != nil {
+		log.Printf("Failed to write output to Cloud Logging: %v", err)
+		for range s.entries {
+		}
+		return
+	}
+	logName := fmt.Sprintf("projects/%s/logs/%s", project, s.LogName)
+	request := map[string]interface{}{
+		"logName":  logName,
+		"resource": cloudRunResource(ctx, project),
+		"labels":   s.Labels,
+	}
+	trace := ""
+	if s.Trace != "" {
+		trace = fmt.Sprintf("projects/%s/traces/%s", project, s.Trace)
+	}
+	if jobID := s.Labels["jobId"]; jobID != "" {
+		log.Printf("Writing output to Cloud Logging: %s", runLogURL(project, logName, jobID))
+	}
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	var batch []map[string]interface{}
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		request["entries"] = batch
+		if err := callAPI(ctx, "POST", loggingAPI+"entries:write", request, nil); err != nil {
+			log.Printf("Failed to write output to Cloud Logging: %v", err)
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case entry, ok := <-s.entries:
+			if !ok {
+				flush()
+				return
+			}
+			if trace != "" {
+				entry["trace"] = trace
+			}
+			batch = append(batch, entry)
+			if len(batch) >= loggingBatch {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// requestTrace returns the trace ID of a request from the
+// X-Cloud-Trace-Context or traceparent header.
+func requestTrace(r *http.Request) string {
+	if header := r.Header.Get("X-Cloud-Trace-Context"); header != "" {
+		return strings.SplitN(header, "/", 2)[0]
+	}
+	if parts := strings.Split(r.Header.Get("traceparent"), "-"); len(parts) == 4 {
+		return parts[1]
+	}
+	return ""
+}
+
+// runLogURL links to the log entries of one run.
+func runLogURL(project string, logName string, jobID string) string {
+	query := fmt.Sprintf("logName=\"%s\"\nlabels.jobId=\"%s\"", logName, jobID)
+	return fmt.Sprintf("https://console.cloud.google.com/logs/query;query=%s?project=%s",
+		url.PathEscape(query), url.QueryEscape(project))
+}
+
+// cloudRunResource returns the monitored resource of the Cloud Run service
+// for log entries.
+func cloudRunResource(ctx context.Context, project string) map[string]interface{} {
+	service := os.Getenv("K_SERVICE")
+	if service == "" {
+		return map[string]interface{}{
+			"type":   "global",
+			"labels": map[string]string{"project_id": project},
+		}
+	}
+	location, _ := region(ctx)
+	return map[string]interface{}{
+		"type": "cloud_run_revision",
+		"labels": map[string]string{
+			"project_id":         project,
+			"location":           location,
+			"service_name":       service,
+			"revision_name":      os.Getenv("K_REVISION"),
+			"configuration_name": os.Getenv("K_CONFIGURATION"),
+		},
+	}
+}
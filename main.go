@@ -1,63 +1,106 @@
-/*    
+/*
 	Copyright 2021 Google LLC
- 
+
     Licensed under the Apache License, Version 2.0 (the "License");
     you may not use this file except in compliance with the License.
     You may obtain a copy of the License at
- 
+
         http://www.apache.org/licenses/LICENSE-2.0
- 
+
     Unless required by applicable law or agreed to in writing, software
     distributed under the License is distributed on an "AS IS" BASIS,
     WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
     See the License for the specific language governing permissions and
     limitations under the License.
 */
+
 package main
 
 import (
-	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"net/http"
 	"os"
-	"os/exec"
-	"syscall"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
-	"io/ioutil"
-	"encoding/json"
-	backoff "github.com/cenkalti/backoff/v4"
+
+	"github.com/rosmo/long-cloud-run/pkg/runner"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 var POLL_TIME time.Duration = 5 * time.Second
 var MAX_POLL_TIME time.Duration = 300 * time.Second
 
-type Command struct {
-	Name string
-	Args []string
-
-	ShowOutput       bool
-	CanFail          bool
-	AllowedExitCodes []int
-	Request			 *http.Request
-	Response         *http.ResponseWriter
-	Flusher          *http.Flusher
-
-	StdoutLogger log.Logger
-	StderrLogger log.Logger
-}
+// executor starts the processes of commands, replaced with fake processes in
+// tests.
+var executor runner.Executor = runner.ExecExecutor{}
 
 type PubSubMessage struct {
 	Message struct {
-		Data []byte `json:"data,omitempty"`
-		ID   string `json:"id"`
+		Data       []byte            `json:"data,omitempty"`
+		Attributes map[string]string `json:"attributes,omitempty"`
+		ID         string            `json:"messageId"`
 	} `json:"message"`
-	Subscription string `json:"subscription"`
+	Subscription    string `json:"subscription"`
+	DeliveryAttempt int    `json:"deliveryAttempt,omitempty"`
 }
 
 func main() {
+	loadConfig()
+	if err := runner.StartReaper(SUBREAPER); err != nil {
+		log.Fatal(err)
+	}
+
+	// Cloud Run Jobs run the command directly, without a HTTP server
+	if os.Getenv("CLOUD_RUN_JOB") != "" && len(os.Args) > 1 {
+		runAsJob()
+	}
+
 	log.Print("Starting Cloud Run function...")
-	http.HandleFunc("/", handler)
+	go selfCheck.Run(context.Background())
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", withAuth("/", handler))
+	mux.HandleFunc("/ready", withAuth("/ready", readyHandler))
+	mux.HandleFunc(selfCheckPath, withAuth(selfCheckPath, selfCheckHandler))
+	if ENABLE_H2C {
+		mux.HandleFunc(healthCheckPath, withAuth(healthCheckPath, healthHandler))
+		mux.HandleFunc(healthWatchPath, withAuth(healthWatchPath, healthHandler))
+	}
+	if HISTORY_COLLECTION != "" {
+		mux.HandleFunc("/history", withAuth("/history", historyHandler))
+	}
+	mux.HandleFunc(jobsPath, withAuth(jobsPath, jobHandler))
+	if CONFIG_FILE != "" {
+		mux.HandleFunc(reloadPath, withAuth(reloadPath, reloadHandler))
+		reloadOnSIGHUP()
+	}
+	if ENABLE_DEBUG {
+		registerDebugHandlers(mux)
+	}
+	if sinks := enabledResultSinks(); len(sinks) > 0 {
+		log.Printf("Reporting results to %s.", strings.Join(sinks, ", "))
+	}
+	if MAX_CONCURRENT_RUNS > 0 {
+		trackQueue("runs", runs.Waiting)
+	}
+	if len(CONFIG.Schedules) > 0 {
+		startScheduler(CONFIG.Schedules)
+	}
+	if CLEANUP_CMD != "" {
+		startCleanup()
+	}
+	if DISK_WARN_BYTES > 0 || DISK_LIMIT_BYTES > 0 {
+		startDiskMonitor()
+	}
 
 	// Determine port for HTTP service.
 	port := os.Getenv("PORT")
@@ -68,147 +111,245 @@ func main() {
 
 	// Start HTTP server.
 	log.Printf("Listening on port %s", port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
+	if err := newServer(":"+port, mux).ListenAndServe(); err != nil {
 		log.Fatal(err)
 	}
 }
 
-func NewCommand(request *http.Request, response *http.ResponseWriter, flusher *http.Flusher, name string, args ...string) *Command {
-	stdoutLogger := *log.New(os.Stdout, fmt.Sprintf("[%s] ", name), log.Ldate|log.Ltime)
-	stderrLogger := *log.New(os.Stderr, fmt.Sprintf("[%s] ", name), log.Ldate|log.Ltime)
-	return &Command{
-		Name:             name,
-		Args:             args,
-		ShowOutput:       true,
-		CanFail:          false,
-		AllowedExitCodes: []int{0},
-		Request: request,
-		Response:         response,
-		Flusher:          flusher,
-		StdoutLogger:     stdoutLogger,
-		StderrLogger:     stderrLogger,
+// newServer returns the HTTP server. It has no read or write timeout, as
+// those would cut off uploads and streamed output; the run is limited by the
+// request context instead.
+func newServer(addr string, handler http.Handler) *http.Server {
+	if ENABLE_H2C {
+		handler = h2c.NewHandler(handler, &http2.Server{IdleTimeout: IDLE_TIMEOUT})
+	}
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: READ_HEADER_TIMEOUT,
+		IdleTimeout:       IDLE_TIMEOUT,
 	}
 }
 
-func (c Command) writeProgress(message string) {
-	c.StderrLogger.Println(message)
-	fmt.Fprintln(*c.Response, message)
-	(*c.Flusher).Flush()
+// newCommand returns a command configured from the environment, writing its
+// output to output if it isn't nil.
+func newCommand(output runner.OutputSink, name string, args ...string) *runner.Command {
+	command := runner.NewCommand(name, args...)
+	command.ProgressRegex = PROGRESS_REGEX
+	command.MaxOutputBytes = MAX_OUTPUT_BYTES
+	command.MaxOutputLines = MAX_OUTPUT_LINES
+	command.KillOnOutputLimit = KILL_ON_OUTPUT_LIMIT
+	command.MemoryLimit = MEMORY_LIMIT_BYTES * MEMORY_LIMIT_PERCENT / 100
+	command.MemoryCheckInterval = MEMORY_CHECK_INTERVAL
+	command.ResourceLimits = RESOURCE_LIMITS
+	command.RunAs = RUN_AS
+	command.Dir = WORKING_DIR
+	command.Chroot = CHROOT
+	command.Timeout = REQUEST_TIMEOUT - DEADLINE_MARGIN
+	command.TerminationSignal = TERMINATION_SIGNAL
+	command.TerminationGrace = TERMINATION_GRACE
+	command.PollInterval = POLL_TIME
+	command.MaxPollInterval = MAX_POLL_TIME
+	command.DrainTime = OUTPUT_DRAIN_TIME
+	command.KillOrphans = KILL_ORPHANS
+	command.Executor = executor
+	command.AllowedExitCodes = ALLOWED_EXIT_CODES
+	command.CanFail = CAN_FAIL
+	command.ShowOutput = SHOW_OUTPUT
+	command.BinaryEncoding = BINARY_OUTPUT
+	command.CollapseRepeats = COLLAPSE_REPEATS
+	command.MaxLinesPerSecond = MAX_LINES_PER_SECOND
+	command.SampleEvery = LINE_SAMPLE_EVERY
+	command.HeartbeatDetails = disk.heartbeatDetails
+	if STALL_TIMEOUT > 0 {
+		command.StallTimeout = STALL_TIMEOUT
+		if STALL_SIGNAL != 0 {
+			command.StallSignal = STALL_SIGNAL
+		}
+		command.KillOnStall = KILL_ON_STALL
+		command.OnStall = func(silent time.Duration) {
+			notify(context.Background(), EventStall, runner.Result{JobID: command.JobID, Command: command.Name, Args: command.Args, Duration: silent})
+		}
+	}
+	if output != nil {
+		command.Output = output
+	}
+	return command
 }
 
-func (c Command) Run() error {
-	c.writeProgress(fmt.Sprintf("Running command: %s", c.Name))
-	c.StdoutLogger.Printf("Running as: %s %+q", c.Name, c.Args)
+// uploadStdout uploads the standard output of the command to the object at
+// the gs:// URI as it's written, with the bytes uploaded in the heartbeats.
+// The returned function finishes the upload once the command has exited
+// with err. The object is only created if the command succeeded, and a
+// failed upload fails the run.
+func uploadStdout(ctx context.Context, command *runner.Command, uri string) func(err error) error {
+	upload := newObjectWriter(ctx, uri)
+	command.Stdout = upload
+	heartbeatDetails := command.HeartbeatDetails
+	command.HeartbeatDetails = func() []string {
+		details := []string{runner.FormatBytes(upload.Uploaded()) + " uploaded"}
+		if heartbeatDetails != nil {
+			details = append(details, heartbeatDetails()...)
+		}
+		return details
+	}
+	return func(err error) error {
+		if err != nil {
+			return err
+		}
+		if err := upload.Close(); err != nil {
+			command.Result.Status = runner.StatusFailed
+			command.Result.Error = err.Error()
+			return err
+		}
+		log.Printf("Uploaded %s of output to %s.", runner.FormatBytes(upload.Uploaded()), uri)
+		return nil
+	}
+}
 
-	// Build command
-	cmd := exec.CommandContext(c.Request.Context(), c.Name, c.Args...)
+// Formats of the output streamed to the client.
+const (
+	FormatText   = "text"
+	FormatSSE    = "sse"
+	FormatNDJSON = "ndjson"
+)
 
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return fmt.Errorf("error getting stdout pipe: %w", err)
+// outputFormat returns the format the client asked for with the Accept
+// header: server-sent events, newline-delimited JSON or plain text.
+func outputFormat(r *http.Request) string {
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, "text/event-stream"):
+		return FormatSSE
+	case strings.Contains(accept, "application/x-ndjson"):
+		return FormatNDJSON
 	}
-	stdoutBuf := bufio.NewScanner(stdout)
+	return FormatText
+}
 
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		return fmt.Errorf("error getting stderr pipe: %w", err)
-	}
-	stderrBuf := bufio.NewScanner(stderr)
-
-	startTime := time.Now()
-	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("error starting command: %w", err)
-	}
-
-	done := make(chan error)
-	output := make(chan string)
-
-	// Wait for actual command to complete
-	go func() { 
-		done <- cmd.Wait() 
-	}()
-
-	// Read stdout and stderr and relay output via channel
-	go func() {
-		for stdoutBuf.Scan() {
-			text := stdoutBuf.Text()
-			output <- text
-		}
-	}()
-	go func() {
-		for stderrBuf.Scan() {
-			text := stderrBuf.Text()
-			output <- text
-		}
-	}()
-
-	b := backoff.NewExponentialBackOff()
-	bctx := backoff.WithContext(b, c.Request.Context())
-	b.InitialInterval = POLL_TIME
-	b.MaxInterval = MAX_POLL_TIME
-	b.Stop = backoff.Stop
-
-	// This will set the maximum duration the command can run
-	b.MaxElapsedTime = 60 * time.Minute
-
-	pollTimer := backoff.NewTicker(bctx)
-	lastIntervalTime := time.Now()
-	processTerminated := false
-	for {
-		select {
-		case line := <-output:
-			if c.ShowOutput {
-				c.writeProgress(line)
-			} else {
-				c.StderrLogger.Println(line)
-			}
-		case tick := <-pollTimer.C:
-			intervalTime := time.Now()
-			if tick.Year() == 1 {
-				if !processTerminated {
-					pollTimer.Stop()
-					if err := cmd.Process.Kill(); err != nil {
-						return fmt.Errorf("Failed to terminate command: %w", err)
-					}
-					c.writeProgress(fmt.Sprintf("Command timed out in %s: %s", b.MaxElapsedTime.Truncate(time.Minute).String(), c.Name))
-					processTerminated = true
-				}
-			} else {
-				if intervalTime.Sub(lastIntervalTime) > time.Second {
-					c.writeProgress(fmt.Sprintf("[Still waiting for command to complete: %s --- %s]", c.Name, intervalTime.Sub(startTime).Truncate(time.Second).String()))
-					lastIntervalTime = time.Now()
-				}
-			}
-		case err := <-done:
-			pollTimer.Stop()
-			endTime := time.Now()
-			commandDuration := endTime.Sub(startTime).Truncate(time.Second).String()
-			if err != nil {
-				if c.CanFail {
-					c.StdoutLogger.Printf("Warning, command failed (ignoring error) in %s: %v", commandDuration, err)
-					return nil
-				}
-				if exiterr, ok := err.(*exec.ExitError); ok {
-					if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
-						for _, exitcode := range c.AllowedExitCodes {
-							if status.ExitStatus() == exitcode {
-								c.StdoutLogger.Printf("Command completed with allowed status code in %s: %d", commandDuration, status.ExitStatus())
-								return nil
-							}
-						}
-						return fmt.Errorf("Command exited with status code in %s: %d", commandDuration, status.ExitStatus())
-					}
-				}
-				return fmt.Errorf("Command failed in %s: %w", commandDuration, err)
-			} else {
-				c.writeProgress(fmt.Sprintf("Command completed in %s: %s", commandDuration, c.Name))
-				return nil
-			}
+// clientSink returns the sink streaming the output to the client.
+func clientSink(w io.Writer, flusher http.Flusher, format string) runner.OutputSink {
+	switch format {
+	case FormatSSE:
+		return &runner.SSESink{Writer: w, Flusher: flusher}
+	case FormatNDJSON:
+		return &runner.NDJSONSink{Writer: w, Flusher: flusher}
+	}
+	return &runner.HTTPSink{Writer: w, Flusher: flusher}
+}
+
+// flushWriter flushes every write, for passing through the standard output
+// of a command as it is written.
+type flushWriter struct {
+	io.Writer
+	flusher http.Flusher
+}
+
+func (w *flushWriter) Write(b []byte) (int, error) {
+	n, err := w.Writer.Write(b)
+	w.flusher.Flush()
+	return n, err
+}
+
+// runOutputs returns the sinks for the output of a run: the client, and the
+// transcript and log, if configured. The transcripts of a tenant are kept
+// under its name.
+func runOutputs(client runner.OutputSink, tenant *Tenant, command string, trigger string, jobID string, trace string, startTime time.Time) runner.MultiSink {
+	fields := lineFields(command)
+	if ndjson, ok := client.(*runner.NDJSONSink); ok {
+		ndjson.Fields = fields
+	}
+	if PREFIX_JOB_ID {
+		client = &prefixSink{client, "[" + jobID + "] "}
+	}
+	outputs := runner.MultiSink{client}
+	if TRANSCRIPT_GCS_URI != "" {
+		transcript, err := NewGCSSink(tenantPrefix(TRANSCRIPT_GCS_URI, tenant), command, jobID, startTime)
+		if err != nil {
+			log.Printf("Failed to create transcript: %v", err)
+		} else {
+			log.Printf("Writing transcript to %s", transcript.URI())
+			outputs = append(outputs, transcript)
 		}
 	}
+	if LOGGING_LOG_NAME != "" {
+		logging := NewCloudLoggingSink(LOGGING_LOG_NAME, map[string]string{
+			"jobId":   jobID,
+			"command": commandLabel(command),
+			"trigger": trigger,
+		}, trace)
+		logging.Fields = fields
+		outputs = append(outputs, logging)
+	}
+	return outputs
+}
+
+// newJobID returns a random UUID identifying a run.
+func newJobID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// setJobID sets the run ID of the command and adds it to the prefix of its
+// log lines.
+func setJobID(command *runner.Command, jobID string) {
+	if jobID == "" {
+		return
+	}
+	command.JobID = jobID
+	for _, logger := range []*log.Logger{command.StdoutLogger, command.StderrLogger} {
+		logger.SetPrefix(strings.TrimSuffix(logger.Prefix(), "] ") + " " + jobID + "] ")
+	}
+}
+
+// reportResult records the result of a run in the circuit breaker and
+// reports it to the enabled result sinks.
+func reportResult(trigger string, result runner.Result, err error) {
+	ctx := context.Background()
+	breaker.record(result.Command, err, time.Now())
+	reportToSinks(ctx, trigger, result, err)
+}
+
+// commandTimeout returns how long a command started now can run, so that it
+// completes before the request deadline, and within the timeout requested
+// with X-Command-Timeout.
+func commandTimeout(r *http.Request, requestStart time.Time) time.Duration {
+	deadline := requestStart.Add(REQUEST_TIMEOUT)
+	if requestDeadline, ok := r.Context().Deadline(); ok && requestDeadline.Before(deadline) {
+		deadline = requestDeadline
+	}
+	timeout := time.Until(deadline) - DEADLINE_MARGIN
+	if requested, err := requestedTimeout(r); err == nil && requested > 0 {
+		if remaining := requestStart.Add(requested).Sub(time.Now()); remaining < timeout {
+			timeout = remaining
+		}
+	}
+	return timeout
+}
+
+// requestedTimeout returns the timeout requested with the X-Command-Timeout
+// header, as a duration (15m) or seconds. It can only shorten the timeout.
+func requestedTimeout(r *http.Request) (time.Duration, error) {
+	value := r.Header.Get("X-Command-Timeout")
+	if value == "" {
+		return 0, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, atoiErr := strconv.Atoi(value)
+		timeout, err = time.Duration(seconds)*time.Second, atoiErr
+	}
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("invalid X-Command-Timeout: %s", value)
+	}
+	return timeout, nil
 }
 
 func handler(w http.ResponseWriter, r *http.Request) {
+	requestStart := time.Now()
 	if len(os.Args) == 1 {
 		log.Fatalf("No command to run set!")
 	}
@@ -219,43 +360,746 @@ func handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	go func(done <-chan struct{}) {
-        <-done
-        log.Println("Client closed connection, command terminating.")
-    }(r.Context().Done())
-
+	if err := selfCheck.Wait(r.Context()); err != nil {
+		log.Printf("Not ready: %v", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
 
 	var m PubSubMessage
-	body, err := ioutil.ReadAll(r.Body)
+	var body []byte
+	var upload *Upload
+	var err error
+	if isMultipart(r) {
+		if HANDOFF_TO_JOB != "" {
+			http.Error(w, "Uploads aren't supported with HANDOFF_TO_JOB", http.StatusBadRequest)
+			return
+		}
+		if upload, err = stageUpload(r); err != nil {
+			log.Printf("Failed to stage upload: %v", err)
+			status := http.StatusBadRequest
+			if errors.Is(err, errUploadTooLarge) {
+				status = http.StatusRequestEntityTooLarge
+			}
+			http.Error(w, fmt.Sprintf("Invalid upload: %v", err), status)
+			return
+		}
+		defer upload.Remove()
+		defer disk.use(upload.Dir)()
+	} else if body, err = readBody(r, &m); err != nil {
+		var envelopeErr *envelopeError
+		if !errors.As(err, &envelopeErr) {
+			log.Printf("Failed to read request body: %v", err)
+			status := http.StatusBadRequest
+			if errors.Is(err, errBodyTooLarge) {
+				status = http.StatusRequestEntityTooLarge
+			}
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		if !PLAIN_TRIGGER {
+			log.Printf("Failed to parse JSON body: %v", err)
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		log.Println("Not a Pub/Sub invocation (plain request body).")
+		m = PubSubMessage{}
+	}
+	trigger := "http"
+	if isCloudScheduler(r) {
+		trigger = "cloudscheduler"
+		log.Printf("Invoked by Cloud Scheduler job %s.", r.Header.Get("X-CloudScheduler-JobName"))
+	} else if len(body) == 0 && m.Subscription == "" && upload == nil {
+		log.Println("Not a Pub/Sub invocation (no request body).")
+	}
+
+	if m.Subscription != "" {
+		trigger = "pubsub"
+	}
+	resume, err := unwrapContinuation(&m)
 	if err != nil {
-		log.Printf("Failed to read request body: %v", err)
+		log.Print(err)
 		http.Error(w, "Bad Request", http.StatusBadRequest)
 		return
 	}
-	if len(body) > 0 {
-		if err := json.Unmarshal(body, &m); err != nil {
-			log.Printf("Failed to parse JSON body: %v", err)
-			http.Error(w, "Bad Request", http.StatusBadRequest)
+	jobID := newJobID()
+	w.Header().Set("X-Job-Id", jobID)
+	audit := newAuditEntry(r, trigger)
+	audit.MessageID = m.Message.ID
+	audit.JobID = jobID
+
+	followup, err := newFollowup(r, body, &m)
+	if err != nil {
+		log.Print(err)
+		audit.Deny(err.Error())
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := requestedTimeout(r); err != nil {
+		log.Print(err)
+		audit.Deny(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	options, err := requestOptions(r, &m)
+	if err != nil {
+		log.Print(err)
+		audit.Deny(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	priority, err := requestPriority(r, &m)
+	if err != nil {
+		log.Print(err)
+		audit.Deny(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	batch, err := parseBatch(body, &m)
+	if err != nil {
+		log.Printf("Invalid batch: %v", err)
+		audit.Deny(fmt.Sprintf("invalid batch: %v", err))
+		http.Error(w, fmt.Sprintf("Invalid batch: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	commandName, commandArgs := os.Args[1], os.Args[2:]
+	var rule *DispatchRule
+	if trigger == "pubsub" {
+		if rule, err = dispatchRule(&m); err != nil {
+			log.Print(err)
+			audit.Deny(err.Error())
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if rule != nil {
+			log.Printf("Dispatching message %s to %s.", m.Message.ID, rule.Name)
+			commandName, commandArgs = rule.Command, rule.Args
+		}
+	}
+	caller := verifiedCaller(r, time.Now())
+	tenant, err := requestTenant(r, caller)
+	if err == nil && tenant != nil {
+		audit.Tenant = tenant.Name
+		if rule == nil && tenant.Command != "" {
+			commandName, commandArgs = tenant.Command, tenant.Args
+		}
+		commands := []string{commandName}
+		if batch != nil {
+			commands = batch.commands()
+		}
+		for _, command := range commands {
+			if !tenant.allows(command) {
+				err = fmt.Errorf("command not allowed for tenant %s: %s", tenant.Name, command)
+				break
+			}
+		}
+	}
+	if err != nil {
+		log.Print(err)
+		audit.Deny(err.Error())
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	var tenantDir string
+	if tenant != nil {
+		if tenantDir, err = tenant.workingDir(); err != nil {
+			log.Print(err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		defer disk.use(tenantDir)()
+	}
+	invocation := newInvocation(r, trigger, body, &m)
+	invocation.JobID = jobID
+	if tenant != nil {
+		invocation.Tenant = tenant.Name
+	}
+	if upload != nil {
+		invocation.Body = upload.Values
+		invocation.Files = upload.paths()
+	}
+	if batch == nil {
+		schema := PAYLOAD_SCHEMA
+		if rule != nil && rule.Schema != nil {
+			schema = rule.Schema
+		}
+		if err := schema.Validate(invocation.Body); err != nil {
+			log.Printf("Invalid payload: %v", err)
+			audit.Deny(fmt.Sprintf("invalid payload: %v", err))
+			http.Error(w, fmt.Sprintf("Invalid payload: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if len(commandArgs) > 0 {
+		commandArgs, err = renderArgs(commandArgs, invocation)
+		if err != nil {
+			log.Print(err)
+			audit.Deny(err.Error())
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-	} else {
-		log.Println("Not a Pub/Sub invocation (no request body).")
 	}
 
-	// You can unmarshal m.Message.Data here to leverage Pub/Sub message contents
-	// as arguments
+	extraArgs, err := queryArgs(r)
+	if err == nil && len(extraArgs) > 0 && batch != nil {
+		err = fmt.Errorf("arguments can't be given for batches")
+	}
+	var callback string
+	if err == nil {
+		callback, err = requestCallback(r, &m, invocation)
+	}
+	if err == nil && callback != "" && batch != nil {
+		err = fmt.Errorf("callbacks can't be given for batches")
+	}
+	if err != nil {
+		log.Print(err)
+		audit.Deny(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(extraArgs) > 0 {
+		commandArgs = append(append([]string{}, commandArgs...), extraArgs...)
+	}
+
+	stdinURI, err := renderURI(STDIN_GCS_URI, invocation)
+	var stdoutURI string
+	if err == nil {
+		stdoutURI, err = renderURI(OUTPUT_STDOUT_GCS_URI, invocation)
+	}
+	if err != nil {
+		log.Print(err)
+		audit.Deny(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if tenant != nil {
+		// every object the request or its rule can read or write
+		uris := []string{stdinURI, stdoutURI, options.Stdin}
+		if rule != nil {
+			uris = append(uris, rule.Stdin)
+		}
+		if batch != nil {
+			for _, job := range batch.Jobs {
+				uris = append(uris, job.Stdin)
+			}
+		}
+		for _, uri := range uris {
+			if err = tenant.checkURI(uri); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			log.Print(err)
+			audit.Deny(err.Error())
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	commands := []string{commandName}
+	if batch != nil {
+		batch.jobID = jobID
+		commands = batch.commands()
+	}
+	limitedCaller := rateLimitCaller(r, caller)
+	ok, retryAfter := checkRateLimits(r.URL.Path, limitedCaller, commands)
+	if ok && tenant != nil && tenant.rateLimit != nil {
+		ok, retryAfter = limiter.take("tenant "+tenant.Name, tenant.rateLimit, time.Now())
+	}
+	if !ok {
+		log.Printf("Rate limit reached for %s, retry after %s.", limitedCaller, retryAfter.Round(time.Second))
+		audit.Deny("rate limited")
+		rateLimited(w, retryAfter)
+		return
+	}
+
+	var lock *Lock
+	lockAcquired := false
+	dryRunRequested := isDryRun(r)
+	cacheKey := ""
+	ttl := cacheTTL(commandName)
+	// A continuation resumes from its checkpoint, which isn't part of the key
+	if ttl > 0 && batch == nil && upload == nil && resume == nil && !dryRunRequested && STDOUT_CONTENT_TYPE == "" && stdoutURI == "" {
+		keyOptions := []CommandOptions{options}
+		if rule != nil {
+			keyOptions = append(keyOptions, rule.CommandOptions)
+		}
+		cacheKey = resultCacheKey(tenant, commandName, commandArgs, stdinURI, keyOptions...)
+		if cached, ok := cache.get(cacheKey, time.Now()); ok {
+			log.Printf("Returning the cached result of run %s.", cached.Result.JobID)
+			audit.Reason = "cached result of run " + cached.Result.JobID
+			audit.write()
+			if trigger != "pubsub" {
+				w.Header().Set("X-Cached-Job-Id", cached.Result.JobID)
+				fmt.Fprintln(w, cached.message())
+			}
+			return
+		}
+	}
+	if SPILL_ARG_BYTES > 0 {
+		var spilled []string
+		commandArgs, spilled, err = spillArgs(commandArgs, SPILL_ARG_BYTES)
+		if err != nil {
+			log.Print(err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		defer removeFiles(spilled)
+		defer disk.use(spilled...)()
+	}
+	for _, command := range commands {
+		if err := verifyExecutable(command); err != nil {
+			log.Print(err)
+			audit.Deny(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	var expect []runner.Expectation
+	if batch == nil {
+		if expect, err = expectations(r.Context(), commandName); err != nil {
+			log.Print(err)
+			audit.Deny(err.Error())
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if len(expect) > 0 && (stdinURI != "" || options.Stdin != "" || (rule != nil && rule.Stdin != "")) {
+			audit.Deny("expect with stdin")
+			http.Error(w, "Standard input can't be given to a command with expect rules", http.StatusBadRequest)
+			return
+		}
+	}
+	if err := runner.CheckArgs(commandName, commandArgs, os.Environ()); err != nil {
+		log.Print(err)
+		audit.Deny(err.Error())
+		http.Error(w, fmt.Sprintf("%v, pass large data in a file or on standard input", err), http.StatusRequestEntityTooLarge)
+		return
+	}
+	// waitWindow is set when the run waits on the instance for its window
+	var waitWindow *WindowClosedError
+	if !dryRunRequested {
+		if closed := checkWindows(commands, time.Now()); closed != nil {
+			log.Print(closed)
+			switch action := closed.Window.Action; {
+			case action == WindowQueue && !closed.Opens.IsZero() && closed.Opens.Before(time.Now().Add(commandTimeout(r, requestStart))):
+				waitWindow = closed
+			case action == WindowDelay && !closed.Opens.IsZero() && upload == nil:
+				replay := body
+				var err error
+				if trigger == "pubsub" {
+					replay, err = json.Marshal(m)
+				}
+				var task string
+				if err == nil {
+					task, err = delayRun(r.Context(), closed, r, replay)
+				}
+				if err != nil {
+					log.Printf("Failed to delay the run: %v", err)
+					http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+					return
+				}
+				message := fmt.Sprintf("[Delayed until %s: %s]", closed.Opens.Format(time.RFC3339), task)
+				log.Println(message)
+				audit.Reason = "delayed until " + closed.Opens.Format(time.RFC3339)
+				audit.write()
+				w.WriteHeader(http.StatusAccepted)
+				fmt.Fprintln(w, message)
+				return
+			default:
+				audit.Deny(closed.Error())
+				if retryAfter := closed.RetryAfter(time.Now()); retryAfter > 0 {
+					w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+				}
+				http.Error(w, closed.Error(), errorStatus(closed))
+				return
+			}
+		}
+		for _, command := range commands {
+			allowed := time.Now()
+			if err := breaker.allow(command, allowed); err != nil {
+				log.Print(err)
+				audit.Deny(err.Error())
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(err.(*CircuitOpenError).RetryAfter.Seconds()))))
+				http.Error(w, err.Error(), errorStatus(err))
+				return
+			}
+			defer breaker.release(command, allowed)
+		}
+		if err := disk.Allow(); err != nil {
+			log.Print(err)
+			audit.Deny(err.Error())
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+	}
+	if LOCK_BUCKET != "" && !dryRunRequested {
+		lock = NewLock(LOCK_BUCKET, lockKey(commandName))
+		acquired, holder, err := lock.TryAcquire(r.Context(), lockTTL())
+		lockAcquired = acquired
+		if err != nil {
+			log.Printf("Failed to acquire lock: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if !acquired && LOCK_MODE == "reject" {
+			log.Printf("Command already running (lock %s held by %s).", lockKey(commandName), holder)
+			audit.Deny(fmt.Sprintf("already running (held by %s)", holder))
+			http.Error(w, fmt.Sprintf("Command already running (held by %s)", holder), http.StatusConflict)
+			return
+		}
+		// A run handed off to a job takes the lock along
+		defer func() {
+			if lock != nil {
+				lock.Release(context.Background())
+			}
+		}()
+	}
+
+	// Pub/Sub only looks at the response status, so hold it back until the
+	// command has completed. The output is still logged.
+	response := w
+	// In passthrough mode the response body is the standard output of the
+	// command, and everything else is only logged.
+	passthrough := STDOUT_CONTENT_TYPE != "" && OUTPUT_STDOUT_GCS_URI == "" && trigger != "pubsub" && batch == nil && !dryRunRequested && HANDOFF_TO_JOB == ""
+	format := outputFormat(r)
+	if passthrough {
+		format = FormatText
+		w.Header().Set("Content-Type", STDOUT_CONTENT_TYPE)
+	} else if format == FormatNDJSON {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	if trigger == "pubsub" {
+		discard := &discardResponseWriter{}
+		w = discard
+		flusher = discard
+	} else if format == FormatSSE {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+	} else if !DISABLE_GZIP && KEEPALIVE_PADDING == 0 && acceptsGzip(r) {
+		gzw := newGzipResponseWriter(w, flusher)
+		defer gzw.Close()
+		w = gzw
+		flusher = gzw
+	}
+
+	if trigger != "pubsub" {
+		w.Header().Set("Transfer-Encoding", "chunked")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+	}
+	if KEEPALIVE_INTERVAL > 0 && trigger != "pubsub" && !passthrough {
+		keeper := newKeepAliveWriter(w, flusher, format)
+		defer keeper.Stop()
+		w = keeper
+		flusher = keeper
+	}
+	var stdout io.Writer
+	if passthrough {
+		stdout = &flushWriter{Writer: w, flusher: flusher}
+		discard := &discardResponseWriter{}
+		w = discard
+		flusher = discard
+	}
+
+	if lock != nil && !lockAcquired {
+		if err := waitForLock(r.Context(), lock, w, flusher); err != nil {
+			log.Printf("Failed to acquire lock: %v", err)
+			if trigger == "pubsub" {
+				http.Error(response, "Service Unavailable", http.StatusServiceUnavailable)
+			}
+			return
+		}
+	}
+
+	if waitWindow != nil {
+		err := waitForWindow(r.Context(), waitWindow, func() {
+			message := fmt.Sprintf("[Waiting for the execution window until %s]", waitWindow.Opens.Format(time.RFC3339))
+			log.Println(message)
+			fmt.Fprintln(w, message)
+			flusher.Flush()
+		})
+		if err != nil {
+			log.Printf("Cancelled while waiting for the execution window: %v", err)
+			if trigger == "pubsub" {
+				http.Error(response, "Service Unavailable", http.StatusServiceUnavailable)
+			}
+			return
+		}
+	}
 
-	w.Header().Set("Transfer-Encoding", "chunked")
-	w.WriteHeader(http.StatusOK)
-	flusher.Flush()
+	if dryRunRequested {
+		err := dryRun(r.Context(), w, batch, commandName, commandArgs, commandTimeout(r, requestStart))
+		flusher.Flush()
+		if err != nil {
+			log.Print(err)
+			fmt.Fprintf(w, "[%v]\n", err)
+		}
+		audit.Reason = "dry run"
+		audit.write()
+		if trigger == "pubsub" {
+			respondPubSub(response, &m, err, PERMANENT_FAILURE_STATUS)
+		}
+		return
+	}
 
-	var commandArgs []string
-	if len(os.Args) > 2 {
-		commandArgs = os.Args[2:len(os.Args)]
+	if HANDOFF_TO_JOB != "" {
+		jobOptions := CommandOptions{Stdin: stdinURI}
+		if rule != nil {
+			jobOptions = jobOptions.override(rule.CommandOptions)
+		}
+		handoff := &JobHandoff{
+			JobName:  HANDOFF_TO_JOB,
+			JobID:    jobID,
+			Args:     append([]string{commandName}, commandArgs...),
+			Options:  jobOptions.override(options),
+			Lock:     lock,
+			Request:  r,
+			Response: &w,
+			Flusher:  &flusher,
+			Logger:   log.New(os.Stderr, fmt.Sprintf("[%s] ", HANDOFF_TO_JOB), log.Ldate|log.Ltime),
+		}
+		lock = nil
+		err := handoff.Run()
+		if err != nil {
+			log.Print(err)
+			audit.Error = err.Error()
+		}
+		audit.Reason = "handed off to job " + HANDOFF_TO_JOB
+		audit.write()
+		if trigger == "pubsub" {
+			respondPubSub(response, &m, err, http.StatusServiceUnavailable)
+		}
+		return
 	}
-	command := NewCommand(r, &w, &flusher, os.Args[1], commandArgs...)
-	err = command.Run()
+
+	queuedAt := time.Now()
+	err = runs.acquire(r.Context(), priority, func(position int) {
+		message := fmt.Sprintf("[Queued at position %d --- %s]", position, time.Since(queuedAt).Truncate(time.Second))
+		log.Println(message)
+		fmt.Fprintln(w, message)
+		flusher.Flush()
+	})
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("Cancelled while queued: %v", err)
+		if trigger == "pubsub" {
+			http.Error(response, "Service Unavailable", http.StatusServiceUnavailable)
+		}
+		return
+	}
+	defer runs.release()
+
+	releaseSidecars, err := startSidecars(r.Context())
+	if err != nil {
+		log.Print(err)
+		fmt.Fprintf(w, "[%v]\n", err)
+		audit.Error = err.Error()
+		audit.write()
+		if trigger == "pubsub" {
+			respondPubSub(response, &m, err, http.StatusServiceUnavailable)
+		} else {
+			setStatusTrailer(response, http.StatusServiceUnavailable)
+		}
+		return
 	}
-}
\ No newline at end of file
+	defer releaseSidecars()
+
+	if batch != nil {
+		defer trackRun(jobID, "batch", trigger)()
+		sw := &syncResponseWriter{ResponseWriter: w, flusher: flusher}
+		outputs := runOutputs(clientSink(sw, sw, format), tenant, "batch", trigger, jobID, requestTrace(r), time.Now())
+		results, err := runBatch(r.Context(), outputs, time.Now().Add(commandTimeout(r, requestStart)), trigger, batch)
+		if lock != nil {
+			lock.Release(context.Background())
+		}
+		if err := outputs.Close(); err != nil {
+			log.Print(err)
+		}
+		audit.FinishBatch(batch, results, err)
+		status := http.StatusOK
+		if err != nil {
+			log.Print(err)
+			status = PERMANENT_FAILURE_STATUS
+			if batchRetryable(results) {
+				status = http.StatusServiceUnavailable
+			}
+		}
+		if trigger == "pubsub" {
+			respondPubSub(response, &m, err, status)
+		} else {
+			setStatusTrailer(response, status)
+		}
+		return
+	}
+
+	ctx, cancelRun := runContext(r.Context())
+	defer cancelRun()
+	outputs := runOutputs(clientSink(w, flusher, format), tenant, commandName, trigger, jobID, requestTrace(r), time.Now())
+	// The client is the first sink
+	client := &clientGuard{sink: outputs[0]}
+	outputs[0] = client
+	command := newCommand(outputs, commandName, commandArgs...)
+	setJobID(command, jobID)
+	if tenant != nil {
+		command.Labels = map[string]string{"tenant": tenant.Name}
+	}
+	if tenantDir != "" {
+		command.Dir = tenantDir
+	}
+	command.Version = pinnedVersion(r.Context(), commandName)
+	command.Expect = expect
+	if stdinURI != "" {
+		command.Stdin = newObjectReader(ctx, stdinURI)
+	}
+	if rule != nil {
+		rule.CommandOptions.apply(ctx, command)
+	}
+	options.apply(ctx, command)
+	command.Checkpoint = newCheckpoint(&m, resume)
+	var attempts *attemptRecord
+	if trigger == "pubsub" {
+		attempts = newAttemptRecord(&m)
+	}
+	command.Transcript = transcriptURI(outputs)
+	if attempts != nil {
+		if err := attempts.start(r.Context(), command, m.DeliveryAttempt, command.Transcript); err != nil {
+			log.Printf("Failed to record attempt: %v", err)
+		}
+	}
+	if upload != nil {
+		command.Env = upload.env()
+	}
+	if m.DeliveryAttempt > 0 {
+		command.Env = append(command.Env, fmt.Sprintf("DELIVERY_ATTEMPT=%d", m.DeliveryAttempt))
+		if finalDelivery(&m) {
+			command.Env = append(command.Env, "FINAL_DELIVERY=1")
+		}
+	}
+	command.Stdout = stdout
+	finishUpload := func(err error) error { return err }
+	if stdoutURI != "" {
+		finishUpload = uploadStdout(ctx, command, stdoutURI)
+	}
+	command.Timeout = commandTimeout(r, requestStart)
+	if rule != nil && rule.Timeout.Duration > 0 && rule.Timeout.Duration < command.Timeout {
+		command.Timeout = rule.Timeout.Duration
+	}
+	var lineWriter *BigQueryLineWriter
+	if BIGQUERY_LINES_TABLE != "" {
+		lineWriter = NewBigQueryLineWriter(BIGQUERY_LINES_TABLE, command.Name, jobID)
+		command.OnOutput = lineWriter.WriteLine
+	}
+	var tail *runner.BufferSink
+	if FAILURE_TOPIC != "" {
+		tail = &runner.BufferSink{MaxLines: FAILURE_TAIL_LINES}
+		onOutput := command.OnOutput
+		command.OnOutput = func(line string) {
+			tail.WriteLine(line)
+			if onOutput != nil {
+				onOutput(line)
+			}
+		}
+	}
+	if HISTORY_COLLECTION != "" && ANOMALY_FACTOR > 0 {
+		threshold, median, err := slowThreshold(r.Context(), command.Name)
+		if err != nil {
+			log.Printf("Failed to query history for duration anomalies: %v", err)
+		} else if threshold > 0 {
+			command.SlowThreshold = threshold
+			command.OnSlow = func(elapsed time.Duration) {
+				sendDurationAlert(context.Background(), durationAnomaly{
+					Command:               command.Name,
+					ElapsedSeconds:        elapsed.Seconds(),
+					MedianDurationSeconds: median.Seconds(),
+					Factor:                ANOMALY_FACTOR,
+				})
+			}
+		}
+	}
+	defer trackRun(jobID, command.Name, trigger)()
+	var manifest *RunManifest
+	if MANIFEST_GCS_URI != "" {
+		var inputs []string
+		if stdinURI != "" {
+			inputs = append(inputs, stdinURI)
+		}
+		if upload != nil {
+			var files []string
+			for _, path := range upload.Files {
+				files = append(files, path)
+			}
+			sort.Strings(files)
+			inputs = append(inputs, files...)
+		}
+		manifest = newRunManifest(r.Context(), trigger, command, inputs)
+		if tenant != nil {
+			manifest.Tenant = tenant.Name
+		}
+	}
+	job := trackJob(command, trigger)
+	client.onGone = func(reason string) { clientGone(reason, jobID, cancelRun, job) }
+	stopWatch := client.watch(r.Context())
+	notify(r.Context(), EventStart, runner.Result{JobID: command.JobID, Command: command.Name, Args: command.Args, Transcript: command.Transcript})
+	err = finishUpload(command.Run(ctx))
+	stopWatch()
+	if lock != nil {
+		lock.Release(context.Background())
+	}
+	if lineWriter != nil {
+		lineWriter.Close()
+	}
+	if err := outputs.Close(); err != nil {
+		log.Print(err)
+	}
+	job.finish()
+	if manifest != nil {
+		var artifacts []string
+		for _, uri := range []string{stdoutURI, transcriptURI(outputs)} {
+			if uri != "" {
+				artifacts = append(artifacts, uri)
+			}
+		}
+		manifest.finish(context.Background(), command.Result, artifacts)
+		if err := manifest.write(context.Background()); err != nil {
+			log.Print(err)
+		}
+	}
+	reportResult(trigger, command.Result, err)
+	if cacheKey != "" && err == nil && command.Result.Status == runner.StatusSucceeded {
+		cache.put(cacheKey, command.Result, transcriptURI(outputs), ttl, time.Now())
+	}
+	audit.Finish(command.Result, err)
+	if callback != "" {
+		if err := sendCallback(callback, trigger, command.Result); err != nil {
+			log.Print(err)
+		}
+	}
+	if followup != nil {
+		if err := followup.Schedule(context.Background(), command.Result); err != nil {
+			log.Print(err)
+		}
+	}
+	status := errorStatus(err)
+	if attempts != nil && (err == nil || finalDelivery(&m)) {
+		if err := attempts.finish(context.Background()); err != nil {
+			log.Printf("Failed to delete attempt record: %v", err)
+		}
+	}
+	if err != nil {
+		log.Print(err)
+		if tail != nil && (trigger != "pubsub" || status < 500 || finalDelivery(&m)) {
+			if err := publishFailure(context.Background(), &m, command.Result, tail.Lines()); err != nil {
+				log.Print(err)
+			}
+		}
+	}
+	if trigger == "pubsub" {
+		respondPubSub(response, &m, err, status)
+	} else {
+		setStatusTrailer(response, status)
+	}
+}
@@ -0,0 +1,239 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rosmo/long-cloud-run/pkg/runner"
+)
+
+// RunManifest records what a run ran with and produced, as an audit trail
+// stored with the artifacts of the run.
+type RunManifest struct {
+	JobID   string `json:"jobId"`
+	Trigger string `json:"trigger"`
+	Tenant  string `json:"tenant,omitempty"`
+	// Command is the resolved path of the executable, and Version the first
+	// line of its MANIFEST_VERSION_ARG output.
+	Command string   `json:"command"`
+	Version string   `json:"version,omitempty"`
+	Args    []string `json:"args"`
+	// Env are the names of the environment variables of the command,
+	// without their values.
+	Env             []string              `json:"env"`
+	Inputs          []ManifestArtifact    `json:"inputs,omitempty"`
+	Outputs         []ManifestArtifact    `json:"outputs,omitempty"`
+	Status          string                `json:"status"`
+	ExitCode        int                   `json:"exitCode"`
+	Error           string                `json:"error,omitempty"`
+	StartTime       time.Time             `json:"startTime"`
+	EndTime         time.Time             `json:"endTime"`
+	DurationSeconds float64               `json:"durationSeconds"`
+	Output          runner.OutputTotals   `json:"output"`
+	Usage           *runner.ResourceUsage `json:"usage,omitempty"`
+}
+
+// ManifestArtifact is an input or output of a run: a Cloud Storage object
+// with its generation and MD5 hash, or a local file with its SHA-256 hash.
+type ManifestArtifact struct {
+	URI        string `json:"uri"`
+	Size       int64  `json:"size"`
+	Generation string `json:"generation,omitempty"`
+	MD5        string `json:"md5,omitempty"`
+	SHA256     string `json:"sha256,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// newRunManifest starts the manifest of a command before it runs, with the
+// checksums of its inputs: gs:// URIs or local files.
+func newRunManifest(ctx context.Context, trigger string, command *runner.Command, inputs []string) *RunManifest {
+	manifest := &RunManifest{
+		JobID:   command.JobID,
+		Trigger: trigger,
+		Command: command.Name,
+		Args:    redactArgs(command.Args),
+		Env:     envNames(append(os.Environ(), command.Env...)),
+	}
+	if path, err := findExecutable(command.Name); err == nil {
+		manifest.Command = path
+	}
+	manifest.Version = commandVersion(ctx, manifest.Command)
+	for _, input := range inputs {
+		manifest.Inputs = append(manifest.Inputs, describeArtifact(ctx, input))
+	}
+	return manifest
+}
+
+// finish completes the manifest with the result and the checksums of the
+// outputs.
+func (m *RunManifest) finish(ctx context.Context, result runner.Result, outputs []string) {
+	m.Status = result.Status
+	m.ExitCode = result.ExitCode
+	m.Error = result.Error
+	m.StartTime = result.StartTime
+	m.EndTime = result.EndTime
+	m.DurationSeconds = result.Duration.Seconds()
+	m.Output = result.Output
+	m.Usage = result.Usage
+	for _, output := range outputs {
+		m.Outputs = append(m.Outputs, describeArtifact(ctx, output))
+	}
+}
+
+// write stores the manifest in MANIFEST_GCS_URI, named like the transcript
+// of the run, under the name of its tenant.
+func (m *RunManifest) write(ctx context.Context) error {
+	uri := MANIFEST_GCS_URI
+	if m.Tenant != "" {
+		uri = strings.TrimSuffix(uri, "/") + "/" + m.Tenant
+	}
+	bucket, prefix, err := parseGCSPrefix(uri)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	name := runObjectName(prefix, m.Command, m.JobID, m.StartTime) + ".manifest.json"
+	if _, err := uploadObject(ctx, bucket, name, "application/json", data, -1); err != nil {
+		return fmt.Errorf("failed to write run manifest: %w", err)
+	}
+	log.Printf("Wrote run manifest to gs://%s/%s", bucket, name)
+	return nil
+}
+
+// envNames returns the sorted, unique names of environment variables.
+func envNames(env []string) []string {
+	seen := make(map[string]bool)
+	names := []string{}
+	for _, variable := range env {
+		name := strings.SplitN(variable, "=", 2)[0]
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// describeArtifact returns the size and checksum of a gs:// object or local
+// file, or the error getting them.
+func describeArtifact(ctx context.Context, uri string) ManifestArtifact {
+	artifact := ManifestArtifact{URI: uri}
+	if strings.HasPrefix(uri, "gs://") {
+		bucket, name, err := parseGCSURI(uri)
+		if err == nil {
+			var object storageObject
+			if object, err = getObject(ctx, bucket, name); err == nil {
+				artifact.Size, _ = strconv.ParseInt(object.Size, 10, 64)
+				artifact.Generation = object.Generation
+				artifact.MD5 = object.MD5Hash
+			}
+		}
+		if err != nil {
+			artifact.Error = err.Error()
+		}
+		return artifact
+	}
+	size, hash, err := fileSHA256(uri)
+	if err != nil {
+		artifact.Error = err.Error()
+	}
+	artifact.Size, artifact.SHA256 = size, hash
+	return artifact
+}
+
+func fileSHA256(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// commandVersions caches the versions of executables by path, size and
+// modification time, so that an executable that is replaced gets its
+// version again.
+var commandVersions sync.Map
+
+// executableKey returns the key of the version of an executable in
+// commandVersions, or "" if it can't be found.
+func executableKey(path string) string {
+	executable, err := findExecutable(path)
+	if err != nil {
+		return ""
+	}
+	info, err := os.Stat(filepath.Join(CHROOT, executable))
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%s %d %d", executable, info.Size(), info.ModTime().UnixNano())
+}
+
+// commandVersion returns the first line of output of the executable run with
+// MANIFEST_VERSION_ARG, or "" if it fails or the argument is none.
+func commandVersion(ctx context.Context, path string) string {
+	if MANIFEST_VERSION_ARG == "none" {
+		return ""
+	}
+	key := executableKey(path)
+	if version, ok := commandVersions.Load(key); ok && key != "" {
+		return version.(string)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	command := newCommand(nil, path, MANIFEST_VERSION_ARG)
+	command.Timeout = 10 * time.Second
+	command.PollInterval = 0
+	command.ShowOutput = false
+	var version string
+	command.OnOutput = func(line string) {
+		if version == "" {
+			version = strings.TrimSpace(line)
+		}
+	}
+	if err := command.Run(ctx); err != nil {
+		log.Printf("Failed to get the version of %s: %v", path, err)
+		version = ""
+	}
+	if key != "" {
+		commandVersions.Store(key, version)
+	}
+	return version
+}
@@ -0,0 +1,159 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rosmo/long-cloud-run/pkg/runner"
+)
+
+const monitoringAPI = "https://monitoring.googleapis.com/v3/"
+
+// cumulativeCounter is a cumulative metric with a fixed set of labels.
+type cumulativeCounter struct {
+	metric string
+	labels map[string]string
+	value  int64
+}
+
+// runCounters holds the cumulative run counts since the instance started, as
+// custom metrics only support gauge and cumulative kinds.
+var runCounters = struct {
+	sync.Mutex
+	start    time.Time
+	counters map[string]*cumulativeCounter
+}{start: time.Now(), counters: make(map[string]*cumulativeCounter)}
+
+// incrementCounter increments a counter and returns a copy of it.
+func incrementCounter(metric string, labels map[string]string) cumulativeCounter {
+	keys := make([]string, 0, len(labels))
+	for k, v := range labels {
+		keys = append(keys, k+"="+v)
+	}
+	sort.Strings(keys)
+	key := metric + "{" + strings.Join(keys, ",") + "}"
+
+	runCounters.Lock()
+	defer runCounters.Unlock()
+	counter, ok := runCounters.counters[key]
+	if !ok {
+		counter = &cumulativeCounter{metric: metric, labels: labels}
+		runCounters.counters[key] = counter
+	}
+	counter.value++
+	return *counter
+}
+
+// metricLabels returns the labels of a run's metrics.
+func metricLabels(trigger string, result runner.Result) map[string]string {
+	labels := map[string]string{
+		"command": commandLabel(result.Command),
+		"trigger": trigger,
+	}
+	for k, v := range METRICS_LABELS {
+		labels[k] = v
+	}
+	for k, v := range result.Labels {
+		labels[k] = v
+	}
+	return labels
+}
+
+// monitoredResource identifies this instance, so that concurrent instances
+// write separate time series.
+func monitoredResource(ctx context.Context, project string) map[string]interface{} {
+	location, _ := region(ctx)
+	if location == "" {
+		location = "global"
+	}
+	instance, _ := metadata(ctx, "instance/id")
+	if instance == "" {
+		instance, _ = os.Hostname()
+	}
+	return map[string]interface{}{
+		"type": "generic_task",
+		"labels": map[string]string{
+			"project_id": project,
+			"location":   location,
+			"namespace":  os.Getenv("K_SERVICE"),
+			"job":        os.Getenv("K_REVISION"),
+			"task_id":    instance,
+		},
+	}
+}
+
+// reportRunMetrics writes the run count, timeout count and duration of a
+// run to Cloud Monitoring.
+func reportRunMetrics(ctx context.Context, trigger string, result runner.Result) error {
+	project, err := projectID(ctx)
+	if err != nil {
+		return err
+	}
+	resource := monitoredResource(ctx, project)
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	start := runCounters.start.UTC().Format(time.RFC3339Nano)
+	metricType := func(name string) string {
+		return fmt.Sprintf("custom.googleapis.com/%s/%s", METRICS_PREFIX, name)
+	}
+
+	labels := metricLabels(trigger, result)
+	statusLabels := map[string]string{"status": result.Status}
+	for k, v := range labels {
+		statusLabels[k] = v
+	}
+	counters := []cumulativeCounter{incrementCounter("runs", statusLabels)}
+	if result.Status == runner.StatusTimeout {
+		counters = append(counters, incrementCounter("timeouts", labels))
+	}
+
+	var timeSeries []map[string]interface{}
+	for _, counter := range counters {
+		timeSeries = append(timeSeries, map[string]interface{}{
+			"metric":     map[string]interface{}{"type": metricType(counter.metric), "labels": counter.labels},
+			"resource":   resource,
+			"metricKind": "CUMULATIVE",
+			"valueType":  "INT64",
+			"points": []map[string]interface{}{{
+				"interval": map[string]string{"startTime": start, "endTime": now},
+				"value":    map[string]string{"int64Value": fmt.Sprint(counter.value)},
+			}},
+		})
+	}
+	timeSeries = append(timeSeries, map[string]interface{}{
+		"metric":     map[string]interface{}{"type": metricType("duration_seconds"), "labels": statusLabels},
+		"resource":   resource,
+		"metricKind": "GAUGE",
+		"valueType":  "DOUBLE",
+		"points": []map[string]interface{}{{
+			"interval": map[string]string{"endTime": now},
+			"value":    map[string]float64{"doubleValue": result.Duration.Seconds()},
+		}},
+	})
+
+	request := map[string]interface{}{"timeSeries": timeSeries}
+	if err := callAPI(ctx, "POST", monitoringAPI+"projects/"+project+"/timeSeries", request, nil); err != nil {
+		return fmt.Errorf("error writing metrics: %w", err)
+	}
+	return nil
+}
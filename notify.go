@@ -0,0 +1,143 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/rosmo/long-cloud-run/pkg/runner"
+)
+
+// Notification events.
+const (
+	EventStart   = "start"
+	EventSuccess = "success"
+	EventFailure = "failure"
+	EventTimeout = "timeout"
+	EventStall   = "stall"
+)
+
+const defaultNotifyTemplate = `{{if eq .Event "start"}}:arrow_forward: Started{{else if eq .Event "success"}}:white_check_mark: Succeeded{{else if eq .Event "timeout"}}:hourglass: Timed out{{else if eq .Event "stall"}}:warning: No output for {{.Duration}}{{else}}:x: Failed{{end}}: {{.Command}}` +
+	`{{if and (ne .Event "start") (ne .Event "stall")}} in {{.Duration}} (exit code {{.ExitCode}}){{end}}` +
+	`{{if .Error}}
+{{.Error}}{{end}}{{if .LogURL}}
+<{{.LogURL}}|Logs>{{end}}{{if .TranscriptURL}}
+<{{.TranscriptURL}}|Transcript>{{end}}`
+
+// Notification is the data available to the notification template.
+type Notification struct {
+	JobID    string
+	Event    string
+	Command  string
+	Args     []string
+	Service  string
+	Status   string
+	ExitCode int
+	Duration time.Duration
+	Error    string
+	LogURL   string
+	// Transcript is the gs:// URI of the transcript, and TranscriptURL the
+	// link to it in the Cloud Console.
+	Transcript    string
+	TranscriptURL string
+	Output        runner.OutputTotals
+	Usage         *runner.ResourceUsage
+}
+
+var notifyTemplate *template.Template
+
+// parseNotifyTemplate parses NOTIFY_TEMPLATE, or the default template.
+func parseNotifyTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		text = defaultNotifyTemplate
+	}
+	return template.New("notify").Parse(text)
+}
+
+// notify posts a message about an event to NOTIFY_WEBHOOK_URL, if the event
+// is enabled. Google Chat and Slack incoming webhooks both accept the
+// {"text": ...} payload.
+func notify(ctx context.Context, event string, result runner.Result) {
+	if NOTIFY_WEBHOOK_URL == "" || !NOTIFY_ON[event] {
+		return
+	}
+	notification := Notification{
+		JobID:    result.JobID,
+		Event:    event,
+		Command:  result.Command,
+		Args:     result.Args,
+		Service:  os.Getenv("K_SERVICE"),
+		Status:   result.Status,
+		ExitCode: result.ExitCode,
+		Duration: result.Duration.Truncate(time.Second),
+		Error:    result.Error,
+
+		Transcript: result.Transcript,
+		Output:     result.Output,
+		Usage:      result.Usage,
+	}
+	if bucket, name, err := parseGCSURI(result.Transcript); err == nil {
+		notification.TranscriptURL = storageConsoleURL(bucket, name)
+	}
+	if event != EventStart && event != EventStall {
+		if project, err := projectID(ctx); err == nil {
+			notification.LogURL = logsURL(project, result.StartTime, result.EndTime)
+		}
+	}
+
+	var text bytes.Buffer
+	if err := notifyTemplate.Execute(&text, notification); err != nil {
+		log.Printf("Failed to render notification: %v", err)
+		return
+	}
+	body, err := json.Marshal(map[string]string{"text": strings.TrimSpace(text.String())})
+	if err != nil {
+		log.Printf("Failed to encode notification: %v", err)
+		return
+	}
+	if err := postWebhook(ctx, NOTIFY_WEBHOOK_URL, body); err != nil {
+		log.Printf("Failed to send %s notification: %v", event, err)
+	}
+}
+
+// parseNotifyEvents parses a comma-separated list of events.
+func parseNotifyEvents(value string) (map[string]bool, error) {
+	events := make(map[string]bool)
+	for _, event := range strings.Split(value, ",") {
+		event = strings.TrimSpace(event)
+		switch event {
+		case "":
+		case EventStart, EventSuccess, EventTimeout, EventStall:
+			events[event] = true
+		case EventFailure:
+			// Timeouts are failures too
+			events[EventFailure] = true
+			events[EventTimeout] = true
+		default:
+			return nil, fmt.Errorf("unknown event: %s", event)
+		}
+	}
+	return events, nil
+}
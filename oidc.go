@@ -0,0 +1,208 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// googleCertsURL serves the keys that Google signs OIDC tokens with.
+var googleCertsURL = "https://www.googleapis.com/oauth2/v3/certs"
+
+// oidcIssuers are the issuers of Google OIDC tokens.
+var oidcIssuers = map[string]bool{"accounts.google.com": true, "https://accounts.google.com": true}
+
+// oidcKeys caches the keys of googleCertsURL for an hour, and fetches them
+// again for an unknown key at most once a minute.
+var oidcKeys = &keyCache{}
+
+type keyCache struct {
+	mu      sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+}
+
+func (c *keyCache) key(kid string, now time.Time) (*rsa.PublicKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key, ok := c.keys[kid]
+	if ok && now.Sub(c.fetched) < time.Hour {
+		return key, nil
+	}
+	if !ok && now.Sub(c.fetched) < time.Minute {
+		return nil, fmt.Errorf("unknown key: %s", kid)
+	}
+	keys, err := fetchKeys()
+	if err != nil {
+		return nil, err
+	}
+	c.keys, c.fetched = keys, now
+	if key, ok = keys[kid]; !ok {
+		return nil, fmt.Errorf("unknown key: %s", kid)
+	}
+	return key, nil
+}
+
+// fetchKeys returns the RSA keys of googleCertsURL by their IDs.
+func fetchKeys() (map[string]*rsa.PublicKey, error) {
+	resp, err := apiClient.Get(googleCertsURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error fetching %s: %s", googleCertsURL, resp.Status)
+	}
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	return keys, nil
+}
+
+// verifiedCaller returns the email of the Google OIDC token of the request
+// after verifying its signature, issuer, expiry and audience, or "". The
+// token is taken from X-Serverless-Authorization if it's set, as Cloud Run
+// then passes Authorization through without checking it.
+func verifiedCaller(r *http.Request, now time.Time) string {
+	authorization := r.Header.Get("X-Serverless-Authorization")
+	if authorization == "" {
+		authorization = r.Header.Get("Authorization")
+	}
+	if len(authorization) <= 7 || !strings.EqualFold(authorization[:7], "Bearer ") {
+		return ""
+	}
+	email, err := verifyIDToken(authorization[7:], requestAudiences(r), now)
+	if err != nil {
+		return ""
+	}
+	return email
+}
+
+// requestAudiences returns the audiences that OIDC tokens for the request
+// can have: OIDC_AUDIENCES, or else URLs of the host of the request, like
+// the service URL or the endpoint of a push subscription.
+func requestAudiences(r *http.Request) []string {
+	if len(OIDC_AUDIENCES) > 0 {
+		return OIDC_AUDIENCES
+	}
+	return []string{"https://" + r.Host}
+}
+
+// verifyIDToken verifies a Google OIDC token and returns its email. An
+// audience matches the same URL or one under it.
+func verifyIDToken(token string, audiences []string, now time.Time) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("not a JWT")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return "", err
+	}
+	if header.Alg != "RS256" {
+		return "", fmt.Errorf("unsupported algorithm: %s", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", err
+	}
+	key, err := oidcKeys.key(header.Kid, now)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature); err != nil {
+		return "", fmt.Errorf("invalid signature: %w", err)
+	}
+	var claims struct {
+		Issuer        string `json:"iss"`
+		Audience      string `json:"aud"`
+		Expires       int64  `json:"exp"`
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return "", err
+	}
+	if !oidcIssuers[claims.Issuer] {
+		return "", fmt.Errorf("unknown issuer: %s", claims.Issuer)
+	}
+	if now.Unix() >= claims.Expires {
+		return "", fmt.Errorf("token expired")
+	}
+	if !audienceMatches(claims.Audience, audiences) {
+		return "", fmt.Errorf("unexpected audience: %s", claims.Audience)
+	}
+	if claims.Email == "" || !claims.EmailVerified {
+		return "", fmt.Errorf("no verified email")
+	}
+	return claims.Email, nil
+}
+
+func audienceMatches(audience string, audiences []string) bool {
+	for _, expected := range audiences {
+		expected = strings.TrimSuffix(expected, "/")
+		if audience == expected || strings.HasPrefix(audience, expected+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,138 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/rosmo/long-cloud-run/pkg/runner"
+)
+
+// CommandOptions are settings of a command that can be given per job,
+// schedule or request, overriding ALLOWED_EXIT_CODES, CAN_FAIL,
+// SHOW_OUTPUT and STDIN_GCS_URI.
+type CommandOptions struct {
+	// AllowedExitCodes are the exit codes that count as success.
+	AllowedExitCodes []int `json:"allowedExitCodes,omitempty"`
+	// CanFail makes any failure of the command count as success.
+	CanFail *bool `json:"canFail,omitempty"`
+	// ShowOutput streams the output to the client. Output hidden with
+	// SHOW_OUTPUT=false can't be shown.
+	ShowOutput *bool `json:"showOutput,omitempty"`
+	// Stdin is the gs:// URI of an object that is streamed to the standard
+	// input of the command.
+	Stdin string `json:"stdin,omitempty"`
+}
+
+// apply sets the options of the command, streaming Stdin as long as ctx
+// isn't done.
+func (o CommandOptions) apply(ctx context.Context, command *runner.Command) {
+	if o.AllowedExitCodes != nil {
+		command.AllowedExitCodes = o.AllowedExitCodes
+	}
+	if o.CanFail != nil {
+		command.CanFail = *o.CanFail
+	}
+	if o.ShowOutput != nil && (SHOW_OUTPUT || !*o.ShowOutput) {
+		command.ShowOutput = *o.ShowOutput
+	}
+	if o.Stdin != "" {
+		command.Stdin = newObjectReader(ctx, o.Stdin)
+	}
+}
+
+// override returns the options with those set in other replacing them.
+func (o CommandOptions) override(other CommandOptions) CommandOptions {
+	if other.AllowedExitCodes != nil {
+		o.AllowedExitCodes = other.AllowedExitCodes
+	}
+	if other.CanFail != nil {
+		o.CanFail = other.CanFail
+	}
+	if other.ShowOutput != nil {
+		o.ShowOutput = other.ShowOutput
+	}
+	if other.Stdin != "" {
+		o.Stdin = other.Stdin
+	}
+	return o
+}
+
+// queryArgs returns the arguments given as arg query parameters, if
+// ALLOW_QUERY_ARGS is set. Each has to match QUERY_ARGS_ALLOWLIST.
+func queryArgs(r *http.Request) ([]string, error) {
+	if !ALLOW_QUERY_ARGS {
+		return nil, nil
+	}
+	args := r.URL.Query()["arg"]
+	for _, arg := range args {
+		if !queryArgAllowed(arg) {
+			return nil, fmt.Errorf("argument not allowed: %s", arg)
+		}
+	}
+	return args, nil
+}
+
+// queryArgAllowed returns whether an argument is in QUERY_ARGS_ALLOWLIST,
+// where entries ending with * match the arguments they prefix.
+func queryArgAllowed(arg string) bool {
+	for _, allowed := range QUERY_ARGS_ALLOWLIST {
+		if arg == allowed || (strings.HasSuffix(allowed, "*") && strings.HasPrefix(arg, strings.TrimSuffix(allowed, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestOptions returns the options given as query parameters or Pub/Sub
+// message attributes of the same names.
+func requestOptions(r *http.Request, m *PubSubMessage) (CommandOptions, error) {
+	var options CommandOptions
+	value := func(name string) string {
+		if value := r.URL.Query().Get(name); value != "" {
+			return value
+		}
+		return m.Message.Attributes[name]
+	}
+	if codes := value("allowedExitCodes"); codes != "" {
+		allowed, err := parseExitCodes(codes)
+		if err != nil || allowed == nil {
+			return options, fmt.Errorf("invalid allowedExitCodes: %s", codes)
+		}
+		options.AllowedExitCodes = allowed
+	}
+	if stdin := value("stdin"); stdin != "" {
+		if _, _, err := parseGCSURI(stdin); err != nil {
+			return options, fmt.Errorf("invalid stdin: %w", err)
+		}
+		options.Stdin = stdin
+	}
+	for name, field := range map[string]**bool{"canFail": &options.CanFail, "showOutput": &options.ShowOutput} {
+		if v := value(name); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return options, fmt.Errorf("invalid %s: %s", name, v)
+			}
+			*field = &b
+		}
+	}
+	return options, nil
+}
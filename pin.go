@@ -0,0 +1,143 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CommandPin pins the SHA-256 checksum of an executable in the config file,
+// so that a changed binary in the image isn't run.
+type CommandPin struct {
+	Command string `json:"command"`
+	SHA256  string `json:"sha256"`
+}
+
+func (p *CommandPin) parse() error {
+	if p.Command == "" {
+		return fmt.Errorf("no command set")
+	}
+	if b, err := hex.DecodeString(p.SHA256); err != nil || len(b) != 32 {
+		return fmt.Errorf("invalid sha256: %s", p.SHA256)
+	}
+	p.SHA256 = strings.ToLower(p.SHA256)
+	return nil
+}
+
+// commandPin returns the pin of a command, matched by the path or the base
+// name of the command, or nil.
+func commandPin(command string) *CommandPin {
+	for _, pin := range currentConfig().Pins {
+		if pin.Command == command || pin.Command == filepath.Base(command) {
+			return pin
+		}
+	}
+	return nil
+}
+
+// fileID identifies the contents of a file: the modification time can be
+// set back after changing a file, but the change time can't, and replacing
+// the file changes its inode.
+type fileID struct {
+	device     uint64
+	inode      uint64
+	size       int64
+	modTime    time.Time
+	changeTime time.Time
+}
+
+// fileChecksum is the checksum of a file as of its ID.
+type fileChecksum struct {
+	id     fileID
+	sha256 string
+}
+
+// checksums caches the checksums of executables by path, so that they're
+// only computed again when the files change.
+var checksums = struct {
+	sync.Mutex
+	files map[string]fileChecksum
+}{files: make(map[string]fileChecksum)}
+
+// executableChecksum returns the SHA-256 checksum of a file. Files are
+// hashed every time on platforms without change times.
+func executableChecksum(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	id, ok := statFileID(info)
+	if ok {
+		checksums.Lock()
+		cached, found := checksums.files[path]
+		checksums.Unlock()
+		if found && cached.id == id {
+			return cached.sha256, nil
+		}
+	}
+	_, sum, err := fileSHA256(path)
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		checksums.Lock()
+		checksums.files[path] = fileChecksum{id: id, sha256: sum}
+		checksums.Unlock()
+	}
+	return sum, nil
+}
+
+// verifyExecutable checks the executable of a pinned command against its
+// checksum.
+func verifyExecutable(command string) error {
+	pin := commandPin(command)
+	if pin == nil {
+		return nil
+	}
+	path, err := findExecutable(command)
+	if err != nil {
+		return fmt.Errorf("failed to verify %s: %w", command, err)
+	}
+	sum, err := executableChecksum(filepath.Join(CHROOT, path))
+	if err != nil {
+		return fmt.Errorf("failed to verify %s: %w", command, err)
+	}
+	if sum != pin.SHA256 {
+		return fmt.Errorf("checksum mismatch of %s: sha256 %s, pinned %s", path, sum, pin.SHA256)
+	}
+	return nil
+}
+
+// pinnedVersion returns the version of a pinned command for its result, or
+// "" if it isn't pinned.
+func pinnedVersion(ctx context.Context, command string) string {
+	if commandPin(command) == nil {
+		return ""
+	}
+	path, err := findExecutable(command)
+	if err != nil {
+		return ""
+	}
+	return commandVersion(ctx, path)
+}
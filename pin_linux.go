@@ -0,0 +1,38 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// statFileID returns the ID of a file from its stat.
+func statFileID(info os.FileInfo) (fileID, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileID{}, false
+	}
+	return fileID{
+		device:     uint64(stat.Dev),
+		inode:      uint64(stat.Ino),
+		size:       info.Size(),
+		modTime:    info.ModTime(),
+		changeTime: time.Unix(int64(stat.Ctim.Sec), int64(stat.Ctim.Nsec)),
+	}, true
+}
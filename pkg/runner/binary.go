@@ -0,0 +1,123 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package runner
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"unicode/utf8"
+)
+
+// Encodings of binary output chunks.
+const (
+	BinaryBase64 = "base64"
+	BinaryHex    = "hex"
+)
+
+// binaryChunkSize is the most bytes of binary output relayed as one line,
+// a multiple of 3 so that base64 chunks have no padding but the last.
+const binaryChunkSize = 3 * 1024
+
+// IsBinary returns true if the line isn't valid UTF-8 or contains control
+// characters other than tabs, carriage returns and escape sequences.
+func IsBinary(line string) bool {
+	if !utf8.ValidString(line) {
+		return true
+	}
+	for i := 0; i < len(line); i++ {
+		switch b := line[i]; {
+		case b == '\t', b == '\r', b == '\x1b':
+		case b < 0x20, b == 0x7f:
+			return true
+		}
+	}
+	return false
+}
+
+// encodeChunk returns a chunk of output as "[<encoding>] <data>".
+func encodeChunk(chunk []byte, encoding string) string {
+	switch encoding {
+	case BinaryHex:
+		return "[" + BinaryHex + "] " + hex.EncodeToString(chunk)
+	default:
+		return "[" + BinaryBase64 + "] " + base64.StdEncoding.EncodeToString(chunk)
+	}
+}
+
+// chunkLines returns the lines to relay for a chunk of output read with
+// scanChunks. A chunk of complete lines of text is relayed as these lines,
+// anything else is encoded as a whole, so that the output can be rebuilt
+// from the lines (with a newline after each) and the decoded chunks.
+func chunkLines(chunk []byte, encoding string) []string {
+	if bytes.HasSuffix(chunk, []byte{'\n'}) {
+		lines := strings.Split(string(chunk[:len(chunk)-1]), "\n")
+		text := true
+		for _, line := range lines {
+			if IsBinary(line) {
+				text = false
+				break
+			}
+		}
+		if text {
+			return lines
+		}
+	}
+	return []string{encodeChunk(chunk, encoding)}
+}
+
+// binaryChunk splits a line of encoded binary output into the encoding and
+// the encoded data.
+func binaryChunk(line string) (encoding string, data string, ok bool) {
+	for _, encoding := range []string{BinaryBase64, BinaryHex} {
+		if prefix := "[" + encoding + "] "; strings.HasPrefix(line, prefix) {
+			return encoding, line[len(prefix):], true
+		}
+	}
+	return "", "", false
+}
+
+// DecodeBinary returns the decoded data of a line of binary output encoded
+// by a command with BinaryEncoding set.
+func DecodeBinary(line string) ([]byte, bool) {
+	encoding, data, ok := binaryChunk(line)
+	if !ok {
+		return nil, false
+	}
+	var decoded []byte
+	var err error
+	if encoding == BinaryHex {
+		decoded, err = hex.DecodeString(data)
+	} else {
+		decoded, err = base64.StdEncoding.DecodeString(data)
+	}
+	return decoded, err == nil
+}
+
+// scanChunks is a bufio.SplitFunc that splits the output into chunks of
+// what has been read, up to binaryChunkSize, keeping every byte, so that
+// binary output without newlines is still read as it's written.
+func scanChunks(data []byte, atEOF bool) (int, []byte, error) {
+	if len(data) > binaryChunkSize {
+		return binaryChunkSize, data[:binaryChunkSize], nil
+	}
+	if len(data) == 0 {
+		return 0, nil, nil
+	}
+	return len(data), data, nil
+}
@@ -0,0 +1,112 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package runner
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// Checkpoint implements resumable commands. Before the deadline, the
+// command is sent a signal and is expected to write its state to File and
+// exit. The state is then passed to Requeue, which arranges for the command
+// to be resumed from it.
+//
+// Every run gets its own directory for the checkpoint, next to File and
+// owned by the user the command runs as. The command sees the following
+// environment variables:
+//
+//	CHECKPOINT_FILE: where to write the checkpoint, named like File
+//	RESUME_FROM_CHECKPOINT: set to 1 if File contains a checkpoint to resume from
+//	CONTINUATION: how many times the command has been continued
+type Checkpoint struct {
+	File   string
+	Margin time.Duration
+	Signal syscall.Signal
+
+	// Continuation is the number of this continuation, and Resume the
+	// checkpoint being resumed from (if any).
+	Continuation int
+	Resume       []byte
+
+	// Requeue is called with the checkpoint written by the command, and
+	// returns an identifier for the continuation.
+	Requeue func(ctx context.Context, checkpoint []byte) (string, error)
+
+	// path is the checkpoint file of the current run.
+	path string
+}
+
+// prepare creates the checkpoint directory of the run, with the checkpoint
+// to resume from, handing both to runAs.
+func (cp *Checkpoint) prepare(runAs *RunAs) error {
+	dir, err := ioutil.TempDir(filepath.Dir(cp.File), "checkpoint-")
+	if err != nil {
+		return err
+	}
+	cp.path = filepath.Join(dir, filepath.Base(cp.File))
+	paths := []string{dir}
+	if cp.Resume != nil {
+		if err := ioutil.WriteFile(cp.path, cp.Resume, 0600); err != nil {
+			cp.cleanup()
+			return err
+		}
+		paths = append(paths, cp.path)
+	}
+	if runAs != nil {
+		for _, path := range paths {
+			if err := os.Chown(path, int(runAs.Uid), int(runAs.Gid)); err != nil {
+				cp.cleanup()
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// cleanup removes the checkpoint directory of the run.
+func (cp *Checkpoint) cleanup() {
+	if cp.path != "" {
+		os.RemoveAll(filepath.Dir(cp.path))
+		cp.path = ""
+	}
+}
+
+func (cp *Checkpoint) env() []string {
+	env := []string{
+		"CHECKPOINT_FILE=" + cp.path,
+		fmt.Sprintf("CONTINUATION=%d", cp.Continuation),
+	}
+	if cp.Resume != nil {
+		env = append(env, "RESUME_FROM_CHECKPOINT=1")
+	}
+	return env
+}
+
+// requeue passes the checkpoint written by the command to Requeue.
+func (cp *Checkpoint) requeue(ctx context.Context) (string, error) {
+	data, err := ioutil.ReadFile(cp.path)
+	if err != nil {
+		return "", fmt.Errorf("command did not write a checkpoint: %w", err)
+	}
+	return cp.Requeue(ctx, data)
+}
@@ -0,0 +1,868 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package runner runs long-running commands, streaming their output and
+// reporting progress with heartbeats while they run.
+package runner
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	backoff "github.com/cenkalti/backoff/v4"
+)
+
+type Command struct {
+	Name string
+	Args []string
+
+	ShowOutput        bool
+	CanFail           bool
+	AllowedExitCodes  []int
+	ProgressRegex     *regexp.Regexp
+	MaxOutputBytes    int64
+	MaxOutputLines    int64
+	KillOnOutputLimit bool
+	MemoryLimit       int64
+	ResourceLimits    ResourceLimits
+	RunAs             *RunAs
+	Dir               string
+	Chroot            string
+	Checkpoint        *Checkpoint
+	// Attempt is the number of the attempt at the run, if it's retried, and
+	// Previous the attempt before it. They're passed to the command as
+	// ATTEMPT and PREVIOUS_ATTEMPT, PREVIOUS_JOB_ID and PREVIOUS_TRANSCRIPT,
+	// and recorded in the result.
+	Attempt  int
+	Previous *Attempt
+	// JobID identifies the run. It is passed to the command as JOB_ID and
+	// recorded in the result.
+	JobID string
+	// Labels describe the run, like the tenant it's for, and are recorded in
+	// the result.
+	Labels map[string]string
+	// Version is the version of the executable, if known, recorded in the
+	// result.
+	Version string
+	// Transcript is where the output of the run is stored, if anywhere,
+	// recorded in the result.
+	Transcript string
+	// Env are environment variables of the command, in addition to those
+	// of the wrapper.
+	Env []string
+	// CollapseRepeats relays consecutive identical output lines once,
+	// followed by how many times the line was repeated. The output totals
+	// still count every line.
+	CollapseRepeats bool
+	// MaxLinesPerSecond limits the standard output lines relayed per second.
+	// Above the limit only every SampleEvery-th line is relayed (none if it
+	// is zero), followed by how many were omitted. Standard error is always
+	// relayed.
+	MaxLinesPerSecond int64
+	SampleEvery       int64
+	// BinaryEncoding relays output that isn't text as lines of base64 or
+	// hex (BinaryBase64 or BinaryHex), see DecodeBinary. Output is then
+	// read in chunks, so that long binary lines don't stop it, and no byte
+	// of it is lost.
+	BinaryEncoding string
+	// Stdin, if set, is read as the standard input of the command. It's
+	// closed when the command exits if it's an io.Closer, and a read error
+	// fails the run.
+	Stdin io.Reader
+	// Expect answers the prompts of interactive commands on their standard
+	// input, which is then a pipe kept open until they exit. It can't be
+	// used with Stdin.
+	Expect []Expectation
+	// Stdout, if set, receives the standard output of the command byte for
+	// byte, instead of it being relayed line by line to Output. Standard
+	// error is still relayed.
+	Stdout io.Writer
+
+	// Timeout is how long the command can run, zero meaning no limit.
+	Timeout time.Duration
+	// On timeout or cancellation, the command is sent TerminationSignal and
+	// killed if it is still running after TerminationGrace. Without a grace
+	// period the command is killed right away.
+	TerminationSignal os.Signal
+	TerminationGrace  time.Duration
+
+	// Heartbeats are written with exponentially increasing intervals, from
+	// PollInterval up to MaxPollInterval.
+	PollInterval    time.Duration
+	MaxPollInterval time.Duration
+	// MemoryCheckInterval is how often memory usage is checked against
+	// MemoryLimit.
+	MemoryCheckInterval time.Duration
+	// HeartbeatDetails, if set, returns details to add to the heartbeats,
+	// such as warnings about the environment.
+	HeartbeatDetails func() []string
+	// DrainTime is how long output is still read after the command has
+	// exited, in case a background process is holding stdout or stderr open.
+	DrainTime time.Duration
+	// KillOrphans kills the processes left behind by the command when it
+	// exits.
+	KillOrphans bool
+
+	// OnOutput is called for every output line of the command
+	OnOutput func(line string)
+
+	// OnProgress is called with the percentage whenever ProgressRegex finds
+	// a new progress in the output
+	OnProgress func(percent float64)
+
+	// OnSlow is called if the command is still running after SlowThreshold
+	SlowThreshold time.Duration
+	OnSlow        func(elapsed time.Duration)
+
+	// StallTimeout warns when the command hasn't written any output for
+	// this long, once per silence. The command is sent StallSignal, if set,
+	// eg. SIGQUIT to have a Go or Java program dump its stacks, and
+	// terminated if KillOnStall is set. OnStall is called with how long the
+	// command has been silent.
+	StallTimeout time.Duration
+	StallSignal  os.Signal
+	KillOnStall  bool
+	OnStall      func(silent time.Duration)
+
+	// Output receives the output and progress messages, which are also
+	// logged to StderrLogger.
+	Output OutputSink
+	Clock  Clock
+	// Executor starts the process of the command.
+	Executor Executor
+
+	StdoutLogger *log.Logger
+	StderrLogger *log.Logger
+
+	// Result is filled in by Run()
+	Result Result
+
+	progress    float64
+	outputLines int64
+	outputBytes int64
+	truncated   bool
+	// lastOutput is the last line read, at lastOutputTime, for the
+	// heartbeats.
+	lastOutput     string
+	lastOutputTime time.Time
+	usage          ResourceUsage
+	// lastLine is repeated repeats times since it was relayed, with
+	// CollapseRepeats.
+	lastLine  *string
+	repeats   int64
+	collapsed int64
+	// windowLines stdout lines have been read in the second since
+	// windowStart, with MaxLinesPerSecond, and omitted lines not relayed.
+	windowStart  time.Time
+	windowLines  int64
+	omitted      int64
+	totalOmitted int64
+}
+
+// outputLine is a line of the standard output or error of the command.
+type outputLine struct {
+	text   string
+	stderr bool
+}
+
+// NewCommand returns a command with the default settings.
+func NewCommand(name string, args ...string) *Command {
+	return &Command{
+		Name:                name,
+		Args:                args,
+		ShowOutput:          true,
+		CanFail:             false,
+		AllowedExitCodes:    []int{0},
+		PollInterval:        5 * time.Second,
+		MaxPollInterval:     300 * time.Second,
+		MemoryCheckInterval: 5 * time.Second,
+		DrainTime:           5 * time.Second,
+		KillOrphans:         true,
+		TerminationSignal:   syscall.SIGTERM,
+		Output:              discardSink{},
+		Clock:               RealClock{},
+		Executor:            ExecExecutor{},
+		StdoutLogger:        log.New(os.Stdout, fmt.Sprintf("[%s] ", name), log.Ldate|log.Ltime),
+		StderrLogger:        log.New(os.Stderr, fmt.Sprintf("[%s] ", name), log.Ldate|log.Ltime),
+		progress:            -1,
+	}
+}
+
+// scannedLines returns the output lines to relay for what the scanner has
+// read: a line, or the lines of a chunk with BinaryEncoding.
+func (c *Command) scannedLines(scanner *bufio.Scanner) []string {
+	if c.BinaryEncoding == "" {
+		return []string{scanner.Text()}
+	}
+	return chunkLines(scanner.Bytes(), c.BinaryEncoding)
+}
+
+func (c *Command) writeProgress(message string) {
+	c.StderrLogger.Println(message)
+	c.Output.WriteLine(message)
+}
+
+// extractProgress matches an output line against the progress regex and
+// records the percentage, returning true if the progress changed.
+func (c *Command) extractProgress(line string) bool {
+	if c.ProgressRegex == nil {
+		return false
+	}
+	match := c.ProgressRegex.FindStringSubmatch(line)
+	if match == nil {
+		return false
+	}
+	value := match[0]
+	if len(match) > 1 {
+		value = match[1]
+	}
+	progress, err := strconv.ParseFloat(value, 64)
+	if err != nil || progress == c.progress {
+		return false
+	}
+	c.progress = progress
+	return true
+}
+
+// countOutput adds a line to the output totals and returns false if the line
+// exceeds the configured output limits.
+func (c *Command) countOutput(line string) bool {
+	c.outputLines++
+	c.outputBytes += int64(len(line)) + 1
+	c.lastOutput = line
+	c.lastOutputTime = c.Clock.Now()
+	if c.MaxOutputLines > 0 && c.outputLines > c.MaxOutputLines {
+		return false
+	}
+	if c.MaxOutputBytes > 0 && c.outputBytes > c.MaxOutputBytes {
+		return false
+	}
+	return true
+}
+
+// outputDetails describes the output so far for the heartbeats: the totals,
+// and how long ago the last line was read and, if the output is shown, the
+// line.
+func (c *Command) outputDetails() string {
+	if c.outputLines == 0 {
+		return "no output"
+	}
+	details := fmt.Sprintf("%d lines, %s output, last line %s ago", c.outputLines, FormatBytes(c.outputBytes), c.Clock.Now().Sub(c.lastOutputTime).Truncate(time.Second))
+	if c.ShowOutput {
+		line := []rune(c.lastOutput)
+		if len(line) > 100 {
+			line = append(line[:100], '…')
+		}
+		details += fmt.Sprintf(": %q", string(line))
+	}
+	return details
+}
+
+// flushRepeats relays how many times the last line was repeated, if it was.
+func (c *Command) flushRepeats() {
+	if c.repeats == 0 {
+		return
+	}
+	message := fmt.Sprintf("[Last line repeated %d times]", c.repeats)
+	if c.ShowOutput {
+		c.writeProgress(message)
+	} else {
+		c.StderrLogger.Println(message)
+	}
+	c.repeats = 0
+}
+
+// sampleLine returns whether a standard output line is relayed under
+// MaxLinesPerSecond.
+func (c *Command) sampleLine() bool {
+	if c.MaxLinesPerSecond <= 0 {
+		return true
+	}
+	if now := c.Clock.Now(); now.Sub(c.windowStart) >= time.Second {
+		c.flushOmitted()
+		c.windowStart = now
+		c.windowLines = 0
+	}
+	c.windowLines++
+	over := c.windowLines - c.MaxLinesPerSecond
+	if over <= 0 || (c.SampleEvery > 0 && over%c.SampleEvery == 0) {
+		return true
+	}
+	c.omitted++
+	c.totalOmitted++
+	return false
+}
+
+// flushOmitted relays how many lines were omitted, if any were.
+func (c *Command) flushOmitted() {
+	if c.omitted == 0 {
+		return
+	}
+	c.writeProgress(fmt.Sprintf("[Omitted %d lines over %d per second]", c.omitted, c.MaxLinesPerSecond))
+	c.omitted = 0
+}
+
+func (c *Command) outputTotals() string {
+	totals := fmt.Sprintf("[Output totals: %d lines, %d bytes", c.outputLines, c.outputBytes)
+	if c.collapsed > 0 {
+		totals += fmt.Sprintf(", %d repeated lines collapsed", c.collapsed)
+	}
+	if c.totalOmitted > 0 {
+		totals += fmt.Sprintf(", %d lines omitted", c.totalOmitted)
+	}
+	if c.truncated {
+		totals += ", truncated"
+	}
+	return totals + "]"
+}
+
+func (c *Command) progressString() string {
+	return strconv.FormatFloat(c.progress, 'f', -1, 64) + "%"
+}
+
+// killWaitTime is how long a killed process has to exit, besides DrainTime,
+// before it is abandoned.
+var killWaitTime = 5 * time.Second
+
+// processExit is how the process of a command exited.
+type processExit struct {
+	code int
+	err  error
+}
+
+func (e processExit) String() string {
+	if e.err != nil {
+		return e.err.Error()
+	}
+	return fmt.Sprintf("exit status %d", e.code)
+}
+
+// timer returns the channel of a new timer, and a function to stop it. A
+// non-positive duration returns a nil channel, which never fires.
+func (c *Command) timer(d time.Duration) (<-chan time.Time, func()) {
+	if d <= 0 {
+		return nil, func() {}
+	}
+	t := c.Clock.NewTimer(d)
+	return t.C(), func() { t.Stop() }
+}
+
+// Run runs the command until it exits, the timeout expires or ctx is
+// cancelled.
+func (c *Command) Run(ctx context.Context) (err error) {
+	c.Result = Result{JobID: c.JobID, Command: c.Name, Args: c.Args, ExitCode: -1, StartTime: c.Clock.Now(), Attempt: c.Attempt, Previous: c.Previous, Labels: c.Labels, Version: c.Version, Transcript: c.Transcript}
+	defer func() {
+		c.Result.EndTime = c.Clock.Now()
+		c.Result.Output = OutputTotals{
+			Lines:     c.outputLines,
+			Bytes:     c.outputBytes,
+			Collapsed: c.collapsed,
+			Omitted:   c.totalOmitted,
+			Truncated: c.truncated,
+		}
+		if c.usage != (ResourceUsage{}) {
+			usage := c.usage
+			c.Result.Usage = &usage
+		}
+		c.Result.Finish(err)
+	}()
+
+	c.writeProgress(fmt.Sprintf("Running command: %s", c.Name))
+	c.StdoutLogger.Printf("Running as: %s %+q", c.Name, c.Args)
+
+	executor := c.Executor
+	if executor == nil {
+		executor = ExecExecutor{}
+	}
+
+	env := append([]string{}, c.Env...)
+	if c.JobID != "" {
+		env = append(env, "JOB_ID="+c.JobID)
+	}
+	if c.Attempt > 0 {
+		env = append(env, fmt.Sprintf("ATTEMPT=%d", c.Attempt))
+	}
+	if c.Previous != nil {
+		env = append(env, c.Previous.env()...)
+		c.writeProgress(fmt.Sprintf("Previous attempt %d: %s", c.Previous.Number, c.Previous.JobID))
+	}
+	if c.Checkpoint != nil {
+		if err := c.Checkpoint.prepare(c.RunAs); err != nil {
+			return &StartError{fmt.Errorf("error preparing checkpoint: %w", err)}
+		}
+		defer c.Checkpoint.cleanup()
+		env = append(env, c.Checkpoint.env()...)
+		if c.Checkpoint.Resume != nil {
+			c.writeProgress(fmt.Sprintf("Resuming from checkpoint (continuation %d): %s", c.Checkpoint.Continuation, c.Name))
+		}
+	}
+
+	if err := CheckArgs(c.Name, c.Args, append(os.Environ(), env...)); err != nil {
+		return &StartError{err}
+	}
+
+	stdin := c.Stdin
+	var expect *expecter
+	if len(c.Expect) > 0 {
+		if stdin != nil {
+			return &StartError{fmt.Errorf("expect can't be used with stdin")}
+		}
+		stdinReader, stdinWriter, err := os.Pipe()
+		if err != nil {
+			return &StartError{fmt.Errorf("error getting stdin pipe: %w", err)}
+		}
+		defer stdinWriter.Close()
+		expect = newExpecter(c.Expect, stdinWriter, c.StdoutLogger)
+		// the executor reads the standard input of the command
+		stdin = stdinReader
+		c.Stdin = stdinReader
+		defer func() { c.Stdin = nil }()
+	}
+
+	// Pipes are created by us instead of using StdoutPipe(), so that Wait()
+	// doesn't close them before all output has been read.
+	stdout, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		return &StartError{fmt.Errorf("error getting stdout pipe: %w", err)}
+	}
+	defer stdout.Close()
+	var stdoutReader io.Reader = stdout
+	if expect != nil {
+		stdoutReader = io.TeeReader(stdout, expect.stream())
+	}
+	stdoutBuf := bufio.NewScanner(stdoutReader)
+	if c.BinaryEncoding != "" {
+		stdoutBuf.Split(scanChunks)
+	}
+
+	stderr, stderrWriter, err := os.Pipe()
+	if err != nil {
+		stdoutWriter.Close()
+		return &StartError{fmt.Errorf("error getting stderr pipe: %w", err)}
+	}
+	defer stderr.Close()
+	var stderrReader io.Reader = stderr
+	if expect != nil {
+		stderrReader = io.TeeReader(stderr, expect.stream())
+	}
+	stderrBuf := bufio.NewScanner(stderrReader)
+	if c.BinaryEncoding != "" {
+		stderrBuf.Split(scanChunks)
+	}
+
+	startTime := c.Clock.Now()
+	c.Result.StartTime = startTime
+	process, err := executor.Start(ctx, c, env, stdoutWriter, stderrWriter)
+	if err != nil {
+		if c.RunAs != nil {
+			return &StartError{fmt.Errorf("as uid %d, gid %d: %w", c.RunAs.Uid, c.RunAs.Gid, err)}
+		}
+		return &StartError{err}
+	}
+
+	done := make(chan processExit)
+	output := make(chan outputLine)
+	// quit stops the goroutines if Run returns before the process has exited
+	quit := make(chan struct{})
+	defer close(quit)
+
+	// Read stdout and stderr and relay output via channel
+	var readers sync.WaitGroup
+	readers.Add(2)
+	go func() {
+		defer readers.Done()
+		if c.Stdout != nil {
+			if _, err := io.Copy(c.Stdout, stdoutReader); err != nil {
+				c.StderrLogger.Printf("Failed to pass through output: %v", err)
+				io.Copy(ioutil.Discard, stdout)
+			}
+			return
+		}
+		for stdoutBuf.Scan() {
+			for _, text := range c.scannedLines(stdoutBuf) {
+				select {
+				case output <- outputLine{text: text}:
+				case <-quit:
+					return
+				}
+			}
+		}
+	}()
+	go func() {
+		defer readers.Done()
+		for stderrBuf.Scan() {
+			for _, text := range c.scannedLines(stderrBuf) {
+				select {
+				case output <- outputLine{text: text, stderr: true}:
+				case <-quit:
+					return
+				}
+			}
+		}
+	}()
+
+	// Wait for actual command to complete, and for all output to be read
+	go func() {
+		exitCode, err := process.Wait()
+		if closer, ok := stdin.(io.Closer); ok {
+			closer.Close()
+		}
+
+		drained := make(chan struct{})
+		go func() {
+			readers.Wait()
+			close(drained)
+		}()
+		drainTimeout, stopDrainTimeout := c.timer(c.DrainTime)
+		defer stopDrainTimeout()
+		select {
+		case <-drained:
+		case <-drainTimeout:
+			c.StdoutLogger.Printf("Output still open %s after command exited, closing", c.DrainTime)
+			stdout.Close()
+			stderr.Close()
+			<-drained
+		}
+		select {
+		case done <- processExit{exitCode, err}:
+		case <-quit:
+		}
+	}()
+
+	// Heartbeats are written with exponentially increasing intervals
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = c.PollInterval
+	b.MaxInterval = c.MaxPollInterval
+	b.MaxElapsedTime = 0
+	b.Clock = c.Clock
+	b.Reset()
+	heartbeat, stopHeartbeat := c.timer(b.NextBackOff())
+	defer func() { stopHeartbeat() }()
+
+	deadline, stopDeadline := c.timer(c.Timeout)
+	defer stopDeadline()
+	cancelled := ctx.Done()
+	processTerminated := false
+	terminatedReason := ""
+	var cancelErr error
+
+	// Terminating the command sends TerminationSignal first, and kills it if
+	// it is still running after TerminationGrace, so that it can clean up.
+	var killTime <-chan time.Time
+	stopKillTimer := func() {}
+	defer func() { stopKillTimer() }()
+	// A killed process that doesn't exit, eg. in uninterruptible sleep, is
+	// abandoned so that Run always returns.
+	var abandonTime <-chan time.Time
+	stopAbandonTimer := func() {}
+	defer func() { stopAbandonTimer() }()
+	kill := func() error {
+		if abandonTime == nil {
+			abandonTime, stopAbandonTimer = c.timer(c.DrainTime + killWaitTime)
+		}
+		return process.Kill()
+	}
+	shutdown := func() error {
+		if c.TerminationGrace <= 0 || c.TerminationSignal == nil {
+			return kill()
+		}
+		if err := process.Signal(c.TerminationSignal); err != nil {
+			return kill()
+		}
+		killTime, stopKillTimer = c.timer(c.TerminationGrace)
+		return nil
+	}
+
+	// Request a checkpoint before the deadline, if checkpointing is enabled
+	var checkpointTime <-chan time.Time
+	checkpointRequested := false
+	if c.Checkpoint != nil {
+		var deadline time.Time
+		if c.Timeout > 0 {
+			deadline = startTime.Add(c.Timeout)
+		}
+		if ctxDeadline, ok := ctx.Deadline(); ok && (deadline.IsZero() || ctxDeadline.Before(deadline)) {
+			deadline = ctxDeadline
+		}
+		if !deadline.IsZero() {
+			var stopCheckpointTimer func()
+			checkpointTime, stopCheckpointTimer = c.timer(deadline.Add(-c.Checkpoint.Margin).Sub(c.Clock.Now()))
+			defer stopCheckpointTimer()
+		}
+	}
+
+	// Warn about anomalously long runs
+	slowTime, stopSlowTimer := c.timer(c.SlowThreshold)
+	defer stopSlowTimer()
+
+	// Watch memory usage, if a limit has been set
+	var memoryCheck <-chan time.Time
+	stopMemoryCheck := func() {}
+	if c.MemoryLimit > 0 {
+		memoryCheck, stopMemoryCheck = c.timer(c.MemoryCheckInterval)
+	}
+	defer func() { stopMemoryCheck() }()
+
+	// Watch for silence, if a stall timeout has been set
+	var stallCheck <-chan time.Time
+	stopStallCheck := func() {}
+	if c.StallTimeout > 0 {
+		stallCheck, stopStallCheck = c.timer(c.StallTimeout)
+	}
+	defer func() { stopStallCheck() }()
+	var stalledSince time.Time
+	for {
+		select {
+		case out := <-output:
+			line := out.text
+			// collapsed and sampled lines aren't relayed, but count
+			// towards the output limits
+			relay := true
+			if c.CollapseRepeats {
+				if c.lastLine != nil && line == *c.lastLine {
+					c.repeats++
+					c.collapsed++
+					relay = false
+				} else {
+					c.flushRepeats()
+					c.lastLine = &line
+				}
+			}
+			if relay && !out.stderr && !c.sampleLine() {
+				relay = false
+			}
+			if !c.countOutput(line) {
+				if !c.truncated {
+					c.truncated = true
+					c.writeProgress(fmt.Sprintf("[Output truncated after %d lines, %d bytes: %s]", c.outputLines-1, c.outputBytes-int64(len(line))-1, c.Name))
+					if c.KillOnOutputLimit && !processTerminated {
+						c.writeProgress(fmt.Sprintf("Command terminated after reaching output limit: %s", c.Name))
+						if err := shutdown(); err != nil {
+							return fmt.Errorf("Failed to terminate command: %w", err)
+						}
+						processTerminated = true
+						terminatedReason = "reaching output limit"
+					}
+				}
+			} else if relay {
+				if c.ShowOutput {
+					c.writeProgress(line)
+				} else {
+					c.StderrLogger.Println(line)
+				}
+				if c.OnOutput != nil {
+					c.OnOutput(line)
+				}
+			}
+			if relay && c.extractProgress(line) {
+				c.writeProgress(fmt.Sprintf("[Progress: %s]", c.progressString()))
+				if c.OnProgress != nil {
+					c.OnProgress(c.progress)
+				}
+			}
+		case <-deadline:
+			if !processTerminated {
+				c.writeProgress(fmt.Sprintf("Command timed out in %s: %s", c.Timeout.Round(time.Second).String(), c.Name))
+				if err := shutdown(); err != nil {
+					return fmt.Errorf("Failed to terminate command: %w", err)
+				}
+				processTerminated = true
+				c.Result.Status = StatusTimeout
+			}
+		case <-cancelled:
+			cancelled = nil
+			if !processTerminated {
+				c.writeProgress(fmt.Sprintf("Request cancelled, terminating command: %s", c.Name))
+				if err := shutdown(); err != nil {
+					return fmt.Errorf("Failed to terminate command: %w", err)
+				}
+				processTerminated = true
+				cancelErr = ctx.Err()
+			}
+		case <-killTime:
+			killTime = nil
+			c.writeProgress(fmt.Sprintf("Command still running %s after %s, killing: %s", c.TerminationGrace, c.TerminationSignal, c.Name))
+			if err := kill(); err != nil {
+				return fmt.Errorf("Failed to kill command: %w", err)
+			}
+		case <-abandonTime:
+			duration := c.Clock.Now().Sub(startTime).Truncate(time.Second)
+			c.writeProgress(fmt.Sprintf("Command still running %s after it was killed, abandoning it: %s", c.DrainTime+killWaitTime, c.Name))
+			c.flushRepeats()
+			c.flushOmitted()
+			c.writeProgress(c.outputTotals())
+			switch {
+			case terminatedReason != "":
+				c.Result.Status = StatusTerminated
+				return &TerminatedError{Reason: terminatedReason, Duration: duration}
+			case c.Result.Status == StatusTimeout:
+				return &TimeoutError{Timeout: c.Timeout}
+			case cancelErr != nil:
+				c.Result.Status = StatusTerminated
+				return &CanceledError{Duration: duration, Err: cancelErr}
+			}
+			c.Result.Status = StatusTerminated
+			return fmt.Errorf("Command didn't exit after it was killed in %s", duration)
+		case <-heartbeat:
+			details := []string{c.Clock.Now().Sub(startTime).Truncate(time.Second).String()}
+			if c.progress >= 0 {
+				details = append(details, c.progressString()+" complete")
+			}
+			if usage, err := process.Usage(); err == nil {
+				c.usage = usage
+				details = append(details, usage.String())
+			}
+			details = append(details, c.outputDetails())
+			if c.HeartbeatDetails != nil {
+				details = append(details, c.HeartbeatDetails()...)
+			}
+			c.flushRepeats()
+			c.flushOmitted()
+			c.writeProgress(fmt.Sprintf("[Still waiting for command to complete: %s --- %s]", c.Name, strings.Join(details, ", ")))
+			heartbeat, stopHeartbeat = c.timer(b.NextBackOff())
+		case <-checkpointTime:
+			if !processTerminated {
+				c.writeProgress(fmt.Sprintf("Approaching deadline, requesting checkpoint: %s", c.Name))
+				if err := process.Signal(c.Checkpoint.Signal); err != nil {
+					return fmt.Errorf("Failed to signal command: %w", err)
+				}
+				checkpointRequested = true
+			}
+		case <-slowTime:
+			elapsed := c.Clock.Now().Sub(startTime)
+			c.writeProgress(fmt.Sprintf("[Warning: command has been running for %s, longer than usual (threshold %s): %s]", elapsed.Truncate(time.Second), c.SlowThreshold.Truncate(time.Second), c.Name))
+			if c.OnSlow != nil {
+				go c.OnSlow(elapsed)
+			}
+		case <-stallCheck:
+			lastOutput := c.lastOutputTime
+			if lastOutput.Before(startTime) {
+				lastOutput = startTime
+			}
+			silent := c.Clock.Now().Sub(lastOutput)
+			if silent < c.StallTimeout {
+				stallCheck, stopStallCheck = c.timer(c.StallTimeout - silent)
+				continue
+			}
+			stallCheck, stopStallCheck = c.timer(c.StallTimeout)
+			if lastOutput.Equal(stalledSince) || processTerminated {
+				continue
+			}
+			stalledSince = lastOutput
+			c.writeProgress(fmt.Sprintf("[Warning: no output for %s, the command may be hung: %s]", silent.Truncate(time.Second), c.Name))
+			if c.OnStall != nil {
+				go c.OnStall(silent)
+			}
+			if c.StallSignal != nil {
+				if err := process.Signal(c.StallSignal); err != nil {
+					c.StderrLogger.Printf("Failed to send %s to stalled command: %v", c.StallSignal, err)
+				}
+			}
+			if c.KillOnStall {
+				c.writeProgress(fmt.Sprintf("Command terminated after producing no output for %s: %s", silent.Truncate(time.Second), c.Name))
+				if err := shutdown(); err != nil {
+					return fmt.Errorf("Failed to terminate command: %w", err)
+				}
+				processTerminated = true
+				terminatedReason = "producing no output for " + silent.Truncate(time.Second).String()
+			}
+		case <-memoryCheck:
+			memoryCheck, stopMemoryCheck = c.timer(c.MemoryCheckInterval)
+			if usage := process.MemoryUsage(); usage > c.MemoryLimit {
+				if !processTerminated {
+					c.writeProgress(fmt.Sprintf("Memory limit approached (%s used, limit %s), terminating command: %s", FormatBytes(usage), FormatBytes(c.MemoryLimit), c.Name))
+					if err := shutdown(); err != nil {
+						return fmt.Errorf("Failed to terminate command: %w", err)
+					}
+					processTerminated = true
+					terminatedReason = "approaching memory limit"
+				} else if err := kill(); err != nil {
+					return fmt.Errorf("Failed to terminate command: %w", err)
+				}
+			}
+		case exit := <-done:
+			endTime := c.Clock.Now()
+			duration := endTime.Sub(startTime).Truncate(time.Second)
+			commandDuration := duration.String()
+			c.flushRepeats()
+			c.flushOmitted()
+			c.writeProgress(c.outputTotals())
+			if usage, err := process.Usage(); err == nil {
+				c.usage = usage
+			}
+			c.writeProgress(fmt.Sprintf("[Resource usage: %s]", c.usage))
+			if exit.err == nil {
+				c.Result.ExitCode = exit.code
+			}
+			if p, ok := process.(SignaledProcess); ok {
+				if signal, coreDump := p.ExitSignal(); signal != nil {
+					c.Result.Signal = SignalName(signal)
+					c.Result.CoreDump = coreDump
+				}
+			}
+			if checkpointRequested && terminatedReason == "" {
+				messageId, err := c.Checkpoint.requeue(ctx)
+				if err != nil {
+					return fmt.Errorf("Command checkpoint failed in %s: %w", commandDuration, err)
+				}
+				c.writeProgress(fmt.Sprintf("Command checkpointed in %s, continuation published as message %s: %s", commandDuration, messageId, c.Name))
+				c.Result.Status = StatusCheckpointed
+				return nil
+			}
+			if terminatedReason != "" {
+				c.Result.Status = StatusTerminated
+				return &TerminatedError{Reason: terminatedReason, Duration: duration}
+			}
+			if c.Result.Status == StatusTimeout {
+				return &TimeoutError{Timeout: c.Timeout}
+			}
+			if cancelErr != nil {
+				c.Result.Status = StatusTerminated
+				return &CanceledError{Duration: duration, Err: cancelErr}
+			}
+			if exit.err != nil || exit.code != 0 {
+				if c.CanFail {
+					c.StdoutLogger.Printf("Warning, command failed (ignoring error) in %s: %v", commandDuration, exit)
+					return nil
+				}
+				if exit.err != nil {
+					return fmt.Errorf("Command failed in %s: %w", commandDuration, exit.err)
+				}
+				for _, exitcode := range c.AllowedExitCodes {
+					if exit.code == exitcode {
+						c.StdoutLogger.Printf("Command completed with allowed status code in %s: %d", commandDuration, exit.code)
+						return nil
+					}
+				}
+				return &ExitCodeError{ExitCode: exit.code, Duration: duration, Signal: c.Result.Signal, CoreDump: c.Result.CoreDump}
+			} else {
+				c.writeProgress(fmt.Sprintf("Command completed in %s: %s", commandDuration, c.Name))
+				return nil
+			}
+		}
+	}
+}
@@ -0,0 +1,782 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package runner
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeExecutor starts fake processes, which write their output lines and
+// exit with exitCode after running for duration, unless they are killed.
+type fakeExecutor struct {
+	lines       []string
+	stderrLines []string
+	exitCode    int
+	duration    time.Duration
+	startErr    error
+	// ignoreTerm makes the process only exit when it is killed.
+	ignoreTerm bool
+	// unkillable makes the process never exit, like in uninterruptible
+	// sleep.
+	unkillable bool
+	// exitSignal makes the process die from the signal after duration,
+	// dumping core if coreDump is set.
+	exitSignal os.Signal
+	coreDump   bool
+	// checkpoint is written to CHECKPOINT_FILE when the process is
+	// signalled.
+	checkpoint []byte
+
+	process *fakeProcess
+}
+
+func (e *fakeExecutor) Start(ctx context.Context, c *Command, env []string, stdout io.WriteCloser, stderr io.WriteCloser) (Process, error) {
+	if e.startErr != nil {
+		stdout.Close()
+		stderr.Close()
+		return nil, e.startErr
+	}
+	p := &fakeProcess{killed: make(chan os.Signal, 2), exited: make(chan struct{}), env: env}
+	e.process = p
+	go func() {
+		defer close(p.exited)
+		defer stdout.Close()
+		defer stderr.Close()
+		for _, line := range e.lines {
+			fmt.Fprintln(stdout, line)
+		}
+		if c.Stdin != nil {
+			io.Copy(stdout, c.Stdin)
+		}
+		for _, line := range e.stderrLines {
+			fmt.Fprintln(stderr, line)
+		}
+		var exited <-chan time.Time
+		if e.duration >= 0 {
+			exited = time.After(e.duration)
+		}
+		for {
+			select {
+			case <-exited:
+				p.exitCode = e.exitCode
+				if e.exitSignal != nil {
+					p.signal, p.coreDump = e.exitSignal, e.coreDump
+					p.exitCode = -1
+				}
+				return
+			case sig := <-p.killed:
+				p.signals = append(p.signals, sig)
+				if e.checkpoint != nil {
+					for _, v := range env {
+						if strings.HasPrefix(v, "CHECKPOINT_FILE=") {
+							ioutil.WriteFile(strings.TrimPrefix(v, "CHECKPOINT_FILE="), e.checkpoint, 0600)
+						}
+					}
+				}
+				if e.unkillable || (e.ignoreTerm && sig != os.Kill) {
+					continue
+				}
+				p.signal = sig
+				p.exitCode = -1
+				return
+			}
+		}
+	}()
+	return p, nil
+}
+
+type fakeProcess struct {
+	env      []string
+	killed   chan os.Signal
+	exited   chan struct{}
+	signal   os.Signal
+	signals  []os.Signal
+	exitCode int
+	coreDump bool
+}
+
+func (p *fakeProcess) ExitSignal() (os.Signal, bool) {
+	return p.signal, p.coreDump
+}
+
+func (p *fakeProcess) Pid() int {
+	return 42
+}
+
+func (p *fakeProcess) Signal(sig os.Signal) error {
+	select {
+	case p.killed <- sig:
+	default:
+	}
+	return nil
+}
+
+func (p *fakeProcess) Kill() error {
+	return p.Signal(os.Kill)
+}
+
+func (p *fakeProcess) Wait() (int, error) {
+	<-p.exited
+	return p.exitCode, nil
+}
+
+func (p *fakeProcess) Usage() (ResourceUsage, error) {
+	return ResourceUsage{UserTime: time.Second, MaxRSS: 1 << 20}, nil
+}
+
+func (p *fakeProcess) MemoryUsage() int64 {
+	return 1 << 20
+}
+
+func newTestCommand(executor Executor) (*Command, *BufferSink) {
+	output := &BufferSink{}
+	c := NewCommand("fake", "arg")
+	c.Executor = executor
+	c.Output = output
+	c.PollInterval = 10 * time.Millisecond
+	c.MaxPollInterval = 10 * time.Millisecond
+	c.DrainTime = time.Second
+	c.StdoutLogger = log.New(ioutil.Discard, "", 0)
+	c.StderrLogger = log.New(ioutil.Discard, "", 0)
+	return c, output
+}
+
+func TestRunSucceeds(t *testing.T) {
+	c, output := newTestCommand(&fakeExecutor{lines: []string{"hello", "world"}})
+	if err := c.Run(context.Background()); err != nil {
+		t.Fatalf("Run() = %v", err)
+	}
+	if c.Result.Status != StatusSucceeded || c.Result.ExitCode != 0 {
+		t.Errorf("Result = %s, exit code %d", c.Result.Status, c.Result.ExitCode)
+	}
+	lines := output.Lines()
+	if lines[0] != "Running command: fake" || lines[1] != "hello" || lines[2] != "world" {
+		t.Errorf("unexpected output: %q", lines)
+	}
+	if !strings.Contains(output.String(), "[Output totals: 2 lines, 12 bytes]") {
+		t.Errorf("missing output totals: %q", lines)
+	}
+	if !strings.Contains(lines[len(lines)-1], "Command completed in") {
+		t.Errorf("missing completion: %q", lines)
+	}
+}
+
+func TestRunExitCodes(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []int
+		canFail bool
+		wantErr bool
+	}{
+		{"failed", []int{0}, false, true},
+		{"allowed exit code", []int{0, 3}, false, false},
+		{"can fail", []int{0}, true, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, _ := newTestCommand(&fakeExecutor{exitCode: 3})
+			c.AllowedExitCodes = test.allowed
+			c.CanFail = test.canFail
+			err := c.Run(context.Background())
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Run() = %v, want error %v", err, test.wantErr)
+			}
+			if c.Result.ExitCode != 3 {
+				t.Errorf("ExitCode = %d, want 3", c.Result.ExitCode)
+			}
+			var exitErr *ExitCodeError
+			if test.wantErr && (c.Result.Status != StatusFailed || !errors.As(err, &exitErr) || exitErr.ExitCode != 3) {
+				t.Errorf("Result = %s, error %#v", c.Result.Status, err)
+			}
+		})
+	}
+}
+
+func TestRunStartError(t *testing.T) {
+	c, _ := newTestCommand(&fakeExecutor{startErr: errors.New("no such file")})
+	err := c.Run(context.Background())
+	var startErr *StartError
+	if !errors.As(err, &startErr) || err.Error() != "error starting command: no such file" {
+		t.Fatalf("Run() = %v", err)
+	}
+	if c.Result.Status != StatusFailed || c.Result.ExitCode != -1 {
+		t.Errorf("Result = %s, exit code %d", c.Result.Status, c.Result.ExitCode)
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	executor := &fakeExecutor{duration: -1}
+	c, output := newTestCommand(executor)
+	c.Timeout = 50 * time.Millisecond
+	err := c.Run(context.Background())
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) || timeoutErr.Timeout != c.Timeout {
+		t.Fatalf("Run() = %#v, want TimeoutError", err)
+	}
+	if c.Result.Status != StatusTimeout {
+		t.Errorf("Status = %s, want %s", c.Result.Status, StatusTimeout)
+	}
+	if executor.process.signal != os.Kill {
+		t.Errorf("process got %v, want kill", executor.process.signal)
+	}
+	if !strings.Contains(output.String(), "Command timed out") {
+		t.Errorf("missing timeout message: %q", output.Lines())
+	}
+}
+
+func TestRunCancelled(t *testing.T) {
+	executor := &fakeExecutor{duration: -1}
+	c, output := newTestCommand(executor)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	err := c.Run(ctx)
+	var canceledErr *CanceledError
+	if !errors.As(err, &canceledErr) || !errors.Is(err, context.Canceled) {
+		t.Fatalf("Run() = %#v, want CanceledError", err)
+	}
+	if c.Result.Status != StatusTerminated {
+		t.Errorf("Status = %s, want %s", c.Result.Status, StatusTerminated)
+	}
+	if executor.process.signal != os.Kill {
+		t.Errorf("process got %v, want kill", executor.process.signal)
+	}
+	if !strings.Contains(output.String(), "Request cancelled, terminating command") {
+		t.Errorf("missing cancellation message: %q", output.Lines())
+	}
+}
+
+func TestRunHeartbeat(t *testing.T) {
+	c, output := newTestCommand(&fakeExecutor{duration: 100 * time.Millisecond})
+	c.HeartbeatDetails = func() []string { return []string{"warning: 1.0 GiB disk used"} }
+	if err := c.Run(context.Background()); err != nil {
+		t.Fatalf("Run() = %v", err)
+	}
+	if !strings.Contains(output.String(), "[Still waiting for command to complete: fake --- ") {
+		t.Errorf("missing heartbeat: %q", output.Lines())
+	}
+	if !strings.Contains(output.String(), ", no output, warning: 1.0 GiB disk used]") {
+		t.Errorf("missing heartbeat details: %q", output.Lines())
+	}
+}
+
+func TestRunHeartbeatOutput(t *testing.T) {
+	for _, show := range []bool{true, false} {
+		c, output := newTestCommand(&fakeExecutor{lines: []string{"exporting table"}, duration: 100 * time.Millisecond})
+		c.ShowOutput = show
+		if err := c.Run(context.Background()); err != nil {
+			t.Fatalf("Run() = %v", err)
+		}
+		want := ", 1 lines, 16 B output, last line 0s ago]"
+		if show {
+			want = `, 1 lines, 16 B output, last line 0s ago: "exporting table"]`
+		}
+		if !strings.Contains(output.String(), want) {
+			t.Errorf("ShowOutput %v: missing %s in heartbeat: %q", show, want, output.Lines())
+		}
+	}
+}
+
+func TestRunProgress(t *testing.T) {
+	c, output := newTestCommand(&fakeExecutor{lines: []string{"10% done", "10% done", "50% done"}})
+	c.ProgressRegex = regexp.MustCompile(`(\d+)%`)
+	if err := c.Run(context.Background()); err != nil {
+		t.Fatalf("Run() = %v", err)
+	}
+	if got := strings.Count(output.String(), "[Progress: "); got != 2 {
+		t.Errorf("got %d progress messages, want 2: %q", got, output.Lines())
+	}
+}
+
+func TestRunOutputLimit(t *testing.T) {
+	c, output := newTestCommand(&fakeExecutor{lines: []string{"1", "2", "3", "4"}})
+	c.MaxOutputLines = 2
+	c.ShowOutput = true
+	var seen []string
+	c.OnOutput = func(line string) { seen = append(seen, line) }
+	if err := c.Run(context.Background()); err != nil {
+		t.Fatalf("Run() = %v", err)
+	}
+	if len(seen) != 2 {
+		t.Errorf("OnOutput got %q, want 2 lines", seen)
+	}
+	if !strings.Contains(output.String(), "[Output truncated after 2 lines, 4 bytes: fake]") {
+		t.Errorf("missing truncation: %q", output.Lines())
+	}
+}
+
+func TestRunHiddenOutput(t *testing.T) {
+	c, output := newTestCommand(&fakeExecutor{lines: []string{"secret"}})
+	c.ShowOutput = false
+	if err := c.Run(context.Background()); err != nil {
+		t.Fatalf("Run() = %v", err)
+	}
+	if strings.Contains(output.String(), "secret") {
+		t.Errorf("hidden output was streamed: %q", output.Lines())
+	}
+}
+
+func TestRunKillOnOutputLimit(t *testing.T) {
+	c, _ := newTestCommand(&fakeExecutor{lines: []string{"1", "2", "3"}, duration: -1})
+	c.MaxOutputLines = 1
+	c.KillOnOutputLimit = true
+	err := c.Run(context.Background())
+	var terminatedErr *TerminatedError
+	if !errors.As(err, &terminatedErr) || terminatedErr.Reason != "reaching output limit" {
+		t.Fatalf("Run() = %#v, want TerminatedError", err)
+	}
+	if c.Result.Status != StatusTerminated {
+		t.Errorf("Status = %s, want %s", c.Result.Status, StatusTerminated)
+	}
+}
+
+func TestRunGracefulTermination(t *testing.T) {
+	tests := []struct {
+		name       string
+		ignoreTerm bool
+		want       []os.Signal
+	}{
+		{"exits on SIGTERM", false, []os.Signal{syscall.SIGTERM}},
+		{"killed after grace", true, []os.Signal{syscall.SIGTERM, os.Kill}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			executor := &fakeExecutor{duration: -1, ignoreTerm: test.ignoreTerm}
+			c, output := newTestCommand(executor)
+			c.Timeout = 20 * time.Millisecond
+			c.TerminationGrace = 50 * time.Millisecond
+			err := c.Run(context.Background())
+			var timeoutErr *TimeoutError
+			if !errors.As(err, &timeoutErr) {
+				t.Fatalf("Run() = %#v, want TimeoutError", err)
+			}
+			if !reflect.DeepEqual(executor.process.signals, test.want) {
+				t.Errorf("process got %v, want %v", executor.process.signals, test.want)
+			}
+			if killed := strings.Contains(output.String(), "killing: fake"); killed != test.ignoreTerm {
+				t.Errorf("kill message %v, want %v: %q", killed, test.ignoreTerm, output.Lines())
+			}
+		})
+	}
+}
+
+func TestRunAbandonsUnkillableProcess(t *testing.T) {
+	defer func(d time.Duration) { killWaitTime = d }(killWaitTime)
+	killWaitTime = 50 * time.Millisecond
+	c, output := newTestCommand(&fakeExecutor{duration: -1, unkillable: true})
+	c.Timeout = 20 * time.Millisecond
+	c.DrainTime = 0
+	err := c.Run(context.Background())
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("Run() = %#v, want TimeoutError", err)
+	}
+	if c.Result.Status != StatusTimeout {
+		t.Errorf("Status = %s, want %s", c.Result.Status, StatusTimeout)
+	}
+	if !strings.Contains(output.String(), "abandoning it") {
+		t.Errorf("missing abandon message: %q", output.Lines())
+	}
+}
+
+func TestRunStdoutPassthrough(t *testing.T) {
+	c, output := newTestCommand(&fakeExecutor{lines: []string{"binary\x00data", "more"}})
+	var stdout bytes.Buffer
+	c.Stdout = &stdout
+	if err := c.Run(context.Background()); err != nil {
+		t.Fatalf("Run() = %v", err)
+	}
+	if stdout.String() != "binary\x00data\nmore\n" {
+		t.Errorf("stdout = %q", stdout.String())
+	}
+	if strings.Contains(output.String(), "more") {
+		t.Errorf("stdout relayed as output lines: %q", output.Lines())
+	}
+}
+
+func TestRunBinaryOutput(t *testing.T) {
+	random := make([]byte, 4*binaryChunkSize)
+	rand.New(rand.NewSource(1)).Read(random)
+	binary := string(random) + "\r\n\x00\n\n" + strings.Repeat("\x00\x01\xff", binaryChunkSize)
+	for _, encoding := range []string{BinaryBase64, BinaryHex} {
+		c, _ := newTestCommand(&fakeExecutor{lines: []string{"text", binary}})
+		c.BinaryEncoding = encoding
+		// the output is rebuilt from the text lines and the decoded chunks
+		var rebuilt []byte
+		c.OnOutput = func(line string) {
+			if data, ok := DecodeBinary(line); ok {
+				rebuilt = append(rebuilt, data...)
+			} else if IsBinary(line) {
+				t.Errorf("binary line relayed as is: %q", line)
+			} else {
+				rebuilt = append(rebuilt, line+"\n"...)
+			}
+		}
+		if err := c.Run(context.Background()); err != nil {
+			t.Fatalf("Run() = %v", err)
+		}
+		if want := "text\n" + binary + "\n"; string(rebuilt) != want {
+			t.Errorf("%s: rebuilt %d bytes, want the %d bytes of output", encoding, len(rebuilt), len(want))
+		}
+	}
+}
+
+func TestChunkLines(t *testing.T) {
+	if lines := chunkLines([]byte("one\r\ntwo\n"), BinaryBase64); !reflect.DeepEqual(lines, []string{"one\r", "two"}) {
+		t.Errorf("chunkLines() = %q, want the lines of text", lines)
+	}
+	for _, chunk := range []string{"partial", "\x00\n", "one\n\x00"} {
+		lines := chunkLines([]byte(chunk), BinaryBase64)
+		if data, ok := DecodeBinary(lines[0]); len(lines) != 1 || !ok || string(data) != chunk {
+			t.Errorf("chunkLines(%q) = %q, want the chunk encoded", chunk, lines)
+		}
+	}
+}
+
+func TestRunCollapseRepeats(t *testing.T) {
+	c, output := newTestCommand(&fakeExecutor{lines: []string{"retrying", "retrying", "retrying", "done", "done"}})
+	c.CollapseRepeats = true
+	if err := c.Run(context.Background()); err != nil {
+		t.Fatalf("Run() = %v", err)
+	}
+	want := []string{"retrying", "[Last line repeated 2 times]", "done", "[Last line repeated 1 times]", "[Output totals: 5 lines, 37 bytes, 3 repeated lines collapsed]"}
+	if got := output.Lines()[1:6]; !reflect.DeepEqual(got, want) {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+	wantTotals := OutputTotals{Lines: 5, Bytes: 37, Collapsed: 3}
+	if c.Result.Output != wantTotals {
+		t.Errorf("Result.Output = %+v, want %+v", c.Result.Output, wantTotals)
+	}
+	if c.Result.Usage == nil || c.Result.Usage.MaxRSS != 1<<20 {
+		t.Errorf("Result.Usage = %+v, want max rss of 1 MiB", c.Result.Usage)
+	}
+}
+
+func TestRunMaxLinesPerSecond(t *testing.T) {
+	var lines []string
+	for i := 1; i <= 10; i++ {
+		lines = append(lines, fmt.Sprintf("line %d", i))
+	}
+	c, output := newTestCommand(&fakeExecutor{lines: lines, stderrLines: []string{"error"}})
+	c.MaxLinesPerSecond = 2
+	c.SampleEvery = 3
+	if err := c.Run(context.Background()); err != nil {
+		t.Fatalf("Run() = %v", err)
+	}
+	var relayed []string
+	for _, line := range output.Lines() {
+		if strings.HasPrefix(line, "line") || strings.HasPrefix(line, "[Omitted") {
+			relayed = append(relayed, line)
+		}
+	}
+	want := []string{"line 1", "line 2", "line 5", "line 8", "[Omitted 6 lines over 2 per second]"}
+	if !reflect.DeepEqual(relayed, want) {
+		t.Errorf("relayed %q, want %q", relayed, want)
+	}
+	if !strings.Contains(output.String(), "error\n") {
+		t.Errorf("standard error not relayed: %q", output.Lines())
+	}
+	if !strings.Contains(output.String(), "11 lines, 77 bytes, 6 lines omitted") {
+		t.Errorf("missing omitted total: %q", output.Lines())
+	}
+}
+
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (r *closeRecorder) Close() error {
+	r.closed = true
+	return nil
+}
+
+func TestRunStdin(t *testing.T) {
+	c, output := newTestCommand(&fakeExecutor{})
+	stdin := &closeRecorder{Reader: strings.NewReader("from stdin\n")}
+	c.Stdin = stdin
+	if err := c.Run(context.Background()); err != nil {
+		t.Fatalf("Run() = %v", err)
+	}
+	if !strings.Contains(output.String(), "from stdin\n") {
+		t.Errorf("missing stdin in output: %q", output.Lines())
+	}
+	if !stdin.closed {
+		t.Error("stdin not closed")
+	}
+}
+
+func TestRunPreviousAttempt(t *testing.T) {
+	e := &fakeExecutor{}
+	c, output := newTestCommand(e)
+	c.Attempt = 3
+	c.Previous = &Attempt{Number: 2, JobID: "job-2", Transcript: "gs://bucket/job-2.log"}
+	if err := c.Run(context.Background()); err != nil {
+		t.Fatalf("Run() = %v", err)
+	}
+	env := strings.Join(e.process.env, " ")
+	for _, want := range []string{"ATTEMPT=3", "PREVIOUS_ATTEMPT=2", "PREVIOUS_JOB_ID=job-2", "PREVIOUS_TRANSCRIPT=gs://bucket/job-2.log"} {
+		if !strings.Contains(env, want) {
+			t.Errorf("missing %s in environment %q", want, e.process.env)
+		}
+	}
+	if !strings.Contains(output.String(), "Previous attempt 2: job-2") {
+		t.Errorf("missing previous attempt in output: %q", output.Lines())
+	}
+	if c.Result.Attempt != 3 || c.Result.Previous == nil || c.Result.Previous.JobID != "job-2" {
+		t.Errorf("result = %+v, want attempt 3 after job-2", c.Result)
+	}
+}
+
+func TestRunArgsTooLarge(t *testing.T) {
+	maxTotal, _ := argLimits()
+	c, _ := newTestCommand(&fakeExecutor{})
+	c.Args = []string{strings.Repeat("x", maxTotal/2), strings.Repeat("x", maxTotal/2)}
+	err := c.Run(context.Background())
+	var tooLarge *ArgsTooLargeError
+	if !errors.As(err, &tooLarge) {
+		t.Fatalf("Run() = %v, want ArgsTooLargeError", err)
+	}
+	if err := CheckArgs("true", []string{"small"}, []string{"A=b"}); err != nil {
+		t.Errorf("CheckArgs() = %v for small arguments", err)
+	}
+}
+
+func TestRunStall(t *testing.T) {
+	c, output := newTestCommand(&fakeExecutor{duration: 100 * time.Millisecond})
+	c.StallTimeout = 30 * time.Millisecond
+	stalls := make(chan time.Duration, 10)
+	c.OnStall = func(silent time.Duration) { stalls <- silent }
+	if err := c.Run(context.Background()); err != nil {
+		t.Fatalf("Run() = %v", err)
+	}
+	if got := strings.Count(output.String(), "[Warning: no output for "); got != 1 {
+		t.Errorf("got %d stall warnings, want 1: %q", got, output.Lines())
+	}
+	select {
+	case silent := <-stalls:
+		if silent < c.StallTimeout {
+			t.Errorf("OnStall(%s), want at least %s", silent, c.StallTimeout)
+		}
+	case <-time.After(time.Second):
+		t.Error("OnStall not called")
+	}
+
+	e := &fakeExecutor{ignoreTerm: true, duration: -1}
+	c, _ = newTestCommand(e)
+	c.StallTimeout = 30 * time.Millisecond
+	c.StallSignal = syscall.SIGQUIT
+	c.KillOnStall = true
+	err := c.Run(context.Background())
+	var terminatedErr *TerminatedError
+	if !errors.As(err, &terminatedErr) || !strings.HasPrefix(terminatedErr.Reason, "producing no output for ") {
+		t.Fatalf("Run() = %#v, want TerminatedError", err)
+	}
+	if len(e.process.signals) == 0 || e.process.signals[0] != syscall.SIGQUIT {
+		t.Errorf("signals = %v, want SIGQUIT first", e.process.signals)
+	}
+}
+
+func TestRunExitSignal(t *testing.T) {
+	tests := []struct {
+		signal   syscall.Signal
+		coreDump bool
+		want     string
+	}{
+		{syscall.SIGKILL, false, "Command killed by signal SIGKILL in 0s (possibly by the OOM killer)"},
+		{syscall.SIGSEGV, true, "Command killed by signal SIGSEGV in 0s (core dumped)"},
+	}
+	for _, test := range tests {
+		c, _ := newTestCommand(&fakeExecutor{exitSignal: test.signal, coreDump: test.coreDump})
+		err := c.Run(context.Background())
+		var exitErr *ExitCodeError
+		if !errors.As(err, &exitErr) || err.Error() != test.want {
+			t.Errorf("Run() = %v, want %s", err, test.want)
+		}
+		if c.Result.Signal != SignalName(test.signal) || c.Result.CoreDump != test.coreDump {
+			t.Errorf("result signal = %s, core dump %v, want %s, %v", c.Result.Signal, c.Result.CoreDump, SignalName(test.signal), test.coreDump)
+		}
+	}
+}
+
+func TestRunExpect(t *testing.T) {
+	c, output := newTestCommand(ExecExecutor{})
+	c.Name = "sh"
+	c.Args = []string{"-c", `printf 'Continue? [y/N] '; read answer; echo "answer $answer"; printf 'Passphrase: '; read pass; echo "passphrase $pass"`}
+	c.Expect = []Expectation{
+		{Pattern: regexp.MustCompile(`\[y/N\] $`), Response: "y", Times: 1},
+		{Pattern: regexp.MustCompile(`Passphrase: $`), Response: "secret"},
+	}
+	c.Timeout = 10 * time.Second
+	if err := c.Run(context.Background()); err != nil {
+		t.Fatalf("Run() = %v", err)
+	}
+	text := output.String()
+	if !strings.Contains(text, "answer y\n") || !strings.Contains(text, "passphrase secret\n") {
+		t.Errorf("prompts not answered: %q", output.Lines())
+	}
+	if c.Stdin != nil {
+		t.Errorf("Stdin = %v after Run", c.Stdin)
+	}
+
+	c, _ = newTestCommand(&fakeExecutor{})
+	c.Stdin = strings.NewReader("")
+	c.Expect = []Expectation{{Pattern: regexp.MustCompile(`\?`), Response: "y"}}
+	if err := c.Run(context.Background()); err == nil {
+		t.Error("Run() = nil with both Stdin and Expect")
+	}
+}
+
+func TestRunMemoryLimit(t *testing.T) {
+	executor := &fakeExecutor{duration: -1, ignoreTerm: true}
+	c, output := newTestCommand(executor)
+	c.MemoryLimit = 1 << 10
+	c.MemoryCheckInterval = 10 * time.Millisecond
+	c.TerminationSignal = syscall.SIGINT
+	c.TerminationGrace = time.Minute
+	err := c.Run(context.Background())
+	var terminatedErr *TerminatedError
+	if !errors.As(err, &terminatedErr) || terminatedErr.Reason != "approaching memory limit" {
+		t.Fatalf("Run() = %#v, want TerminatedError", err)
+	}
+	if want := []os.Signal{syscall.SIGINT, os.Kill}; !reflect.DeepEqual(executor.process.signals, want) {
+		t.Errorf("process got %v, want %v", executor.process.signals, want)
+	}
+	if !strings.Contains(output.String(), "Memory limit approached") {
+		t.Errorf("missing memory limit message: %q", output.Lines())
+	}
+}
+
+func TestRunResourceLimits(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("resource limits are only supported on Linux")
+	}
+	c, output := newTestCommand(ExecExecutor{})
+	c.Name = "sh"
+	c.Args = []string{"-c", "echo files $(ulimit -n); echo nice $(nice)"}
+	c.ResourceLimits = ResourceLimits{OpenFiles: 64, Nice: 5}
+	if err := c.Run(context.Background()); err != nil {
+		t.Fatalf("Run() = %v", err)
+	}
+	text := output.String()
+	if !strings.Contains(text, "files 64\n") || !strings.Contains(text, "nice 5\n") {
+		t.Errorf("limits not applied: %q", output.Lines())
+	}
+
+	cgroup, err := ioutil.TempDir("/sys/fs/cgroup/unified", "runner")
+	if err != nil {
+		t.Skipf("no writable cgroup v2 hierarchy: %v", err)
+	}
+	defer os.Remove(cgroup)
+	c, output = newTestCommand(ExecExecutor{})
+	c.Name = "sh"
+	c.Args = []string{"-c", "cat /proc/self/cgroup"}
+	c.ResourceLimits = ResourceLimits{Cgroup: cgroup}
+	if err := c.Run(context.Background()); err != nil {
+		t.Fatalf("Run() = %v", err)
+	}
+	if want := "0::/" + filepath.Base(cgroup) + "\n"; !strings.Contains(output.String(), want) {
+		t.Errorf("process not started in the cgroup, want %q: %q", want, output.Lines())
+	}
+}
+
+func TestRunOutputLimitOfSkippedLines(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		setup func(c *Command)
+	}{
+		{"collapsed", []string{"retrying", "retrying", "retrying", "retrying"}, func(c *Command) { c.CollapseRepeats = true }},
+		{"sampled", []string{"1", "2", "3", "4"}, func(c *Command) { c.MaxLinesPerSecond = 1 }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, output := newTestCommand(&fakeExecutor{lines: test.lines, duration: -1})
+			test.setup(c)
+			c.MaxOutputLines = 2
+			c.KillOnOutputLimit = true
+			err := c.Run(context.Background())
+			var terminatedErr *TerminatedError
+			if !errors.As(err, &terminatedErr) || terminatedErr.Reason != "reaching output limit" {
+				t.Fatalf("Run() = %#v, want TerminatedError", err)
+			}
+			if !strings.Contains(output.String(), "[Output truncated after 2 lines") {
+				t.Errorf("missing truncation message: %q", output.Lines())
+			}
+		})
+	}
+}
+
+func TestRunCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	e := &fakeExecutor{duration: -1, checkpoint: []byte("state 2")}
+	c, output := newTestCommand(e)
+	c.Timeout = time.Second
+	var requeued []byte
+	c.Checkpoint = &Checkpoint{
+		File:         filepath.Join(dir, "state"),
+		Margin:       950 * time.Millisecond,
+		Signal:       syscall.SIGUSR1,
+		Continuation: 1,
+		Resume:       []byte("state 1"),
+		Requeue: func(ctx context.Context, checkpoint []byte) (string, error) {
+			requeued = checkpoint
+			return "42", nil
+		},
+	}
+	if err := c.Run(context.Background()); err != nil {
+		t.Fatalf("Run() = %v", err)
+	}
+	if c.Result.Status != StatusCheckpointed || string(requeued) != "state 2" {
+		t.Errorf("Result = %s, requeued %q, want the checkpoint requeued: %q", c.Result.Status, requeued, output.Lines())
+	}
+	var file string
+	for _, v := range e.process.env {
+		if strings.HasPrefix(v, "CHECKPOINT_FILE=") {
+			file = strings.TrimPrefix(v, "CHECKPOINT_FILE=")
+		}
+	}
+	if filepath.Dir(filepath.Dir(file)) != dir || filepath.Base(file) != "state" {
+		t.Errorf("CHECKPOINT_FILE = %q, want a file of the run in %s", file, dir)
+	}
+	env := strings.Join(e.process.env, "\n")
+	if !strings.Contains(env, "RESUME_FROM_CHECKPOINT=1") || !strings.Contains(env, "CONTINUATION=1") {
+		t.Errorf("env = %q, want the continuation resumed", e.process.env)
+	}
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("%d checkpoint directories left behind", len(entries))
+	}
+}
@@ -0,0 +1,114 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package runner
+
+import (
+	"fmt"
+	"time"
+)
+
+// StartError is returned by Run when the command couldn't be started.
+type StartError struct {
+	Err error
+}
+
+func (e *StartError) Error() string {
+	return fmt.Sprintf("error starting command: %v", e.Err)
+}
+
+func (e *StartError) Unwrap() error {
+	return e.Err
+}
+
+// ArgsTooLargeError is returned by CheckArgs when the arguments and
+// environment of a command exceed the limits of the OS, on which exec fails
+// with "argument list too long".
+type ArgsTooLargeError struct {
+	// Arg names the argument or environment variable over the limit of a
+	// single string, or is empty if the total size is over the limit.
+	Arg   string
+	Size  int
+	Limit int
+}
+
+func (e *ArgsTooLargeError) Error() string {
+	if e.Arg != "" {
+		return fmt.Sprintf("%s is %s, over the limit of %s", e.Arg, FormatBytes(int64(e.Size)), FormatBytes(int64(e.Limit)))
+	}
+	return fmt.Sprintf("arguments and environment are %s, over the limit of %s (ARG_MAX)", FormatBytes(int64(e.Size)), FormatBytes(int64(e.Limit)))
+}
+
+// ExitCodeError is returned by Run when the command exited with a status
+// code that isn't allowed.
+type ExitCodeError struct {
+	ExitCode int
+	Duration time.Duration
+	// Signal is the name of the signal that terminated the command, if any,
+	// and CoreDump whether it dumped core.
+	Signal   string
+	CoreDump bool
+}
+
+func (e *ExitCodeError) Error() string {
+	if e.Signal == "" {
+		return fmt.Sprintf("Command exited with status code in %s: %d", e.Duration, e.ExitCode)
+	}
+	message := fmt.Sprintf("Command killed by signal %s in %s", e.Signal, e.Duration)
+	switch {
+	case e.CoreDump:
+		message += " (core dumped)"
+	case e.Signal == "SIGKILL":
+		message += " (possibly by the OOM killer)"
+	}
+	return message
+}
+
+// TimeoutError is returned by Run when the command was killed after running
+// for longer than its timeout.
+type TimeoutError struct {
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("Command timed out in %s", e.Timeout.Round(time.Second))
+}
+
+// CanceledError is returned by Run when the command was killed because its
+// context was cancelled, eg. when the client disconnected.
+type CanceledError struct {
+	Duration time.Duration
+	Err      error
+}
+
+func (e *CanceledError) Error() string {
+	return fmt.Sprintf("Command cancelled in %s: %v", e.Duration, e.Err)
+}
+
+func (e *CanceledError) Unwrap() error {
+	return e.Err
+}
+
+// TerminatedError is returned by Run when the command was terminated for
+// reaching the output or memory limits.
+type TerminatedError struct {
+	Reason   string
+	Duration time.Duration
+}
+
+func (e *TerminatedError) Error() string {
+	return fmt.Sprintf("Command terminated after %s in %s", e.Reason, e.Duration)
+}
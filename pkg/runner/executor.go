@@ -0,0 +1,181 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package runner
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"sync"
+	"syscall"
+)
+
+// Executor starts the processes of commands. ExecExecutor runs them with
+// os/exec; tests can substitute fake processes.
+type Executor interface {
+	// Start starts the process of the command with the additional
+	// environment variables, writing its output to stdout and stderr. The
+	// executor closes stdout and stderr when the process no longer needs
+	// them, also when starting it fails.
+	Start(ctx context.Context, c *Command, env []string, stdout io.WriteCloser, stderr io.WriteCloser) (Process, error)
+}
+
+// Process is a process started by an Executor.
+type Process interface {
+	Pid() int
+	Signal(sig os.Signal) error
+	Kill() error
+	// Wait waits for the process to exit and returns its exit code, or -1 if
+	// it was terminated by a signal. An error is only returned if waiting
+	// failed.
+	Wait() (int, error)
+	// Usage returns the resource usage of the process, which is final once
+	// Wait has returned.
+	Usage() (ResourceUsage, error)
+	// MemoryUsage returns the memory usage counted against the memory limit
+	// of the command.
+	MemoryUsage() int64
+}
+
+// SignaledProcess is implemented by processes that can tell which signal
+// terminated them.
+type SignaledProcess interface {
+	// ExitSignal returns the signal that terminated the process, if any,
+	// and whether it dumped core, once Wait has returned.
+	ExitSignal() (os.Signal, bool)
+}
+
+// ExecExecutor runs commands as child processes.
+type ExecExecutor struct{}
+
+func (ExecExecutor) Start(ctx context.Context, c *Command, env []string, stdout io.WriteCloser, stderr io.WriteCloser) (Process, error) {
+	defer stdout.Close()
+	defer stderr.Close()
+
+	// The process isn't tied to ctx, as Run terminates it gracefully when
+	// ctx is cancelled
+	cmd := exec.Command(c.Name, c.Args...)
+	cmd.Dir = c.Dir
+	setProcessGroup(cmd)
+	if c.Chroot != "" {
+		if err := setChroot(cmd, c.Chroot); err != nil {
+			return nil, fmt.Errorf("error setting chroot: %w", err)
+		}
+	}
+	if c.RunAs != nil {
+		if err := setRunAs(cmd, c.RunAs); err != nil {
+			return nil, fmt.Errorf("error setting user: %w", err)
+		}
+	}
+	if len(env) > 0 {
+		addEnv(cmd, env...)
+	}
+	cmd.Stdin = c.Stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	release, err := prepareResourceLimits(cmd, c.ResourceLimits)
+	if err != nil {
+		return nil, fmt.Errorf("error applying resource limits: %w", err)
+	}
+	defer release()
+
+	// The limits are applied by the thread that started the process, which
+	// is its tracer until then
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := startTracked(cmd); err != nil {
+		return nil, err
+	}
+	if err := applyResourceLimits(cmd.Process.Pid, c.ResourceLimits); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		untrack(cmd.Process.Pid)
+		return nil, fmt.Errorf("error applying resource limits: %w", err)
+	}
+	return &execProcess{cmd: cmd, command: c}, nil
+}
+
+// execProcess is a process started by ExecExecutor.
+type execProcess struct {
+	cmd     *exec.Cmd
+	command *Command
+
+	mu    sync.Mutex
+	state *os.ProcessState
+	last  ResourceUsage
+}
+
+func (p *execProcess) Pid() int {
+	return p.cmd.Process.Pid
+}
+
+func (p *execProcess) Signal(sig os.Signal) error {
+	return p.cmd.Process.Signal(sig)
+}
+
+func (p *execProcess) Kill() error {
+	return p.cmd.Process.Kill()
+}
+
+func (p *execProcess) Wait() (int, error) {
+	err := p.cmd.Wait()
+	untrack(p.cmd.Process.Pid)
+	if p.command.KillOrphans {
+		if killed := killOrphans(p.cmd.Process.Pid); killed > 0 {
+			p.command.StdoutLogger.Printf("Killed %d orphaned processes left behind by command", killed)
+		}
+	}
+	p.mu.Lock()
+	p.state = p.cmd.ProcessState
+	p.mu.Unlock()
+	if _, ok := err.(*exec.ExitError); ok || err == nil {
+		return p.cmd.ProcessState.ExitCode(), nil
+	}
+	return -1, err
+}
+
+func (p *execProcess) ExitSignal() (os.Signal, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.state == nil {
+		return nil, false
+	}
+	if status, ok := p.state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return status.Signal(), status.CoreDump()
+	}
+	return nil, false
+}
+
+func (p *execProcess) Usage() (ResourceUsage, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.state != nil {
+		return finalResourceUsage(p.state, p.last), nil
+	}
+	usage, err := sampleResourceUsage(p.cmd.Process.Pid)
+	if err == nil {
+		p.last = usage
+	}
+	return usage, err
+}
+
+func (p *execProcess) MemoryUsage() int64 {
+	return memoryUsage(p.cmd.Process.Pid)
+}
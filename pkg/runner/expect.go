@@ -0,0 +1,110 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package runner
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"sync"
+)
+
+// maxExpectBuffer is how much of the latest output is kept to match prompts.
+const maxExpectBuffer = 4096
+
+// Expectation answers a prompt of an interactive command: when its output
+// matches Pattern, Response and a newline are written to its standard input.
+// The output is matched as it's read, so that prompts that don't end in a
+// newline are answered.
+type Expectation struct {
+	Pattern  *regexp.Regexp
+	Response string
+	// Times is how many times the prompt is answered, zero meaning every
+	// time it appears.
+	Times int
+}
+
+// expecter answers the prompts of a command on its standard input.
+type expecter struct {
+	mu           sync.Mutex
+	expectations []Expectation
+	answered     []int
+	stdin        io.Writer
+	logger       *log.Logger
+}
+
+func newExpecter(expectations []Expectation, stdin io.Writer, logger *log.Logger) *expecter {
+	return &expecter{
+		expectations: expectations,
+		answered:     make([]int, len(expectations)),
+		stdin:        stdin,
+		logger:       logger,
+	}
+}
+
+// stream returns a writer that matches the output written to it, for each
+// of stdout and stderr.
+func (e *expecter) stream() io.Writer {
+	return &expectStream{expecter: e}
+}
+
+// answer writes the response of the first expectation that matches buf, and
+// returns the end of the match, or -1.
+func (e *expecter) answer(buf []byte) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for i, expectation := range e.expectations {
+		if expectation.Times > 0 && e.answered[i] >= expectation.Times {
+			continue
+		}
+		loc := expectation.Pattern.FindIndex(buf)
+		if loc == nil || loc[1] == 0 {
+			continue
+		}
+		e.answered[i]++
+		// the response isn't logged, as it may be a secret
+		e.logger.Printf("Answering prompt %q", expectation.Pattern.String())
+		if _, err := fmt.Fprintln(e.stdin, expectation.Response); err != nil {
+			e.logger.Printf("Failed to answer prompt: %v", err)
+		}
+		return loc[1]
+	}
+	return -1
+}
+
+// expectStream keeps the latest output of a stream until it matches.
+type expectStream struct {
+	expecter *expecter
+	buf      []byte
+}
+
+func (s *expectStream) Write(p []byte) (int, error) {
+	s.buf = append(s.buf, p...)
+	for {
+		end := s.expecter.answer(s.buf)
+		if end < 0 {
+			break
+		}
+		// output up to the end of the match isn't matched again
+		s.buf = s.buf[end:]
+	}
+	if len(s.buf) > maxExpectBuffer {
+		s.buf = append(s.buf[:0], s.buf[len(s.buf)-maxExpectBuffer:]...)
+	}
+	return len(p), nil
+}
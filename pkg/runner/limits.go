@@ -0,0 +1,65 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package runner
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ResourceLimits are applied to the spawned process, so that a misbehaving
+// command can't starve the HTTP server.
+type ResourceLimits struct {
+	// Maximum size of the process's virtual memory (RLIMIT_AS) in bytes.
+	AddressSpace uint64
+	// Maximum number of open file descriptors (RLIMIT_NOFILE).
+	OpenFiles uint64
+	// Scheduling priority (niceness) of the process.
+	Nice int
+
+	// Path of a cgroup v2 directory the process is moved into. The
+	// directory is created if it doesn't exist.
+	Cgroup          string
+	CgroupMemoryMax int64
+	CgroupCPUWeight int64
+}
+
+func (l ResourceLimits) IsSet() bool {
+	return l.AddressSpace > 0 || l.OpenFiles > 0 || l.Nice != 0 || l.Cgroup != ""
+}
+
+// CheckArgs returns an ArgsTooLargeError if exec would reject the arguments
+// and environment of a command for their size, counting each string with
+// its terminating null byte and pointer.
+func CheckArgs(name string, args []string, env []string) error {
+	maxTotal, maxString := argLimits()
+	size := 0
+	for i, s := range append(append([]string{name}, args...), env...) {
+		if maxString > 0 && len(s)+1 > maxString {
+			arg := fmt.Sprintf("argument %d", i)
+			if i > len(args) {
+				arg = "environment variable " + strings.SplitN(s, "=", 2)[0]
+			}
+			return &ArgsTooLargeError{Arg: arg, Size: len(s) + 1, Limit: maxString}
+		}
+		size += len(s) + 1 + 8
+	}
+	if size > maxTotal {
+		return &ArgsTooLargeError{Size: size, Limit: maxTotal}
+	}
+	return nil
+}
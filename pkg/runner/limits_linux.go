@@ -0,0 +1,135 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package runner
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// argLimits returns the limits of exec on the total size of the arguments
+// and environment, a quarter of the stack size limit but at most 6 MiB, and
+// on a single string (MAX_ARG_STRLEN).
+func argLimits() (int, int) {
+	maxTotal := 6 << 20
+	var stack unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_STACK, &stack); err == nil && stack.Cur != unix.RLIM_INFINITY && stack.Cur/4 < uint64(maxTotal) {
+		maxTotal = int(stack.Cur / 4)
+	}
+	if maxTotal < 128<<10 {
+		maxTotal = 128 << 10
+	}
+	return maxTotal, 32 * 4096
+}
+
+// prepareResourceLimits arranges for the resource limits to be in place
+// before cmd runs its first instruction: the process is created in the
+// cgroup, so none of its children can escape it, and it's traced to stop
+// on exec for applyResourceLimits to set the rest. The returned function
+// releases the cgroup, once cmd has started.
+func prepareResourceLimits(cmd *exec.Cmd, limits ResourceLimits) (func(), error) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	release := func() {}
+	if limits.Cgroup != "" {
+		cgroup, err := openCgroup(limits)
+		if err != nil {
+			return nil, fmt.Errorf("error setting cgroup %s: %w", limits.Cgroup, err)
+		}
+		cmd.SysProcAttr.UseCgroupFD = true
+		cmd.SysProcAttr.CgroupFD = int(cgroup.Fd())
+		release = func() { cgroup.Close() }
+	}
+	cmd.SysProcAttr.Ptrace = limits.stopsOnExec()
+	return release, nil
+}
+
+// stopsOnExec returns whether the process has to be stopped on exec for
+// limits that can only be set from outside it.
+func (l ResourceLimits) stopsOnExec() bool {
+	return l.AddressSpace > 0 || l.OpenFiles > 0 || l.Nice != 0
+}
+
+// applyResourceLimits sets the resource limits of a process started with
+// prepareResourceLimits, which is stopped on exec, and lets it run. It must
+// be called from the thread that started the process, its tracer.
+func applyResourceLimits(pid int, limits ResourceLimits) error {
+	if !limits.stopsOnExec() {
+		return nil
+	}
+	var status unix.WaitStatus
+	for {
+		_, err := unix.Wait4(pid, &status, 0, nil)
+		if err == nil {
+			break
+		}
+		if err != unix.EINTR {
+			return fmt.Errorf("error waiting for exec: %w", err)
+		}
+	}
+	if !status.Stopped() || status.StopSignal() != unix.SIGTRAP {
+		return fmt.Errorf("process didn't stop on exec: %v", status)
+	}
+	if limits.AddressSpace > 0 {
+		rlimit := unix.Rlimit{Cur: limits.AddressSpace, Max: limits.AddressSpace}
+		if err := unix.Prlimit(pid, unix.RLIMIT_AS, &rlimit, nil); err != nil {
+			return fmt.Errorf("error setting RLIMIT_AS: %w", err)
+		}
+	}
+	if limits.OpenFiles > 0 {
+		rlimit := unix.Rlimit{Cur: limits.OpenFiles, Max: limits.OpenFiles}
+		if err := unix.Prlimit(pid, unix.RLIMIT_NOFILE, &rlimit, nil); err != nil {
+			return fmt.Errorf("error setting RLIMIT_NOFILE: %w", err)
+		}
+	}
+	if limits.Nice != 0 {
+		if err := unix.Setpriority(unix.PRIO_PROCESS, pid, limits.Nice); err != nil {
+			return fmt.Errorf("error setting niceness: %w", err)
+		}
+	}
+	if err := unix.PtraceDetach(pid); err != nil {
+		return fmt.Errorf("error resuming process: %w", err)
+	}
+	return nil
+}
+
+// openCgroup creates the cgroup with its limits and opens it, to start a
+// process in it.
+func openCgroup(limits ResourceLimits) (*os.File, error) {
+	if err := os.MkdirAll(limits.Cgroup, 0755); err != nil {
+		return nil, err
+	}
+	if limits.CgroupMemoryMax > 0 {
+		if err := ioutil.WriteFile(filepath.Join(limits.Cgroup, "memory.max"), []byte(strconv.FormatInt(limits.CgroupMemoryMax, 10)), 0644); err != nil {
+			return nil, err
+		}
+	}
+	if limits.CgroupCPUWeight > 0 {
+		if err := ioutil.WriteFile(filepath.Join(limits.Cgroup, "cpu.weight"), []byte(strconv.FormatInt(limits.CgroupCPUWeight, 10)), 0644); err != nil {
+			return nil, err
+		}
+	}
+	return os.Open(limits.Cgroup)
+}
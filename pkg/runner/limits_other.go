@@ -0,0 +1,43 @@
+//go:build !linux
+// +build !linux
+
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package runner
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// argLimits returns the limit of exec on the total size of the arguments
+// and environment, using the smallest common ARG_MAX, and no limit on a
+// single string.
+func argLimits() (int, int) {
+	return 256 << 10, 0
+}
+
+func prepareResourceLimits(cmd *exec.Cmd, limits ResourceLimits) (func(), error) {
+	if limits.IsSet() {
+		return nil, fmt.Errorf("resource limits are only supported on Linux")
+	}
+	return func() {}, nil
+}
+
+func applyResourceLimits(pid int, limits ResourceLimits) error {
+	return nil
+}
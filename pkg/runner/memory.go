@@ -0,0 +1,97 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package runner
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// processRSS returns the resident set size of a process in bytes.
+func processRSS(pid int) (int64, error) {
+	status, err := readProcKeyValues(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, err
+	}
+	rss, ok := status["VmRSS"]
+	if !ok {
+		return 0, fmt.Errorf("no VmRSS for process %d", pid)
+	}
+	return rss * 1024, nil
+}
+
+// readCgroupValue reads the first existing file of the candidates as a
+// number of bytes. Unlimited values ("max") are returned as zero.
+func readCgroupValue(candidates ...string) (int64, error) {
+	var lastErr error
+	for _, candidate := range candidates {
+		contents, err := ioutil.ReadFile(candidate)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		value := strings.TrimSpace(string(contents))
+		if value == "max" {
+			return 0, nil
+		}
+		return strconv.ParseInt(value, 10, 64)
+	}
+	return 0, lastErr
+}
+
+// cgroupMemoryUsage returns the memory usage of the container. Both cgroup v2
+// and v1 hierarchies are supported.
+func cgroupMemoryUsage() (int64, error) {
+	return readCgroupValue("/sys/fs/cgroup/memory.current", "/sys/fs/cgroup/memory/memory.usage_in_bytes")
+}
+
+// CgroupMemoryLimit returns the memory limit of the container, or zero if
+// no limit could be determined.
+func CgroupMemoryLimit() (int64, error) {
+	limit, err := readCgroupValue("/sys/fs/cgroup/memory.max", "/sys/fs/cgroup/memory/memory.limit_in_bytes")
+	// cgroup v1 reports a huge number when there is no limit
+	if limit >= 1<<62 {
+		return 0, err
+	}
+	return limit, err
+}
+
+// memoryUsage returns the larger of the container's and the process's memory
+// usage, as in-memory filesystems count against the container limit.
+func memoryUsage(pid int) int64 {
+	usage, _ := cgroupMemoryUsage()
+	if rss, err := processRSS(pid); err == nil && rss > usage {
+		usage = rss
+	}
+	return usage
+}
+
+// FormatBytes formats a size in bytes with binary units, like "1.5 MiB".
+func FormatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,176 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package runner
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OutputSink receives the output lines and progress messages of a command.
+type OutputSink interface {
+	WriteLine(line string) error
+}
+
+// HTTPSink streams the output to a HTTP response, flushing every line.
+type HTTPSink struct {
+	Writer  io.Writer
+	Flusher http.Flusher
+}
+
+func (s *HTTPSink) WriteLine(line string) error {
+	if _, err := fmt.Fprintln(s.Writer, line); err != nil {
+		return err
+	}
+	if s.Flusher != nil {
+		s.Flusher.Flush()
+	}
+	return nil
+}
+
+// SSESink streams the output to a HTTP response as server-sent events, one
+// event per line.
+type SSESink struct {
+	Writer  io.Writer
+	Flusher http.Flusher
+}
+
+func (s *SSESink) WriteLine(line string) error {
+	if _, err := fmt.Fprintf(s.Writer, "data: %s\n\n", line); err != nil {
+		return err
+	}
+	if s.Flusher != nil {
+		s.Flusher.Flush()
+	}
+	return nil
+}
+
+// NDJSONSink streams the output to a HTTP response as newline-delimited
+// JSON, one object per line. Binary output encoded by the command is given
+// as data with its encoding instead of as a line.
+type NDJSONSink struct {
+	Writer  io.Writer
+	Flusher http.Flusher
+	// Fields returns structured fields parsed from a line, added to its
+	// event as fields.
+	Fields func(line string) map[string]interface{}
+}
+
+type ndjsonEvent struct {
+	Time     string                 `json:"time"`
+	Line     string                 `json:"line,omitempty"`
+	Data     string                 `json:"data,omitempty"`
+	Encoding string                 `json:"encoding,omitempty"`
+	Fields   map[string]interface{} `json:"fields,omitempty"`
+}
+
+func (s *NDJSONSink) WriteLine(line string) error {
+	event := ndjsonEvent{Time: time.Now().UTC().Format(time.RFC3339Nano)}
+	if encoding, data, ok := binaryChunk(line); ok {
+		event.Data, event.Encoding = data, encoding
+	} else {
+		event.Line = line
+		if s.Fields != nil {
+			event.Fields = s.Fields(line)
+		}
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(s.Writer, "%s\n", data); err != nil {
+		return err
+	}
+	if s.Flusher != nil {
+		s.Flusher.Flush()
+	}
+	return nil
+}
+
+// BufferSink keeps the output in memory, up to MaxLines lines if it is set,
+// dropping the oldest lines.
+type BufferSink struct {
+	MaxLines int
+
+	mu    sync.Mutex
+	lines []string
+}
+
+func (s *BufferSink) WriteLine(line string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lines = append(s.lines, line)
+	if s.MaxLines > 0 && len(s.lines) > s.MaxLines {
+		s.lines = s.lines[len(s.lines)-s.MaxLines:]
+	}
+	return nil
+}
+
+// Lines returns a copy of the buffered lines.
+func (s *BufferSink) Lines() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.lines...)
+}
+
+func (s *BufferSink) String() string {
+	lines := s.Lines()
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// MultiSink writes the output to all of its sinks.
+type MultiSink []OutputSink
+
+// WriteLine writes the line to every sink, returning the first error.
+func (m MultiSink) WriteLine(line string) error {
+	var firstErr error
+	for _, sink := range m {
+		if err := sink.WriteLine(line); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Close closes the sinks that implement io.Closer, returning the first
+// error.
+func (m MultiSink) Close() error {
+	var firstErr error
+	for _, sink := range m {
+		if closer, ok := sink.(io.Closer); ok {
+			if err := closer.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// discardSink is used when a command has no output sink.
+type discardSink struct{}
+
+func (discardSink) WriteLine(line string) error {
+	return nil
+}
@@ -0,0 +1,71 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package runner
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBufferSinkMaxLines(t *testing.T) {
+	sink := &BufferSink{MaxLines: 2}
+	for _, line := range []string{"a", "b", "c"} {
+		sink.WriteLine(line)
+	}
+	if got := sink.Lines(); !reflect.DeepEqual(got, []string{"b", "c"}) {
+		t.Errorf("Lines() = %q", got)
+	}
+	if got := sink.String(); got != "b\nc\n" {
+		t.Errorf("String() = %q", got)
+	}
+}
+
+type failingSink struct{}
+
+func (failingSink) WriteLine(line string) error {
+	return errors.New("broken pipe")
+}
+
+func TestMultiSink(t *testing.T) {
+	a, b := &BufferSink{}, &BufferSink{}
+	sink := MultiSink{a, failingSink{}, b}
+	if err := sink.WriteLine("line"); err == nil {
+		t.Error("WriteLine() didn't return the error")
+	}
+	if len(a.Lines()) != 1 || len(b.Lines()) != 1 {
+		t.Errorf("lines not written to all sinks: %q, %q", a.Lines(), b.Lines())
+	}
+}
+
+func TestNDJSONSink(t *testing.T) {
+	var out bytes.Buffer
+	sink := &NDJSONSink{Writer: &out}
+	sink.WriteLine("hello")
+	sink.WriteLine(encodeChunk([]byte("\x00\xff"), BinaryHex))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	var text, binary ndjsonEvent
+	if err := json.Unmarshal([]byte(lines[0]), &text); err != nil || text.Line != "hello" {
+		t.Errorf("text event = %s, %v", lines[0], err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &binary); err != nil || binary.Data != "00ff" || binary.Encoding != BinaryHex {
+		t.Errorf("binary event = %s, %v", lines[1], err)
+	}
+}
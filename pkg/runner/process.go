@@ -0,0 +1,130 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package runner
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"sync"
+)
+
+// addEnv adds environment variables to the command's environment.
+func addEnv(cmd *exec.Cmd, env ...string) {
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, env...)
+}
+
+// RunAs is the user and group the command is run as.
+type RunAs struct {
+	Uid    uint32
+	Gid    uint32
+	Groups []uint32
+	Home   string
+}
+
+// LookupRunAs resolves the user (name or numeric uid) and an optional group
+// (name or numeric gid) to run the command as.
+func LookupRunAs(username string, group string) (*RunAs, error) {
+	runAs := &RunAs{}
+	u, err := user.Lookup(username)
+	if err != nil {
+		u, err = user.LookupId(username)
+	}
+	if err == nil {
+		uid, _ := strconv.ParseUint(u.Uid, 10, 32)
+		gid, _ := strconv.ParseUint(u.Gid, 10, 32)
+		runAs.Uid, runAs.Gid, runAs.Home = uint32(uid), uint32(gid), u.HomeDir
+		if groupIds, err := u.GroupIds(); err == nil {
+			for _, groupId := range groupIds {
+				if gid, err := strconv.ParseUint(groupId, 10, 32); err == nil {
+					runAs.Groups = append(runAs.Groups, uint32(gid))
+				}
+			}
+		}
+	} else {
+		// Allow numeric uids that don't exist in /etc/passwd
+		uid, parseErr := strconv.ParseUint(username, 10, 32)
+		if parseErr != nil {
+			return nil, fmt.Errorf("unknown user %s: %w", username, err)
+		}
+		runAs.Uid, runAs.Gid = uint32(uid), uint32(uid)
+	}
+
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			g, err = user.LookupGroupId(group)
+		}
+		if err == nil {
+			gid, _ := strconv.ParseUint(g.Gid, 10, 32)
+			runAs.Gid = uint32(gid)
+		} else {
+			gid, parseErr := strconv.ParseUint(group, 10, 32)
+			if parseErr != nil {
+				return nil, fmt.Errorf("unknown group %s: %w", group, err)
+			}
+			runAs.Gid = uint32(gid)
+		}
+	}
+	return runAs, nil
+}
+
+// children tracks the commands currently started by us, so that the zombie
+// reaper doesn't steal their exit status from exec.Cmd.Wait().
+// subreaper is set when we are a child subreaper, and orphaned processes of
+// commands are reparented to us.
+var subreaper bool
+
+var children = struct {
+	sync.Mutex
+	pids map[int]bool
+}{pids: make(map[int]bool)}
+
+// startTracked starts the command and registers it as a tracked child.
+func startTracked(cmd *exec.Cmd) error {
+	children.Lock()
+	defer children.Unlock()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	children.pids[cmd.Process.Pid] = true
+	return nil
+}
+
+// untrack removes an exited command from the tracked children.
+func untrack(pid int) {
+	children.Lock()
+	defer children.Unlock()
+	delete(children.pids, pid)
+}
+
+func isTracked(pid int) bool {
+	children.Lock()
+	defer children.Unlock()
+	return children.pids[pid]
+}
+
+func trackedCount() int {
+	children.Lock()
+	defer children.Unlock()
+	return len(children.pids)
+}
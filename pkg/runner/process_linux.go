@@ -0,0 +1,185 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package runner
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// procStat is the subset of /proc/<pid>/stat we care about.
+type procStat struct {
+	Pid   int
+	State string
+	Ppid  int
+	Pgrp  int
+}
+
+func readProcStat(pid int) (procStat, error) {
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return procStat{}, err
+	}
+	fields := strings.Fields(string(stat[strings.LastIndex(string(stat), ")")+1:]))
+	if len(fields) < 3 {
+		return procStat{}, fmt.Errorf("unexpected format in /proc/%d/stat", pid)
+	}
+	ppid, _ := strconv.Atoi(fields[1])
+	pgrp, _ := strconv.Atoi(fields[2])
+	return procStat{Pid: pid, State: fields[0], Ppid: ppid, Pgrp: pgrp}, nil
+}
+
+// listProcesses returns all processes visible in /proc.
+func listProcesses() []procStat {
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+	var processes []procStat
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		if stat, err := readProcStat(pid); err == nil {
+			processes = append(processes, stat)
+		}
+	}
+	return processes
+}
+
+// SignalByName returns a signal by its name (eg. SIGTERM or TERM).
+func SignalByName(name string) (syscall.Signal, error) {
+	signal := unix.SignalNum("SIG" + strings.TrimPrefix(strings.ToUpper(name), "SIG"))
+	if signal == 0 {
+		return 0, fmt.Errorf("unknown signal: %s", name)
+	}
+	return signal, nil
+}
+
+// SignalName returns the name of a signal, like SIGKILL.
+func SignalName(sig os.Signal) string {
+	if s, ok := sig.(syscall.Signal); ok {
+		if name := unix.SignalName(s); name != "" {
+			return name
+		}
+	}
+	return sig.String()
+}
+
+// setProcessGroup makes the command the leader of a new process group, so
+// that its descendants can be terminated together.
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// setRunAs makes the command run as another user.
+func setRunAs(cmd *exec.Cmd, runAs *RunAs) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{
+		Uid:    runAs.Uid,
+		Gid:    runAs.Gid,
+		Groups: runAs.Groups,
+	}
+	if runAs.Home != "" {
+		addEnv(cmd, "HOME="+runAs.Home)
+	}
+	return nil
+}
+
+// setChroot confines the command to a directory.
+func setChroot(cmd *exec.Cmd, root string) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Chroot = root
+	return nil
+}
+
+// killOrphans kills the processes left behind by an exited command: members
+// of its process group and, when acting as a subreaper with no other commands
+// running, any descendants that were reparented to us.
+func killOrphans(pgid int) int {
+	self := os.Getpid()
+	killed := 0
+	reparented := subreaper && trackedCount() == 0
+	for _, process := range listProcesses() {
+		if process.State == "Z" || process.Pid == self {
+			continue
+		}
+		if process.Pgrp == pgid || (reparented && process.Ppid == self) {
+			if err := syscall.Kill(process.Pid, syscall.SIGKILL); err == nil {
+				killed++
+			}
+		}
+	}
+	return killed
+}
+
+// StartReaper sets us up as a subreaper if requested, and reaps zombie
+// processes when running as PID 1 or a subreaper.
+func StartReaper(asSubreaper bool) error {
+	if asSubreaper {
+		if err := unix.Prctl(unix.PR_SET_CHILD_SUBREAPER, 1, 0, 0, 0); err != nil {
+			return fmt.Errorf("failed to become a child subreaper: %w", err)
+		}
+		subreaper = true
+		log.Print("Running as a child subreaper.")
+	}
+	if os.Getpid() != 1 && !subreaper {
+		return nil
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGCHLD)
+	go func() {
+		for range signals {
+			reapZombies()
+		}
+	}()
+	return nil
+}
+
+// reapZombies waits for exited children that aren't commands started by us.
+func reapZombies() {
+	self := os.Getpid()
+	for _, process := range listProcesses() {
+		if process.State != "Z" || process.Ppid != self {
+			continue
+		}
+		children.Lock()
+		if !children.pids[process.Pid] {
+			var status syscall.WaitStatus
+			syscall.Wait4(process.Pid, &status, syscall.WNOHANG, nil)
+		}
+		children.Unlock()
+	}
+}
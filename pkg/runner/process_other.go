@@ -0,0 +1,67 @@
+//go:build !linux
+// +build !linux
+
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package runner
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+func SignalByName(name string) (syscall.Signal, error) {
+	switch strings.TrimPrefix(strings.ToUpper(name), "SIG") {
+	case "INT":
+		return syscall.SIGINT, nil
+	case "TERM":
+		return syscall.SIGTERM, nil
+	case "KILL":
+		return syscall.SIGKILL, nil
+	}
+	return 0, fmt.Errorf("unknown signal: %s", name)
+}
+
+// SignalName returns the name of a signal.
+func SignalName(sig os.Signal) string {
+	return sig.String()
+}
+
+func setProcessGroup(cmd *exec.Cmd) {
+}
+
+func setRunAs(cmd *exec.Cmd, runAs *RunAs) error {
+	return fmt.Errorf("running as another user is only supported on Linux")
+}
+
+func setChroot(cmd *exec.Cmd, root string) error {
+	return fmt.Errorf("chroot is only supported on Linux")
+}
+
+func killOrphans(pgid int) int {
+	return 0
+}
+
+func StartReaper(asSubreaper bool) error {
+	if asSubreaper {
+		return fmt.Errorf("subreaper is only supported on Linux")
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package runner
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Result statuses of a command run.
+const (
+	StatusSucceeded    = "succeeded"
+	StatusFailed       = "failed"
+	StatusTimeout      = "timeout"
+	StatusTerminated   = "terminated"
+	StatusCheckpointed = "checkpointed"
+	StatusSkipped      = "skipped"
+)
+
+// Attempt identifies an earlier attempt at a run, so that a rerun command
+// can find what the attempt completed before it failed.
+type Attempt struct {
+	Number     int    `json:"number"`
+	JobID      string `json:"jobId"`
+	Transcript string `json:"transcript,omitempty"`
+}
+
+// env returns the environment variables describing the previous attempt.
+func (a *Attempt) env() []string {
+	env := []string{
+		fmt.Sprintf("PREVIOUS_ATTEMPT=%d", a.Number),
+		"PREVIOUS_JOB_ID=" + a.JobID,
+	}
+	if a.Transcript != "" {
+		env = append(env, "PREVIOUS_TRANSCRIPT="+a.Transcript)
+	}
+	return env
+}
+
+// Result is the outcome of a command run.
+type Result struct {
+	JobID     string        `json:"jobId,omitempty"`
+	Command   string        `json:"command"`
+	Args      []string      `json:"args"`
+	Status    string        `json:"status"`
+	ExitCode  int           `json:"exitCode"`
+	Error     string        `json:"error,omitempty"`
+	StartTime time.Time     `json:"startTime"`
+	EndTime   time.Time     `json:"endTime"`
+	Duration  time.Duration `json:"duration"`
+	// Signal is the name of the signal that terminated the command, if any,
+	// and CoreDump whether it dumped core.
+	Signal   string `json:"signal,omitempty"`
+	CoreDump bool   `json:"coreDump,omitempty"`
+	// Attempt and Previous are copied from the command.
+	Attempt  int      `json:"attempt,omitempty"`
+	Previous *Attempt `json:"previous,omitempty"`
+	// Labels, Version and Transcript are copied from the command.
+	Labels     map[string]string `json:"labels,omitempty"`
+	Version    string            `json:"version,omitempty"`
+	Transcript string            `json:"transcript,omitempty"`
+	// Output counts the output of the run, and Usage is the last sample of
+	// the resources it used, if any was taken.
+	Output OutputTotals   `json:"output"`
+	Usage  *ResourceUsage `json:"usage,omitempty"`
+}
+
+// OutputTotals counts the output lines and bytes of a run, including the
+// lines that were collapsed as repeats or omitted over MaxLinesPerSecond.
+type OutputTotals struct {
+	Lines     int64 `json:"lines"`
+	Bytes     int64 `json:"bytes"`
+	Collapsed int64 `json:"collapsed,omitempty"`
+	Omitted   int64 `json:"omitted,omitempty"`
+	Truncated bool  `json:"truncated,omitempty"`
+}
+
+// Finish completes the result when the run ends with err, at EndTime if it
+// has been set.
+func (r *Result) Finish(err error) {
+	if r.EndTime.IsZero() {
+		r.EndTime = time.Now()
+	}
+	if !r.StartTime.IsZero() {
+		r.Duration = r.EndTime.Sub(r.StartTime)
+	}
+	if r.Status == "" {
+		if err == nil {
+			r.Status = StatusSucceeded
+		} else {
+			r.Status = StatusFailed
+		}
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+}
+
+// ArgsHash identifies the arguments of a run, without revealing them.
+func (r *Result) ArgsHash() string {
+	hash := sha256.Sum256([]byte(strings.Join(r.Args, "\x00")))
+	return hex.EncodeToString(hash[:])
+}
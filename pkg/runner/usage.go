@@ -0,0 +1,126 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package runner
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clockTicks is the kernel's USER_HZ, used by CPU times in /proc.
+const clockTicks = 100
+
+// ResourceUsage is a sample of the resources used by the command.
+type ResourceUsage struct {
+	UserTime   time.Duration `json:"userTime"`
+	SystemTime time.Duration `json:"systemTime"`
+	RSS        int64         `json:"rss"`
+	MaxRSS     int64         `json:"maxRss"`
+	ReadBytes  int64         `json:"readBytes"`
+	WriteBytes int64         `json:"writeBytes"`
+}
+
+// sampleResourceUsage reads the resource usage of a running process from
+// /proc.
+func sampleResourceUsage(pid int) (ResourceUsage, error) {
+	var usage ResourceUsage
+
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return usage, err
+	}
+	// Process name may contain spaces, so skip past it
+	fields := strings.Fields(string(stat[strings.LastIndex(string(stat), ")")+1:]))
+	if len(fields) < 13 {
+		return usage, fmt.Errorf("unexpected format in /proc/%d/stat", pid)
+	}
+	utime, _ := strconv.ParseInt(fields[11], 10, 64)
+	stime, _ := strconv.ParseInt(fields[12], 10, 64)
+	usage.UserTime = time.Duration(utime) * time.Second / clockTicks
+	usage.SystemTime = time.Duration(stime) * time.Second / clockTicks
+
+	status, err := readProcKeyValues(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return usage, err
+	}
+	usage.RSS = status["VmRSS"] * 1024
+	usage.MaxRSS = status["VmHWM"] * 1024
+
+	// I/O counters may not be readable, depending on permissions
+	if io, err := readProcKeyValues(fmt.Sprintf("/proc/%d/io", pid)); err == nil {
+		usage.ReadBytes = io["read_bytes"]
+		usage.WriteBytes = io["write_bytes"]
+	}
+	return usage, nil
+}
+
+// readProcKeyValues parses "key: value" formatted files in /proc.
+func readProcKeyValues(path string) (map[string]int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := make(map[string]int64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		if value, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+			values[strings.TrimSuffix(fields[0], ":")] = value
+		}
+	}
+	return values, scanner.Err()
+}
+
+// finalResourceUsage combines the last sample with the rusage of the exited
+// process.
+func finalResourceUsage(state *os.ProcessState, last ResourceUsage) ResourceUsage {
+	usage := last
+	if state == nil {
+		return usage
+	}
+	usage.UserTime = state.UserTime()
+	usage.SystemTime = state.SystemTime()
+	usage.RSS = 0
+	if maxRSS := rusageMaxRSS(state); maxRSS > usage.MaxRSS {
+		usage.MaxRSS = maxRSS
+	}
+	return usage
+}
+
+func (u ResourceUsage) String() string {
+	details := []string{
+		fmt.Sprintf("cpu %s user, %s system", u.UserTime.Truncate(time.Millisecond), u.SystemTime.Truncate(time.Millisecond)),
+	}
+	if u.RSS > 0 {
+		details = append(details, fmt.Sprintf("rss %s", FormatBytes(u.RSS)))
+	}
+	if u.MaxRSS > 0 {
+		details = append(details, fmt.Sprintf("max rss %s", FormatBytes(u.MaxRSS)))
+	}
+	details = append(details, fmt.Sprintf("read %s, written %s", FormatBytes(u.ReadBytes), FormatBytes(u.WriteBytes)))
+	return strings.Join(details, ", ")
+}
@@ -0,0 +1,63 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+const pubsubAPI = "https://pubsub.googleapis.com/v1/"
+
+// topicName returns the full name of a topic, which can be given either as
+// projects/<project>/topics/<topic> or just the topic name.
+func topicName(ctx context.Context, topic string) (string, error) {
+	if strings.HasPrefix(topic, "projects/") {
+		return topic, nil
+	}
+	project, err := projectID(ctx)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("projects/%s/topics/%s", project, topic), nil
+}
+
+// publishMessage publishes a message to a Pub/Sub topic and returns the
+// message ID.
+func publishMessage(ctx context.Context, topic string, data []byte, attributes map[string]string) (string, error) {
+	name, err := topicName(ctx, topic)
+	if err != nil {
+		return "", err
+	}
+	request := map[string]interface{}{
+		"messages": []map[string]interface{}{{
+			"data":       data,
+			"attributes": attributes,
+		}},
+	}
+	var response struct {
+		MessageIds []string `json:"messageIds"`
+	}
+	if err := callAPI(ctx, "POST", pubsubAPI+name+":publish", request, &response); err != nil {
+		return "", fmt.Errorf("error publishing to %s: %w", name, err)
+	}
+	if len(response.MessageIds) == 0 {
+		return "", fmt.Errorf("no message ID returned when publishing to %s", name)
+	}
+	return response.MessageIds[0], nil
+}
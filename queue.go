@@ -0,0 +1,167 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// runQueue limits the runs in progress on the instance to
+// MAX_CONCURRENT_RUNS. Runs beyond the limit wait, those with the highest
+// priority first and otherwise in order of arrival.
+type runQueue struct {
+	mu      sync.Mutex
+	running int
+	waiting []*queuedRun
+}
+
+// queuedRun is a run waiting in the queue, until ready is closed.
+type queuedRun struct {
+	priority int
+	ready    chan struct{}
+}
+
+var runs = &runQueue{}
+
+// acquire waits until the run can start, calling waiting with its position
+// in the queue every POLL_TIME. The caller has to release the run when it's
+// over.
+func (q *runQueue) acquire(ctx context.Context, priority int, waiting func(position int)) error {
+	if MAX_CONCURRENT_RUNS <= 0 {
+		return nil
+	}
+	q.mu.Lock()
+	if q.running < MAX_CONCURRENT_RUNS && len(q.waiting) == 0 {
+		q.running++
+		q.mu.Unlock()
+		return nil
+	}
+	run := &queuedRun{priority: priority, ready: make(chan struct{})}
+	i := sort.Search(len(q.waiting), func(i int) bool {
+		return q.waiting[i].priority < priority
+	})
+	q.waiting = append(q.waiting, nil)
+	copy(q.waiting[i+1:], q.waiting[i:])
+	q.waiting[i] = run
+	q.mu.Unlock()
+
+	waiting(q.position(run))
+	ticker := time.NewTicker(POLL_TIME)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-run.ready:
+			return nil
+		case <-ctx.Done():
+			if !q.remove(run) {
+				// The run was started just as it was cancelled
+				q.release()
+			}
+			return ctx.Err()
+		case <-ticker.C:
+			if position := q.position(run); position > 0 {
+				waiting(position)
+			}
+		}
+	}
+}
+
+// release starts the next waiting run, if any.
+func (q *runQueue) release() {
+	if MAX_CONCURRENT_RUNS <= 0 {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.waiting) > 0 {
+		close(q.waiting[0].ready)
+		q.waiting = q.waiting[1:]
+		return
+	}
+	q.running--
+}
+
+// position returns the 1-based position of the run in the queue, or 0 if
+// it isn't waiting.
+func (q *runQueue) position(run *queuedRun) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, waiting := range q.waiting {
+		if waiting == run {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// remove removes a waiting run and returns whether it was still waiting.
+func (q *runQueue) remove(run *queuedRun) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, waiting := range q.waiting {
+		if waiting == run {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Full returns true if MAX_CONCURRENT_RUNS runs are in progress, so that
+// another would wait.
+func (q *runQueue) Full() bool {
+	if MAX_CONCURRENT_RUNS <= 0 {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.running >= MAX_CONCURRENT_RUNS
+}
+
+// Waiting returns the number of runs waiting.
+func (q *runQueue) Waiting() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.waiting)
+}
+
+// requestPriority returns the priority given as the priority query parameter
+// or Pub/Sub message attribute, or the X-Priority header. Higher priorities
+// run first, the default is 0.
+func requestPriority(r *http.Request, m *PubSubMessage) (int, error) {
+	value := r.URL.Query().Get("priority")
+	if value == "" {
+		value = m.Message.Attributes["priority"]
+	}
+	if value == "" {
+		value = r.Header.Get("X-Priority")
+	}
+	if value == "" {
+		return 0, nil
+	}
+	priority, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid priority: %s", value)
+	}
+	return priority, nil
+}
@@ -0,0 +1,186 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit allows Count invocations per Period, in bursts of up to Count.
+type RateLimit struct {
+	Count  int
+	Period time.Duration
+}
+
+// parseRateLimit parses a rate limit like "10/m", "100/h" or "5/30s". An
+// empty value means no limit.
+func parseRateLimit(value string) (*RateLimit, error) {
+	if value == "" {
+		return nil, nil
+	}
+	parts := strings.SplitN(value, "/", 2)
+	count, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || count <= 0 || len(parts) != 2 {
+		return nil, fmt.Errorf("invalid rate limit: %s (must be like 10/m)", value)
+	}
+	period := strings.TrimSpace(parts[1])
+	switch period {
+	case "s", "m", "h":
+		period = "1" + period
+	case "d":
+		period = "24h"
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return nil, fmt.Errorf("invalid rate limit period: %s", value)
+	}
+	return &RateLimit{Count: count, Period: d}, nil
+}
+
+// RateLimitRule limits the invocations of a route and command in the config
+// file, in total and per caller. Empty Route and Command match any.
+type RateLimitRule struct {
+	Route     string `json:"route,omitempty"`
+	Command   string `json:"command,omitempty"`
+	Limit     string `json:"limit,omitempty"`
+	PerCaller string `json:"perCaller,omitempty"`
+
+	limit     *RateLimit
+	perCaller *RateLimit
+}
+
+func (r *RateLimitRule) parse() (err error) {
+	if r.limit, err = parseRateLimit(r.Limit); err != nil {
+		return err
+	}
+	r.perCaller, err = parseRateLimit(r.PerCaller)
+	return err
+}
+
+// rateLimits returns the limits of a route and command: from the first
+// matching rule of the config file, or RATE_LIMIT and RATE_LIMIT_PER_CALLER.
+func rateLimits(route string, command string) (*RateLimit, *RateLimit) {
+	for _, rule := range currentConfig().RateLimits {
+		if (rule.Route == "" || rule.Route == route) && (rule.Command == "" || rule.Command == command) {
+			return rule.limit, rule.perCaller
+		}
+	}
+	return RATE_LIMIT, RATE_LIMIT_PER_CALLER
+}
+
+// tokenBucket holds the tokens of a rate limit, refilled continuously.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	period time.Duration
+}
+
+// rateLimiter keeps the token buckets of the rate limits in this instance.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+var limiter = &rateLimiter{buckets: make(map[string]*tokenBucket)}
+
+// maxBuckets is the number of buckets after which full buckets are dropped.
+const maxBuckets = 10000
+
+// take takes a token from the bucket of key, returning how long to wait for
+// one if the bucket is empty.
+func (l *rateLimiter) take(key string, limit *RateLimit, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rate := float64(limit.Count) / limit.Period.Seconds()
+	bucket, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxBuckets {
+			l.prune(now)
+		}
+		bucket = &tokenBucket{tokens: float64(limit.Count), last: now, period: limit.Period}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(float64(limit.Count), bucket.tokens+now.Sub(bucket.last).Seconds()*rate)
+	bucket.last = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - bucket.tokens) / rate * float64(time.Second))
+}
+
+// prune drops the buckets that have been idle long enough to be full.
+func (l *rateLimiter) prune(now time.Time) {
+	for key, bucket := range l.buckets {
+		if now.Sub(bucket.last) >= bucket.period {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// rateLimitCaller returns the caller a request is limited as: the email of
+// its verified OIDC token, or else the client address that the frontend
+// appended to X-Forwarded-For, as the entries before it come from the
+// client and the caller of the audit log isn't verified.
+func rateLimitCaller(r *http.Request, verified string) string {
+	if verified != "" {
+		return verified
+	}
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		entries := strings.Split(forwarded, ",")
+		return strings.TrimSpace(entries[len(entries)-1])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// checkRateLimits takes a token for each of the commands of a request from
+// the limits of the route and of the caller. It returns how long to wait
+// before retrying if a limit has been reached.
+func checkRateLimits(route string, caller string, commands []string) (bool, time.Duration) {
+	now := time.Now()
+	for _, command := range commands {
+		limit, perCaller := rateLimits(route, command)
+		if limit != nil {
+			if ok, retryAfter := limiter.take(route+" "+command, limit, now); !ok {
+				return false, retryAfter
+			}
+		}
+		if perCaller != nil {
+			if ok, retryAfter := limiter.take(route+" "+command+" "+caller, perCaller, now); !ok {
+				return false, retryAfter
+			}
+		}
+	}
+	return true, 0
+}
+
+// rateLimited answers a request that reached a rate limit with 429.
+func rateLimited(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+}
@@ -0,0 +1,162 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisJobStore keeps the state in Redis, eg. Memorystore, as JSON values
+// that expire after JOB_STORE_TTL. It speaks just enough of the protocol for
+// that, with a connection per call.
+type redisJobStore struct {
+	addr     string
+	password string
+	db       int
+}
+
+// newRedisJobStore returns the store of a redis://[:password@]host[:port][/db]
+// URI.
+func newRedisJobStore(uri string) (*redisJobStore, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("no host in %s", uri)
+	}
+	s := &redisJobStore{addr: u.Host}
+	if u.Port() == "" {
+		s.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		s.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if s.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid database in %s: %s", uri, db)
+		}
+	}
+	return s, nil
+}
+
+func (s *redisJobStore) key(jobID string) string {
+	return "long-cloud-run:job:" + jobID
+}
+
+func (s *redisJobStore) Put(ctx context.Context, state *JobState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	ttl := strconv.FormatInt(int64(JOB_STORE_TTL/time.Millisecond), 10)
+	_, err = s.do(ctx, "SET", s.key(state.JobID), string(data), "PX", ttl)
+	return err
+}
+
+func (s *redisJobStore) Get(ctx context.Context, jobID string) (*JobState, error) {
+	data, err := s.do(ctx, "GET", s.key(jobID))
+	if err != nil || data == nil {
+		return nil, err
+	}
+	return decodeJobState(data)
+}
+
+// do runs a command, after authenticating and selecting the database, and
+// returns the reply of the last command: nil for a null reply.
+func (s *redisJobStore) do(ctx context.Context, args ...string) ([]byte, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(30 * time.Second)
+	}
+	conn.SetDeadline(deadline)
+
+	var commands [][]string
+	if s.password != "" {
+		commands = append(commands, []string{"AUTH", s.password})
+	}
+	if s.db != 0 {
+		commands = append(commands, []string{"SELECT", strconv.Itoa(s.db)})
+	}
+	commands = append(commands, args)
+	writer := bufio.NewWriter(conn)
+	for _, command := range commands {
+		fmt.Fprintf(writer, "*%d\r\n", len(command))
+		for _, arg := range command {
+			fmt.Fprintf(writer, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	var reply []byte
+	for _, command := range commands {
+		if reply, err = readRedisReply(reader); err != nil {
+			return nil, fmt.Errorf("redis %s: %w", command[0], err)
+		}
+	}
+	return reply, nil
+}
+
+// readRedisReply reads a simple string, error, integer or bulk string reply.
+func readRedisReply(reader *bufio.Reader) ([]byte, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty reply")
+	}
+	switch line[0] {
+	case '+', ':':
+		return []byte(line[1:]), nil
+	case '-':
+		return nil, errors.New(line[1:])
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid reply: %s", line)
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		return data[:size], nil
+	}
+	return nil, fmt.Errorf("unsupported reply: %s", line)
+}
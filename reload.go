@@ -0,0 +1,193 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// reloadPath is the path of the endpoint that reloads CONFIG_FILE.
+const reloadPath = "/-/reload"
+
+var (
+	// configMu guards CONFIG, which is replaced as a whole on reloads
+	configMu sync.RWMutex
+	// reloadMu serializes reloads
+	reloadMu sync.Mutex
+)
+
+// currentConfig returns the configuration file in effect. Callers should
+// use the returned config for the whole invocation, so that a reload applies
+// to new invocations only.
+func currentConfig() *ConfigFile {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return CONFIG
+}
+
+// reloadConfig reads CONFIG_FILE again and swaps it in, returning what
+// changed. Schedules and sidecars that didn't change are kept, with their
+// runs; changed and removed schedules are stopped and new ones started. The
+// replacement of a changed schedule or sidecar only runs once the old one's
+// run in progress is over. If the file is invalid, the current configuration
+// stays in effect.
+func reloadConfig() ([]string, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	config, err := loadConfigFile(CONFIG_FILE)
+	if err != nil {
+		return nil, err
+	}
+	old := currentConfig()
+	var changes []string
+
+	oldSchedules := make(map[string]*Schedule)
+	for _, schedule := range old.Schedules {
+		oldSchedules[schedule.Name] = schedule
+	}
+	var started []*Schedule
+	for i, schedule := range config.Schedules {
+		previous, ok := oldSchedules[schedule.Name]
+		delete(oldSchedules, schedule.Name)
+		switch {
+		case !ok:
+			changes = append(changes, "added schedule "+schedule.Name)
+		case sameJSON(previous, schedule):
+			config.Schedules[i] = previous
+			continue
+		default:
+			changes = append(changes, "changed schedule "+schedule.Name)
+			previous.stop()
+			schedule.replaces = previous
+		}
+		started = append(started, schedule)
+	}
+	for name, schedule := range oldSchedules {
+		changes = append(changes, "removed schedule "+name)
+		schedule.stop()
+	}
+
+	oldSidecars := make(map[string]*Sidecar)
+	for _, sidecar := range old.Sidecars {
+		oldSidecars[sidecar.Name] = sidecar
+	}
+	for i, sidecar := range config.Sidecars {
+		previous, ok := oldSidecars[sidecar.Name]
+		delete(oldSidecars, sidecar.Name)
+		switch {
+		case !ok:
+			changes = append(changes, "added sidecar "+sidecar.Name)
+		case sameJSON(previous, sidecar):
+			// Runs using the sidecar keep sharing it
+			config.Sidecars[i] = previous
+		default:
+			changes = append(changes, "changed sidecar "+sidecar.Name)
+			sidecar.previous = previous.lastRun()
+		}
+	}
+	for name := range oldSidecars {
+		// Removed sidecars stop once the runs using them release them
+		changes = append(changes, "removed sidecar "+name)
+	}
+
+	for _, section := range []struct {
+		name     string
+		old, new interface{}
+	}{
+		{"routes", old.Routes, config.Routes},
+		{"rateLimits", old.RateLimits, config.RateLimits},
+		{"dispatch", old.Dispatch, config.Dispatch},
+		{"cache", old.Cache, config.Cache},
+		{"extractors", old.Extractors, config.Extractors},
+		{"tenants", old.Tenants, config.Tenants},
+		{"pins", old.Pins, config.Pins},
+		{"expect", old.Expect, config.Expect},
+		{"windows", old.Windows, config.Windows},
+	} {
+		if !sameJSON(section.old, section.new) {
+			changes = append(changes, "changed "+section.name)
+		}
+	}
+
+	configMu.Lock()
+	CONFIG = config
+	configMu.Unlock()
+	startScheduler(started)
+	return changes, nil
+}
+
+// sameJSON returns true if a and b have the same JSON encoding, comparing
+// the settings of the config file without their parsed state.
+func sameJSON(a interface{}, b interface{}) bool {
+	aJSON, aErr := json.Marshal(a)
+	bJSON, bErr := json.Marshal(b)
+	return aErr == nil && bErr == nil && bytes.Equal(aJSON, bJSON)
+}
+
+// logReload reloads the config file and logs the outcome.
+func logReload() ([]string, error) {
+	changes, err := reloadConfig()
+	switch {
+	case err != nil:
+		log.Printf("Failed to reload CONFIG_FILE, keeping the current configuration: %v", err)
+	case len(changes) == 0:
+		log.Printf("Reloaded CONFIG_FILE, no changes.")
+	default:
+		log.Printf("Reloaded CONFIG_FILE: %s.", strings.Join(changes, ", "))
+	}
+	return changes, err
+}
+
+// reloadOnSIGHUP reloads the config file whenever the process gets SIGHUP.
+func reloadOnSIGHUP() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			logReload()
+		}
+	}()
+}
+
+// reloadHandler reloads the config file on POST requests and responds with
+// the changes.
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	changes, err := logReload()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to reload %s: %v", CONFIG_FILE, err), http.StatusInternalServerError)
+		return
+	}
+	if len(changes) == 0 {
+		fmt.Fprintln(w, "No changes")
+	}
+	for _, change := range changes {
+		fmt.Fprintln(w, change)
+	}
+}
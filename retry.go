@@ -0,0 +1,175 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/rosmo/long-cloud-run/pkg/runner"
+)
+
+// isRetryable returns true if a failed run should be retried. Timeouts and
+// terminations are always transient, failures are classified by exit code
+// using RETRYABLE_EXIT_CODES.
+func isRetryable(result runner.Result) bool {
+	switch result.Status {
+	case runner.StatusTimeout, runner.StatusTerminated:
+		return true
+	case runner.StatusFailed:
+		if RETRYABLE_EXIT_CODES == nil {
+			return true
+		}
+		for _, exitCode := range RETRYABLE_EXIT_CODES {
+			if result.ExitCode == exitCode {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// exitCodeStatus returns the HTTP status of a run that exited with exitCode:
+// 503 for RETRYABLE_EXIT_CODES, PERMANENT_FAILURE_STATUS otherwise.
+func exitCodeStatus(exitCode int) int {
+	if status, ok := ERROR_STATUS[strconv.Itoa(exitCode)]; ok {
+		return status
+	}
+	if isRetryable(runner.Result{Status: runner.StatusFailed, ExitCode: exitCode}) {
+		return http.StatusServiceUnavailable
+	}
+	return PERMANENT_FAILURE_STATUS
+}
+
+// errorStatus returns the HTTP status of a run that ended with err, as set in
+// ERROR_STATUS for the type of error or the exit code. Timeouts, terminations,
+// cancellations and open circuits default to 503, commands that couldn't be started are
+// treated as exiting with -1.
+func errorStatus(err error) int {
+	var exitErr *runner.ExitCodeError
+	var startErr *runner.StartError
+	var timeoutErr *runner.TimeoutError
+	var canceledErr *runner.CanceledError
+	var terminatedErr *runner.TerminatedError
+	var circuitErr *CircuitOpenError
+	var diskErr *DiskFullError
+	var windowErr *WindowClosedError
+	key := ""
+	switch {
+	case err == nil:
+		return http.StatusOK
+	case errors.As(err, &exitErr):
+		return exitCodeStatus(exitErr.ExitCode)
+	case errors.As(err, &startErr):
+		if status, ok := ERROR_STATUS["start"]; ok {
+			return status
+		}
+		return exitCodeStatus(-1)
+	case errors.As(err, &timeoutErr):
+		key = "timeout"
+	case errors.As(err, &canceledErr):
+		key = "canceled"
+	case errors.As(err, &terminatedErr):
+		key = "terminated"
+	case errors.As(err, &circuitErr):
+		key = "circuit"
+	case errors.As(err, &diskErr):
+		key = "disk"
+	case errors.As(err, &windowErr):
+		key = "window"
+	}
+	if status, ok := ERROR_STATUS[key]; ok {
+		return status
+	}
+	return http.StatusServiceUnavailable
+}
+
+// finalDelivery returns true if a Pub/Sub message won't be redelivered
+// after this attempt, because it has reached MAX_DELIVERY_ATTEMPTS. Pub/Sub
+// only counts the delivery attempts of subscriptions with a dead-letter
+// topic.
+func finalDelivery(m *PubSubMessage) bool {
+	return MAX_DELIVERY_ATTEMPTS > 0 && m.DeliveryAttempt >= MAX_DELIVERY_ATTEMPTS
+}
+
+// respondPubSub answers a Pub/Sub push once the run has completed: 2xx
+// acknowledges the message, 5xx has it redelivered, and a 4xx lets it go to
+// the dead-letter topic once the subscription's maximum delivery attempts
+// have been reached.
+func respondPubSub(w http.ResponseWriter, m *PubSubMessage, err error, status int) {
+	if err == nil {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	log.Printf("Responding to Pub/Sub message %s with status %d.", m.Message.ID, status)
+	if finalDelivery(m) {
+		log.Printf("Delivery attempt %d of message %s was the last, it goes to the dead-letter topic.", m.DeliveryAttempt, m.Message.ID)
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// setStatusTrailer sends the HTTP status of the run as the X-Command-Status
+// trailer of a streamed response, whose status line has already been sent.
+func setStatusTrailer(w http.ResponseWriter, status int) {
+	w.Header().Set(http.TrailerPrefix+"X-Command-Status", strconv.Itoa(status))
+}
+
+// parseErrorStatus parses the ERROR_STATUS mapping of error types (start,
+// timeout, canceled, terminated, circuit, disk) and exit codes to HTTP statuses.
+func parseErrorStatus(mapping map[string]string) (map[string]int, error) {
+	statuses := make(map[string]int)
+	for key, value := range mapping {
+		switch key {
+		case "start", "timeout", "canceled", "terminated", "circuit", "disk", "window":
+		default:
+			if _, err := strconv.Atoi(key); err != nil {
+				return nil, fmt.Errorf("unknown error type: %s", key)
+			}
+		}
+		status, err := strconv.Atoi(value)
+		if err != nil || status < 200 || status > 599 {
+			return nil, fmt.Errorf("invalid status for %s: %s", key, value)
+		}
+		statuses[key] = status
+	}
+	return statuses, nil
+}
+
+// parseExitCodes parses a comma-separated list of exit codes, "*" matches
+// any exit code and is returned as nil.
+func parseExitCodes(value string) ([]int, error) {
+	if strings.TrimSpace(value) == "*" {
+		return nil, nil
+	}
+	exitCodes := []int{}
+	for _, code := range strings.Split(value, ",") {
+		code = strings.TrimSpace(code)
+		if code == "" {
+			continue
+		}
+		exitCode, err := strconv.Atoi(code)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exit code: %s", code)
+		}
+		exitCodes = append(exitCodes, exitCode)
+	}
+	return exitCodes, nil
+}
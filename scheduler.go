@@ -0,0 +1,250 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Schedule runs a command on a cron schedule from within the service, without
+// Cloud Scheduler.
+type Schedule struct {
+	Name     string   `json:"name"`
+	Schedule string   `json:"schedule"`
+	TimeZone string   `json:"timeZone,omitempty"`
+	Command  string   `json:"command,omitempty"`
+	Args     []string `json:"args,omitempty"`
+	// Jitter delays each run by up to this long, so that schedules firing at
+	// the same time don't all start at once.
+	Jitter  Duration `json:"jitter,omitempty"`
+	Timeout Duration `json:"timeout,omitempty"`
+	// Priority orders the run in the queue of MAX_CONCURRENT_RUNS.
+	Priority int `json:"priority,omitempty"`
+	CommandOptions
+
+	cron    *cronSchedule
+	stopped chan struct{}
+	mu      sync.Mutex
+	running bool
+	// idle is closed when the run in progress is over.
+	idle chan struct{}
+	// replaces is the schedule that this one replaced on a reload, whose run
+	// in progress has to finish before this one fires.
+	replaces *Schedule
+}
+
+func (s *Schedule) parse() error {
+	location := time.UTC
+	if s.TimeZone != "" {
+		var err error
+		if location, err = time.LoadLocation(s.TimeZone); err != nil {
+			return err
+		}
+	}
+	cron, err := parseCron(s.Schedule, location)
+	if err != nil {
+		return err
+	}
+	s.cron = cron
+	s.stopped = make(chan struct{})
+	if s.Command == "" {
+		if len(os.Args) < 2 {
+			return fmt.Errorf("no command set")
+		}
+		s.Command = os.Args[1]
+		if s.Args == nil {
+			s.Args = os.Args[2:]
+		}
+	}
+	return nil
+}
+
+// jitter returns the delay for the run at the given time. It's derived from
+// the name and time, so that all instances delay the same run equally and
+// the lock prevents them from running it more than once.
+func (s *Schedule) jitter(next time.Time) time.Duration {
+	if s.Jitter.Duration <= 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s/%d", s.Name, next.Unix())
+	return time.Duration(h.Sum64() % uint64(s.Jitter.Duration))
+}
+
+// startScheduler runs the schedules in the background.
+func startScheduler(schedules []*Schedule) {
+	for _, schedule := range schedules {
+		log.Printf("Scheduling %s: %s %s", schedule.Name, schedule.Schedule, schedule.cron.location)
+		go schedule.loop()
+	}
+}
+
+func (s *Schedule) loop() {
+	if s.replaces != nil {
+		select {
+		case <-s.replaces.finished():
+		case <-s.stopped:
+			log.Printf("Stopped schedule %s.", s.Name)
+			return
+		}
+	}
+	for {
+		next := s.cron.Next(time.Now())
+		if next.IsZero() {
+			log.Printf("Schedule %s never fires again.", s.Name)
+			return
+		}
+		timer := time.NewTimer(time.Until(next.Add(s.jitter(next))))
+		select {
+		case <-timer.C:
+			go s.run()
+		case <-s.stopped:
+			timer.Stop()
+			log.Printf("Stopped schedule %s.", s.Name)
+			return
+		}
+	}
+}
+
+// stop stops scheduling runs, for schedules removed or changed by a reload.
+// A run in progress isn't interrupted.
+func (s *Schedule) stop() {
+	close(s.stopped)
+}
+
+// finished returns a channel that is closed once the run in progress, if
+// any, is over.
+func (s *Schedule) finished() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.running {
+		idle := make(chan struct{})
+		close(idle)
+		return idle
+	}
+	return s.idle
+}
+
+// run runs the command, unless the previous run is still in progress on this
+// or, when LOCK_BUCKET is set, any other instance.
+func (s *Schedule) run() {
+	s.mu.Lock()
+	select {
+	case <-s.stopped:
+		// The timer fired as the schedule was stopped
+		s.mu.Unlock()
+		return
+	default:
+	}
+	if s.running {
+		s.mu.Unlock()
+		log.Printf("Skipping scheduled run of %s, the previous run is still in progress.", s.Name)
+		return
+	}
+	s.running = true
+	s.idle = make(chan struct{})
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.running = false
+		close(s.idle)
+		s.mu.Unlock()
+	}()
+
+	allowed := time.Now()
+	if err := breaker.allow(s.Command, allowed); err != nil {
+		log.Printf("Skipping scheduled run of %s: %v", s.Name, err)
+		return
+	}
+	defer breaker.release(s.Command, allowed)
+	if err := disk.Allow(); err != nil {
+		log.Printf("Skipping scheduled run of %s: %v", s.Name, err)
+		return
+	}
+	if closed := checkWindows([]string{s.Command}, time.Now()); closed != nil {
+		log.Printf("Skipping scheduled run of %s: %v", s.Name, closed)
+		return
+	}
+	if err := verifyExecutable(s.Command); err != nil {
+		log.Printf("Skipping scheduled run of %s: %v", s.Name, err)
+		return
+	}
+	expect, err := expectations(context.Background(), s.Command)
+	if err != nil {
+		log.Printf("Skipping scheduled run of %s: %v", s.Name, err)
+		return
+	}
+
+	timeout := s.Timeout.Duration
+	if timeout <= 0 {
+		timeout = REQUEST_TIMEOUT
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if LOCK_BUCKET != "" {
+		lock := NewLock(LOCK_BUCKET, "schedule-"+s.Name)
+		acquired, holder, err := lock.TryAcquire(ctx, timeout)
+		if err != nil {
+			log.Printf("Skipping scheduled run of %s, failed to acquire lock: %v", s.Name, err)
+			return
+		}
+		if !acquired {
+			log.Printf("Skipping scheduled run of %s, already running on %s.", s.Name, holder)
+			return
+		}
+		defer lock.Release(context.Background())
+	}
+
+	err = runs.acquire(ctx, s.Priority, func(position int) {
+		log.Printf("Scheduled run of %s queued at position %d.", s.Name, position)
+	})
+	if err != nil {
+		log.Printf("Skipping scheduled run of %s: %v", s.Name, err)
+		return
+	}
+	defer runs.release()
+
+	releaseSidecars, err := startSidecars(ctx)
+	if err != nil {
+		log.Printf("Skipping scheduled run of %s: %v", s.Name, err)
+		return
+	}
+	defer releaseSidecars()
+
+	log.Printf("Starting scheduled run of %s.", s.Name)
+	command := newCommand(nil, s.Command, s.Args...)
+	setJobID(command, newJobID())
+	defer trackRun(command.JobID, command.Name, "schedule")()
+	command.Timeout = timeout
+	command.Version = pinnedVersion(ctx, s.Command)
+	command.Expect = expect
+	s.CommandOptions.apply(ctx, command)
+	err = command.Run(ctx)
+	if err != nil {
+		log.Printf("Scheduled run of %s failed: %v", s.Name, err)
+	}
+	reportResult("schedule", command.Result, err)
+	audit := &AuditEntry{JobID: command.JobID, Caller: "scheduler", Trigger: "schedule", Decision: AuditAllowed, Reason: "schedule " + s.Name, timestamp: command.Result.StartTime}
+	audit.Finish(command.Result, err)
+}
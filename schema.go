@@ -0,0 +1,258 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Schema is the subset of JSON Schema that payloads are validated with:
+// type, enum, properties, required, additionalProperties, items, minimum,
+// maximum, minLength, maxLength, pattern, minItems and maxItems. The boolean
+// schemas true and false match anything and nothing.
+type Schema struct {
+	Type                 schemaTypes        `json:"type,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	MinItems             *int               `json:"minItems,omitempty"`
+	MaxItems             *int               `json:"maxItems,omitempty"`
+
+	pattern *regexp.Regexp
+	never   bool
+}
+
+// schemaTypes is a type name or a list of them.
+type schemaTypes []string
+
+func (t *schemaTypes) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err == nil {
+		*t = schemaTypes{name}
+		return nil
+	}
+	var names []string
+	if err := json.Unmarshal(b, &names); err != nil {
+		return fmt.Errorf("type must be a string or a list of strings: %s", b)
+	}
+	*t = names
+	return nil
+}
+
+func (s *Schema) UnmarshalJSON(b []byte) error {
+	var always bool
+	if err := json.Unmarshal(b, &always); err == nil {
+		*s = Schema{never: !always}
+		return nil
+	}
+	type schema Schema
+	if err := json.Unmarshal(b, (*schema)(s)); err != nil {
+		return err
+	}
+	for _, name := range s.Type {
+		switch name {
+		case "object", "array", "string", "number", "integer", "boolean", "null":
+		default:
+			return fmt.Errorf("unknown type: %s", name)
+		}
+	}
+	if s.Pattern != "" {
+		pattern, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern: %w", err)
+		}
+		s.pattern = pattern
+	}
+	return nil
+}
+
+// loadSchema reads a JSON Schema from a file.
+func loadSchema(path string) (*Schema, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	schema := &Schema{}
+	if err := json.Unmarshal(data, schema); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", path, err)
+	}
+	return schema, nil
+}
+
+// SchemaError lists all the ways a payload doesn't match the schema.
+type SchemaError struct {
+	Problems []string
+}
+
+func (e *SchemaError) Error() string {
+	return strings.Join(e.Problems, "; ")
+}
+
+// Validate checks a value decoded from JSON, with numbers as float64 or
+// json.Number, against the schema. A nil schema matches anything.
+func (s *Schema) Validate(value interface{}) error {
+	if s == nil {
+		return nil
+	}
+	var problems []string
+	s.validate(value, "$", &problems)
+	if len(problems) > 0 {
+		return &SchemaError{Problems: problems}
+	}
+	return nil
+}
+
+func (s *Schema) validate(value interface{}, path string, problems *[]string) {
+	fail := func(format string, args ...interface{}) {
+		*problems = append(*problems, path+": "+fmt.Sprintf(format, args...))
+	}
+	if s.never {
+		fail("not allowed")
+		return
+	}
+	if len(s.Type) > 0 {
+		matched := false
+		for _, name := range s.Type {
+			if hasSchemaType(value, name) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			fail("expected %s, got %s", strings.Join(s.Type, " or "), schemaTypeOf(value))
+			return
+		}
+	}
+	if len(s.Enum) > 0 {
+		encoded, _ := json.Marshal(value)
+		found := false
+		for _, allowed := range s.Enum {
+			if candidate, _ := json.Marshal(allowed); bytes.Equal(encoded, candidate) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("%s is not one of the allowed values", encoded)
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				fail("missing required property %q", name)
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if property, ok := s.Properties[name]; ok {
+				property.validate(v[name], path+"."+name, problems)
+			} else if s.AdditionalProperties != nil {
+				s.AdditionalProperties.validate(v[name], path+"."+name, problems)
+			}
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			fail("expected at least %d items, got %d", *s.MinItems, len(v))
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			fail("expected at most %d items, got %d", *s.MaxItems, len(v))
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				s.Items.validate(item, fmt.Sprintf("%s[%d]", path, i), problems)
+			}
+		}
+	case string:
+		length := utf8.RuneCountInString(v)
+		if s.MinLength != nil && length < *s.MinLength {
+			fail("expected at least %d characters, got %d", *s.MinLength, length)
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			fail("expected at most %d characters, got %d", *s.MaxLength, length)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			fail("%q doesn't match %s", v, s.Pattern)
+		}
+	case json.Number, float64:
+		number, _ := schemaNumber(v)
+		if s.Minimum != nil && number < *s.Minimum {
+			fail("%v is less than the minimum %v", v, *s.Minimum)
+		}
+		if s.Maximum != nil && number > *s.Maximum {
+			fail("%v is greater than the maximum %v", v, *s.Maximum)
+		}
+	}
+}
+
+func schemaNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case json.Number:
+		number, err := v.Float64()
+		return number, err == nil
+	}
+	return 0, false
+}
+
+func hasSchemaType(value interface{}, name string) bool {
+	if name == "integer" {
+		number, ok := schemaNumber(value)
+		return ok && number == math.Trunc(number)
+	}
+	return schemaTypeOf(value) == name
+}
+
+// schemaTypeOf returns the JSON Schema type name of a decoded value.
+func schemaTypeOf(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64, json.Number:
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
@@ -0,0 +1,275 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// SelfCheck validates the configuration at startup: that the commands exist,
+// the required environment variables are set, the buckets are accessible and
+// the config file parses, and then runs STARTUP_CMD. Until it passes, /ready
+// and requests are answered with 503 and the report, so that a broken
+// revision doesn't become ready.
+type SelfCheck struct {
+	done   chan struct{}
+	failed int
+	warned int
+	report string
+}
+
+var selfCheck = &SelfCheck{done: make(chan struct{})}
+
+// Run runs the checks and logs the report.
+func (s *SelfCheck) Run(ctx context.Context) {
+	defer close(s.done)
+	var report strings.Builder
+	check := func(description string, err error) {
+		if err != nil {
+			s.failed++
+			fmt.Fprintf(&report, "ERROR %s: %v\n", description, err)
+		} else {
+			fmt.Fprintf(&report, "OK    %s\n", description)
+		}
+	}
+	// warn reports a problem that doesn't fail the checks
+	warn := func(description string, err error) {
+		s.warned++
+		fmt.Fprintf(&report, "WARN  %s: %v\n", description, err)
+	}
+
+	if CONFIG_FILE != "" {
+		check("config file "+CONFIG_FILE, configFileError)
+	}
+	commands := []string{}
+	if len(os.Args) > 1 {
+		commands = append(commands, os.Args[1])
+	}
+	commands = append(commands, ALLOWED_COMMANDS...)
+	config := currentConfig()
+	for _, schedule := range config.Schedules {
+		commands = append(commands, schedule.Command)
+	}
+	for _, rule := range config.Dispatch {
+		commands = append(commands, rule.Command)
+	}
+	for _, sidecar := range config.Sidecars {
+		commands = append(commands, sidecar.Command)
+	}
+	checked := make(map[string]bool)
+	for _, command := range commands {
+		if checked[command] {
+			continue
+		}
+		checked[command] = true
+		path, err := findExecutable(command)
+		if path == "" {
+			path = command
+		}
+		check("executable "+path, err)
+	}
+	for _, name := range REQUIRED_ENV {
+		var err error
+		if os.Getenv(name) == "" {
+			err = fmt.Errorf("not set")
+		}
+		check("environment variable "+name, err)
+	}
+	buckets, err := configuredBuckets()
+	if err != nil {
+		check("buckets", err)
+	}
+	for _, bucket := range buckets {
+		check("bucket "+bucket, checkBucket(ctx, bucket))
+	}
+	if modes := backgroundModes(); len(modes) > 0 && os.Getenv("K_SERVICE") != "" {
+		description := "CPU allocation for " + strings.Join(modes, ", ")
+		problems, err := cpuAllocationProblems(ctx, os.Getenv("K_SERVICE"))
+		switch {
+		case err != nil:
+			warn(description, fmt.Errorf("failed to check the service configuration: %w", err))
+		case len(problems) == 0:
+			check(description, nil)
+		case CPU_THROTTLING_POLICY == CPUThrottlingFail:
+			check(description, errors.New(strings.Join(problems, ", ")))
+		default:
+			warn(description, errors.New(strings.Join(problems, ", ")))
+		}
+	}
+	if STARTUP_CMD != "" {
+		check("startup command", startupCommandError(ctx))
+	}
+
+	s.report = report.String()
+	if s.failed > 0 {
+		log.Printf("Self-check failed with %d problems:\n%s", s.failed, s.report)
+	} else if s.warned > 0 {
+		log.Printf("Self-check passed with %d warnings:\n%s", s.warned, s.report)
+	} else {
+		log.Printf("Self-check passed.")
+	}
+}
+
+// Wait waits for the checks to complete and returns the error if any
+// failed.
+func (s *SelfCheck) Wait(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.done:
+	}
+	if s.failed > 0 {
+		return fmt.Errorf("self-check failed with %d problems:\n%s", s.failed, s.report)
+	}
+	return nil
+}
+
+// Policies for services that run commands outside of requests without
+// CPU allocated.
+const (
+	CPUThrottlingWarn = "warn"
+	CPUThrottlingFail = "fail"
+)
+
+// backgroundModes returns the features that run commands outside of
+// requests.
+func backgroundModes() []string {
+	var modes []string
+	if len(currentConfig().Schedules) > 0 {
+		modes = append(modes, "schedules")
+	}
+	if CLEANUP_CMD != "" {
+		modes = append(modes, "CLEANUP_CMD")
+	}
+	return modes
+}
+
+// cpuAllocationProblems returns why commands run outside of requests would
+// stall: the service can scale to zero, or only has CPU during requests.
+func cpuAllocationProblems(ctx context.Context, serviceName string) ([]string, error) {
+	project, err := projectID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	location, err := region(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var service struct {
+		Template struct {
+			Scaling struct {
+				MinInstanceCount int `json:"minInstanceCount"`
+			} `json:"scaling"`
+			Containers []struct {
+				Resources struct {
+					CPUIdle *bool `json:"cpuIdle"`
+				} `json:"resources"`
+			} `json:"containers"`
+		} `json:"template"`
+	}
+	name := fmt.Sprintf("projects/%s/locations/%s/services/%s", project, location, serviceName)
+	if err := callAPI(ctx, "GET", runAPI+name, nil, &service); err != nil {
+		return nil, err
+	}
+	var problems []string
+	if service.Template.Scaling.MinInstanceCount < 1 {
+		problems = append(problems, "the service can scale to zero (set --min-instances=1)")
+	}
+	for _, container := range service.Template.Containers {
+		if cpuIdle := container.Resources.CPUIdle; cpuIdle == nil || *cpuIdle {
+			problems = append(problems, "CPU is only allocated during requests (set --no-cpu-throttling)")
+			break
+		}
+	}
+	return problems, nil
+}
+
+// configuredBuckets returns the buckets that the configuration reads and
+// writes, once each, and the error of an invalid URI. URIs with templates
+// are only known per request and are skipped.
+func configuredBuckets() ([]string, error) {
+	var buckets []string
+	var invalid error
+	seen := make(map[string]bool)
+	add := func(bucket string) {
+		if !seen[bucket] {
+			seen[bucket] = true
+			buckets = append(buckets, bucket)
+		}
+	}
+	if LOCK_BUCKET != "" {
+		add(LOCK_BUCKET)
+	}
+	uris := []string{TRANSCRIPT_GCS_URI, RESULT_GCS_URI, MANIFEST_GCS_URI, CORE_DUMP_GCS_URI, ATTEMPTS_GCS_URI, OUTPUT_STDOUT_GCS_URI, STDIN_GCS_URI}
+	if strings.HasPrefix(JOB_STORE, "gs://") {
+		uris = append(uris, JOB_STORE)
+	}
+	for _, uri := range uris {
+		if uri == "" || strings.Contains(uri, "{{") {
+			continue
+		}
+		bucket, _, err := parseGCSPrefix(uri)
+		if err != nil {
+			invalid = err
+			continue
+		}
+		add(bucket)
+	}
+	return buckets, invalid
+}
+
+// checkBucket checks that a bucket exists and is accessible.
+func checkBucket(ctx context.Context, bucket string) error {
+	return callAPI(ctx, "GET", storageAPI+"b/"+url.PathEscape(bucket), nil, nil)
+}
+
+// selfCheckPath is the path of the endpoint that serves the report of the
+// self-check.
+const selfCheckPath = "/-/selfcheck"
+
+// readyHandler answers readiness and startup probes. Probes don't send
+// credentials, so only the status is returned, and the report is served
+// from selfCheckPath.
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	if err := selfCheck.Wait(ctx); err != nil {
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "OK")
+}
+
+// selfCheckHandler responds with the report of the self-check, with 503 if
+// it failed.
+func selfCheckHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	if err := selfCheck.Wait(ctx); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprint(w, selfCheck.report)
+}
@@ -0,0 +1,218 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Sidecar is a helper process, like the Cloud SQL Auth Proxy, that is
+// started before the commands and stopped after them. It's shared by the
+// runs in progress, and stopped when the last one is over.
+type Sidecar struct {
+	Name    string   `json:"name"`
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+	// Port is a local TCP port that the sidecar accepts connections on once
+	// it's ready.
+	Port int `json:"port,omitempty"`
+	// ReadyTimeout is how long to wait for the port, 30s by default.
+	ReadyTimeout Duration `json:"readyTimeout,omitempty"`
+
+	mu    sync.Mutex
+	users int
+	run   *sidecarRun
+	// previous is the last run that was stopped, or the run of the sidecar
+	// that this one replaced on a reload, which a new run waits for so that
+	// they don't both hold the port.
+	previous *sidecarRun
+}
+
+// sidecarRun is a started sidecar process.
+type sidecarRun struct {
+	cancel   context.CancelFunc
+	ready    chan struct{}
+	readyErr error
+	done     chan struct{}
+}
+
+func (s *Sidecar) parse() error {
+	if s.Command == "" {
+		return fmt.Errorf("no command set")
+	}
+	if s.Port < 0 || s.Port > 65535 {
+		return fmt.Errorf("invalid port: %d", s.Port)
+	}
+	if s.ReadyTimeout.Duration <= 0 {
+		s.ReadyTimeout.Duration = 30 * time.Second
+	}
+	return nil
+}
+
+// startSidecars starts the sidecars of the config file, or shares those
+// already running, and waits until they are ready. The returned function
+// releases them once the run is over.
+func startSidecars(ctx context.Context) (func(), error) {
+	var started []*Sidecar
+	release := func() {
+		for _, sidecar := range started {
+			sidecar.release()
+		}
+	}
+	for _, sidecar := range currentConfig().Sidecars {
+		if err := sidecar.acquire(ctx); err != nil {
+			release()
+			return nil, fmt.Errorf("failed to start sidecar %s: %w", sidecar.Name, err)
+		}
+		started = append(started, sidecar)
+	}
+	return release, nil
+}
+
+// acquire starts the sidecar unless it's already running and waits until
+// it's ready.
+func (s *Sidecar) acquire(ctx context.Context) error {
+	s.mu.Lock()
+	if s.run == nil || s.run.exited() {
+		s.run = s.start(s.previous)
+	}
+	s.users++
+	run := s.run
+	s.mu.Unlock()
+
+	select {
+	case <-run.ready:
+	case <-ctx.Done():
+		s.release()
+		return ctx.Err()
+	}
+	if run.readyErr != nil {
+		s.release()
+		return run.readyErr
+	}
+	return nil
+}
+
+// release stops the sidecar once it has no more users. It's terminated like
+// the commands, with TERMINATION_SIGNAL and TERMINATION_GRACE.
+func (s *Sidecar) release() {
+	s.mu.Lock()
+	if s.users--; s.users > 0 || s.run == nil {
+		s.mu.Unlock()
+		return
+	}
+	run := s.run
+	s.run, s.previous = nil, run
+	s.mu.Unlock()
+
+	log.Printf("Stopping sidecar %s.", s.Name)
+	run.cancel()
+	<-run.done
+}
+
+// lastRun returns the run in progress or the last one stopped, if any.
+func (s *Sidecar) lastRun() *sidecarRun {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.run != nil {
+		return s.run
+	}
+	return s.previous
+}
+
+// start starts the sidecar process once the previous run, if any, has
+// exited.
+func (s *Sidecar) start(previous *sidecarRun) *sidecarRun {
+	log.Printf("Starting sidecar %s.", s.Name)
+	ctx, cancel := context.WithCancel(context.Background())
+	run := &sidecarRun{cancel: cancel, ready: make(chan struct{}), done: make(chan struct{})}
+	command := newCommand(nil, s.Command, s.Args...)
+	command.StdoutLogger = log.New(os.Stdout, fmt.Sprintf("[%s] ", s.Name), log.Ldate|log.Ltime)
+	command.StderrLogger = log.New(os.Stderr, fmt.Sprintf("[%s] ", s.Name), log.Ldate|log.Ltime)
+	command.Timeout = 0
+	// Heartbeats would only fill the logs
+	command.PollInterval = 0
+	// The stall and memory watchdogs and output limits are meant for the
+	// runs, not for a helper that is quiet and long-lived
+	command.StallTimeout = 0
+	command.OnStall = nil
+	command.MemoryLimit = 0
+	command.MaxOutputBytes = 0
+	command.MaxOutputLines = 0
+	go func() {
+		defer close(run.ready)
+		if previous != nil {
+			select {
+			case <-previous.done:
+			case <-ctx.Done():
+				// Released before it could start
+				close(run.done)
+				run.readyErr = ctx.Err()
+				return
+			}
+		}
+		go func() {
+			defer close(run.done)
+			err := command.Run(ctx)
+			if ctx.Err() == nil {
+				log.Printf("Sidecar %s exited: %v", s.Name, err)
+			}
+		}()
+		run.readyErr = s.waitReady(run.done)
+	}()
+	return run
+}
+
+// waitReady waits until the port of the sidecar accepts connections.
+func (s *Sidecar) waitReady(done <-chan struct{}) error {
+	if s.Port == 0 {
+		return nil
+	}
+	address := net.JoinHostPort("localhost", strconv.Itoa(s.Port))
+	timeout := time.After(s.ReadyTimeout.Duration)
+	for {
+		if conn, err := net.DialTimeout("tcp", address, time.Second); err == nil {
+			conn.Close()
+			log.Printf("Sidecar %s is ready.", s.Name)
+			return nil
+		}
+		select {
+		case <-done:
+			return errors.New("exited before it was ready")
+		case <-timeout:
+			return fmt.Errorf("port %d not ready after %s", s.Port, s.ReadyTimeout.Duration)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func (r *sidecarRun) exited() bool {
+	select {
+	case <-r.done:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,129 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Headers of signed requests.
+const (
+	signatureHeader          = "X-Signature"
+	signatureTimestampHeader = "X-Signature-Timestamp"
+	signatureNonceHeader     = "X-Signature-Nonce"
+)
+
+// signedPayload returns what's signed for a request: the timestamp, nonce,
+// method, path with the query and the body, separated by newlines.
+func signedPayload(timestamp string, nonce string, r *http.Request, body []byte) []byte {
+	var payload bytes.Buffer
+	fmt.Fprintf(&payload, "%s\n%s\n%s\n%s\n", timestamp, nonce, r.Method, r.URL.RequestURI())
+	payload.Write(body)
+	return payload.Bytes()
+}
+
+// requestSignature returns the signature of a request with a key, as sent
+// in the X-Signature header.
+func requestSignature(key string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifySignature checks that a request is signed with one of
+// REQUEST_SIGNING_KEY, within SIGNATURE_MAX_AGE of now and with a nonce that
+// wasn't used before, so that a captured request can't be replayed. The body
+// is read to be verified and replaced for the handler.
+func verifySignature(r *http.Request, now time.Time) error {
+	signature := r.Header.Get(signatureHeader)
+	timestamp := r.Header.Get(signatureTimestampHeader)
+	nonce := r.Header.Get(signatureNonceHeader)
+	if signature == "" || timestamp == "" || nonce == "" {
+		return fmt.Errorf("missing %s, %s or %s", signatureHeader, signatureTimestampHeader, signatureNonceHeader)
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %s", signatureTimestampHeader, timestamp)
+	}
+	if age := now.Sub(time.Unix(seconds, 0)); age > SIGNATURE_MAX_AGE || age < -SIGNATURE_MAX_AGE {
+		return fmt.Errorf("stale timestamp %s (%v from now)", timestamp, -age.Round(time.Second))
+	}
+
+	reader := io.Reader(r.Body)
+	if MAX_BODY_BYTES > 0 {
+		reader = &limitReader{r: r.Body, remaining: MAX_BODY_BYTES + 1, err: errBodyTooLarge}
+	}
+	body, err := ioutil.ReadAll(reader)
+	r.Body.Close()
+	if err != nil {
+		return err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	payload := signedPayload(timestamp, nonce, r, body)
+	valid := false
+	for _, key := range REQUEST_SIGNING_KEY {
+		if hmac.Equal([]byte(signature), []byte(requestSignature(key, payload))) {
+			valid = true
+		}
+	}
+	if !valid {
+		return errors.New("invalid signature")
+	}
+	if !nonces.use(nonce, now) {
+		return fmt.Errorf("reused nonce %s", nonce)
+	}
+	return nil
+}
+
+// nonceCache remembers the nonces of signed requests for as long as their
+// timestamps are accepted. It's kept in memory, so a request could still be
+// replayed once to another instance.
+type nonceCache struct {
+	mu     sync.Mutex
+	nonces map[string]time.Time
+}
+
+var nonces = &nonceCache{nonces: make(map[string]time.Time)}
+
+// use records a nonce and returns false if it was already used.
+func (c *nonceCache) use(nonce string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for n, expires := range c.nonces {
+		if now.After(expires) {
+			delete(c.nonces, n)
+		}
+	}
+	if _, used := c.nonces[nonce]; used {
+		return false
+	}
+	// timestamps up to SIGNATURE_MAX_AGE in the future are accepted too
+	c.nonces[nonce] = now.Add(2 * SIGNATURE_MAX_AGE)
+	return true
+}
@@ -0,0 +1,203 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/rosmo/long-cloud-run/pkg/runner"
+)
+
+// ResultSink receives the result of every run when it ends.
+type ResultSink interface {
+	// Enabled returns true if the sink is configured.
+	Enabled() bool
+	// Report delivers the result of a run that ended with err.
+	Report(ctx context.Context, trigger string, result runner.Result, err error) error
+}
+
+// resultSinkFuncs adapts a pair of functions to a ResultSink.
+type resultSinkFuncs struct {
+	enabled func() bool
+	report  func(ctx context.Context, trigger string, result runner.Result, err error) error
+}
+
+func (s resultSinkFuncs) Enabled() bool {
+	return s.enabled()
+}
+
+func (s resultSinkFuncs) Report(ctx context.Context, trigger string, result runner.Result, err error) error {
+	return s.report(ctx, trigger, result, err)
+}
+
+type namedResultSink struct {
+	name string
+	sink ResultSink
+}
+
+// resultSinks are the registered sinks, in the order of registration.
+var resultSinks []namedResultSink
+
+// registerResultSink adds a sink that the results of all runs are reported
+// to while it's enabled.
+func registerResultSink(name string, sink ResultSink) {
+	for _, registered := range resultSinks {
+		if registered.name == name {
+			panic(fmt.Sprintf("result sink %s registered twice", name))
+		}
+	}
+	resultSinks = append(resultSinks, namedResultSink{name, sink})
+}
+
+// enabledResultSinks returns the names of the enabled sinks.
+func enabledResultSinks() []string {
+	var names []string
+	for _, registered := range resultSinks {
+		if registered.sink.Enabled() {
+			names = append(names, registered.name)
+		}
+	}
+	return names
+}
+
+// reportToSinks reports a result to the enabled sinks concurrently, so that
+// a slow sink doesn't delay the others, and waits for all of them.
+func reportToSinks(ctx context.Context, trigger string, result runner.Result, err error) {
+	var wg sync.WaitGroup
+	for _, registered := range resultSinks {
+		if !registered.sink.Enabled() {
+			continue
+		}
+		wg.Add(1)
+		go func(registered namedResultSink) {
+			defer wg.Done()
+			if err := registered.sink.Report(ctx, trigger, result, err); err != nil {
+				log.Printf("Failed to report result to %s: %v", registered.name, err)
+			}
+		}(registered)
+	}
+	wg.Wait()
+}
+
+// resultEvent returns the notification event of a run that ended with err.
+func resultEvent(err error) string {
+	var timeoutErr *runner.TimeoutError
+	switch {
+	case errors.As(err, &timeoutErr):
+		return EventTimeout
+	case err != nil:
+		return EventFailure
+	default:
+		return EventSuccess
+	}
+}
+
+// resultMessage is published to RESULT_TOPIC and written under
+// RESULT_GCS_URI when a run ends.
+type resultMessage struct {
+	runner.Result
+	Trigger         string  `json:"trigger"`
+	DurationSeconds float64 `json:"durationSeconds"`
+}
+
+func newResultMessage(trigger string, result runner.Result) ([]byte, error) {
+	return json.Marshal(resultMessage{
+		Result:          result,
+		Trigger:         trigger,
+		DurationSeconds: result.Duration.Seconds(),
+	})
+}
+
+// publishResult publishes the result to RESULT_TOPIC, with the command,
+// status and exit code as attributes for subscription filters.
+func publishResult(ctx context.Context, trigger string, result runner.Result) error {
+	data, err := newResultMessage(trigger, result)
+	if err != nil {
+		return err
+	}
+	attributes := map[string]string{
+		"command":  commandLabel(result.Command),
+		"status":   result.Status,
+		"exitCode": fmt.Sprint(result.ExitCode),
+		"trigger":  trigger,
+	}
+	if result.JobID != "" {
+		attributes["jobId"] = result.JobID
+	}
+	_, err = publishMessage(ctx, RESULT_TOPIC, data, attributes)
+	return err
+}
+
+// writeResult writes the result as a JSON object under RESULT_GCS_URI.
+func writeResult(ctx context.Context, trigger string, result runner.Result) error {
+	bucket, prefix, err := parseGCSPrefix(RESULT_GCS_URI)
+	if err != nil {
+		return err
+	}
+	data, err := newResultMessage(trigger, result)
+	if err != nil {
+		return err
+	}
+	name := runObjectName(prefix, result.Command, result.JobID, result.StartTime) + ".json"
+	_, err = uploadObject(ctx, bucket, name, "application/json", data, -1)
+	return err
+}
+
+func init() {
+	registerResultSink("history", resultSinkFuncs{
+		enabled: func() bool { return HISTORY_COLLECTION != "" },
+		report: func(ctx context.Context, trigger string, result runner.Result, err error) error {
+			return recordHistory(ctx, trigger, result)
+		},
+	})
+	registerResultSink("bigquery", resultSinkFuncs{
+		enabled: func() bool { return BIGQUERY_TABLE != "" },
+		report: func(ctx context.Context, trigger string, result runner.Result, err error) error {
+			return insertRunResult(ctx, trigger, result)
+		},
+	})
+	registerResultSink("metrics", resultSinkFuncs{
+		enabled: func() bool { return METRICS_PREFIX != "" },
+		report: func(ctx context.Context, trigger string, result runner.Result, err error) error {
+			return reportRunMetrics(ctx, trigger, result)
+		},
+	})
+	registerResultSink("pubsub", resultSinkFuncs{
+		enabled: func() bool { return RESULT_TOPIC != "" },
+		report: func(ctx context.Context, trigger string, result runner.Result, err error) error {
+			return publishResult(ctx, trigger, result)
+		},
+	})
+	registerResultSink("gcs", resultSinkFuncs{
+		enabled: func() bool { return RESULT_GCS_URI != "" },
+		report: func(ctx context.Context, trigger string, result runner.Result, err error) error {
+			return writeResult(ctx, trigger, result)
+		},
+	})
+	registerResultSink("webhook", resultSinkFuncs{
+		enabled: func() bool { return NOTIFY_WEBHOOK_URL != "" },
+		report: func(ctx context.Context, trigger string, result runner.Result, err error) error {
+			notify(ctx, resultEvent(err), result)
+			return nil
+		},
+	})
+}
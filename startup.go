@@ -0,0 +1,75 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/rosmo/long-cloud-run/pkg/runner"
+)
+
+// Failure policies of the startup command.
+const (
+	StartupFailureFail   = "fail"
+	StartupFailureExit   = "exit"
+	StartupFailureIgnore = "ignore"
+)
+
+// newShellCommand returns a command running script with sh -c, with its
+// output logged with the name as prefix.
+func newShellCommand(name string, script string, timeout time.Duration) *runner.Command {
+	command := newCommand(nil, "sh", "-c", script)
+	command.Timeout = timeout
+	command.StdoutLogger = log.New(os.Stdout, "["+name+"] ", log.Ldate|log.Ltime)
+	command.StderrLogger = log.New(os.Stderr, "["+name+"] ", log.Ldate|log.Ltime)
+	return command
+}
+
+// runStartupCommand runs STARTUP_CMD, logging its output.
+func runStartupCommand(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, STARTUP_TIMEOUT)
+	defer cancel()
+	log.Printf("Running startup command: %s", STARTUP_CMD)
+	command := newShellCommand("startup", STARTUP_CMD, STARTUP_TIMEOUT)
+	if err := command.Run(ctx); err != nil {
+		return err
+	}
+	log.Printf("Startup command finished in %s.", command.Result.Duration)
+	return nil
+}
+
+// startupCommandError runs the startup command and applies
+// STARTUP_FAILURE_POLICY: with fail the error is returned, with exit the
+// container exits and with ignore it's only logged.
+func startupCommandError(ctx context.Context) error {
+	err := runStartupCommand(ctx)
+	if err == nil {
+		return nil
+	}
+	switch STARTUP_FAILURE_POLICY {
+	case StartupFailureExit:
+		log.Fatalf("Startup command failed: %v", err)
+	case StartupFailureIgnore:
+		log.Printf("Startup command failed, ignoring: %v", err)
+		return nil
+	}
+	return fmt.Errorf("startup command failed: %w", err)
+}
@@ -0,0 +1,342 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rosmo/long-cloud-run/pkg/runner"
+)
+
+// JobState is the state of a run kept in the job store, so that any
+// instance can answer for it.
+type JobState struct {
+	JobID   string `json:"jobId"`
+	Command string `json:"command"`
+	Trigger string `json:"trigger"`
+	Tenant  string `json:"tenant,omitempty"`
+	Status  string `json:"status"`
+	// Progress is the latest percentage found by PROGRESS_REGEX, if any.
+	Progress  *float64       `json:"progress,omitempty"`
+	StartTime time.Time      `json:"startTime"`
+	Updated   time.Time      `json:"updated"`
+	Result    *runner.Result `json:"result,omitempty"`
+	// Output is the tail of the output, up to JOB_STORE_LINES lines.
+	Output []string `json:"output,omitempty"`
+	// Detached is set when the client of the run is gone and it continues
+	// without it, see CLIENT_GONE.
+	Detached bool `json:"detached,omitempty"`
+}
+
+// JobStatusRunning is the status of runs in progress.
+const JobStatusRunning = "running"
+
+// JobStore keeps the state of runs. Get returns nil if there is no state for
+// the job, for example because it expired after JOB_STORE_TTL.
+type JobStore interface {
+	Put(ctx context.Context, state *JobState) error
+	Get(ctx context.Context, jobID string) (*JobState, error)
+}
+
+// newJobStore returns the job store of a JOB_STORE URI: memory,
+// gs://bucket/prefix, firestore://collection or redis://host:port.
+func newJobStore(uri string) (JobStore, error) {
+	switch {
+	case uri == "" || uri == "memory":
+		return &memoryJobStore{jobs: make(map[string]*JobState)}, nil
+	case strings.HasPrefix(uri, "gs://"):
+		bucket, prefix, err := parseGCSPrefix(uri)
+		if err != nil {
+			return nil, err
+		}
+		return &gcsJobStore{bucket: bucket, prefix: prefix}, nil
+	case strings.HasPrefix(uri, "firestore://"):
+		collection := strings.Trim(strings.TrimPrefix(uri, "firestore://"), "/")
+		if collection == "" {
+			return nil, fmt.Errorf("no collection in %s", uri)
+		}
+		return &firestoreJobStore{collection: collection}, nil
+	case strings.HasPrefix(uri, "redis://"):
+		return newRedisJobStore(uri)
+	}
+	return nil, fmt.Errorf("unknown job store: %s (must be memory, gs://, firestore:// or redis://)", uri)
+}
+
+// memoryJobStore keeps the state in this instance only.
+type memoryJobStore struct {
+	mu   sync.Mutex
+	jobs map[string]*JobState
+}
+
+func (s *memoryJobStore) Put(ctx context.Context, state *JobState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for jobID, job := range s.jobs {
+		if time.Since(job.Updated) > JOB_STORE_TTL {
+			delete(s.jobs, jobID)
+		}
+	}
+	copy := *state
+	s.jobs[state.JobID] = &copy
+	return nil
+}
+
+func (s *memoryJobStore) Get(ctx context.Context, jobID string) (*JobState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, ok := s.jobs[jobID]
+	if !ok || time.Since(state.Updated) > JOB_STORE_TTL {
+		return nil, nil
+	}
+	copy := *state
+	return &copy, nil
+}
+
+// gcsJobStore keeps the state in JSON objects named after the jobs. Expire
+// them with a lifecycle rule of the bucket.
+type gcsJobStore struct {
+	bucket string
+	prefix string
+}
+
+func (s *gcsJobStore) Put(ctx context.Context, state *JobState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	_, err = uploadObject(ctx, s.bucket, s.prefix+state.JobID+".json", "application/json", data, -1)
+	return err
+}
+
+func (s *gcsJobStore) Get(ctx context.Context, jobID string) (*JobState, error) {
+	data, err := downloadObject(ctx, s.bucket, s.prefix+jobID+".json")
+	if isAPIError(err, http.StatusNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeJobState(data)
+}
+
+// firestoreJobStore keeps the state in documents named after the jobs, with
+// an expireTime field for a TTL policy of the collection.
+type firestoreJobStore struct {
+	collection string
+}
+
+func (s *firestoreJobStore) document(ctx context.Context, jobID string) (string, error) {
+	root, err := firestoreDocuments(ctx)
+	if err != nil {
+		return "", err
+	}
+	return firestoreAPI + root + "/" + s.collection + "/" + url.PathEscape(jobID), nil
+}
+
+func (s *firestoreJobStore) Put(ctx context.Context, state *JobState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	document, err := s.document(ctx, state.JobID)
+	if err != nil {
+		return err
+	}
+	fields := toFirestoreFields(map[string]interface{}{
+		"state":      string(data),
+		"status":     state.Status,
+		"updated":    state.Updated,
+		"expireTime": state.Updated.Add(JOB_STORE_TTL),
+	})
+	return callAPI(ctx, "PATCH", document, map[string]interface{}{"fields": fields}, nil)
+}
+
+func (s *firestoreJobStore) Get(ctx context.Context, jobID string) (*JobState, error) {
+	document, err := s.document(ctx, jobID)
+	if err != nil {
+		return nil, err
+	}
+	var doc firestoreDocument
+	err = callAPI(ctx, "GET", document, nil, &doc)
+	if isAPIError(err, http.StatusNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, _ := doc.Fields["state"].decode().(string)
+	return decodeJobState([]byte(data))
+}
+
+func decodeJobState(data []byte) (*JobState, error) {
+	state := &JobState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("error parsing job state: %w", err)
+	}
+	return state, nil
+}
+
+// jobTracker records a run in the job store.
+type jobTracker struct {
+	command *runner.Command
+	tail    *runner.BufferSink
+	lines   int64
+	done    chan struct{}
+	stopped chan struct{}
+
+	mu    sync.Mutex
+	state *JobState
+}
+
+// trackJob records a run in the job store: as running when it starts, and
+// with the tail of its output every JOB_STORE_INTERVAL while it runs, until
+// it's finished.
+func trackJob(command *runner.Command, trigger string) *jobTracker {
+	t := &jobTracker{
+		command: command,
+		tail:    &runner.BufferSink{MaxLines: JOB_STORE_LINES},
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		state: &JobState{
+			JobID:     command.JobID,
+			Command:   command.Name,
+			Trigger:   trigger,
+			Tenant:    command.Labels["tenant"],
+			Status:    JobStatusRunning,
+			StartTime: time.Now(),
+		},
+	}
+	onOutput := command.OnOutput
+	command.OnOutput = func(line string) {
+		// Output that isn't shown isn't served from the job either
+		if command.ShowOutput {
+			t.tail.WriteLine(line)
+		}
+		atomic.AddInt64(&t.lines, 1)
+		if onOutput != nil {
+			onOutput(line)
+		}
+	}
+	onProgress := command.OnProgress
+	command.OnProgress = func(percent float64) {
+		t.mu.Lock()
+		t.state.Progress = &percent
+		t.mu.Unlock()
+		if onProgress != nil {
+			onProgress(percent)
+		}
+	}
+	t.put(nil)
+	go t.loop()
+	return t
+}
+
+func (t *jobTracker) put(result *runner.Result) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.state.Updated = time.Now()
+	t.state.Output = t.tail.Lines()
+	if result != nil {
+		t.state.Result = result
+		t.state.Status = result.Status
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := jobStore.Put(ctx, t.state); err != nil {
+		log.Printf("Failed to store the state of %s: %v", t.state.JobID, err)
+	}
+}
+
+func (t *jobTracker) loop() {
+	defer close(t.stopped)
+	ticker := time.NewTicker(JOB_STORE_INTERVAL)
+	defer ticker.Stop()
+	var written int64
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-ticker.C:
+		}
+		// only write again when there is new output
+		if n := atomic.LoadInt64(&t.lines); n != written {
+			written = n
+			t.put(nil)
+		}
+	}
+}
+
+// detach records that the client of the run is gone, and that the run
+// continues without it.
+func (t *jobTracker) detach() {
+	t.mu.Lock()
+	t.state.Detached = true
+	t.mu.Unlock()
+	t.put(nil)
+}
+
+// finish records the result of the run.
+func (t *jobTracker) finish() {
+	close(t.done)
+	<-t.stopped
+	result := t.command.Result
+	t.put(&result)
+}
+
+// jobsPath is the path of the job states.
+const jobsPath = "/-/jobs/"
+
+// jobHandler serves GET /-/jobs/<jobID> with the state of a run from the
+// job store.
+func jobHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	jobID := strings.TrimPrefix(r.URL.Path, jobsPath)
+	if jobID == "" || strings.Contains(jobID, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	tenant, err := tenantScope(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	state, err := jobStore.Get(r.Context(), jobID)
+	if err != nil {
+		log.Printf("Failed to get the state of %s: %v", jobID, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	// the runs of other tenants aren't found
+	if state == nil || (tenant != nil && state.Tenant != tenant.Name) {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
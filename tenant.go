@@ -0,0 +1,204 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// tenantsPath is the path prefix that selects the tenant of a request, as in
+// /tenants/<name>.
+const tenantsPath = "/tenants/"
+
+// Tenant isolates the invocations of a team in the config file: they run
+// only the tenant's commands, in its working directory, with its own rate
+// limit, and their artifacts are kept under its name.
+type Tenant struct {
+	Name string `json:"name"`
+	// Tokens authenticate requests as the tenant, like AUTH_TOKEN, and
+	// Callers are the identities of the OIDC tokens of its callers, such as
+	// the service account of a push subscription.
+	Tokens  []string `json:"tokens,omitempty"`
+	Callers []string `json:"callers,omitempty"`
+	// Command and Args replace the command of the service for the tenant.
+	// Commands are the other commands it can run, in batches or dispatched
+	// messages.
+	Command  string   `json:"command,omitempty"`
+	Args     []string `json:"args,omitempty"`
+	Commands []string `json:"commands,omitempty"`
+	// WorkingDir is the working directory of the tenant's commands, created
+	// if it doesn't exist. Like WORKING_DIR, it's relative to CHROOT.
+	WorkingDir string `json:"workingDir,omitempty"`
+	// GCSPrefix is the gs://bucket/prefix that the STDIN_GCS_URI and
+	// OUTPUT_STDOUT_GCS_URI objects of the tenant have to be under.
+	GCSPrefix string `json:"gcsPrefix,omitempty"`
+	// RateLimit limits all the invocations of the tenant, like "100/h".
+	RateLimit string `json:"rateLimit,omitempty"`
+
+	rateLimit *RateLimit
+}
+
+func (t *Tenant) parse() (err error) {
+	if t.Name == "" || strings.ContainsAny(t.Name, "/ ") {
+		return fmt.Errorf("invalid name: %q", t.Name)
+	}
+	if t.GCSPrefix != "" {
+		if _, _, err := parseGCSPrefix(t.GCSPrefix); err != nil {
+			return err
+		}
+		t.GCSPrefix = strings.TrimSuffix(t.GCSPrefix, "/") + "/"
+	}
+	t.rateLimit, err = parseRateLimit(t.RateLimit)
+	return err
+}
+
+// allows returns true if the command is in the tenant's registry.
+func (t *Tenant) allows(command string) bool {
+	if command == t.command() {
+		return true
+	}
+	for _, allowed := range t.Commands {
+		if command == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// command returns the default command of the tenant.
+func (t *Tenant) command() string {
+	if t.Command != "" {
+		return t.Command
+	}
+	if len(os.Args) > 1 {
+		return os.Args[1]
+	}
+	return ""
+}
+
+// authorizes returns true if the request has one of the tenant's tokens or
+// comes from one of its callers.
+func (t *Tenant) authorizes(token string, caller string) bool {
+	valid := false
+	for _, expected := range t.Tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1 {
+			valid = true
+		}
+	}
+	for _, expected := range t.Callers {
+		if caller != "" && caller == expected {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// checkURI checks that a gs:// URI of the tenant is under its GCSPrefix.
+func (t *Tenant) checkURI(uri string) error {
+	if uri == "" || t.GCSPrefix == "" || strings.HasPrefix(uri, t.GCSPrefix) {
+		return nil
+	}
+	return fmt.Errorf("%s is outside of the prefix of tenant %s", uri, t.Name)
+}
+
+// workingDir returns the working directory of the tenant's commands, after
+// creating it, or "" to use WORKING_DIR.
+func (t *Tenant) workingDir() (string, error) {
+	if t.WorkingDir == "" {
+		return "", nil
+	}
+	if err := os.MkdirAll(filepath.Join(CHROOT, t.WorkingDir), 0755); err != nil {
+		return "", fmt.Errorf("failed to create the working directory of tenant %s: %w", t.Name, err)
+	}
+	return t.WorkingDir, nil
+}
+
+// requestTenant returns the tenant of a request, when the config file has
+// tenants: the one a Cloud Task replays the request for, the one named in
+// the path, which the request has to be authorized for if it has tokens or
+// callers, or else the one whose token or caller the request has. Requests
+// without a tenant are rejected.
+func requestTenant(r *http.Request, caller string) (*Tenant, error) {
+	tenants := currentConfig().Tenants
+	if len(tenants) == 0 {
+		return nil, nil
+	}
+	if name := r.Header.Get(replayTenantHeader); name != "" && isTaskAccount(r.Context(), caller) {
+		// a run replayed by a Cloud Task of the service
+		for _, tenant := range tenants {
+			if tenant.Name == name {
+				return tenant, nil
+			}
+		}
+		return nil, fmt.Errorf("unknown tenant: %s", name)
+	}
+	token := requestToken(r)
+	if strings.HasPrefix(r.URL.Path, tenantsPath) {
+		name := strings.SplitN(strings.TrimPrefix(r.URL.Path, tenantsPath), "/", 2)[0]
+		for _, tenant := range tenants {
+			if tenant.Name != name {
+				continue
+			}
+			if (len(tenant.Tokens) > 0 || len(tenant.Callers) > 0) && !tenant.authorizes(token, caller) {
+				return nil, fmt.Errorf("not authorized for tenant %s", name)
+			}
+			return tenant, nil
+		}
+		return nil, fmt.Errorf("unknown tenant: %s", name)
+	}
+	for _, tenant := range tenants {
+		if tenant.authorizes(token, caller) {
+			return tenant, nil
+		}
+	}
+	return nil, fmt.Errorf("no tenant for the request")
+}
+
+// tenantScope returns the tenant whose runs a request for jobs or history
+// can see, or nil for all runs. When the config file has tenants, only
+// requests with AUTH_TOKEN see all runs.
+func tenantScope(r *http.Request) (*Tenant, error) {
+	if len(currentConfig().Tenants) == 0 || (len(AUTH_TOKEN) > 0 && validToken(requestToken(r))) {
+		return nil, nil
+	}
+	return requestTenant(r, verifiedCaller(r, time.Now()))
+}
+
+// tenantToken returns true if the token is one of a tenant's tokens.
+func tenantToken(token string) bool {
+	for _, tenant := range currentConfig().Tenants {
+		if len(tenant.Tokens) > 0 && tenant.authorizes(token, "") {
+			return true
+		}
+	}
+	return false
+}
+
+// tenantPrefix returns a gs://bucket/prefix for the artifacts of a tenant,
+// with its name appended, or the prefix itself without a tenant.
+func tenantPrefix(uri string, tenant *Tenant) string {
+	if tenant == nil || uri == "" {
+		return uri
+	}
+	return strings.TrimSuffix(uri, "/") + "/" + tenant.Name
+}
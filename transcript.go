@@ -0,0 +1,118 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// parseGCSPrefix splits a gs://bucket/prefix URI into the bucket and the
+// prefix, which ends with a slash unless it's empty.
+func parseGCSPrefix(uri string) (string, string, error) {
+	uri = strings.TrimSuffix(uri, "/") + "/"
+	bucket, prefix, err := parseGCSURI(uri + "x")
+	if err != nil {
+		return "", "", err
+	}
+	return bucket, strings.TrimSuffix(prefix, "x"), nil
+}
+
+// runObjectName returns the name, without extension, of an object about a
+// run under a prefix: prefix/command/start-jobid.
+func runObjectName(prefix string, command string, jobID string, startTime time.Time) string {
+	name := startTime.UTC().Format("20060102T150405.000Z")
+	if jobID != "" {
+		name += "-" + jobID
+	}
+	return fmt.Sprintf("%s%s/%s", prefix, filepath.Base(command), name)
+}
+
+// GCSSink writes the transcript of a run to a temporary file, and uploads
+// it to Cloud Storage when closed.
+type GCSSink struct {
+	Bucket string
+	Name   string
+
+	mu     sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+}
+
+// NewGCSSink returns a sink for the transcript of a run of a command, which
+// is uploaded under the gs://bucket/prefix URI.
+func NewGCSSink(uri string, command string, jobID string, startTime time.Time) (*GCSSink, error) {
+	bucket, prefix, err := parseGCSPrefix(uri)
+	if err != nil {
+		return nil, err
+	}
+	file, err := ioutil.TempFile("", "transcript-*.log")
+	if err != nil {
+		return nil, err
+	}
+	return &GCSSink{
+		Bucket: bucket,
+		Name:   runObjectName(prefix, command, jobID, startTime) + ".log",
+		file:   file,
+		writer: bufio.NewWriter(file),
+	}, nil
+}
+
+func (s *GCSSink) WriteLine(line string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := fmt.Fprintln(s.writer, line)
+	return err
+}
+
+// Close uploads the transcript and removes the temporary file.
+func (s *GCSSink) Close() error {
+	defer os.Remove(s.file.Name())
+	defer s.file.Close()
+	if err := s.writer.Flush(); err != nil {
+		return err
+	}
+	if _, err := s.file.Seek(0, 0); err != nil {
+		return err
+	}
+	if _, err := uploadObjectFrom(context.Background(), s.Bucket, s.Name, "text/plain; charset=utf-8", s.file, -1); err != nil {
+		return fmt.Errorf("failed to upload transcript to %s: %w", s.URI(), err)
+	}
+	return nil
+}
+
+// URI returns the gs:// URI of the transcript.
+func (s *GCSSink) URI() string {
+	return fmt.Sprintf("gs://%s/%s", s.Bucket, s.Name)
+}
+
+// ConsoleURL returns the link to the transcript in the Cloud Console.
+func (s *GCSSink) ConsoleURL() string {
+	return storageConsoleURL(s.Bucket, s.Name)
+}
+
+// storageConsoleURL returns the link to an object in the Cloud Console.
+func storageConsoleURL(bucket string, name string) string {
+	return fmt.Sprintf("https://console.cloud.google.com/storage/browser/_details/%s/%s", bucket, name)
+}
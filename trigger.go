@@ -0,0 +1,161 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"text/template"
+	"time"
+)
+
+// Invocation is the data of a request available to argument templates.
+type Invocation struct {
+	// Trigger is http, pubsub or cloudscheduler.
+	Trigger string
+	// Body is the request body, or the data of a Pub/Sub message, decoded
+	// from JSON, or as a string if it isn't JSON.
+	Body       interface{}
+	Attributes map[string]string
+	MessageID  string
+	// Job is the name of the Cloud Scheduler job.
+	Job string
+	// Files are the paths of the files uploaded with a multipart/form-data
+	// request by form field name.
+	Files map[string]string
+	// JobID is the run ID.
+	JobID string
+	// Tenant is the name of the tenant of the request, if the config file
+	// has tenants.
+	Tenant string
+}
+
+// isCloudScheduler returns true for requests from an HTTP target of Cloud
+// Scheduler, which are never wrapped in a Pub/Sub envelope.
+func isCloudScheduler(r *http.Request) bool {
+	return r.Header.Get("X-CloudScheduler") == "true"
+}
+
+// requestPayload returns the data of the Pub/Sub message, or the request
+// body for other invocations.
+func requestPayload(body []byte, m *PubSubMessage) []byte {
+	if m.Subscription != "" || len(m.Message.Data) > 0 {
+		return m.Message.Data
+	}
+	return body
+}
+
+// newInvocation returns the template data of a request.
+func newInvocation(r *http.Request, trigger string, body []byte, m *PubSubMessage) *Invocation {
+	invocation := &Invocation{
+		Trigger:    trigger,
+		Attributes: m.Message.Attributes,
+		MessageID:  m.Message.ID,
+		Job:        r.Header.Get("X-CloudScheduler-JobName"),
+	}
+	payload := bytes.TrimSpace(requestPayload(body, m))
+	if len(payload) > 0 {
+		decoder := json.NewDecoder(bytes.NewReader(payload))
+		decoder.UseNumber()
+		if err := decoder.Decode(&invocation.Body); err != nil || decoder.More() {
+			invocation.Body = string(payload)
+		}
+	}
+	return invocation
+}
+
+// renderURI renders a gs:// URI as a template with the invocation, if
+// TEMPLATE_ARGS is set, and checks that it's valid. An empty URI is
+// returned as is.
+func renderURI(uri string, invocation *Invocation) (string, error) {
+	if uri == "" {
+		return "", nil
+	}
+	rendered, err := renderArgs([]string{uri}, invocation)
+	if err != nil {
+		return "", err
+	}
+	if _, _, err := parseGCSURI(rendered[0]); err != nil {
+		return "", err
+	}
+	return rendered[0], nil
+}
+
+// templateFuncs are the functions of the argument templates: now, the
+// current UTC time, date, the current UTC time in a layout like
+// "2006-01-02", uuid, a random UUID, and default, its first argument if the
+// second is empty. Missing keys of the body can be given defaults with
+// index, like {{default "full" (index .Body "mode")}}.
+//
+// The arguments of the service can also read the environment with env.
+// It's not available to the templates of batch requests, which come from
+// the caller.
+var templateFuncs = template.FuncMap{
+	"now": func() time.Time {
+		return time.Now().UTC()
+	},
+	"date": func(layout string) string {
+		return time.Now().UTC().Format(layout)
+	},
+	"uuid":    newJobID,
+	"default": defaultValue,
+}
+
+// defaultValue returns value unless it's empty (nil, false, zero or of zero
+// length), and otherwise def.
+func defaultValue(def interface{}, value interface{}) interface{} {
+	if value == nil {
+		return def
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		if v.Len() == 0 {
+			return def
+		}
+	default:
+		if v.IsZero() {
+			return def
+		}
+	}
+	return value
+}
+
+// renderArgs renders the arguments as templates with the invocation, if
+// TEMPLATE_ARGS is set.
+func renderArgs(args []string, invocation *Invocation) ([]string, error) {
+	if !TEMPLATE_ARGS {
+		return args, nil
+	}
+	rendered := make([]string, len(args))
+	for i, arg := range args {
+		t, err := template.New("arg").Option("missingkey=error").Funcs(templateFuncs).Funcs(template.FuncMap{"env": os.Getenv}).Parse(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid argument %q: %w", arg, err)
+		}
+		var out bytes.Buffer
+		if err := t.Execute(&out, invocation); err != nil {
+			return nil, fmt.Errorf("failed to render argument %q: %w", arg, err)
+		}
+		rendered[i] = out.String()
+	}
+	return rendered, nil
+}
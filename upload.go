@@ -0,0 +1,227 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var errUploadTooLarge = errors.New("upload too large")
+
+// Upload is the files and values of a multipart/form-data request, with the
+// files staged in a temporary workspace directory for the run.
+type Upload struct {
+	Dir string
+	// Files are the paths of the uploaded files by form field name.
+	Files  map[string]string
+	Values map[string]interface{}
+}
+
+// isMultipart returns whether the request is a multipart/form-data upload.
+func isMultipart(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "multipart/form-data"
+}
+
+// stageUpload writes the files of a multipart/form-data request into a new
+// directory in UPLOAD_DIR. The caller has to remove it when the run is over.
+func stageUpload(r *http.Request) (*Upload, error) {
+	r.Body = ioutil.NopCloser(&limitReader{r: r.Body, remaining: MAX_UPLOAD_BYTES + 1, err: errUploadTooLarge})
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir(UPLOAD_DIR, "upload-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upload directory: %w", err)
+	}
+	upload := &Upload{Dir: dir, Files: make(map[string]string), Values: make(map[string]interface{})}
+	if err := upload.read(reader); err != nil {
+		upload.Remove()
+		return nil, err
+	}
+	if err := upload.chown(); err != nil {
+		upload.Remove()
+		return nil, err
+	}
+	log.Printf("Staged %d uploaded files in %s.", len(upload.Files), dir)
+	return upload, nil
+}
+
+func (u *Upload) read(reader *multipart.Reader) error {
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		field := part.FormName()
+		if field == "" {
+			continue
+		}
+		if _, ok := u.Files[field]; ok {
+			return fmt.Errorf("duplicate upload field: %s", field)
+		}
+		if _, ok := u.Values[field]; ok {
+			return fmt.Errorf("duplicate upload field: %s", field)
+		}
+		if part.FileName() == "" {
+			value, err := ioutil.ReadAll(part)
+			if err != nil {
+				return err
+			}
+			u.Values[field] = string(value)
+			continue
+		}
+		name := filepath.Base(filepath.Clean("/" + part.FileName()))
+		if name == "/" || name == "." {
+			name = field
+		}
+		path := filepath.Join(u.Dir, name)
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to stage upload %s: %w", field, err)
+		}
+		_, err = io.Copy(file, part)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to stage upload %s: %w", field, err)
+		}
+		u.Files[field] = path
+	}
+}
+
+// chown hands the files to RUN_AS, so that the command can read them.
+func (u *Upload) chown() error {
+	if RUN_AS == nil {
+		return nil
+	}
+	paths := []string{u.Dir}
+	for _, path := range u.Files {
+		paths = append(paths, path)
+	}
+	for _, path := range paths {
+		if err := os.Chown(path, int(RUN_AS.Uid), int(RUN_AS.Gid)); err != nil {
+			return fmt.Errorf("failed to change the owner of %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// commandPath returns the path of an uploaded file as the command sees it,
+// inside CHROOT.
+func commandPath(path string) string {
+	if CHROOT == "" {
+		return path
+	}
+	return "/" + strings.TrimPrefix(strings.TrimPrefix(path, filepath.Clean(CHROOT)), "/")
+}
+
+// env returns the environment variables with the paths of the files:
+// UPLOAD_DIR, and UPLOAD_<FIELD> for each file.
+func (u *Upload) env() []string {
+	env := []string{"UPLOAD_DIR=" + commandPath(u.Dir)}
+	for field, path := range u.Files {
+		env = append(env, "UPLOAD_"+envName(field)+"="+commandPath(path))
+	}
+	return env
+}
+
+// paths returns the paths of the files as the command sees them.
+func (u *Upload) paths() map[string]string {
+	paths := make(map[string]string, len(u.Files))
+	for field, path := range u.Files {
+		paths[field] = commandPath(path)
+	}
+	return paths
+}
+
+// Remove deletes the staged files.
+func (u *Upload) Remove() {
+	if err := os.RemoveAll(u.Dir); err != nil {
+		log.Printf("Failed to remove uploads: %v", err)
+	}
+}
+
+// spillArgs writes the arguments longer than limit to files in UPLOAD_DIR,
+// and replaces them with the paths of the files. The caller removes the
+// files when the run is over.
+func spillArgs(args []string, limit int64) ([]string, []string, error) {
+	var files []string
+	spilled := args
+	for i, arg := range args {
+		if int64(len(arg)) <= limit {
+			continue
+		}
+		file, err := ioutil.TempFile(UPLOAD_DIR, "arg-")
+		if err == nil {
+			files = append(files, file.Name())
+			_, err = file.WriteString(arg)
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		if err == nil && RUN_AS != nil {
+			err = os.Chown(file.Name(), int(RUN_AS.Uid), int(RUN_AS.Gid))
+		}
+		if err != nil {
+			removeFiles(files)
+			return nil, nil, fmt.Errorf("failed to write argument %d to a file: %w", i+1, err)
+		}
+		if len(files) == 1 {
+			spilled = append([]string{}, args...)
+		}
+		spilled[i] = commandPath(file.Name())
+	}
+	return spilled, files, nil
+}
+
+// removeFiles removes temporary files.
+func removeFiles(files []string) {
+	for _, file := range files {
+		if err := os.Remove(file); err != nil {
+			log.Printf("Failed to remove %s: %v", file, err)
+		}
+	}
+}
+
+// envName turns a form field name into an environment variable name.
+func envName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, name)
+}
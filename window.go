@@ -0,0 +1,304 @@
+/*
+   Copyright 2021 Google LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// What happens to triggers outside of the execution windows of a command:
+// they're rejected with 503 and Retry-After, delayed with Cloud Tasks until
+// the window opens, or wait on the instance until it opens.
+const (
+	WindowReject = "reject"
+	WindowDelay  = "delay"
+	WindowQueue  = "queue"
+)
+
+// weekdays are the days of RunWindow.Days.
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// RunWindow is a time of day, from Start to End (as in "20:00" to "08:00"
+// of the next day) on Days in TimeZone, when a command may run or, for a
+// blackout, may not. Commands with windows that aren't blackouts only run
+// within one of them. An empty Command matches any.
+type RunWindow struct {
+	Name     string   `json:"name,omitempty"`
+	Command  string   `json:"command,omitempty"`
+	Start    string   `json:"start"`
+	End      string   `json:"end"`
+	Days     []string `json:"days,omitempty"`
+	TimeZone string   `json:"timeZone,omitempty"`
+	Blackout bool     `json:"blackout,omitempty"`
+	// Action is WindowReject, WindowDelay or WindowQueue, for the triggers
+	// that this window keeps from running.
+	Action string `json:"action,omitempty"`
+	// Queue is the Cloud Tasks queue of delayed runs, FOLLOWUP_QUEUE by
+	// default.
+	Queue string `json:"queue,omitempty"`
+
+	location *time.Location
+	start    time.Time
+	end      time.Time
+	days     map[time.Weekday]bool
+}
+
+func (w *RunWindow) parse() error {
+	var err error
+	if w.start, err = time.Parse("15:04", w.Start); err != nil {
+		return fmt.Errorf("invalid start: %s", w.Start)
+	}
+	if w.end, err = time.Parse("15:04", w.End); err != nil {
+		return fmt.Errorf("invalid end: %s", w.End)
+	}
+	if w.start.Equal(w.end) {
+		return fmt.Errorf("start and end are the same")
+	}
+	w.location = time.UTC
+	if w.TimeZone != "" {
+		if w.location, err = time.LoadLocation(w.TimeZone); err != nil {
+			return err
+		}
+	}
+	w.days = nil
+	for _, day := range w.Days {
+		weekday, ok := weekdays[strings.ToLower(day)]
+		if !ok {
+			return fmt.Errorf("invalid day: %s (must be mon, tue, wed, thu, fri, sat or sun)", day)
+		}
+		if w.days == nil {
+			w.days = make(map[time.Weekday]bool)
+		}
+		w.days[weekday] = true
+	}
+	switch w.Action {
+	case "":
+		w.Action = WindowReject
+	case WindowReject, WindowDelay, WindowQueue:
+	default:
+		return fmt.Errorf("invalid action: %s (must be reject, delay or queue)", w.Action)
+	}
+	return nil
+}
+
+// String describes the window, by its name if it has one.
+func (w *RunWindow) String() string {
+	if w.Name != "" {
+		return w.Name
+	}
+	days := ""
+	if len(w.Days) > 0 {
+		days = " " + strings.Join(w.Days, ",")
+	}
+	return fmt.Sprintf("%s-%s%s %s", w.Start, w.End, days, w.location)
+}
+
+// bounds returns when the window starts on the day and when it ends, which
+// may be the next day.
+func (w *RunWindow) bounds(day time.Time) (time.Time, time.Time) {
+	y, m, d := day.In(w.location).Date()
+	start := time.Date(y, m, d, w.start.Hour(), w.start.Minute(), 0, 0, w.location)
+	if !w.end.After(w.start) {
+		d++
+	}
+	end := time.Date(y, m, d, w.end.Hour(), w.end.Minute(), 0, 0, w.location)
+	return start, end
+}
+
+// onDays returns the days that the window is on, from the day before t to
+// n days after it.
+func (w *RunWindow) onDays(t time.Time, n int) []time.Time {
+	var days []time.Time
+	y, m, d := t.In(w.location).Date()
+	for i := -1; i < n; i++ {
+		day := time.Date(y, m, d+i, 0, 0, 0, 0, w.location)
+		if w.days == nil || w.days[day.Weekday()] {
+			days = append(days, day)
+		}
+	}
+	return days
+}
+
+// contains returns true if t is within the window.
+func (w *RunWindow) contains(t time.Time) bool {
+	for _, day := range w.onDays(t, 1) {
+		start, end := w.bounds(day)
+		if !t.Before(start) && t.Before(end) {
+			return true
+		}
+	}
+	return false
+}
+
+// commandWindows returns the windows of a command, matched by the path or
+// the base name of the command.
+func commandWindows(command string) []*RunWindow {
+	var windows []*RunWindow
+	for _, window := range currentConfig().Windows {
+		if window.Command == "" || window.Command == command || window.Command == filepath.Base(command) {
+			windows = append(windows, window)
+		}
+	}
+	return windows
+}
+
+// closedBy returns the window that keeps a command with the windows from
+// running at t: a blackout it's in, or the first other window, if it's in
+// none of them. It returns nil if the command can run.
+func closedBy(windows []*RunWindow, t time.Time) *RunWindow {
+	var closed *RunWindow
+	for _, window := range windows {
+		if window.Blackout && window.contains(t) {
+			return window
+		}
+	}
+	for _, window := range windows {
+		if window.Blackout {
+			continue
+		}
+		if window.contains(t) {
+			return nil
+		}
+		if closed == nil {
+			closed = window
+		}
+	}
+	return closed
+}
+
+// nextOpening returns when a command with the windows can next run after t,
+// within a week, or the zero time.
+func nextOpening(windows []*RunWindow, t time.Time) time.Time {
+	var candidates []time.Time
+	for _, window := range windows {
+		for _, day := range window.onDays(t, 8) {
+			start, end := window.bounds(day)
+			candidate := start
+			if window.Blackout {
+				candidate = end
+			}
+			if candidate.After(t) {
+				candidates = append(candidates, candidate)
+			}
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Before(candidates[j]) })
+	for _, candidate := range candidates {
+		if closedBy(windows, candidate) == nil {
+			return candidate
+		}
+	}
+	return time.Time{}
+}
+
+// WindowClosedError is returned for runs outside of the execution windows of
+// their command. Opens is when the window opens, the latest of the commands
+// of a batch, or zero if not within a week.
+type WindowClosedError struct {
+	Command string
+	Window  *RunWindow
+	Opens   time.Time
+}
+
+func (e *WindowClosedError) Error() string {
+	kind := "outside of the execution window"
+	if e.Window.Blackout {
+		kind = "in the blackout period"
+	}
+	message := fmt.Sprintf("%s is %s %s", e.Command, kind, e.Window)
+	if !e.Opens.IsZero() {
+		message += fmt.Sprintf(", it can run at %s", e.Opens.Format(time.RFC3339))
+	}
+	return message
+}
+
+// RetryAfter returns how long until the window opens, or zero.
+func (e *WindowClosedError) RetryAfter(now time.Time) time.Duration {
+	if e.Opens.IsZero() {
+		return 0
+	}
+	return e.Opens.Sub(now)
+}
+
+// checkWindows returns a WindowClosedError if any of the commands can't run
+// at now.
+func checkWindows(commands []string, now time.Time) *WindowClosedError {
+	var closed *WindowClosedError
+	for _, command := range commands {
+		windows := commandWindows(command)
+		window := closedBy(windows, now)
+		if window == nil {
+			continue
+		}
+		opens := nextOpening(windows, now)
+		if closed == nil {
+			closed = &WindowClosedError{Command: command, Window: window, Opens: opens}
+		} else if opens.IsZero() || (!closed.Opens.IsZero() && opens.After(closed.Opens)) {
+			closed.Opens = opens
+		}
+	}
+	return closed
+}
+
+// delayRun replays the request with a Cloud Task when the window opens, and
+// returns the name of the task.
+func delayRun(ctx context.Context, closed *WindowClosedError, r *http.Request, body []byte) (string, error) {
+	queue := closed.Window.Queue
+	if queue == "" {
+		queue = FOLLOWUP_QUEUE
+	}
+	if queue == "" {
+		return "", fmt.Errorf("no queue for delayed runs, set the queue of the window or FOLLOWUP_QUEUE")
+	}
+	if err := checkReplay(r); err != nil {
+		return "", err
+	}
+	headers := replayHeaders(r)
+	if headers["Content-Type"] == "" {
+		headers["Content-Type"] = "application/json"
+	}
+	return createTask(ctx, queue, "https://"+r.Host+r.URL.RequestURI(), "https://"+r.Host, headers, body, closed.Opens)
+}
+
+// waitForWindow waits until the window opens, calling waiting every
+// POLL_TIME.
+func waitForWindow(ctx context.Context, closed *WindowClosedError, waiting func()) error {
+	timer := time.NewTimer(time.Until(closed.Opens))
+	defer timer.Stop()
+	ticker := time.NewTicker(POLL_TIME)
+	defer ticker.Stop()
+	waiting()
+	for {
+		select {
+		case <-timer.C:
+			return nil
+		case <-ticker.C:
+			waiting()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}